@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Bot's side of the MCP chat tools. Path policy has already been applied by
+// the MCP server; the TOTP gate is applied here because it depends on the
+// user's unlock state.
+
+// SendFile implements bridgeActions.
+func (b *Bot) SendFile(run *mcpRun, path, caption string, photo bool) error {
+	if b.totp != nil && b.totp.Required(totpActionSendFile) && !b.totp.Elevated(run.userID) {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			resolved = path
+		}
+		if sendNeedsTOTP(resolved) {
+			log.Printf("[PAI Bridge] send_file held (TOTP unlock required): %s", path)
+			b.send(run.chatID, fmt.Sprintf("🔐 Not sent — files outside the projects tree need /unlock first: %s",
+				filepath.Base(path)))
+			return fmt.Errorf("not sent: the user must /unlock with their authenticator code before files outside /mnt/pai-data/projects can be sent")
+		}
+	}
+
+	var c tgbotapi.Chattable
+	if photo {
+		p := tgbotapi.NewPhoto(run.chatID, tgbotapi.FilePath(path))
+		p.Caption = caption
+		c = p
+	} else {
+		d := tgbotapi.NewDocument(run.chatID, tgbotapi.FilePath(path))
+		d.Caption = caption
+		c = d
+	}
+	if _, err := b.api.Send(c); err != nil {
+		log.Printf("[PAI Bridge] send_file failed for %s: %v", path, err)
+		return fmt.Errorf("telegram rejected the file: %w", err)
+	}
+	return nil
+}
+
+// SendText implements bridgeActions.
+func (b *Bot) SendText(run *mcpRun, text string) error {
+	b.sendFormatted(run.chatID, parseResponse(text, b.config.Response.Format))
+	return nil
+}
+
+// SendVoice implements bridgeActions.
+func (b *Bot) SendVoice(run *mcpRun, text string) error {
+	if b.synth == nil {
+		return fmt.Errorf("voice notes are not enabled on this bridge")
+	}
+	return b.synthesizeAndSendVoice(run.chatID, text)
+}
+
+// pendingQuestion is an ask_user call waiting for the user's answer. There
+// is at most one per user; the next plain-text message or a button press
+// answers it.
+type pendingQuestion struct {
+	id       string
+	chatID   int64
+	msgID    int
+	question string
+	options  []string
+	answer   chan string
+}
+
+// AskUser implements bridgeActions.
+func (b *Bot) AskUser(ctx context.Context, run *mcpRun, question string, options []string) (string, error) {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	q := &pendingQuestion{
+		id:       hex.EncodeToString(buf),
+		chatID:   run.chatID,
+		question: question,
+		options:  options,
+		answer:   make(chan string, 1),
+	}
+
+	b.questionMu.Lock()
+	if _, busy := b.questions[run.userID]; busy {
+		b.questionMu.Unlock()
+		return "", fmt.Errorf("another question is already waiting for the user's answer")
+	}
+	b.questions[run.userID] = q
+	b.questionMu.Unlock()
+
+	defer func() {
+		b.questionMu.Lock()
+		if b.questions[run.userID] == q {
+			delete(b.questions, run.userID)
+		}
+		b.questionMu.Unlock()
+	}()
+
+	msg := tgbotapi.NewMessage(run.chatID, "❓ "+question)
+	if len(options) > 0 {
+		var rows [][]tgbotapi.InlineKeyboardButton
+		for i, opt := range options {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(truncate(opt, 60), fmt.Sprintf("ask:%s:%d", q.id, i)),
+			))
+		}
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	}
+	sent, err := b.api.Send(msg)
+	if err != nil {
+		return "", fmt.Errorf("could not send the question: %w", err)
+	}
+	b.questionMu.Lock()
+	q.msgID = sent.MessageID
+	b.questionMu.Unlock()
+
+	timeout := time.Duration(b.config.Response.AskTimeoutSec) * time.Second
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case a := <-q.answer:
+		return a, nil
+	case <-timer.C:
+		b.api.Request(tgbotapi.NewEditMessageText(q.chatID, q.msgID, "⌛ "+question+"\n\n(no answer)"))
+		return "", fmt.Errorf("the user did not answer within %v", timeout)
+	case <-ctx.Done():
+		b.api.Request(tgbotapi.NewEditMessageText(q.chatID, q.msgID, "❓ "+question+"\n\n(run ended)"))
+		return "", fmt.Errorf("run ended before the user answered")
+	}
+}
+
+// answerQuestion resolves the user's pending ask_user question with text,
+// reporting whether there was one to answer.
+func (b *Bot) answerQuestion(userID, text string) bool {
+	b.questionMu.Lock()
+	q, ok := b.questions[userID]
+	var msgID int
+	if ok {
+		delete(b.questions, userID)
+		msgID = q.msgID
+	}
+	b.questionMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	select {
+	case q.answer <- text:
+	default:
+	}
+	if msgID != 0 {
+		b.api.Request(tgbotapi.NewEditMessageText(q.chatID, msgID, "❓ "+q.question+"\n\n→ "+truncate(text, 200)))
+	}
+	return true
+}
+
+// handleAskCallback resolves an "ask:<id>:<option>" button press.
+func (b *Bot) handleAskCallback(cq *tgbotapi.CallbackQuery, userID, arg string) {
+	id, idxStr, _ := strings.Cut(arg, ":")
+	idx, err := strconv.Atoi(idxStr)
+
+	b.questionMu.Lock()
+	q, ok := b.questions[userID]
+	b.questionMu.Unlock()
+	if !ok || q.id != id || err != nil || idx < 0 || idx >= len(q.options) {
+		b.answerCallback(cq.ID, "This question has expired.")
+		return
+	}
+
+	b.answerQuestion(userID, q.options[idx])
+	b.answerCallback(cq.ID, "")
+}
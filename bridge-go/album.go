@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// mediaGroupWindow is how long the bot waits after the latest part of an
+// album before taking the album as complete. Telegram sends the parts within
+// a second or so of each other.
+const mediaGroupWindow = 1500 * time.Millisecond
+
+// mediaGroupBuffer collects the messages of Telegram albums, which arrive as
+// one update per photo, video or file sharing a MediaGroupID, and hands each
+// album over in one piece once no more parts have arrived for the window.
+type mediaGroupBuffer struct {
+	window time.Duration
+	flush  func(msgs []*tgbotapi.Message) // called with an album's messages in order
+	mu     sync.Mutex
+	groups map[string]*mediaGroup
+}
+
+type mediaGroup struct {
+	msgs  []*tgbotapi.Message
+	timer *time.Timer
+}
+
+func newMediaGroupBuffer(window time.Duration, flush func([]*tgbotapi.Message)) *mediaGroupBuffer {
+	return &mediaGroupBuffer{
+		window: window,
+		flush:  flush,
+		groups: make(map[string]*mediaGroup),
+	}
+}
+
+// Add buffers one part of an album and restarts its window.
+func (mb *mediaGroupBuffer) Add(msg *tgbotapi.Message) {
+	key := fmt.Sprintf("%d:%s", msg.Chat.ID, msg.MediaGroupID)
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	g, ok := mb.groups[key]
+	if !ok {
+		g = &mediaGroup{}
+		g.timer = time.AfterFunc(mb.window, func() { mb.fire(key) })
+		mb.groups[key] = g
+	} else {
+		g.timer.Reset(mb.window)
+	}
+	g.msgs = append(g.msgs, msg)
+}
+
+func (mb *mediaGroupBuffer) fire(key string) {
+	mb.mu.Lock()
+	g, ok := mb.groups[key]
+	delete(mb.groups, key)
+	mb.mu.Unlock()
+	if !ok {
+		return
+	}
+	// Updates are handled concurrently, so parts may have been added out
+	// of order
+	sort.Slice(g.msgs, func(i, j int) bool { return g.msgs[i].MessageID < g.msgs[j].MessageID })
+	mb.flush(g.msgs)
+}
+
+// handleAlbum sends the parts of an album to Claude as one message with the
+// album's caption. Parts that can't be downloaded, or whose images and PDFs
+// would take the album over maxBatchAttachmentBytes, are left out and the
+// user is told.
+func (b *Bot) handleAlbum(msgs []*tgbotapi.Message) {
+	first := msgs[0]
+	chatID := first.Chat.ID
+	userID := fmt.Sprintf("%d", first.From.ID)
+
+	var attachments []*Attachment
+	var captions, notes, skipped []string
+	msgID := first.MessageID
+	size := 0
+	for _, msg := range msgs {
+		ing := ingesterFor(msg)
+		if ing == nil {
+			continue
+		}
+		res, err := ing.ingest(b, msg)
+		if err != nil {
+			b.send(chatID, err.Error())
+			continue
+		}
+		partSize := 0
+		for _, a := range res.Attachments {
+			if isInlineBinary(a) {
+				partSize += base64.StdEncoding.DecodedLen(len(a.Base64))
+			}
+		}
+		if partSize > 0 && size+partSize > maxBatchAttachmentBytes {
+			skipped = append(skipped, attachmentName(res.Attachments[0]))
+			continue
+		}
+		size += partSize
+		attachments = append(attachments, res.Attachments...)
+		if res.Text != "" {
+			notes = append(notes, res.Text)
+		}
+		if msg.Caption != "" {
+			captions = append(captions, msg.Caption)
+			msgID = msg.MessageID
+		}
+	}
+	if len(skipped) > 0 {
+		b.send(chatID, fmt.Sprintf("That album is over the %d MB limit for one message, so %d part(s) were left out: %s. Send them separately.",
+			maxBatchAttachmentBytes>>20, len(skipped), strings.Join(skipped, ", ")))
+	}
+	if len(attachments) == 0 && len(notes) == 0 {
+		return
+	}
+	// Editing the caption updates a queued album, unless there are several
+	// captions to tell apart or the ingesters added text of their own
+	if len(captions) > 1 || len(notes) > 0 {
+		msgID = 0
+	}
+	log.Printf("[PAI Bridge] Album of %d part(s) from user %s", len(msgs)-len(skipped), userID)
+	b.handleMessage(chatID, msgID, userID, joinNonEmpty(strings.Join(captions, "\n\n"), strings.Join(notes, "\n")), attachments)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func albumPart(chatID int64, group string, messageID int) *tgbotapi.Message {
+	return &tgbotapi.Message{MessageID: messageID, Chat: &tgbotapi.Chat{ID: chatID}, MediaGroupID: group}
+}
+
+func TestMediaGroupBuffer(t *testing.T) {
+	var mu sync.Mutex
+	var albums [][]int
+	flushed := make(chan struct{}, 4)
+	mb := newMediaGroupBuffer(50*time.Millisecond, func(msgs []*tgbotapi.Message) {
+		var ids []int
+		for _, m := range msgs {
+			ids = append(ids, m.MessageID)
+		}
+		mu.Lock()
+		albums = append(albums, ids)
+		mu.Unlock()
+		flushed <- struct{}{}
+	})
+
+	// Parts arrive out of order, interleaved with another chat's album
+	mb.Add(albumPart(1, "g1", 12))
+	mb.Add(albumPart(2, "g1", 40))
+	mb.Add(albumPart(1, "g1", 10))
+	time.Sleep(30 * time.Millisecond)
+	mb.Add(albumPart(1, "g1", 11)) // restarts chat 1's window
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-flushed:
+		case <-time.After(2 * time.Second):
+			t.Fatal("album not flushed")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(albums) != 2 || len(albums[0]) != 1 || albums[0][0] != 40 {
+		t.Fatalf("albums: %v", albums)
+	}
+	if got := albums[1]; len(got) != 3 || got[0] != 10 || got[1] != 11 || got[2] != 12 {
+		t.Errorf("chat 1 album should hold its parts in order: %v", got)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// pendingApproval is a permission prompt waiting for an inline-keyboard
+// answer from the user.
+type pendingApproval struct {
+	userID   string
+	chatID   int64
+	msgID    int
+	toolDesc string
+	answer   chan approvalDecision
+}
+
+// RequestApproval implements bridgeActions. It posts the tool call with
+// Allow once / Always for this session / Deny buttons and blocks until the
+// user taps one. Timeouts and cancelled runs deny.
+func (b *Bot) RequestApproval(ctx context.Context, run *mcpRun, toolName string, input map[string]interface{}) approvalDecision {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	id := hex.EncodeToString(buf)
+
+	desc := describeToolUse(toolName, input)
+	text := fmt.Sprintf("🔐 Claude wants to use %s\n\n%s", toolName, approvalDetail(toolName, input))
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Allow once", "perm:"+id+":once"),
+			tgbotapi.NewInlineKeyboardButtonData("Always (session)", "perm:"+id+":always"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Deny", "perm:"+id+":deny"),
+		),
+	)
+	msg := tgbotapi.NewMessage(run.chatID, text)
+	msg.ReplyMarkup = keyboard
+	sent, err := b.api.Send(msg)
+	if err != nil {
+		log.Printf("[PAI Bridge] Failed to send approval prompt: %v", err)
+		return approvalDeny
+	}
+
+	pa := &pendingApproval{
+		userID:   run.userID,
+		chatID:   run.chatID,
+		msgID:    sent.MessageID,
+		toolDesc: desc,
+		answer:   make(chan approvalDecision, 1),
+	}
+	b.approvalMu.Lock()
+	b.approvals[id] = pa
+	b.approvalMu.Unlock()
+
+	defer func() {
+		b.approvalMu.Lock()
+		delete(b.approvals, id)
+		b.approvalMu.Unlock()
+	}()
+
+	timeout := time.Duration(b.config.Security.ApprovalTimeoutSec) * time.Second
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case d := <-pa.answer:
+		return d
+	case <-timer.C:
+		log.Printf("[PAI Bridge] Approval for %s timed out after %v — denying", toolName, timeout)
+		b.api.Request(tgbotapi.NewEditMessageText(pa.chatID, pa.msgID, "⌛ Timed out — denied: "+desc))
+		return approvalDeny
+	case <-ctx.Done():
+		b.api.Request(tgbotapi.NewEditMessageText(pa.chatID, pa.msgID, "Run ended — denied: "+desc))
+		return approvalDeny
+	}
+}
+
+// approvalDetail renders the part of a tool call the user needs to judge it.
+func approvalDetail(toolName string, input map[string]interface{}) string {
+	str := func(key string) string {
+		v, _ := input[key].(string)
+		return v
+	}
+	switch toolName {
+	case "Bash":
+		if cmd := str("command"); cmd != "" {
+			return truncate(cmd, 800)
+		}
+	case "Write", "Edit", "MultiEdit", "Read":
+		if p := str("file_path"); p != "" {
+			return p
+		}
+	case "WebFetch":
+		if u := str("url"); u != "" {
+			return u
+		}
+	}
+	data, err := json.MarshalIndent(input, "", "  ")
+	if err != nil {
+		return describeToolUse(toolName, input)
+	}
+	return truncate(string(data), 800)
+}
+
+// handleApprovalCallback resolves a "perm:<id>:<choice>" button press.
+func (b *Bot) handleApprovalCallback(cq *tgbotapi.CallbackQuery, userID, arg string) {
+	id, choice, _ := strings.Cut(arg, ":")
+
+	b.approvalMu.Lock()
+	pa, ok := b.approvals[id]
+	b.approvalMu.Unlock()
+	if !ok {
+		b.answerCallback(cq.ID, "This request has expired.")
+		return
+	}
+	if pa.userID != userID {
+		b.answerCallback(cq.ID, "Not your request.")
+		return
+	}
+
+	var d approvalDecision
+	var label string
+	switch choice {
+	case "once":
+		d, label = approvalAllowOnce, "✅ Allowed once"
+	case "always":
+		d, label = approvalAllowAlways, "✅ Always allowed this session"
+	default:
+		d, label = approvalDeny, "🚫 Denied"
+	}
+
+	select {
+	case pa.answer <- d:
+	default: // already answered
+	}
+	b.answerCallback(cq.ID, label)
+	b.api.Request(tgbotapi.NewEditMessageText(pa.chatID, pa.msgID, label+": "+pa.toolDesc))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passphraseGate implements security.require_passphrase: an allowlisted user
+// must send the passphrase before any message reaches Claude. Unlocks expire
+// after an idle period, and repeated failures lock the user out for a while.
+type passphraseGate struct {
+	hash        []byte // bcrypt hash from settings.json; empty = nobody can unlock
+	idle        time.Duration
+	maxFailures int
+	lockout     time.Duration
+	now         func() time.Time
+
+	mu    sync.Mutex
+	users map[string]*unlockState
+}
+
+type unlockState struct {
+	unlocked    bool
+	lastSeen    time.Time
+	failures    int
+	lockedUntil time.Time
+}
+
+type unlockResult int
+
+const (
+	unlockOK unlockResult = iota
+	unlockWrong
+	unlockLockedOut
+)
+
+func newPassphraseGate(cfg SecurityConfig) *passphraseGate {
+	g := &passphraseGate{
+		hash:        []byte(cfg.PassphraseHash),
+		idle:        time.Duration(cfg.UnlockIdleMinutes) * time.Minute,
+		maxFailures: cfg.MaxFailedAttempts,
+		lockout:     time.Duration(cfg.LockoutMinutes) * time.Minute,
+		now:         time.Now,
+		users:       make(map[string]*unlockState),
+	}
+	if cfg.PassphraseHash == "" {
+		log.Printf("[PAI Bridge] WARNING: require_passphrase is on but passphrase_hash is empty — nobody can unlock")
+	} else if _, err := bcrypt.Cost(g.hash); err != nil {
+		log.Printf("[PAI Bridge] WARNING: passphrase_hash is not a valid bcrypt hash — nobody can unlock: %v", err)
+	}
+	return g
+}
+
+func (g *passphraseGate) state(userID string) *unlockState {
+	st, ok := g.users[userID]
+	if !ok {
+		st = &unlockState{}
+		g.users[userID] = st
+	}
+	return st
+}
+
+// IsUnlocked reports whether the user may talk to Claude, expiring the
+// unlock after the idle period. A successful check counts as activity.
+func (g *passphraseGate) IsUnlocked(userID string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	st := g.state(userID)
+	if !st.unlocked {
+		return false
+	}
+	now := g.now()
+	if g.idle > 0 && now.Sub(st.lastSeen) > g.idle {
+		st.unlocked = false
+		log.Printf("[PAI Bridge] Unlock expired for user %s after %v idle", userID, g.idle)
+		return false
+	}
+	st.lastSeen = now
+	return true
+}
+
+// Attempt checks a passphrase. After maxFailures consecutive misses the user
+// is locked out until the returned time, and attempts are rejected unchecked.
+func (g *passphraseGate) Attempt(userID, passphrase string) (unlockResult, time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	st := g.state(userID)
+	now := g.now()
+	if now.Before(st.lockedUntil) {
+		return unlockLockedOut, st.lockedUntil
+	}
+
+	if len(g.hash) > 0 && bcrypt.CompareHashAndPassword(g.hash, []byte(passphrase)) == nil {
+		st.unlocked = true
+		st.lastSeen = now
+		st.failures = 0
+		log.Printf("[PAI Bridge] User %s unlocked", userID)
+		return unlockOK, time.Time{}
+	}
+
+	st.failures++
+	log.Printf("[PAI Bridge] Failed passphrase attempt for user %s (%d/%d)", userID, st.failures, g.maxFailures)
+	if g.maxFailures > 0 && st.failures >= g.maxFailures {
+		st.failures = 0
+		st.lockedUntil = now.Add(g.lockout)
+		log.Printf("[PAI Bridge] User %s locked out until %s", userID, st.lockedUntil.Format(time.RFC3339))
+		return unlockLockedOut, st.lockedUntil
+	}
+	return unlockWrong, time.Time{}
+}
+
+// Remaining returns how many attempts the user has before lockout.
+func (g *passphraseGate) Remaining(userID string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.maxFailures - g.state(userID).failures
+}
+
+// Lock ends the user's unlock immediately.
+func (g *passphraseGate) Lock(userID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.state(userID).unlocked = false
+}
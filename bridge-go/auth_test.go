@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestGate returns a passphrase gate for "correct horse" with a
+// controllable clock. bcrypt.MinCost keeps the tests fast.
+func newTestGate(t *testing.T) (*passphraseGate, *time.Time) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	g := newPassphraseGate(SecurityConfig{
+		RequirePassphrase: true,
+		PassphraseHash:    string(hash),
+		UnlockIdleMinutes: 30,
+		MaxFailedAttempts: 3,
+		LockoutMinutes:    15,
+	})
+	g.now = func() time.Time { return now }
+	return g, &now
+}
+
+func TestPassphraseGate_LockedByDefault(t *testing.T) {
+	g, _ := newTestGate(t)
+	if g.IsUnlocked("user1") {
+		t.Error("new user should start locked")
+	}
+}
+
+func TestPassphraseGate_UnlockAndIdleExpiry(t *testing.T) {
+	g, now := newTestGate(t)
+
+	if res, _ := g.Attempt("user1", "correct horse"); res != unlockOK {
+		t.Fatalf("correct passphrase: got %v", res)
+	}
+	if !g.IsUnlocked("user1") {
+		t.Fatal("should be unlocked after correct passphrase")
+	}
+	if g.IsUnlocked("user2") {
+		t.Error("unlock must be per user")
+	}
+
+	// Activity keeps the unlock alive
+	*now = now.Add(20 * time.Minute)
+	if !g.IsUnlocked("user1") {
+		t.Error("should still be unlocked after 20m")
+	}
+	*now = now.Add(20 * time.Minute)
+	if !g.IsUnlocked("user1") {
+		t.Error("activity should reset the idle timer")
+	}
+
+	// Idle past the limit locks again
+	*now = now.Add(31 * time.Minute)
+	if g.IsUnlocked("user1") {
+		t.Error("should lock after 31m idle")
+	}
+}
+
+func TestPassphraseGate_LockoutAfterFailures(t *testing.T) {
+	g, now := newTestGate(t)
+
+	for i := 0; i < 2; i++ {
+		if res, _ := g.Attempt("user1", "wrong"); res != unlockWrong {
+			t.Fatalf("attempt %d: got %v, want unlockWrong", i, res)
+		}
+	}
+	if got := g.Remaining("user1"); got != 1 {
+		t.Errorf("remaining: got %d, want 1", got)
+	}
+
+	res, until := g.Attempt("user1", "wrong")
+	if res != unlockLockedOut {
+		t.Fatalf("third failure should lock out, got %v", res)
+	}
+	if want := now.Add(15 * time.Minute); !until.Equal(want) {
+		t.Errorf("lockout until %v, want %v", until, want)
+	}
+
+	// Even the correct passphrase is rejected during lockout
+	if res, _ := g.Attempt("user1", "correct horse"); res != unlockLockedOut {
+		t.Errorf("correct passphrase during lockout: got %v", res)
+	}
+
+	*now = now.Add(16 * time.Minute)
+	if res, _ := g.Attempt("user1", "correct horse"); res != unlockOK {
+		t.Errorf("after lockout expires: got %v", res)
+	}
+}
+
+func TestPassphraseGate_SuccessResetsFailures(t *testing.T) {
+	g, _ := newTestGate(t)
+	g.Attempt("user1", "wrong")
+	g.Attempt("user1", "wrong")
+	g.Attempt("user1", "correct horse")
+	if got := g.Remaining("user1"); got != 3 {
+		t.Errorf("success should reset failures, remaining=%d", got)
+	}
+}
+
+func TestPassphraseGate_Lock(t *testing.T) {
+	g, _ := newTestGate(t)
+	g.Attempt("user1", "correct horse")
+	g.Lock("user1")
+	if g.IsUnlocked("user1") {
+		t.Error("Lock should end the unlock")
+	}
+}
+
+func TestPassphraseGate_EmptyHashFailsClosed(t *testing.T) {
+	g := newPassphraseGate(SecurityConfig{RequirePassphrase: true, MaxFailedAttempts: 5})
+	if res, _ := g.Attempt("user1", ""); res == unlockOK {
+		t.Error("empty hash must never unlock")
+	}
+	if res, _ := g.Attempt("user1", "anything"); res == unlockOK {
+		t.Error("empty hash must never unlock")
+	}
+}
@@ -1,15 +1,13 @@
 package main
 
 import (
-	"bytes"
-	"encoding/base64"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -17,6 +15,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
@@ -28,33 +27,72 @@ type Bot struct {
 	api            *tgbotapi.BotAPI
 	config         *Config
 	sessions       *SessionManager
-	elevenLabsKey  string
+	synth          SpeechSynthesizer // nil unless voice is enabled and configured
+	transcriber    Transcriber     // nil unless stt.enabled
+	passphrase     *passphraseGate // nil unless security.require_passphrase
+	totp           *totpGate       // nil when security.totp.mode is "off"
+	quota          *quotaGate      // nil unless a quota limit is set
+	deferred       *deferredStore  // nil when sessions.retry.max_attempts is 0
 	rateMap        map[string][]int64
 	rateMu         sync.Mutex
+	approvals      map[string]*pendingApproval // permission prompts awaiting a button press
+	approvalMu     sync.Mutex
+	questions      map[string]*pendingQuestion // userID -> open ask_user question
+	questionMu     sync.Mutex
+	queuedRefs     map[queuedRefKey]queuedRef // queued messages the user may still edit
+	queuedMu       sync.Mutex
+	albums         *mediaGroupBuffer
 	lastPollAt     atomic.Int64 // unix milli of last successful poll cycle
 	stopCh         chan struct{}
 }
 
-func NewBot(cfg *Config, sessions *SessionManager, elevenLabsKey string) (*Bot, error) {
+func NewBot(cfg *Config, sessions *SessionManager, synth SpeechSynthesizer) (*Bot, error) {
 	api, err := tgbotapi.NewBotAPI(cfg.BotToken)
 	if err != nil {
 		return nil, fmt.Errorf("telegram bot init: %w", err)
 	}
 
-	if cfg.Voice.Enabled && elevenLabsKey != "" {
-		log.Printf("[PAI Bridge] Voice enabled (voice_id=%s, model=%s)", cfg.Voice.VoiceID, cfg.Voice.Model)
-	} else if cfg.Voice.Enabled {
-		log.Printf("[PAI Bridge] Voice enabled in config but ELEVENLABS_API_KEY not set — voice disabled")
-	}
-
-	return &Bot{
+	b := &Bot{
 		api:           api,
 		config:        cfg,
 		sessions:      sessions,
-		elevenLabsKey: elevenLabsKey,
+		synth:         synth,
 		rateMap:       make(map[string][]int64),
+		approvals:     make(map[string]*pendingApproval),
+		questions:     make(map[string]*pendingQuestion),
+		queuedRefs:    make(map[queuedRefKey]queuedRef),
 		stopCh:        make(chan struct{}),
-	}, nil
+	}
+	b.albums = newMediaGroupBuffer(mediaGroupWindow, b.handleAlbum)
+	if cfg.Security.RequirePassphrase {
+		b.passphrase = newPassphraseGate(cfg.Security)
+		log.Printf("[PAI Bridge] Passphrase required (idle expiry=%dm, lockout after %d failures)",
+			cfg.Security.UnlockIdleMinutes, cfg.Security.MaxFailedAttempts)
+	}
+	if cfg.Sessions.Retry.MaxAttempts > 0 {
+		b.deferred = newDeferredStore(filepath.Join(sessions.stateDir, "deferred.json"))
+	}
+	if cfg.Quotas.enabled() && sessions.usage != nil {
+		b.quota = newQuotaGate(cfg.Quotas, sessions.usage, sessions.resetLocation)
+		log.Printf("[PAI Bridge] Usage quotas enabled (daily=%+v, monthly=%+v)", cfg.Quotas.Daily, cfg.Quotas.Monthly)
+	}
+	switch cfg.Security.TOTP.Mode {
+	case "off", "":
+	case "sensitive", "all":
+		key, err := loadTOTPKey(cfg.Security.TOTP.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("totp key: %w", err)
+		}
+		store, err := newTOTPStore(filepath.Join(sessions.stateDir, "totp.json"), key)
+		if err != nil {
+			return nil, fmt.Errorf("totp store: %w", err)
+		}
+		b.totp = newTOTPGate(cfg.Security, store)
+		log.Printf("[PAI Bridge] TOTP second factor enabled (mode=%s)", cfg.Security.TOTP.Mode)
+	default:
+		return nil, fmt.Errorf("invalid security.totp.mode %q (want off, sensitive, or all)", cfg.Security.TOTP.Mode)
+	}
+	return b, nil
 }
 
 func (b *Bot) Start() {
@@ -62,12 +100,35 @@ func (b *Bot) Start() {
 	commands := []tgbotapi.BotCommand{
 		{Command: "start", Description: "Show bridge info"},
 		{Command: "status", Description: "Current session status"},
-		{Command: "clear", Description: "End current session"},
+		{Command: "clear", Description: "End current session (or /clear <name>)"},
+		{Command: "new", Description: "Start a named session: /new infra"},
+		{Command: "sessions", Description: "List and switch sessions"},
+		{Command: "switch", Description: "Switch session: /switch infra"},
+		{Command: "model", Description: "Show or change the Claude model"},
+		{Command: "cd", Description: "Change the session's work dir: /cd myrepo"},
+		{Command: "projects", Description: "Pick a git repo to work in"},
+		{Command: "cancel", Description: "Stop Claude's current task, keep the session"},
+		{Command: "queue", Description: "Messages waiting behind the current task"},
+		{Command: "usage", Description: "Tokens and cost today, this week, per session"},
+		{Command: "pending", Description: "Messages waiting for Claude's limits to reset"},
+	}
+	if b.quota != nil {
+		commands = append(commands, tgbotapi.BotCommand{Command: "quota", Description: "Show quota use and reset times"})
+	}
+	if b.passphrase != nil || b.totp != nil {
+		commands = append(commands, tgbotapi.BotCommand{Command: "lock", Description: "Lock the bridge and end any TOTP unlock"})
+	}
+	if b.totp != nil {
+		commands = append(commands,
+			tgbotapi.BotCommand{Command: "unlock", Description: "Verify a TOTP code: /unlock 123456"},
+			tgbotapi.BotCommand{Command: "totp_enroll", Description: "Set up an authenticator app"},
+		)
 	}
 	cmdCfg := tgbotapi.NewSetMyCommands(commands...)
 	b.api.Request(cmdCfg)
 
 	b.sendStartupNotification()
+	b.recoverQueues()
 
 	log.Println("[PAI Bridge] Bot is running.")
 
@@ -92,6 +153,14 @@ func (b *Bot) Start() {
 
 		for _, update := range updates {
 			offset = update.UpdateID + 1
+			if update.CallbackQuery != nil {
+				go b.handleCallback(update.CallbackQuery)
+				continue
+			}
+			if update.EditedMessage != nil {
+				go b.handleEdited(update.EditedMessage)
+				continue
+			}
 			if update.Message == nil {
 				continue
 			}
@@ -112,7 +181,7 @@ func (b *Bot) sendStartupNotification() {
 			continue
 		}
 		b.send(chatID, "PAI online.")
-		if b.config.Voice.Enabled && b.elevenLabsKey != "" {
+		if b.synth != nil {
 			if err := b.synthesizeAndSendVoice(chatID, "PAI online."); err != nil {
 				log.Printf("[PAI Bridge] Startup voice failed for %s: %v", uid, err)
 			}
@@ -137,26 +206,54 @@ func (b *Bot) handleUpdate(update tgbotapi.Update) {
 		return
 	}
 
+	if b.passphrase != nil && !b.passphrase.IsUnlocked(userID) {
+		b.handleLocked(msg, userID)
+		return
+	}
+
+	if b.totp != nil && b.totp.Required(totpActionMessage) && !b.totp.Elevated(userID) && !isTOTPExempt(msg) {
+		if b.totp.Enrolled(userID) {
+			b.send(msg.Chat.ID, "🔐 Send /unlock <code> from your authenticator app first.")
+		} else {
+			b.send(msg.Chat.ID, "🔐 A TOTP second factor is required. Set one up with /totp_enroll.")
+		}
+		return
+	}
+
 	// Handle commands
 	if msg.IsCommand() {
 		b.handleCommand(msg, userID)
 		return
 	}
 
-	// Handle messages with attachments
-	if msg.Photo != nil && len(msg.Photo) > 0 {
-		b.handlePhoto(msg, userID)
+	// A reply to an open ask_user question goes to the waiting tool call,
+	// not to the session queue.
+	if msg.Text != "" && b.answerQuestion(userID, msg.Text) {
+		return
+	}
+
+	// Voice notes are transcribed and handled as text, and so are audio
+	// files when speech-to-text is set up
+	if msg.Voice != nil || (msg.Audio != nil && b.transcriber != nil) {
+		b.handleVoice(msg, userID)
 		return
 	}
 
-	if msg.Document != nil {
-		b.handleDocument(msg, userID)
+	// Photos, files, video, stickers, locations and contacts go through
+	// the ingesters. Parts of an album arrive one update each; they are
+	// collected and sent to Claude together
+	if ing := ingesterFor(msg); ing != nil {
+		if msg.MediaGroupID != "" {
+			b.albums.Add(msg)
+			return
+		}
+		b.handleIngest(msg, userID, ing)
 		return
 	}
 
 	// Plain text
 	if msg.Text != "" {
-		b.handleMessage(msg.Chat.ID, userID, msg.Text, nil)
+		b.handleMessage(msg.Chat.ID, msg.MessageID, userID, msg.Text, nil)
 	}
 }
 
@@ -175,138 +272,291 @@ func (b *Bot) handleCommand(msg *tgbotapi.Message, userID string) {
 			b.send(chatID, "No active session. Send a message to start one.")
 			return
 		}
-		text := fmt.Sprintf("Session: %s...\nStatus: %s\nMessages: %d\nModel: %s\nWork dir: %s\nStarted: %s",
-			session.ID[:8], session.Status, session.MessageCount, session.Model, session.WorkDir,
+		text := fmt.Sprintf("Session: %s (%s...)\nStatus: %s\nMessages: %d\nModel: %s\nWork dir: %s\nStarted: %s",
+			session.Name, session.ID[:8], session.Status, session.MessageCount,
+			modelLabel(b.config.Sessions, session.Model), session.WorkDir,
 			time.UnixMilli(session.CreatedAt).Format(time.RFC822))
+		if usage := b.sessions.usage; usage != nil {
+			today := startOfDay(time.Now(), b.sessions.resetLocation)
+			text += fmt.Sprintf("\nThis session: %s\nToday: %s",
+				usage.SessionTotals(session.ID), usage.Totals(userID, today))
+		}
 		b.send(chatID, text)
 
 	case "clear":
-		killed := b.sessions.KillSession(userID)
+		name := strings.TrimSpace(msg.CommandArguments())
+		killed := b.sessions.KillSession(userID, name)
 		if killed {
 			b.send(chatID, "Session cleared.")
+		} else if name != "" {
+			b.send(chatID, fmt.Sprintf("No session named %q.", name))
 		} else {
 			b.send(chatID, "No active session.")
 		}
 
+	case "new":
+		b.handleNewSession(msg, userID)
+
+	case "sessions":
+		b.sendSessionList(chatID, userID)
+
+	case "switch":
+		b.handleSwitchSession(msg, userID)
+
+	case "model":
+		b.handleModel(msg, userID)
+
+	case "cd":
+		b.handleChangeDir(msg, userID)
+
+	case "projects":
+		b.handleProjects(msg, userID)
+
+	case "cancel":
+		b.handleCancel(msg, userID)
+
+	case "usage":
+		b.handleUsage(msg, userID)
+
+	case "quota":
+		b.handleQuota(msg, userID)
+
+	case "pending":
+		b.handlePending(msg, userID)
+
+	case "queue":
+		b.handleQueue(msg, userID)
+
+	case "lock":
+		if b.passphrase == nil && b.totp == nil {
+			b.send(chatID, "Passphrase protection is not enabled.")
+			return
+		}
+		if b.totp != nil {
+			b.totp.Lock(userID)
+		}
+		if b.passphrase != nil {
+			b.passphrase.Lock(userID)
+			b.send(chatID, "🔒 Locked. Send your passphrase to unlock.")
+		} else {
+			b.send(chatID, "🔒 TOTP unlock ended.")
+		}
+
+	case "totp_enroll":
+		b.handleTOTPEnroll(msg, userID)
+
+	case "unlock":
+		b.handleTOTPUnlock(msg, userID)
+
+	}
+}
+
+// isTOTPExempt reports whether a message may bypass the "all" mode TOTP
+// check — only the commands needed to get unlocked, and /cancel, since
+// stopping work is always safe.
+func isTOTPExempt(msg *tgbotapi.Message) bool {
+	if !msg.IsCommand() {
+		return false
+	}
+	switch msg.Command() {
+	case "start", "unlock", "totp_enroll", "lock", "cancel":
+		return true
 	}
+	return false
 }
 
-func (b *Bot) handlePhoto(msg *tgbotapi.Message, userID string) {
-	photos := msg.Photo
-	largest := photos[len(photos)-1]
+func (b *Bot) handleTOTPEnroll(msg *tgbotapi.Message, userID string) {
+	chatID := msg.Chat.ID
+	if b.totp == nil {
+		b.send(chatID, "TOTP is not enabled.")
+		return
+	}
+	// Re-enrolling must not be a way around the second factor.
+	if b.totp.Enrolled(userID) && !b.totp.Elevated(userID) {
+		b.send(chatID, "Already enrolled. /unlock with a current code first to re-enroll.")
+		return
+	}
 
-	file, err := b.api.GetFile(tgbotapi.FileConfig{FileID: largest.FileID})
+	account := msg.From.UserName
+	if account == "" {
+		account = userID
+	}
+	secret, uri, err := b.totp.Enroll(userID, account)
 	if err != nil {
-		b.send(msg.Chat.ID, fmt.Sprintf("Error getting photo: %v", err))
+		log.Printf("[PAI Bridge] TOTP enroll failed for %s: %v", userID, err)
+		b.send(chatID, "Enrollment failed. Check the bridge logs.")
 		return
 	}
+	b.send(chatID, fmt.Sprintf("Add this to your authenticator app:\n\n%s\n\nSecret: %s\n\n"+
+		"Then confirm with /unlock <code>. Delete this message once it's saved.", uri, secret))
+}
 
-	url := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", b.config.BotToken, file.FilePath)
-	data, err := downloadFile(url)
-	if err != nil {
-		b.send(msg.Chat.ID, fmt.Sprintf("Error downloading photo: %v", err))
+func (b *Bot) handleTOTPUnlock(msg *tgbotapi.Message, userID string) {
+	chatID := msg.Chat.ID
+	if b.totp == nil {
+		b.send(chatID, "TOTP is not enabled.")
+		return
+	}
+	code := strings.TrimSpace(msg.CommandArguments())
+	if code == "" {
+		b.send(chatID, "Usage: /unlock 123456")
 		return
 	}
 
-	ext := filepath.Ext(file.FilePath)
-	mimeType := "image/jpeg"
-	switch strings.ToLower(ext) {
-	case ".png":
-		mimeType = "image/png"
-	case ".gif":
-		mimeType = "image/gif"
-	case ".webp":
-		mimeType = "image/webp"
+	result, until, err := b.totp.Verify(userID, code)
+	if err != nil {
+		log.Printf("[PAI Bridge] TOTP verify error for %s: %v", userID, err)
+		b.send(chatID, "Not enrolled. Set up an authenticator with /totp_enroll.")
+		return
+	}
+	switch result {
+	case unlockOK:
+		b.send(chatID, fmt.Sprintf("🔓 Unlocked until %s.", until.In(b.sessions.resetLocation).Format("15:04 MST")))
+	case unlockLockedOut:
+		b.send(chatID, fmt.Sprintf("Too many failed attempts. Try again after %s.",
+			until.In(b.sessions.resetLocation).Format("15:04 MST")))
+	default:
+		b.send(chatID, "Invalid code.")
 	}
+}
+
+// voiceTranscriptMarker prefixes transcribed voice notes, so Claude knows the
+// text may contain recognition errors and the conversation log records where
+// the turn came from.
+const voiceTranscriptMarker = "[Voice note] "
 
-	attachment := &Attachment{
-		Type:     "image",
-		Base64:   base64.StdEncoding.EncodeToString(data),
-		MimeType: mimeType,
+func (b *Bot) handleVoice(msg *tgbotapi.Message, userID string) {
+	chatID := msg.Chat.ID
+	if b.transcriber == nil {
+		b.send(chatID, "Voice messages aren't enabled on this bridge. Please type your message.")
+		return
 	}
 
-	caption := msg.Caption
-	if caption == "" {
-		caption = ""
+	fileID, duration := "", 0
+	if msg.Voice != nil {
+		fileID, duration = msg.Voice.FileID, msg.Voice.Duration
+	} else {
+		fileID, duration = msg.Audio.FileID, msg.Audio.Duration
+	}
+	if limit := b.config.STT.MaxDurationSec; limit > 0 && duration > limit {
+		b.send(chatID, fmt.Sprintf("That recording is %s long; the limit is %s.",
+			formatElapsed(time.Duration(duration)*time.Second), formatElapsed(time.Duration(limit)*time.Second)))
+		return
 	}
 
-	b.handleMessage(msg.Chat.ID, userID, caption, attachment)
-}
+	b.api.Send(tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping))
 
-func (b *Bot) handleDocument(msg *tgbotapi.Message, userID string) {
-	doc := msg.Document
-	fileName := doc.FileName
-	if fileName == "" {
-		fileName = "document"
+	transcript, err := b.transcribeTelegramFile(fileID)
+	if err != nil {
+		log.Printf("[PAI Bridge] Transcription failed for user %s: %v", userID, err)
+		b.send(chatID, fmt.Sprintf("Couldn't transcribe that: %v", err))
+		return
 	}
+	if transcript == "" {
+		b.send(chatID, "Couldn't make out any speech in that recording.")
+		return
+	}
+	log.Printf("[PAI Bridge] Transcribed %ds of audio for user %s (%d chars)", duration, userID, len(transcript))
 
-	file, err := b.api.GetFile(tgbotapi.FileConfig{FileID: doc.FileID})
-	if err != nil {
-		b.send(msg.Chat.ID, fmt.Sprintf("Error getting document: %v", err))
+	b.send(chatID, "Heard: "+transcript)
+
+	if b.answerQuestion(userID, transcript) {
 		return
 	}
 
+	text := voiceTranscriptMarker + transcript
+	if msg.Caption != "" {
+		text = msg.Caption + "\n\n" + text
+	}
+	b.handleMessage(chatID, 0, userID, text, nil)
+}
+
+// transcribeTelegramFile downloads a voice note or audio file, converts it to
+// WAV and runs it through the configured transcriber.
+func (b *Bot) transcribeTelegramFile(fileID string) (string, error) {
+	file, err := b.api.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	if err != nil {
+		return "", fmt.Errorf("get file: %w", err)
+	}
 	url := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", b.config.BotToken, file.FilePath)
 	data, err := downloadFile(url)
 	if err != nil {
-		b.send(msg.Chat.ID, fmt.Sprintf("Error downloading document: %v", err))
-		return
+		return "", fmt.Errorf("download: %w", err)
 	}
 
-	ext := strings.ToLower(filepath.Ext(fileName))
-	if len(ext) > 0 {
-		ext = ext[1:] // remove leading dot
+	dir, err := os.MkdirTemp("", "pai-stt-*")
+	if err != nil {
+		return "", err
 	}
+	defer os.RemoveAll(dir)
 
-	var attachment *Attachment
-
-	if ext == "pdf" {
-		attachment = &Attachment{
-			Type:     "document",
-			Base64:   base64.StdEncoding.EncodeToString(data),
-			MimeType: "application/pdf",
-			FileName: fileName,
-		}
-	} else if isTextExt(ext) {
-		attachment = &Attachment{
-			Type:        "text-file",
-			MimeType:    "text/plain",
-			FileName:    fileName,
-			TextContent: string(data),
-		}
-	} else {
-		b.send(msg.Chat.ID, fmt.Sprintf("Unsupported file type: .%s. I can handle PDF, text, code, and data files.", ext))
-		return
+	inPath := filepath.Join(dir, "input"+filepath.Ext(file.FilePath))
+	if err := os.WriteFile(inPath, data, 0600); err != nil {
+		return "", err
 	}
+	wavPath := filepath.Join(dir, "audio.wav")
 
-	caption := msg.Caption
-	if caption == "" {
-		caption = ""
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(b.config.STT.TimeoutSec)*time.Second)
+	defer cancel()
+	if err := transcodeToWAV(ctx, inPath, wavPath); err != nil {
+		return "", err
 	}
-
-	b.handleMessage(msg.Chat.ID, userID, caption, attachment)
+	return b.transcriber.Transcribe(ctx, wavPath)
 }
 
-func (b *Bot) handleMessage(chatID int64, userID, text string, attachment *Attachment) {
+// handleMessage runs a message from the user. msgID is the Telegram message
+// it came from, if edits of that message should update it while it is
+// queued, or 0.
+func (b *Bot) handleMessage(chatID int64, msgID int, userID, text string, attachments []*Attachment) {
 	if b.isRateLimited(userID) {
 		b.send(chatID, "Rate limited. Please wait a moment.")
 		return
 	}
 
-	session := b.sessions.GetSession(userID)
-	if session == nil && !b.sessions.CanCreate() {
-		b.send(chatID, "Max concurrent sessions reached. Use /clear to end your session first.")
-		return
+	// "!" in front of a message interrupts the running task instead of
+	// queueing behind it
+	if rest, ok := strings.CutPrefix(text, "!"); ok && (strings.TrimSpace(rest) != "" || len(attachments) > 0) {
+		text = strings.TrimSpace(rest)
+		if b.sessions.Interrupt(userID, pendingMessage{Text: text, Attachments: attachments}) {
+			b.send(chatID, "⚡ Interrupting the current task…")
+			return
+		}
 	}
 
+	b.runMessages(chatID, msgID, userID, "", text, attachments, 0, nil)
+}
+
+// runMessages runs a message through Claude and delivers the reply. msgID is
+// the user's Telegram message, or 0. An empty sessionID means the user's
+// active session. followUps is the number of queued messages batched into
+// text, and replay the deferred prompt being retried, if any.
+func (b *Bot) runMessages(chatID int64, msgID int, userID, sessionID, text string, attachments []*Attachment, followUps int, replay *deferredPrompt) {
 	// Iterative loop: process the initial message, then any follow-up
 	// batches that accumulated while Claude was working. This avoids
 	// recursive handleMessage calls (which would re-run the rate limiter
-	// and could stack-overflow in pathological cases).
+	// and could stack-overflow in pathological cases). Once the first run
+	// picks a session, follow-ups stay with it.
 	curText := text
-	curAttachment := attachment
+	curAttachments := attachments
+	var followUp *FollowUp // the batch about to run, kept on disk until it starts
 
 	for {
+		// Quotas are checked before every run, follow-up batches included
+		if b.quota != nil {
+			block, warnings := b.quota.Check(userID)
+			for _, w := range warnings {
+				b.send(chatID, w)
+			}
+			if block != "" {
+				if followUps > 0 {
+					block += fmt.Sprintf("\n\n%d queued message(s) were not sent.", followUps)
+				}
+				b.send(chatID, block)
+				b.sessions.DropFollowUp(sessionID, followUp)
+				return
+			}
+		}
+
 		// Send typing indicator
 		typing := tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping)
 		b.api.Send(typing)
@@ -326,20 +576,78 @@ func (b *Bot) handleMessage(chatID int64, userID, text string, attachment *Attac
 			}
 		}()
 
-		result, err := b.sessions.SendMessage(userID, curText, curAttachment)
+		// With forward_progress on, stream text into an editable message
+		// as it arrives instead of waiting for the subprocess to exit, and
+		// keep a separate status message listing the tools Claude is using.
+		var live *liveReply
+		var progress *progressTracker
+		var stream *StreamCallbacks
+		if b.config.Response.ForwardProgress {
+			live = newLiveReply(b.api, chatID)
+			stream = &StreamCallbacks{
+				OnStart: func(string) { live.Start() },
+				OnText:  live.Append,
+			}
+			if b.config.Response.ProgressSteps > 0 {
+				progress = newProgressTracker(b.api, chatID, b.config.Response.ProgressSteps)
+				stream.OnStart = func(runSessionID string) {
+					progress.SetStopButton("stop:" + runSessionID)
+					progress.Start()
+					live.Start()
+				}
+				stream.OnToolUse = progress.ToolUse
+				stream.OnToolResult = progress.ToolResult
+			}
+		}
+
+		var result *MessageResult
+		var err error
+		if sessionID == "" {
+			result, err = b.sessions.SendMessage(userID, curText, curAttachments, stream)
+		} else {
+			result, err = b.sessions.SendToSession(sessionID, curText, curAttachments, stream)
+		}
 		close(stopTyping)
 
+		if progress != nil {
+			if err == nil && result.Cancelled {
+				progress.FinishCancelled()
+			} else {
+				progress.Finish(err == nil)
+			}
+		}
+
 		if err != nil {
+			b.sessions.DropFollowUp(sessionID, followUp)
+			if live != nil {
+				live.Abort()
+			}
+			var capErr *capacityError
+			if errors.As(err, &capErr) {
+				b.deferPrompt(chatID, userID, capErr, curText, curAttachments, followUps, replay)
+				return
+			}
+			var limitErr *limitError
+			if errors.As(err, &limitErr) {
+				b.send(chatID, fmt.Sprintf("🛑 Claude's run %s and was stopped. Anything it started was killed; the session is kept.", limitErr))
+				return
+			}
 			b.send(chatID, fmt.Sprintf("Error: %v", err))
 			return
 		}
 
-		// Message was queued because Claude is busy — silently return
+		// Message was queued because Claude is busy
 		if result.Queued > 0 {
+			b.sendQueuedAck(chatID, msgID, result)
 			return
 		}
 
-		b.deliverResult(chatID, result)
+		b.deliverResult(chatID, userID, result, live)
+		if result.Interrupted {
+			b.send(chatID, "⚡ Interrupted. Sending your new message to Claude.")
+		} else if result.Cancelled && strings.TrimSpace(result.Text) != "" {
+			b.send(chatID, "⏹ Cancelled — the reply above is partial. Your next message continues the conversation.")
+		}
 
 		// If there are queued follow-up messages, loop to process them
 		// now that the first response has been delivered to Telegram.
@@ -347,38 +655,49 @@ func (b *Bot) handleMessage(chatID int64, userID, text string, attachment *Attac
 			return
 		}
 		log.Printf("[PAI Bridge] Processing %d queued follow-up message(s) for user %s", result.FollowUp.Count, userID)
-		curText = result.FollowUp.Text
-		curAttachment = result.FollowUp.Attachment
+		sessionID = result.SessionID
+		followUps = result.FollowUp.Count
+		msgID = 0
+		replay = nil
+		followUp = result.FollowUp
+		curText = followUp.Text
+		curAttachments = followUp.Attachments
 	}
 }
 
 // deliverResult sends a Claude response to Telegram: text, voice, and files.
-func (b *Bot) deliverResult(chatID int64, result *MessageResult) {
+// If live is non-nil the response was streamed, and the final formatted text
+// replaces the live messages instead of being sent fresh.
+func (b *Bot) deliverResult(chatID int64, userID string, result *MessageResult, live *liveReply) {
 	if strings.TrimSpace(result.Text) == "" {
-		b.send(chatID, "(No response from Claude)")
+		empty := "(No response from Claude)"
+		if result.Cancelled {
+			empty = "⏹ Cancelled before Claude replied."
+		}
+		if live != nil {
+			live.Finish([]string{empty})
+			return
+		}
+		b.send(chatID, empty)
 		return
 	}
 
-	// Extract SEND: and VOICE: directives
+	// Extract SEND: and VOICE: directives. The MCP chat tools supersede
+	// these, but Claude may still emit them, so they remain a fallback.
 	cleanText, sendPaths := extractSendDirectives(result.Text)
 	cleanText, voiceText := extractVoiceDirective(cleanText)
 
 	// Parse and format response
 	chunks := parseResponse(cleanText, b.config.Response.Format)
 
-	for _, chunk := range chunks {
-		msg := tgbotapi.NewMessage(chatID, chunk)
-		msg.ParseMode = tgbotapi.ModeHTML
-		if _, err := b.api.Send(msg); err != nil {
-			// Fallback to plain text
-			log.Printf("[PAI Bridge] HTML parse failed, falling back: %v", err)
-			msg.ParseMode = ""
-			b.api.Send(msg)
-		}
+	if live != nil {
+		live.Finish(chunks)
+	} else {
+		b.sendFormatted(chatID, chunks)
 	}
 
 	// Synthesize and send voice note if VOICE: directive present
-	if voiceText != "" && b.config.Voice.Enabled && b.elevenLabsKey != "" {
+	if voiceText != "" && b.synth != nil {
 		if err := b.synthesizeAndSendVoice(chatID, voiceText); err != nil {
 			log.Printf("[PAI Bridge] Voice synthesis failed: %v", err)
 		}
@@ -396,6 +715,7 @@ func (b *Bot) deliverResult(chatID int64, result *MessageResult) {
 	}
 
 	// Send files (with path safety check)
+	var needUnlock []string
 	for _, fp := range allFiles {
 		if _, err := os.Stat(fp); os.IsNotExist(err) {
 			continue
@@ -404,6 +724,17 @@ func (b *Bot) deliverResult(chatID int64, result *MessageResult) {
 			log.Printf("[PAI Bridge] SEND blocked (path not in allowlist): %s", fp)
 			continue
 		}
+		if b.totp != nil && b.totp.Required(totpActionSendFile) && !b.totp.Elevated(userID) {
+			resolved, err := filepath.EvalSymlinks(fp)
+			if err != nil {
+				resolved = fp
+			}
+			if sendNeedsTOTP(resolved) {
+				log.Printf("[PAI Bridge] SEND held (TOTP unlock required): %s", fp)
+				needUnlock = append(needUnlock, filepath.Base(fp))
+				continue
+			}
+		}
 		if imageExtRe.MatchString(fp) {
 			photo := tgbotapi.NewPhoto(chatID, tgbotapi.FilePath(fp))
 			if _, err := b.api.Send(photo); err != nil {
@@ -416,6 +747,67 @@ func (b *Bot) deliverResult(chatID int64, result *MessageResult) {
 			}
 		}
 	}
+
+	if len(needUnlock) > 0 {
+		b.send(chatID, fmt.Sprintf("🔐 Not sent — files outside the projects tree need /unlock first: %s",
+			strings.Join(needUnlock, ", ")))
+	}
+}
+
+// handleCallback dispatches inline-keyboard button presses. Callback data is
+// "<kind>:<arg>". The same allowlist and passphrase checks as messages apply.
+func (b *Bot) handleCallback(cq *tgbotapi.CallbackQuery) {
+	if cq.From == nil {
+		return
+	}
+	userID := fmt.Sprintf("%d", cq.From.ID)
+	if !b.isAllowedUser(userID) {
+		b.answerCallback(cq.ID, "Unauthorized.")
+		return
+	}
+	if b.passphrase != nil && !b.passphrase.IsUnlocked(userID) {
+		b.answerCallback(cq.ID, "🔒 Locked. Send your passphrase first.")
+		return
+	}
+
+	kind, arg, _ := strings.Cut(cq.Data, ":")
+	// Buttons approve tools and start or steer runs, so they need the same
+	// second factor as messages. Stopping a run is always allowed, like /cancel.
+	if kind != "stop" && b.totp != nil && b.totp.Required(totpActionMessage) && !b.totp.Elevated(userID) {
+		b.answerCallback(cq.ID, "🔐 Send /unlock <code> from your authenticator app first.")
+		return
+	}
+	switch kind {
+	case "perm":
+		b.handleApprovalCallback(cq, userID, arg)
+	case "ask":
+		b.handleAskCallback(cq, userID, arg)
+	case "sess":
+		b.handleSessionCallback(cq, userID, arg)
+	case "model":
+		b.handleModelCallback(cq, userID, arg)
+	case "cd":
+		b.handleChangeDirCallback(cq, userID, arg)
+	case "stop":
+		b.handleStopCallback(cq, userID, arg)
+	case "pending":
+		b.handlePendingCallback(cq, userID, arg)
+	case "resume":
+		b.handleResumeCallback(cq, userID, arg)
+	case "intr":
+		b.handleInterruptCallback(cq, userID, arg)
+	case "queue":
+		b.handleQueueCallback(cq, userID, arg)
+	default:
+		b.answerCallback(cq.ID, "")
+	}
+}
+
+// answerCallback acknowledges a button press, optionally showing a toast.
+func (b *Bot) answerCallback(id, text string) {
+	if _, err := b.api.Request(tgbotapi.NewCallback(id, text)); err != nil {
+		log.Printf("[PAI Bridge] Failed to answer callback: %v", err)
+	}
 }
 
 // --- Auth & Rate Limiting ---
@@ -426,6 +818,15 @@ func (b *Bot) authorize(msg *tgbotapi.Message) bool {
 	}
 	userID := fmt.Sprintf("%d", msg.From.ID)
 
+	if b.isAllowedUser(userID) {
+		return true
+	}
+
+	b.send(msg.Chat.ID, "Unauthorized. Your user ID is not in the allowlist.")
+	return false
+}
+
+func (b *Bot) isAllowedUser(userID string) bool {
 	if len(b.config.AllowedUsers) == 0 {
 		return true
 	}
@@ -435,11 +836,40 @@ func (b *Bot) authorize(msg *tgbotapi.Message) bool {
 			return true
 		}
 	}
-
-	b.send(msg.Chat.ID, "Unauthorized. Your user ID is not in the allowlist.")
 	return false
 }
 
+// handleLocked treats a plain-text message from a locked user as a
+// passphrase attempt. The message is always deleted from the chat so the
+// passphrase doesn't linger in history, whether or not it was correct.
+func (b *Bot) handleLocked(msg *tgbotapi.Message, userID string) {
+	chatID := msg.Chat.ID
+
+	if msg.Text == "" || msg.IsCommand() {
+		b.send(chatID, "🔒 Locked. Send your passphrase to unlock.")
+		return
+	}
+
+	if _, err := b.api.Request(tgbotapi.NewDeleteMessage(chatID, msg.MessageID)); err != nil {
+		log.Printf("[PAI Bridge] Failed to delete passphrase message: %v", err)
+	}
+
+	result, until := b.passphrase.Attempt(userID, msg.Text)
+	switch result {
+	case unlockOK:
+		text := "🔓 Unlocked."
+		if b.config.Security.UnlockIdleMinutes > 0 {
+			text += fmt.Sprintf(" Locks again after %d minutes of inactivity.", b.config.Security.UnlockIdleMinutes)
+		}
+		b.send(chatID, text)
+	case unlockLockedOut:
+		b.send(chatID, fmt.Sprintf("Too many failed attempts. Try again after %s.",
+			until.In(b.sessions.resetLocation).Format("15:04 MST")))
+	default:
+		b.send(chatID, fmt.Sprintf("Wrong passphrase. %d attempt(s) left.", b.passphrase.Remaining(userID)))
+	}
+}
+
 func (b *Bot) isRateLimited(userID string) bool {
 	b.rateMu.Lock()
 	defer b.rateMu.Unlock()
@@ -487,6 +917,21 @@ func (b *Bot) send(chatID int64, text string) {
 	b.api.Send(msg)
 }
 
+// sendFormatted sends parseResponse chunks as HTML, falling back to plain
+// text for any chunk Telegram refuses to parse.
+func (b *Bot) sendFormatted(chatID int64, chunks []string) {
+	for _, chunk := range chunks {
+		msg := tgbotapi.NewMessage(chatID, chunk)
+		msg.ParseMode = tgbotapi.ModeHTML
+		if _, err := b.api.Send(msg); err != nil {
+			// Fallback to plain text
+			log.Printf("[PAI Bridge] HTML parse failed, falling back: %v", err)
+			msg.ParseMode = ""
+			b.api.Send(msg)
+		}
+	}
+}
+
 // --- Helpers ---
 
 func extractSendDirectives(text string) (string, []string) {
@@ -585,63 +1030,16 @@ func extractVoiceDirective(text string) (string, string) {
 }
 
 func (b *Bot) synthesizeAndSendVoice(chatID int64, text string) error {
-	// Call ElevenLabs TTS API
-	url := fmt.Sprintf("https://api.elevenlabs.io/v1/text-to-speech/%s", b.config.Voice.VoiceID)
-
-	body, _ := json.Marshal(map[string]interface{}{
-		"text":     text,
-		"model_id": b.config.Voice.Model,
-	})
-
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
-	if err != nil {
-		return fmt.Errorf("create request: %w", err)
-	}
-	req.Header.Set("xi-api-key", b.elevenLabsKey)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "audio/mpeg")
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("elevenlabs request: %w", err)
-	}
-	defer resp.Body.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
 
-	if resp.StatusCode != 200 {
-		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return fmt.Errorf("elevenlabs returned %d: %s", resp.StatusCode, string(respBody))
-	}
-
-	mp3Data, err := io.ReadAll(resp.Body)
+	audio, format, err := b.synth.Synthesize(ctx, text)
 	if err != nil {
-		return fmt.Errorf("read mp3: %w", err)
+		return err
 	}
-
-	// Write MP3 to temp file
-	mp3File, err := os.CreateTemp("", "pai-voice-*.mp3")
+	oggData, err := encodeVoiceNote(ctx, audio, format)
 	if err != nil {
-		return fmt.Errorf("create temp mp3: %w", err)
-	}
-	defer os.Remove(mp3File.Name())
-
-	if _, err := mp3File.Write(mp3Data); err != nil {
-		mp3File.Close()
-		return fmt.Errorf("write mp3: %w", err)
-	}
-	mp3File.Close()
-
-	// Convert MP3 to OGG/OPUS via ffmpeg
-	oggPath := mp3File.Name() + ".ogg"
-	defer os.Remove(oggPath)
-
-	cmd := exec.Command("ffmpeg", "-i", mp3File.Name(), "-c:a", "libopus", "-b:a", "64k", "-y", oggPath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("ffmpeg convert: %w (%s)", err, string(output))
-	}
-
-	oggData, err := os.ReadFile(oggPath)
-	if err != nil {
-		return fmt.Errorf("read ogg: %w", err)
+		return err
 	}
 
 	// Send as Telegram voice note
@@ -657,10 +1055,15 @@ func (b *Bot) synthesizeAndSendVoice(chatID int64, text string) error {
 	return nil
 }
 
+// truncate cuts s to at most n bytes, backing off to a rune boundary so the
+// result stays valid UTF-8 (Telegram rejects anything else).
 func truncate(s string, n int) string {
 	if len(s) <= n {
 		return s
 	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
 	return s[:n] + "..."
 }
 
@@ -668,6 +1071,10 @@ const maxDownloadSize = 50 * 1024 * 1024 // 50MB
 
 var httpClient = &http.Client{Timeout: 30 * time.Second}
 
+// ctxHTTPClient has no overall timeout, for requests whose context carries
+// their own, longer deadline.
+var ctxHTTPClient = &http.Client{}
+
 func downloadFile(url string) ([]byte, error) {
 	resp, err := httpClient.Get(url)
 	if err != nil {
@@ -3,6 +3,7 @@ package main
 import (
 	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestExtractVoiceDirective(t *testing.T) {
@@ -193,11 +194,13 @@ func TestTruncate(t *testing.T) {
 		{"hello world", 5, "hello..."},
 		{"", 5, ""},
 		{"ab", 1, "a..."},
+		{"grep 'héllo'", 8, "grep 'h..."},
+		{"echo 日本語", 7, "echo ..."},
 	}
 
 	for _, tt := range tests {
 		got := truncate(tt.input, tt.n)
-		if got != tt.want {
+		if got != tt.want || !utf8.ValidString(got) {
 			t.Errorf("truncate(%q, %d) = %q, want %q", tt.input, tt.n, got, tt.want)
 		}
 	}
@@ -19,30 +19,74 @@ type Config struct {
 	Server       ServerConfig
 	Memory       MemoryConfig
 	Voice        VoiceConfig
+	STT          STTConfig
+	Quotas       QuotaConfig
 }
 
 type SessionConfig struct {
 	TimeoutMinutes       int
-	MaxConcurrent        int
+	MaxConcurrent        int // Claude runs in progress at once, across all users and sessions
+	MaxPerUser           int // Named sessions per user
 	DefaultWorkDir       string
+	ProjectRoots         []string // Trees /cd and /projects may enter. Default: default_work_dir and /mnt/pai-data/projects.
 	DefaultModel         string
-	ResetHour            int    // Hour of day (0-23) for daily session reset. -1 to disable.
-	Timezone             string // IANA timezone for reset_hour (e.g. "America/New_York"). Defaults to UTC.
-	SubprocessTimeoutMin int    // Per-message Claude subprocess timeout in minutes. Default 120 (2 hours).
+	Models               map[string]string // alias -> model ID; the /model allowlist
+	ResetHour            int               // Hour of day (0-23) for daily session reset. -1 to disable.
+	Timezone             string            // IANA timezone for reset_hour (e.g. "America/New_York"). Defaults to UTC.
+	SubprocessTimeoutMin int               // Per-message Claude subprocess timeout in minutes. Default 120 (2 hours).
+	Limits               LimitsConfig
+	Retry                RetryConfig
+}
+
+// RetryConfig controls how prompts refused by a usage limit, rate limit or
+// overload are deferred and replayed.
+type RetryConfig struct {
+	MaxAttempts  int // Replays before giving up. 0 reports the error instead of deferring.
+	BaseDelaySec int // First backoff when Claude gives no reset time; doubles per attempt
+	MaxDelayMin  int // Backoff cap
+}
+
+// LimitsConfig bounds what one Claude run may consume. 0 disables a limit.
+type LimitsConfig struct {
+	MemoryMB       int  // cgroup memory.max for the run's process tree
+	AddressSpaceMB int  // RLIMIT_AS per process. Node reserves far more virtual memory than it uses; keep this generous.
+	CPUSeconds     int  // RLIMIT_CPU per process
+	OpenFiles      int  // RLIMIT_NOFILE per process
+	Processes      int  // cgroup pids.max, and RLIMIT_NPROC when Claude runs as its own user
+	OutputMB       int  // Bytes read from Claude's stdout per run
+	Cgroup         bool // Put each run in its own cgroup v2 child when the bridge's cgroup is writable
 }
 
 type SecurityConfig struct {
 	RequirePassphrase  bool
+	PassphraseHash     string // bcrypt hash; generate with `pai-bridge hash-passphrase`
+	UnlockIdleMinutes  int    // Unlock expires after this much inactivity. 0 = never.
+	MaxFailedAttempts  int    // Failed passphrase attempts before lockout.
+	LockoutMinutes     int
 	RateLimitPerMinute int
+	TOTP               TOTPConfig
+	PermissionPrompts  bool // Relay Claude's permission prompts to Telegram as inline-keyboard approvals
+	ApprovalTimeoutSec int  // Unanswered approvals are denied after this long
+}
+
+type TOTPConfig struct {
+	Mode          string // "off", "sensitive" (flagged actions only), or "all"
+	WindowSteps   int    // 30s steps accepted either side of now
+	UnlockMinutes int    // How long a successful /unlock lasts
+	KeyFile       string // AES key for the secret store; PAI_TOTP_KEY env overrides
 }
 
 type ResponseConfig struct {
 	Format          string
-	ForwardProgress bool
+	ForwardProgress bool // Stream the reply into Telegram by editing a message as Claude works.
+	ProgressSteps   int  // Tool steps shown in the live progress message. 0 to disable.
+	AskTimeoutSec   int  // How long the ask_user tool waits for an answer
 }
 
 type ServerConfig struct {
-	Port int
+	Port      int
+	MCPSocket string // Unix socket the mcp-relay subprocess connects to
+	MCPTools  bool   // Offer send_file, send_voice, ask_user etc. to Claude as MCP tools
 }
 
 type MemoryConfig struct {
@@ -52,10 +96,59 @@ type MemoryConfig struct {
 	RetentionDays int // Base retention: JSONL=1x, daily=2x, summaries=6x. 0 to disable.
 }
 
+// QuotaConfig caps each user's Claude usage per day and per calendar month,
+// both in Sessions.Timezone. A zero limit is no limit.
+type QuotaConfig struct {
+	Daily       QuotaLimits
+	Monthly     QuotaLimits
+	WarnPercent int      // Warn once a limit is this far used. Default 80.
+	Admins      []string // User IDs allowed to grant overrides with /quota grant
+}
+
+type QuotaLimits struct {
+	Runs    int
+	Tokens  int // Input + cache writes + output, as shown by /usage
+	Minutes int // Wall-clock time Claude spent running
+}
+
+type STTConfig struct {
+	Enabled        bool
+	Provider       string   // "whisper-cpp" (local executable) or "http" (OpenAI-compatible /v1/audio/transcriptions)
+	Command        string   // whisper-cpp: executable to run
+	Args           []string // whisper-cpp: arguments, "{input}" is replaced with the WAV path. Empty = whisper-cli defaults.
+	Model          string   // whisper-cpp: model file; http: model name
+	URL            string   // http: transcription endpoint
+	Language       string   // Language hint (e.g. "en"). Empty = auto-detect.
+	TimeoutSec     int
+	MaxDurationSec int // Longer voice notes and audio files are refused
+}
+
 type VoiceConfig struct {
-	Enabled bool
-	VoiceID string
-	Model   string
+	Enabled  bool
+	Provider string // "elevenlabs", "openai" (any /v1/audio/speech endpoint), or "command"
+	VoiceID  string // elevenlabs
+	Model    string // elevenlabs
+	OpenAI   OpenAIVoiceConfig
+	Command  CommandVoiceConfig
+}
+
+type OpenAIVoiceConfig struct {
+	URL   string
+	Model string
+	Voice string
+}
+
+type CommandVoiceConfig struct {
+	Command string
+	Args    []string // "{text}" and "{output}" are substituted; text is also on stdin
+	Format  string   // Audio format the command produces (e.g. "wav")
+}
+
+// defaultModels is the /model allowlist when sessions.models is not set.
+var defaultModels = map[string]string{
+	"opus":   "claude-opus-4-1-20250805",
+	"sonnet": "claude-sonnet-4-5-20250929",
+	"haiku":  "claude-haiku-4-5-20251001",
 }
 
 func LoadConfig() (*Config, error) {
@@ -93,6 +186,12 @@ func LoadConfig() (*Config, error) {
 		json.Unmarshal(rawTB, &tb)
 	}
 
+	security := jsonNested(tb, "security")
+	sessions := jsonNested(tb, "sessions")
+	stt := jsonNested(tb, "stt")
+	voice := jsonNested(tb, "voice")
+	quotas := jsonNested(tb, "quotas")
+
 	cfg := &Config{
 		Enabled:      jsonBool(tb, "enabled", false),
 		BotToken:     botToken,
@@ -100,22 +199,54 @@ func LoadConfig() (*Config, error) {
 		Sessions: SessionConfig{
 			TimeoutMinutes:       jsonIntNested(tb, "sessions", "timeout_minutes", 240),
 			MaxConcurrent:        jsonIntNested(tb, "sessions", "max_concurrent", 2),
+			MaxPerUser:           jsonIntNested(tb, "sessions", "max_per_user", 5),
 			DefaultWorkDir:       resolveHome(jsonStringNested(tb, "sessions", "default_work_dir", "~/projects")),
 			DefaultModel:         jsonStringNested(tb, "sessions", "default_model", "claude-sonnet-4-5-20250929"),
+			Models:               jsonStringMap(sessions, "models", defaultModels),
 			ResetHour:            jsonIntNested(tb, "sessions", "reset_hour", 4),
 			Timezone:             jsonStringNested(tb, "sessions", "timezone", "America/New_York"),
 			SubprocessTimeoutMin: jsonIntNested(tb, "sessions", "subprocess_timeout_minutes", 120),
+			Limits: LimitsConfig{
+				MemoryMB:       jsonIntNested(sessions, "limits", "memory_mb", 2048),
+				AddressSpaceMB: jsonIntNested(sessions, "limits", "address_space_mb", 0),
+				CPUSeconds:     jsonIntNested(sessions, "limits", "cpu_seconds", 0),
+				OpenFiles:      jsonIntNested(sessions, "limits", "open_files", 4096),
+				Processes:      jsonIntNested(sessions, "limits", "processes", 512),
+				OutputMB:       jsonIntNested(sessions, "limits", "output_mb", 64),
+				Cgroup:         jsonBoolNested(sessions, "limits", "cgroup", true),
+			},
+			Retry: RetryConfig{
+				MaxAttempts:  jsonIntNested(sessions, "retry", "max_attempts", 8),
+				BaseDelaySec: jsonIntNested(sessions, "retry", "base_delay_seconds", 60),
+				MaxDelayMin:  jsonIntNested(sessions, "retry", "max_delay_minutes", 60),
+			},
 		},
 		Security: SecurityConfig{
 			RequirePassphrase:  jsonBoolNested(tb, "security", "require_passphrase", false),
+			PassphraseHash:     jsonStringNested(tb, "security", "passphrase_hash", ""),
+			UnlockIdleMinutes:  jsonIntNested(tb, "security", "unlock_idle_minutes", 30),
+			MaxFailedAttempts:  jsonIntNested(tb, "security", "max_failed_attempts", 5),
+			LockoutMinutes:     jsonIntNested(tb, "security", "lockout_minutes", 15),
 			RateLimitPerMinute: jsonIntNested(tb, "security", "rate_limit_per_minute", 10),
+			TOTP: TOTPConfig{
+				Mode:          jsonStringNested(security, "totp", "mode", "off"),
+				WindowSteps:   jsonIntNested(security, "totp", "window_steps", 1),
+				UnlockMinutes: jsonIntNested(security, "totp", "unlock_minutes", 15),
+				KeyFile:       jsonStringNested(security, "totp", "key_file", "/etc/pai/totp.key"),
+			},
+			PermissionPrompts:  jsonBoolNested(tb, "security", "permission_prompts", false),
+			ApprovalTimeoutSec: jsonIntNested(tb, "security", "approval_timeout_seconds", 120),
 		},
 		Response: ResponseConfig{
 			Format:          jsonStringNested(tb, "response", "format", "concise"),
 			ForwardProgress: jsonBoolNested(tb, "response", "forward_progress", true),
+			ProgressSteps:   jsonIntNested(tb, "response", "progress_steps", 5),
+			AskTimeoutSec:   jsonIntNested(tb, "response", "ask_timeout_seconds", 600),
 		},
 		Server: ServerConfig{
-			Port: jsonIntNested(tb, "server", "port", 7777),
+			Port:      jsonIntNested(tb, "server", "port", 7777),
+			MCPSocket: jsonStringNested(tb, "server", "mcp_socket", "/run/pai-bridge/mcp.sock"),
+			MCPTools:  jsonBoolNested(tb, "server", "mcp_tools", true),
 		},
 		Memory: MemoryConfig{
 			Enabled:       jsonBoolNested(tb, "memory", "enabled", true),
@@ -124,10 +255,53 @@ func LoadConfig() (*Config, error) {
 			RetentionDays: jsonIntNested(tb, "memory", "retention_days", 14),
 		},
 		Voice: VoiceConfig{
-			Enabled: jsonBoolNested(tb, "voice", "enabled", false),
-			VoiceID: jsonStringNested(tb, "voice", "voice_id", "pDxcmDdBPmpAPjBko2mF"),
-			Model:   jsonStringNested(tb, "voice", "model", "eleven_turbo_v2_5"),
+			Enabled:  jsonBoolNested(tb, "voice", "enabled", false),
+			Provider: jsonStringNested(tb, "voice", "provider", "elevenlabs"),
+			VoiceID:  jsonStringNested(tb, "voice", "voice_id", "pDxcmDdBPmpAPjBko2mF"),
+			Model:    jsonStringNested(tb, "voice", "model", "eleven_turbo_v2_5"),
+			OpenAI: OpenAIVoiceConfig{
+				URL:   jsonStringNested(voice, "openai", "url", "https://api.openai.com/v1/audio/speech"),
+				Model: jsonStringNested(voice, "openai", "model", "tts-1"),
+				Voice: jsonStringNested(voice, "openai", "voice", "alloy"),
+			},
+			Command: CommandVoiceConfig{
+				Command: jsonStringNested(voice, "command", "command", ""),
+				Args:    jsonStringSlice(jsonNested(voice, "command"), "args"),
+				Format:  jsonStringNested(voice, "command", "format", "wav"),
+			},
+		},
+		STT: STTConfig{
+			Enabled:        jsonBoolNested(tb, "stt", "enabled", false),
+			Provider:       jsonStringNested(tb, "stt", "provider", "whisper-cpp"),
+			Command:        jsonStringNested(tb, "stt", "command", "whisper-cli"),
+			Args:           jsonStringSlice(stt, "args"),
+			Model:          jsonStringNested(tb, "stt", "model", "/mnt/pai-data/models/ggml-base.en.bin"),
+			URL:            jsonStringNested(tb, "stt", "url", ""),
+			Language:       jsonStringNested(tb, "stt", "language", ""),
+			TimeoutSec:     jsonIntNested(tb, "stt", "timeout_seconds", 120),
+			MaxDurationSec: jsonIntNested(tb, "stt", "max_duration_seconds", 600),
 		},
+		Quotas: QuotaConfig{
+			Daily: QuotaLimits{
+				Runs:    jsonIntNested(quotas, "daily", "runs", 0),
+				Tokens:  jsonIntNested(quotas, "daily", "tokens", 0),
+				Minutes: jsonIntNested(quotas, "daily", "minutes", 0),
+			},
+			Monthly: QuotaLimits{
+				Runs:    jsonIntNested(quotas, "monthly", "runs", 0),
+				Tokens:  jsonIntNested(quotas, "monthly", "tokens", 0),
+				Minutes: jsonIntNested(quotas, "monthly", "minutes", 0),
+			},
+			WarnPercent: jsonIntNested(tb, "quotas", "warn_percent", 80),
+			Admins:      jsonStringSlice(quotas, "admins"),
+		},
+	}
+
+	for _, root := range jsonStringSlice(sessions, "project_roots") {
+		cfg.Sessions.ProjectRoots = append(cfg.Sessions.ProjectRoots, resolveHome(root))
+	}
+	if len(cfg.Sessions.ProjectRoots) == 0 {
+		cfg.Sessions.ProjectRoots = []string{cfg.Sessions.DefaultWorkDir, "/mnt/pai-data/projects"}
 	}
 
 	return cfg, nil
@@ -163,6 +337,18 @@ func jsonStringSlice(m map[string]json.RawMessage, key string) []string {
 	return nil
 }
 
+func jsonStringMap(m map[string]json.RawMessage, key string, def map[string]string) map[string]string {
+	if v, ok := m[key]; ok {
+		var out map[string]string
+		if err := json.Unmarshal(v, &out); err != nil {
+			log.Printf("[PAI Config] Warning: %s exists but failed to parse as a string map: %v (using default)", key, err)
+		} else {
+			return out
+		}
+	}
+	return def
+}
+
 func jsonNested(m map[string]json.RawMessage, section string) map[string]json.RawMessage {
 	if v, ok := m[section]; ok {
 		var nested map[string]json.RawMessage
@@ -114,3 +114,22 @@ func TestResolveHome(t *testing.T) {
 		t.Error("home path should be expanded")
 	}
 }
+
+func TestJsonStringMap(t *testing.T) {
+	raw := map[string]json.RawMessage{
+		"models": json.RawMessage(`{"opus": "claude-opus-4-1", "fast": "claude-haiku-4-5"}`),
+		"broken": json.RawMessage(`["not", "a", "map"]`),
+	}
+	def := map[string]string{"x": "y"}
+
+	got := jsonStringMap(raw, "models", def)
+	if len(got) != 2 || got["opus"] != "claude-opus-4-1" || got["fast"] != "claude-haiku-4-5" {
+		t.Errorf("got %v", got)
+	}
+	if got := jsonStringMap(raw, "broken", def); got["x"] != "y" {
+		t.Errorf("invalid map should fall back to default, got %v", got)
+	}
+	if got := jsonStringMap(raw, "missing", def); got["x"] != "y" {
+		t.Errorf("missing key should return default, got %v", got)
+	}
+}
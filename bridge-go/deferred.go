@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
+)
+
+// deferredPrompt is a message Claude refused for lack of capacity, saved to
+// be replayed once the limit has had time to lift.
+type deferredPrompt struct {
+	ID          string           `json:"id"`
+	UserID      string           `json:"userId"`
+	ChatID      int64            `json:"chatId"`
+	SessionID   string           `json:"sessionId"`
+	Text        string           `json:"text"`
+	Attachments []*Attachment    `json:"attachments,omitempty"`
+	Count       int              `json:"count,omitempty"`  // queued messages batched into Text, for a follow-up run
+	Queued      []pendingMessage `json:"queued,omitempty"` // messages that were waiting behind it
+	Kind        string           `json:"kind"`             // capacityError.Kind
+	Attempts    int              `json:"attempts"`         // times it has been deferred
+	CreatedAt   int64            `json:"createdAt"`
+	NextAt      int64            `json:"nextAt"`
+}
+
+// deferredStore keeps deferred prompts in the state dir so a restart doesn't
+// lose them, with attachment payloads spilled to files beside it. Prompts are
+// ordered by when they were first deferred.
+type deferredStore struct {
+	path     string
+	spillDir string
+
+	mu        sync.Mutex
+	prompts   []*deferredPrompt
+	replaying map[string]bool // userIDs with a replay in progress
+}
+
+func newDeferredStore(path string) *deferredStore {
+	st := &deferredStore{
+		path:      path,
+		spillDir:  strings.TrimSuffix(path, ".json") + "-files",
+		replaying: make(map[string]bool),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[PAI Bridge] Failed to read deferred prompts: %v", err)
+		}
+		return st
+	}
+	if err := json.Unmarshal(data, &st.prompts); err != nil {
+		log.Printf("[PAI Bridge] Failed to parse deferred prompts: %v", err)
+	}
+	for _, p := range st.prompts {
+		p.Attachments = unspillAttachments(st.spillDir, p.Attachments)
+		p.Queued = unspillMessages(st.spillDir, p.Queued)
+	}
+	return st
+}
+
+// saveLocked persists the prompts. Caller must hold st.mu.
+func (st *deferredStore) saveLocked() {
+	if err := os.MkdirAll(st.spillDir, 0700); err != nil {
+		log.Printf("[PAI Bridge] Failed to create state dir: %v", err)
+		return
+	}
+	keep := make(map[string]bool)
+	onDisk := make([]deferredPrompt, len(st.prompts))
+	for i, p := range st.prompts {
+		onDisk[i] = *p
+		onDisk[i].Attachments = spillAttachments(st.spillDir, p.Attachments, keep)
+		onDisk[i].Queued = spillMessages(st.spillDir, p.Queued, keep)
+	}
+
+	data, err := json.MarshalIndent(onDisk, "", "  ")
+	if err != nil {
+		log.Printf("[PAI Bridge] Failed to marshal deferred prompts: %v", err)
+		return
+	}
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("[PAI Bridge] Failed to save deferred prompts: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, st.path); err == nil {
+		removeUnusedSpills(st.spillDir, keep)
+	}
+}
+
+// Add saves p, assigning its ID on first deferral. Claude's limits apply to
+// the whole login, so no prompt deferred earlier is retried before p.
+func (st *deferredStore) Add(p *deferredPrompt) {
+	if p.ID == "" {
+		p.ID = uuid.New().String()[:8]
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, other := range st.prompts {
+		if other.NextAt < p.NextAt {
+			other.NextAt = p.NextAt
+		}
+	}
+	i := sort.Search(len(st.prompts), func(i int) bool { return st.prompts[i].CreatedAt > p.CreatedAt })
+	st.prompts = append(st.prompts, nil)
+	copy(st.prompts[i+1:], st.prompts[i:])
+	st.prompts[i] = p
+	st.saveLocked()
+}
+
+// List returns copies of a user's deferred prompts, oldest first.
+func (st *deferredStore) List(userID string) []deferredPrompt {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var out []deferredPrompt
+	for _, p := range st.prompts {
+		if p.UserID == userID {
+			out = append(out, *p)
+		}
+	}
+	return out
+}
+
+// Remove drops one of a user's prompts, reporting whether it was there.
+func (st *deferredStore) Remove(userID, id string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for i, p := range st.prompts {
+		if p.ID == id && p.UserID == userID {
+			st.prompts = append(st.prompts[:i], st.prompts[i+1:]...)
+			st.saveLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// Clear drops all of a user's prompts and returns how many there were.
+func (st *deferredStore) Clear(userID string) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	kept := st.prompts[:0]
+	for _, p := range st.prompts {
+		if p.UserID != userID {
+			kept = append(kept, p)
+		}
+	}
+	n := len(st.prompts) - len(kept)
+	st.prompts = kept
+	if n > 0 {
+		st.saveLocked()
+	}
+	return n
+}
+
+// TakeDue removes and returns each user's oldest prompt that is due, skipping
+// users whose previous replay hasn't finished so a user's prompts run in
+// order. Call Done for each once its replay ends.
+func (st *deferredStore) TakeDue(now time.Time) []*deferredPrompt {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var due []*deferredPrompt
+	taken := make(map[string]bool)
+	kept := st.prompts[:0]
+	for _, p := range st.prompts {
+		if taken[p.UserID] || st.replaying[p.UserID] || p.NextAt > now.UnixMilli() {
+			taken[p.UserID] = true
+			kept = append(kept, p)
+			continue
+		}
+		taken[p.UserID] = true
+		st.replaying[p.UserID] = true
+		due = append(due, p)
+	}
+	st.prompts = kept
+	if len(due) > 0 {
+		st.saveLocked()
+	}
+	return due
+}
+
+// Done marks a user's replay finished.
+func (st *deferredStore) Done(userID string) {
+	st.mu.Lock()
+	delete(st.replaying, userID)
+	st.mu.Unlock()
+}
+
+// nextRetry picks when to replay a prompt deferred for the attempt'th time:
+// just after the reset time Claude gave, or else exponential backoff from
+// BaseDelaySec, capped at MaxDelayMin.
+func nextRetry(cfg RetryConfig, resetAt time.Time, attempt int, now time.Time) time.Time {
+	if resetAt.After(now) {
+		return resetAt.Add(time.Minute)
+	}
+	delay := time.Duration(cfg.BaseDelaySec) * time.Second
+	max := time.Duration(cfg.MaxDelayMin) * time.Minute
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return now.Add(delay)
+}
+
+// deferPrompt handles a run refused for lack of capacity. It saves the prompt
+// and the messages queued behind it for a replay and tells the user when that
+// will be. replay is the deferred prompt this run was replaying, if any.
+func (b *Bot) deferPrompt(chatID int64, userID string, capErr *capacityError, text string, attachments []*Attachment, count int, replay *deferredPrompt) {
+	now := time.Now()
+	loc := b.sessions.resetLocation
+	if b.deferred == nil {
+		msg := "⏳ " + capErr.Reason() + "."
+		if !capErr.ResetAt.IsZero() {
+			msg += " It resets " + describeReset(capErr.ResetAt.In(loc), now) + "."
+		}
+		if n := len(capErr.Queued); n > 0 {
+			msg += fmt.Sprintf(" %d queued message(s) were not sent.", n)
+		}
+		b.send(chatID, msg)
+		return
+	}
+
+	p := &deferredPrompt{
+		UserID:      userID,
+		ChatID:      chatID,
+		SessionID:   capErr.SessionID,
+		Text:        text,
+		Attachments: attachments,
+		Count:       count,
+		Queued:      capErr.Queued,
+		Kind:        capErr.Kind,
+		Attempts:    1,
+		CreatedAt:   now.UnixMilli(),
+	}
+	if replay != nil {
+		p.ID = replay.ID
+		p.Attempts = replay.Attempts + 1
+		p.CreatedAt = replay.CreatedAt
+	}
+	if max := b.config.Sessions.Retry.MaxAttempts; p.Attempts > max {
+		log.Printf("[PAI Bridge] Giving up on deferred prompt %s for user %s after %d retries", p.ID, userID, max)
+		b.send(chatID, fmt.Sprintf("⏳ %s. Giving up on your message after %d retries; send it again later.", capErr.Reason(), max))
+		return
+	}
+	next := nextRetry(b.config.Sessions.Retry, capErr.ResetAt, p.Attempts, now)
+	p.NextAt = next.UnixMilli()
+	b.deferred.Add(p)
+	log.Printf("[PAI Bridge] Deferred prompt %s for user %s until %s (%s, attempt %d)", p.ID, userID, next.Format(time.RFC3339), capErr.Kind, p.Attempts)
+
+	msg := fmt.Sprintf("⏳ %s. I'll retry your message %s", capErr.Reason(), describeReset(next.In(loc), now))
+	if n := len(capErr.Queued); n > 0 {
+		msg += fmt.Sprintf(", followed by %d queued message(s)", n)
+	}
+	b.send(chatID, msg+". /pending shows or drops deferred messages.")
+}
+
+// replayDeferred starts the deferred prompts that are due. It runs from the
+// maintenance ticker in main.
+func (b *Bot) replayDeferred() {
+	if b.deferred == nil {
+		return
+	}
+	for _, p := range b.deferred.TakeDue(time.Now()) {
+		go b.replay(p)
+	}
+}
+
+func (b *Bot) replay(p *deferredPrompt) {
+	defer b.deferred.Done(p.UserID)
+	sessionID, err := b.sessions.Requeue(p.UserID, p.SessionID, p.Queued)
+	if err != nil {
+		b.send(p.ChatID, fmt.Sprintf("Couldn't retry your deferred message: %v", err))
+		return
+	}
+	log.Printf("[PAI Bridge] Replaying deferred prompt %s for user %s (attempt %d)", p.ID, p.UserID, p.Attempts)
+	b.send(p.ChatID, fmt.Sprintf("🔁 Retrying your deferred message: %s", promptPreview(p)))
+	b.runMessages(p.ChatID, 0, p.UserID, sessionID, p.Text, p.Attachments, p.Count, p)
+}
+
+// promptPreview is a short description of a deferred prompt for Telegram.
+func promptPreview(p *deferredPrompt) string {
+	s := messagePreview(p.Text, p.Attachments)
+	if p.Count > 0 {
+		s = fmt.Sprintf("%d follow-up message(s)", p.Count)
+	}
+	if n := len(p.Queued); n > 0 {
+		s += fmt.Sprintf(" +%d queued", n)
+	}
+	return s
+}
+
+// messagePreview quotes the start of a message's text, or names its
+// attachments if it has no text.
+func messagePreview(text string, attachments []*Attachment) string {
+	if strings.TrimSpace(text) == "" && len(attachments) == 1 {
+		return "(" + attachments[0].Type + ")"
+	}
+	if strings.TrimSpace(text) == "" && len(attachments) > 1 {
+		return fmt.Sprintf("(%d attachments)", len(attachments))
+	}
+	s := strings.Join(strings.Fields(text), " ")
+	if r := []rune(s); len(r) > 40 {
+		s = string(r[:40]) + "…"
+	}
+	return fmt.Sprintf("%q", s)
+}
+
+// handlePending implements /pending: the user's deferred messages with a
+// button to drop each. "/pending clear" drops them all.
+func (b *Bot) handlePending(msg *tgbotapi.Message, userID string) {
+	chatID := msg.Chat.ID
+	if b.deferred == nil {
+		b.send(chatID, "Deferred retries are off (sessions.retry.max_attempts is 0).")
+		return
+	}
+	if strings.TrimSpace(msg.CommandArguments()) == "clear" {
+		b.send(chatID, fmt.Sprintf("Dropped %d deferred message(s).", b.deferred.Clear(userID)))
+		return
+	}
+	text, keyboard := b.renderPending(userID)
+	reply := tgbotapi.NewMessage(chatID, text)
+	if keyboard != nil {
+		reply.ReplyMarkup = keyboard
+	}
+	b.api.Send(reply)
+}
+
+func (b *Bot) renderPending(userID string) (string, *tgbotapi.InlineKeyboardMarkup) {
+	prompts := b.deferred.List(userID)
+	if len(prompts) == 0 {
+		return "No deferred messages.", nil
+	}
+	now := time.Now()
+	loc := b.sessions.resetLocation
+	var sb strings.Builder
+	sb.WriteString("⏳ Deferred messages:")
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, p := range prompts {
+		next := time.UnixMilli(p.NextAt).In(loc)
+		fmt.Fprintf(&sb, "\n%d. %s — %s, retry %d of %d %s", i+1, promptPreview(&p), p.Kind, p.Attempts,
+			b.config.Sessions.Retry.MaxAttempts, describeReset(next, now))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("Drop %d", i+1), "pending:"+p.ID),
+		))
+	}
+	if len(prompts) > 1 {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Drop all", "pending:all"),
+		))
+	}
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return sb.String(), &keyboard
+}
+
+// handlePendingCallback resolves "pending:<id>" and "pending:all" from the
+// /pending list and redraws it in place.
+func (b *Bot) handlePendingCallback(cq *tgbotapi.CallbackQuery, userID, arg string) {
+	if b.deferred == nil {
+		b.answerCallback(cq.ID, "")
+		return
+	}
+	if arg == "all" {
+		b.answerCallback(cq.ID, fmt.Sprintf("Dropped %d.", b.deferred.Clear(userID)))
+	} else if b.deferred.Remove(userID, arg) {
+		b.answerCallback(cq.ID, "Dropped.")
+	} else {
+		b.answerCallback(cq.ID, "Already sent or dropped.")
+	}
+	if cq.Message == nil {
+		return
+	}
+	text, keyboard := b.renderPending(userID)
+	edit := tgbotapi.NewEditMessageText(cq.Message.Chat.ID, cq.Message.MessageID, text)
+	edit.ReplyMarkup = keyboard
+	b.api.Request(edit)
+}
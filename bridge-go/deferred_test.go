@@ -0,0 +1,107 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeferredStore_OrderAndPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deferred.json")
+	now := time.Now()
+	st := newDeferredStore(path)
+	st.Add(&deferredPrompt{UserID: "u1", Text: "first", CreatedAt: 1, NextAt: now.Add(-time.Minute).UnixMilli()})
+	st.Add(&deferredPrompt{UserID: "u2", Text: "other user", CreatedAt: 3, NextAt: now.Add(-time.Minute).UnixMilli()})
+	// A re-deferred prompt keeps its place by creation time
+	st.Add(&deferredPrompt{UserID: "u1", Text: "second", CreatedAt: 2, NextAt: now.Add(-time.Minute).UnixMilli()})
+
+	reloaded := newDeferredStore(path)
+	if list := reloaded.List("u1"); len(list) != 2 || list[0].Text != "first" || list[1].Text != "second" || list[0].ID == "" {
+		t.Fatalf("reloaded list: %+v", list)
+	}
+
+	due := reloaded.TakeDue(now)
+	if len(due) != 2 || due[0].Text != "first" || due[1].Text != "other user" {
+		t.Fatalf("one prompt per user should be due: %+v", due)
+	}
+	if again := reloaded.TakeDue(now); len(again) != 0 {
+		t.Errorf("u1's next prompt must wait for the replay to finish: %+v", again)
+	}
+	reloaded.Done("u1")
+	if again := reloaded.TakeDue(now); len(again) != 1 || again[0].Text != "second" {
+		t.Errorf("after Done: %+v", again)
+	}
+	if n := len(newDeferredStore(path).List("u1")); n != 0 {
+		t.Errorf("taken prompts should be removed on disk, %d left", n)
+	}
+}
+
+func TestDeferredStore_HoldsBackEarlierPrompts(t *testing.T) {
+	st := newDeferredStore(filepath.Join(t.TempDir(), "deferred.json"))
+	now := time.Now()
+	st.Add(&deferredPrompt{UserID: "u1", CreatedAt: 1, NextAt: now.Add(time.Minute).UnixMilli()})
+	st.Add(&deferredPrompt{UserID: "u2", CreatedAt: 2, NextAt: now.Add(time.Hour).UnixMilli()})
+
+	if due := st.TakeDue(now.Add(2 * time.Minute)); len(due) != 0 {
+		t.Errorf("a later limit should hold back earlier prompts: %+v", due)
+	}
+	if due := st.TakeDue(now.Add(time.Hour)); len(due) != 2 {
+		t.Errorf("both should be due together: %+v", due)
+	}
+}
+
+func TestDeferredStore_RemoveAndClear(t *testing.T) {
+	st := newDeferredStore(filepath.Join(t.TempDir(), "deferred.json"))
+	a := &deferredPrompt{UserID: "u1", CreatedAt: 1}
+	st.Add(a)
+	st.Add(&deferredPrompt{UserID: "u1", CreatedAt: 2})
+	st.Add(&deferredPrompt{UserID: "u2", CreatedAt: 3})
+
+	if st.Remove("u2", a.ID) {
+		t.Error("users must not drop each other's prompts")
+	}
+	if !st.Remove("u1", a.ID) || st.Remove("u1", a.ID) {
+		t.Error("remove should succeed once")
+	}
+	if n := st.Clear("u1"); n != 1 {
+		t.Errorf("cleared %d, want 1", n)
+	}
+	if len(st.List("u2")) != 1 {
+		t.Error("clear should leave other users' prompts")
+	}
+}
+
+func TestNextRetry(t *testing.T) {
+	cfg := RetryConfig{MaxAttempts: 8, BaseDelaySec: 60, MaxDelayMin: 10}
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	for attempt, want := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 5: 10 * time.Minute, 8: 10 * time.Minute} {
+		if got := nextRetry(cfg, time.Time{}, attempt, now).Sub(now); got != want {
+			t.Errorf("attempt %d: backoff %v, want %v", attempt, got, want)
+		}
+	}
+	reset := now.Add(3 * time.Hour)
+	if got := nextRetry(cfg, reset, 1, now); !got.Equal(reset.Add(time.Minute)) {
+		t.Errorf("known reset: %v", got)
+	}
+	if got := nextRetry(cfg, now.Add(-time.Hour), 2, now); !got.Equal(now.Add(2 * time.Minute)) {
+		t.Errorf("a past reset should fall back to backoff: %v", got)
+	}
+}
+
+func TestPromptPreview(t *testing.T) {
+	tests := []struct {
+		p    deferredPrompt
+		want string
+	}{
+		{deferredPrompt{Text: "fix   the\nbuild"}, `"fix the build"`},
+		{deferredPrompt{Text: "ünïcödé text that goes on well past the forty rune cut"}, `"ünïcödé text that goes on well past the …"`},
+		{deferredPrompt{Attachments: []*Attachment{{Type: "image"}}, Queued: []pendingMessage{{Text: "x"}}}, "(image) +1 queued"},
+		{deferredPrompt{Text: "[While you were working…]", Count: 3}, "3 follow-up message(s)"},
+	}
+	for _, tt := range tests {
+		if got := promptPreview(&tt.p); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+}
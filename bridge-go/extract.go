@@ -0,0 +1,397 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Text extraction for documents Claude can't read directly, in pure Go so
+// the bridge needs no converters installed. Office formats are zip archives
+// of XML; archives get a listing of their contents.
+
+const (
+	// maxExtractedText caps the text extracted from one document.
+	maxExtractedText = 100_000
+	// maxArchiveMemberBytes caps how much of one archive member is
+	// decompressed, against zip bombs.
+	maxArchiveMemberBytes = 64 << 20
+	// maxArchiveListing caps the entries listed for an archive.
+	maxArchiveListing = 500
+	// maxXlsxColumns is Excel's column limit (XFD). Cells beyond it are
+	// skipped rather than padded out to.
+	maxXlsxColumns = 16384
+)
+
+// documentExtractors turn a document into text for Claude, by file name
+// suffix. The original file is saved to the session inbox either way.
+var documentExtractors = []struct {
+	suffix  string
+	extract func(data []byte) (string, error)
+}{
+	{".docx", docxText},
+	{".pptx", pptxText},
+	{".xlsx", xlsxText},
+	{".zip", zipListing},
+	{".tar", tarListing},
+	{".tar.gz", tarListing},
+	{".tgz", tarListing},
+}
+
+// extractDocument returns the text of a document whose type has an
+// extractor, or "" if none applies.
+func extractDocument(fileName string, data []byte) (string, error) {
+	lower := strings.ToLower(fileName)
+	for _, e := range documentExtractors {
+		if strings.HasSuffix(lower, e.suffix) {
+			text, err := e.extract(data)
+			if err != nil {
+				return "", err
+			}
+			return capText(text), nil
+		}
+	}
+	return "", nil
+}
+
+func capText(text string) string {
+	text = strings.TrimSpace(text)
+	if len(text) <= maxExtractedText {
+		return text
+	}
+	cut := maxExtractedText
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + "\n[… truncated]"
+}
+
+// openZipMember opens a member of a zip archive, reading at most
+// maxArchiveMemberBytes of it.
+func openZipMember(zr *zip.Reader, name string) (io.ReadCloser, error) {
+	f, err := zr.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, maxArchiveMemberBytes), f}, nil
+}
+
+// ooxmlText collects the text runs (<w:t>, <a:t>) of an Office XML part,
+// one line per paragraph.
+func ooxmlText(r io.Reader, sb *strings.Builder) error {
+	dec := xml.NewDecoder(r)
+	inText := false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				sb.WriteByte('\t')
+			case "br":
+				sb.WriteByte('\n')
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				sb.WriteByte('\n')
+			}
+		case xml.CharData:
+			if inText {
+				sb.Write(t)
+			}
+		}
+	}
+}
+
+// docxText extracts the body text of a Word document.
+func docxText(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("not a valid .docx: %w", err)
+	}
+	r, err := openZipMember(zr, "word/document.xml")
+	if err != nil {
+		return "", fmt.Errorf("not a valid .docx: %w", err)
+	}
+	defer r.Close()
+	var sb strings.Builder
+	if err := ooxmlText(r, &sb); err != nil {
+		return "", fmt.Errorf("read .docx: %w", err)
+	}
+	return sb.String(), nil
+}
+
+// pptxText extracts the text of each slide of a PowerPoint deck.
+func pptxText(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("not a valid .pptx: %w", err)
+	}
+	var slides []int
+	for _, f := range zr.File {
+		var n int
+		if _, err := fmt.Sscanf(f.Name, "ppt/slides/slide%d.xml", &n); err == nil {
+			slides = append(slides, n)
+		}
+	}
+	sort.Ints(slides)
+	var sb strings.Builder
+	for _, n := range slides {
+		r, err := openZipMember(zr, fmt.Sprintf("ppt/slides/slide%d.xml", n))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sb, "## Slide %d\n", n)
+		err = ooxmlText(r, &sb)
+		r.Close()
+		if err != nil {
+			return "", fmt.Errorf("read .pptx: %w", err)
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String(), nil
+}
+
+// xlsxText extracts each sheet of an Excel workbook as CSV.
+func xlsxText(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("not a valid .xlsx: %w", err)
+	}
+
+	var workbook struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	var rels struct {
+		Rels []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	var shared struct {
+		Items []xlsxString `xml:"si"`
+	}
+	if err := decodeZipXML(zr, "xl/workbook.xml", &workbook); err != nil {
+		return "", fmt.Errorf("not a valid .xlsx: %w", err)
+	}
+	if err := decodeZipXML(zr, "xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return "", fmt.Errorf("not a valid .xlsx: %w", err)
+	}
+	// Workbooks with no text cells have no shared strings part
+	if err := decodeZipXML(zr, "xl/sharedStrings.xml", &shared); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("read .xlsx: %w", err)
+	}
+	targets := make(map[string]string)
+	for _, r := range rels.Rels {
+		target := strings.TrimPrefix(r.Target, "/")
+		if !strings.HasPrefix(target, "xl/") {
+			target = path.Join("xl", target)
+		}
+		targets[r.ID] = target
+	}
+
+	var sb strings.Builder
+	for _, s := range workbook.Sheets {
+		var sheet struct {
+			Rows []struct {
+				Cells []struct {
+					Ref    string     `xml:"r,attr"`
+					Type   string     `xml:"t,attr"`
+					Value  string     `xml:"v"`
+					Inline xlsxString `xml:"is"`
+				} `xml:"c"`
+			} `xml:"sheetData>row"`
+		}
+		if err := decodeZipXML(zr, targets[s.RID], &sheet); err != nil {
+			return "", fmt.Errorf("read sheet %q: %w", s.Name, err)
+		}
+		fmt.Fprintf(&sb, "## Sheet: %s\n", s.Name)
+		w := csv.NewWriter(&sb)
+		for _, row := range sheet.Rows {
+			var record []string
+			for _, c := range row.Cells {
+				col := xlsxColumn(c.Ref)
+				if col >= maxXlsxColumns {
+					continue
+				}
+				if col >= 0 {
+					for len(record) < col {
+						record = append(record, "")
+					}
+				}
+				v := c.Value
+				switch c.Type {
+				case "s":
+					if i, err := strconv.Atoi(v); err == nil && i >= 0 && i < len(shared.Items) {
+						v = shared.Items[i].String()
+					}
+				case "inlineStr":
+					v = c.Inline.String()
+				case "b":
+					v = map[string]string{"1": "TRUE", "0": "FALSE"}[v]
+				}
+				record = append(record, v)
+			}
+			w.Write(record)
+			if sb.Len() > maxExtractedText {
+				break
+			}
+		}
+		w.Flush()
+		sb.WriteByte('\n')
+	}
+	return sb.String(), nil
+}
+
+// xlsxString is a string item in an Excel part: plain text, or rich text
+// runs.
+type xlsxString struct {
+	Text string   `xml:"t"`
+	Runs []string `xml:"r>t"`
+}
+
+func (t xlsxString) String() string {
+	return t.Text + strings.Join(t.Runs, "")
+}
+
+// xlsxColumn returns the zero-based column of a cell reference like "C7",
+// -1 if there is none, or maxXlsxColumns if it is past Excel's last column.
+func xlsxColumn(ref string) int {
+	col := 0
+	n := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A'+1)
+		if col > maxXlsxColumns {
+			return maxXlsxColumns
+		}
+		n++
+	}
+	if n == 0 {
+		return -1
+	}
+	return col - 1
+}
+
+func decodeZipXML(zr *zip.Reader, name string, v interface{}) error {
+	if name == "" {
+		return fmt.Errorf("missing part")
+	}
+	r, err := openZipMember(zr, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return xml.NewDecoder(r).Decode(v)
+}
+
+// zipListing lists the files in a zip archive.
+func zipListing(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("not a valid zip archive: %w", err)
+	}
+	var entries []archiveEntry
+	for _, f := range zr.File {
+		entries = append(entries, archiveEntry{f.Name, int64(f.UncompressedSize64), f.FileInfo().IsDir()})
+	}
+	return formatListing(entries, false), nil
+}
+
+// tarListing lists the files in a tar archive, gzipped or not. A gzipped
+// archive is only read as far as maxArchiveMemberBytes of decompressed data.
+func tarListing(data []byte) (string, error) {
+	var r io.Reader = bytes.NewReader(data)
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return "", fmt.Errorf("not a valid gzip file: %w", err)
+		}
+		defer gz.Close()
+		r = io.LimitReader(gz, maxArchiveMemberBytes)
+	}
+	tr := tar.NewReader(r)
+	var entries []archiveEntry
+	for len(entries) < maxArchiveListing {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return formatListing(entries, false), nil
+		}
+		if err != nil {
+			if len(entries) > 0 {
+				break
+			}
+			return "", fmt.Errorf("read tar archive: %w", err)
+		}
+		entries = append(entries, archiveEntry{h.Name, h.Size, h.Typeflag == tar.TypeDir})
+	}
+	return formatListing(entries, true), nil
+}
+
+type archiveEntry struct {
+	name  string
+	size  int64
+	isDir bool
+}
+
+// formatListing lists archive entries, up to maxArchiveListing of them.
+// partial means entries isn't the whole archive.
+func formatListing(entries []archiveEntry, partial bool) string {
+	var sb strings.Builder
+	files := 0
+	var total int64
+	for _, e := range entries {
+		if !e.isDir {
+			files++
+			total += e.size
+		}
+	}
+	if partial {
+		fmt.Fprintf(&sb, "Archive contents (first %d entries): %d file(s), %d bytes uncompressed\n", len(entries), files, total)
+	} else {
+		fmt.Fprintf(&sb, "Archive contents: %d file(s), %d bytes uncompressed\n", files, total)
+	}
+	for i, e := range entries {
+		if i == maxArchiveListing {
+			fmt.Fprintf(&sb, "… and %d more\n", len(entries)-i)
+			break
+		}
+		if e.isDir {
+			fmt.Fprintf(&sb, "%s\n", e.name)
+		} else {
+			fmt.Fprintf(&sb, "%s (%d bytes)\n", e.name, e.size)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+// zipOf builds a zip archive of the given files, in order.
+func zipOf(t *testing.T, files ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i+1 < len(files); i += 2 {
+		w, err := zw.Create(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(files[i+1]))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractDocument_Docx(t *testing.T) {
+	data := zipOf(t, "word/document.xml", `<?xml version="1.0"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p><w:r><w:t>Quarterly</w:t></w:r><w:r><w:t xml:space="preserve"> report</w:t></w:r></w:p>
+<w:p><w:r><w:t>Revenue</w:t><w:tab/><w:t>up</w:t></w:r></w:p>
+</w:body></w:document>`)
+	text, err := extractDocument("Report.DOCX", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "Quarterly report\nRevenue\tup" {
+		t.Errorf("text: %q", text)
+	}
+}
+
+func TestExtractDocument_Xlsx(t *testing.T) {
+	data := zipOf(t,
+		"xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Sales" sheetId="1" r:id="rId1"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Target="worksheets/sheet1.xml"/></Relationships>`,
+		"xl/sharedStrings.xml", `<sst><si><t>Region</t></si><si><r><t>No</t></r><r><t>rth, east</t></r></si></sst>`,
+		"xl/worksheets/sheet1.xml", `<worksheet><sheetData>
+<row r="1"><c r="A1" t="s"><v>0</v></c><c r="C1" t="inlineStr"><is><t>Total</t></is></c></row>
+<row r="2"><c r="A2" t="s"><v>1</v></c><c r="B2" t="b"><v>1</v></c><c r="C2"><v>42.5</v></c></row>
+</sheetData></worksheet>`)
+	text, err := extractDocument("sales.xlsx", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "## Sheet: Sales\nRegion,,Total\n\"North, east\",TRUE,42.5"; text != want {
+		t.Errorf("text:\n%s\nwant:\n%s", text, want)
+	}
+}
+
+func TestExtractDocument_XlsxColumnBound(t *testing.T) {
+	data := zipOf(t,
+		"xl/workbook.xml", `<workbook xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="S" r:id="rId1"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels", `<Relationships><Relationship Id="rId1" Target="worksheets/sheet1.xml"/></Relationships>`,
+		"xl/worksheets/sheet1.xml", `<worksheet><sheetData>
+<row r="1"><c r="A1"><v>1</v></c><c r="ZZZZZZZZZZZZZZZZZZZZ1"><v>2</v></c><c r="XFE1"><v>3</v></c><c r="B1"><v>4</v></c></row>
+</sheetData></worksheet>`)
+	text, err := extractDocument("huge.xlsx", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "## Sheet: S\n1,4"; text != want {
+		t.Errorf("text: %q, want %q", text, want)
+	}
+	if got := xlsxColumn("XFD1"); got != maxXlsxColumns-1 {
+		t.Errorf("xlsxColumn(XFD1) = %d", got)
+	}
+}
+
+func TestExtractDocument_Archives(t *testing.T) {
+	text, err := extractDocument("src.zip", zipOf(t, "src/", "", "src/main.go", "package main\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text, "1 file(s), 13 bytes") || !strings.Contains(text, "src/main.go (13 bytes)") {
+		t.Errorf("zip listing: %q", text)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "notes.txt", Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.Close()
+	gz.Close()
+	text, err = extractDocument("backup.tar.gz", buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text, "notes.txt (5 bytes)") {
+		t.Errorf("tar listing: %q", text)
+	}
+
+	if _, err := extractDocument("broken.docx", []byte("not a zip")); err == nil {
+		t.Error("a corrupt document should fail")
+	}
+	if text, err := extractDocument("model.bin", []byte{1, 2, 3}); text != "" || err != nil {
+		t.Errorf("no extractor: %q %v", text, err)
+	}
+}
@@ -5,4 +5,5 @@ go 1.23.1
 require (
 	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
 	github.com/google/uuid v1.6.0
+	golang.org/x/crypto v0.40.0
 )
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// inboxDirName is the directory under a session's work dir that files sent
+// from Telegram are saved to, in a subdirectory per session.
+const inboxDirName = ".telegram-inbox"
+
+const (
+	// maxVideoFrames is how many still frames of a video Claude is shown.
+	maxVideoFrames = 4
+	// videoFrameTimeout caps the ffmpeg run for each frame.
+	videoFrameTimeout = 30 * time.Second
+)
+
+// ingester turns one kind of Telegram message payload into prompt text and
+// attachments for Claude. Anything the photo and document paths can't carry
+// inline is sent as a "file" attachment, which is saved to the session inbox
+// when the message runs.
+type ingester struct {
+	name   string
+	match  func(msg *tgbotapi.Message) bool
+	ingest func(b *Bot, msg *tgbotapi.Message) (*ingested, error)
+}
+
+// ingested is what an ingester made of a message. Text goes after the
+// caption; errors returned by an ingester are shown to the user as they are.
+type ingested struct {
+	Text        string
+	Attachments []*Attachment
+}
+
+// ingesters in order of precedence: Telegram sets Document on animations as
+// well, and Location on venues.
+var ingesters = []ingester{
+	{"photo", func(m *tgbotapi.Message) bool { return len(m.Photo) > 0 }, ingestPhoto},
+	{"animation", func(m *tgbotapi.Message) bool { return m.Animation != nil }, ingestAnimation},
+	{"video", func(m *tgbotapi.Message) bool { return m.Video != nil }, ingestVideo},
+	{"video note", func(m *tgbotapi.Message) bool { return m.VideoNote != nil }, ingestVideoNote},
+	{"audio", func(m *tgbotapi.Message) bool { return m.Audio != nil }, ingestAudio},
+	{"document", func(m *tgbotapi.Message) bool { return m.Document != nil }, ingestDocument},
+	{"sticker", func(m *tgbotapi.Message) bool { return m.Sticker != nil }, ingestSticker},
+	{"venue", func(m *tgbotapi.Message) bool { return m.Venue != nil }, ingestVenue},
+	{"location", func(m *tgbotapi.Message) bool { return m.Location != nil }, ingestLocation},
+	{"contact", func(m *tgbotapi.Message) bool { return m.Contact != nil }, ingestContact},
+}
+
+// ingesterFor returns the ingester for a message, or nil if no ingester
+// handles it.
+func ingesterFor(msg *tgbotapi.Message) *ingester {
+	for i := range ingesters {
+		if ingesters[i].match(msg) {
+			return &ingesters[i]
+		}
+	}
+	return nil
+}
+
+// handleIngest sends a non-text message to Claude: its caption, then what
+// the ingester made of it.
+func (b *Bot) handleIngest(msg *tgbotapi.Message, userID string, ing *ingester) {
+	res, err := ing.ingest(b, msg)
+	if err != nil {
+		b.send(msg.Chat.ID, err.Error())
+		return
+	}
+	// Editing the caption replaces the queued text, which would lose
+	// anything the ingester added to it
+	msgID := msg.MessageID
+	if res.Text != "" {
+		msgID = 0
+	}
+	b.handleMessage(msg.Chat.ID, msgID, userID, joinNonEmpty(msg.Caption, res.Text), res.Attachments)
+}
+
+func joinNonEmpty(parts ...string) string {
+	var out []string
+	for _, p := range parts {
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return strings.Join(out, "\n\n")
+}
+
+// downloadTelegramFile fetches a file by ID, returning its contents and its
+// path on Telegram's servers, whose extension tells its format. what names
+// the file in errors, which are user-facing.
+func (b *Bot) downloadTelegramFile(fileID, what string) ([]byte, string, error) {
+	file, err := b.api.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	if err != nil {
+		return nil, "", fmt.Errorf("Error getting %s: %v", what, err)
+	}
+	url := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", b.config.BotToken, file.FilePath)
+	data, err := downloadFile(url)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error downloading %s: %v", what, err)
+	}
+	return data, file.FilePath, nil
+}
+
+// imageMimeType guesses an image's MIME type from its file name.
+func imageMimeType(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".png":
+		return "image/png"
+	case ".gif":
+		return "image/gif"
+	case ".webp":
+		return "image/webp"
+	}
+	return "image/jpeg"
+}
+
+func fileAttachment(fileName, mimeType string, data []byte) *Attachment {
+	return &Attachment{
+		Type:     "file",
+		Base64:   base64.StdEncoding.EncodeToString(data),
+		MimeType: mimeType,
+		FileName: fileName,
+	}
+}
+
+// isInlineBinary reports whether an attachment is sent to Claude in the
+// request itself, where it counts toward maxBatchAttachmentBytes.
+func isInlineBinary(a *Attachment) bool {
+	return a.Type == "image" || a.Type == "document"
+}
+
+// ingestPhoto downloads the largest size of a photo.
+func ingestPhoto(b *Bot, msg *tgbotapi.Message) (*ingested, error) {
+	largest := msg.Photo[len(msg.Photo)-1]
+	data, tgPath, err := b.downloadTelegramFile(largest.FileID, "photo")
+	if err != nil {
+		return nil, err
+	}
+	return &ingested{Attachments: []*Attachment{{
+		Type:     "image",
+		Base64:   base64.StdEncoding.EncodeToString(data),
+		MimeType: imageMimeType(tgPath),
+	}}}, nil
+}
+
+// ingestDocument downloads a file. PDFs and images are passed to Claude
+// directly and text and code files are inlined. Anything else is saved to the
+// session inbox, with its text alongside if it can be extracted (Office
+// documents, archive listings).
+func ingestDocument(b *Bot, msg *tgbotapi.Message) (*ingested, error) {
+	doc := msg.Document
+	fileName := doc.FileName
+	if fileName == "" {
+		fileName = "document"
+	}
+	data, _, err := b.downloadTelegramFile(doc.FileID, "document")
+	if err != nil {
+		return nil, err
+	}
+
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if len(ext) > 0 {
+		ext = ext[1:] // remove leading dot
+	}
+	switch {
+	case ext == "pdf":
+		return &ingested{Attachments: []*Attachment{{
+			Type:     "document",
+			Base64:   base64.StdEncoding.EncodeToString(data),
+			MimeType: "application/pdf",
+			FileName: fileName,
+		}}}, nil
+	case isTextExt(ext):
+		return &ingested{Attachments: []*Attachment{{
+			Type:        "text-file",
+			MimeType:    "text/plain",
+			FileName:    fileName,
+			TextContent: string(data),
+		}}}, nil
+	case imageExtRe.MatchString(fileName):
+		return &ingested{Attachments: []*Attachment{{
+			Type:     "image",
+			Base64:   base64.StdEncoding.EncodeToString(data),
+			MimeType: imageMimeType(fileName),
+			FileName: fileName,
+		}}}, nil
+	}
+
+	res := &ingested{Attachments: []*Attachment{fileAttachment(fileName, doc.MimeType, data)}}
+	text, err := extractDocument(fileName, data)
+	if err != nil {
+		log.Printf("[PAI Bridge] Couldn't extract text from %s: %v", fileName, err)
+		res.Text = fmt.Sprintf("[The bridge couldn't read the text of %s: %v]", fileName, err)
+	} else if text != "" {
+		res.Attachments = append(res.Attachments, &Attachment{
+			Type:        "text-file",
+			MimeType:    "text/plain",
+			FileName:    fileName + " (extracted text)",
+			TextContent: text,
+		})
+	}
+	return res, nil
+}
+
+func ingestVideo(b *Bot, msg *tgbotapi.Message) (*ingested, error) {
+	v := msg.Video
+	return b.ingestMotion(v.FileID, v.FileName, v.MimeType, "video", v.Duration)
+}
+
+func ingestVideoNote(b *Bot, msg *tgbotapi.Message) (*ingested, error) {
+	v := msg.VideoNote
+	return b.ingestMotion(v.FileID, "", "video/mp4", "video message", v.Duration)
+}
+
+func ingestAnimation(b *Bot, msg *tgbotapi.Message) (*ingested, error) {
+	a := msg.Animation
+	return b.ingestMotion(a.FileID, a.FileName, a.MimeType, "animation", a.Duration)
+}
+
+// ingestMotion saves a video to the session inbox and shows Claude a few
+// frames from it. Without ffmpeg Claude gets the file alone.
+func (b *Bot) ingestMotion(fileID, fileName, mimeType, what string, duration int) (*ingested, error) {
+	data, tgPath, err := b.downloadTelegramFile(fileID, what)
+	if err != nil {
+		return nil, err
+	}
+	if fileName == "" {
+		fileName = strings.ReplaceAll(what, " ", "-") + filepath.Ext(tgPath)
+	}
+	res := &ingested{Attachments: []*Attachment{fileAttachment(fileName, mimeType, data)}}
+
+	frames, err := videoFrames(data, filepath.Ext(tgPath), duration)
+	if err != nil {
+		log.Printf("[PAI Bridge] Couldn't take frames from %s: %v", fileName, err)
+		res.Text = fmt.Sprintf("[The bridge couldn't take preview frames from %s: %v]", fileName, err)
+		return res, nil
+	}
+	for i, f := range frames {
+		res.Attachments = append(res.Attachments, &Attachment{
+			Type:     "image",
+			Base64:   base64.StdEncoding.EncodeToString(f.jpeg),
+			MimeType: "image/jpeg",
+			FileName: fmt.Sprintf("%s frame %d", fileName, i+1),
+			Label:    fmt.Sprintf("Frame %d/%d of %s, at %s", i+1, len(frames), fileName, formatElapsed(f.at)),
+		})
+	}
+	return res, nil
+}
+
+type videoFrame struct {
+	at   time.Duration
+	jpeg []byte
+}
+
+// videoFrames takes up to maxVideoFrames frames spread evenly across a video
+// with ffmpeg. ext is the video's extension, which ffmpeg goes by.
+func videoFrames(data []byte, ext string, duration int) ([]videoFrame, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil, fmt.Errorf("ffmpeg is not installed")
+	}
+	dir, err := os.MkdirTemp("", "pai-video-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "in"+ext)
+	if err := os.WriteFile(in, data, 0600); err != nil {
+		return nil, err
+	}
+
+	n := maxVideoFrames
+	if duration < n {
+		n = max(duration, 1)
+	}
+	var frames []videoFrame
+	for i := 0; i < n; i++ {
+		// The middle of each of n equal spans
+		at := time.Duration(duration) * time.Second * time.Duration(2*i+1) / time.Duration(2*n)
+		out := filepath.Join(dir, fmt.Sprintf("frame%d.jpg", i))
+		ctx, cancel := context.WithTimeout(context.Background(), videoFrameTimeout)
+		cmd := exec.CommandContext(ctx, "ffmpeg", "-v", "error", "-y",
+			"-ss", fmt.Sprintf("%.3f", at.Seconds()), "-i", in,
+			"-frames:v", "1", "-vf", "scale='min(1280,iw)':-2", "-q:v", "4", out)
+		output, err := cmd.CombinedOutput()
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(string(output)))
+		}
+		img, err := os.ReadFile(out)
+		if err != nil {
+			// Seeking past the last frame writes nothing
+			continue
+		}
+		frames = append(frames, videoFrame{at, img})
+	}
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("no frames found")
+	}
+	return frames, nil
+}
+
+// ingestAudio saves an audio file to the session inbox. Audio is only
+// ingested when there is no speech-to-text; otherwise it is transcribed.
+func ingestAudio(b *Bot, msg *tgbotapi.Message) (*ingested, error) {
+	a := msg.Audio
+	data, tgPath, err := b.downloadTelegramFile(a.FileID, "audio file")
+	if err != nil {
+		return nil, err
+	}
+	fileName := a.FileName
+	if fileName == "" {
+		fileName = "audio" + filepath.Ext(tgPath)
+	}
+	res := &ingested{Attachments: []*Attachment{fileAttachment(fileName, a.MimeType, data)}}
+	title := a.Title
+	if a.Performer != "" {
+		title = strings.TrimSuffix(a.Performer+" – "+title, " – ")
+	}
+	if title != "" {
+		res.Text = fmt.Sprintf("[Audio: %s, %s]", title, formatElapsed(time.Duration(a.Duration)*time.Second))
+	}
+	return res, nil
+}
+
+// ingestSticker describes a sticker by its emoji and set, and shows it to
+// Claude as an image: static stickers as they are, animated and video ones
+// by their thumbnail.
+func ingestSticker(b *Bot, msg *tgbotapi.Message) (*ingested, error) {
+	s := msg.Sticker
+	text := "[Sticker"
+	if s.Emoji != "" {
+		text += " " + s.Emoji
+	}
+	if s.SetName != "" {
+		text += fmt.Sprintf(" from the set %q", s.SetName)
+	}
+	res := &ingested{Text: text + "]"}
+
+	fileID := s.FileID
+	if s.IsAnimated {
+		if s.Thumbnail == nil {
+			return res, nil
+		}
+		fileID = s.Thumbnail.FileID
+	}
+	data, tgPath, err := b.downloadTelegramFile(fileID, "sticker")
+	if err == nil && !imageExtRe.MatchString(tgPath) && s.Thumbnail != nil && fileID != s.Thumbnail.FileID {
+		data, tgPath, err = b.downloadTelegramFile(s.Thumbnail.FileID, "sticker")
+	}
+	if err != nil {
+		log.Printf("[PAI Bridge] Sticker image not sent: %v", err)
+		return res, nil
+	}
+	if !imageExtRe.MatchString(tgPath) {
+		return res, nil
+	}
+	res.Attachments = []*Attachment{{
+		Type:     "image",
+		Base64:   base64.StdEncoding.EncodeToString(data),
+		MimeType: imageMimeType(tgPath),
+		FileName: "sticker" + filepath.Ext(tgPath),
+	}}
+	return res, nil
+}
+
+func ingestLocation(b *Bot, msg *tgbotapi.Message) (*ingested, error) {
+	return &ingested{Text: "[Location: " + locationText(msg.Location) + "]"}, nil
+}
+
+func ingestVenue(b *Bot, msg *tgbotapi.Message) (*ingested, error) {
+	v := msg.Venue
+	return &ingested{Text: fmt.Sprintf("[Venue: %s]", joinFields(v.Title, v.Address, locationText(&v.Location)))}, nil
+}
+
+// locationText renders coordinates with a map link.
+func locationText(l *tgbotapi.Location) string {
+	text := fmt.Sprintf("%.6f, %.6f", l.Latitude, l.Longitude)
+	if l.HorizontalAccuracy > 0 {
+		text += fmt.Sprintf(" (±%.0f m)", l.HorizontalAccuracy)
+	}
+	if l.LivePeriod > 0 {
+		text += ", shared live"
+	}
+	return text + fmt.Sprintf(" — https://www.google.com/maps?q=%.6f,%.6f", l.Latitude, l.Longitude)
+}
+
+func ingestContact(b *Bot, msg *tgbotapi.Message) (*ingested, error) {
+	c := msg.Contact
+	fields := []string{strings.TrimSpace(c.FirstName + " " + c.LastName), c.PhoneNumber}
+	if c.UserID != 0 {
+		fields = append(fields, fmt.Sprintf("Telegram user ID %d", c.UserID))
+	}
+	text := fmt.Sprintf("[Contact: %s]", joinFields(fields...))
+	if vcard := strings.TrimSpace(c.VCard); vcard != "" {
+		text += "\n" + vcard
+	}
+	return &ingested{Text: text}, nil
+}
+
+func joinFields(fields ...string) string {
+	var out []string
+	for _, f := range fields {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+// saveToInbox writes a file attachment to the session's inbox and returns
+// the line that tells Claude where it is.
+func (sm *SessionManager) saveToInbox(s *Session, a *Attachment) string {
+	what := "File " + attachmentName(a)
+	if a.Label != "" {
+		what = a.Label
+	}
+	path, size, err := sm.writeInboxFile(s, a)
+	if err != nil {
+		log.Printf("[PAI Bridge] Failed to save %s to the inbox of session %s: %v", attachmentName(a), s.ID[:8], err)
+		return fmt.Sprintf("[%s was sent, but the bridge couldn't save it: %v]", what, err)
+	}
+	return fmt.Sprintf("[%s (%s) is saved at %s]", what, formatBytes(size), path)
+}
+
+// writeInboxFile saves a file under <work dir>/.telegram-inbox/<session>,
+// owned by the user Claude runs as. An existing file of the same name is
+// kept and the new one gets a numbered name. The inbox has a .gitignore of
+// its own so uploads stay out of the repo the session works in.
+//
+// Claude can write to its work dir and the bridge may run as root, so every
+// step below the work dir goes through an open directory and refuses
+// symlinks: a planted link can't redirect the write anywhere else.
+func (sm *SessionManager) writeInboxFile(s *Session, a *Attachment) (string, int, error) {
+	data, err := base64.StdEncoding.DecodeString(a.Base64)
+	if err != nil {
+		return "", 0, err
+	}
+	wd, err := syscall.Open(s.WorkDir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return "", 0, fmt.Errorf("open %s: %w", s.WorkDir, err)
+	}
+	defer syscall.Close(wd)
+	root, err := sm.openInboxDir(wd, inboxDirName)
+	if err != nil {
+		return "", 0, err
+	}
+	defer syscall.Close(root)
+	dir, err := sm.openInboxDir(root, s.ID[:8])
+	if err != nil {
+		return "", 0, err
+	}
+	defer syscall.Close(dir)
+
+	if err := sm.createInboxFile(root, ".gitignore", []byte("*\n")); err != nil && err != syscall.EEXIST {
+		return "", 0, err
+	}
+
+	name := inboxFileName(a.FileName)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		err := sm.createInboxFile(dir, name, data)
+		if err == syscall.EEXIST {
+			name = fmt.Sprintf("%s-%d%s", base, i, ext)
+			continue
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		return filepath.Join(s.WorkDir, inboxDirName, s.ID[:8], name), len(data), nil
+	}
+}
+
+// openInboxDir opens the directory name in parent, creating it if needed,
+// and gives it to the inbox owner. A symlink in its place is refused.
+func (sm *SessionManager) openInboxDir(parent int, name string) (int, error) {
+	if err := syscall.Mkdirat(parent, name, 0700); err != nil && err != syscall.EEXIST {
+		return -1, fmt.Errorf("create %s: %w", name, err)
+	}
+	fd, err := syscall.Openat(parent, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		if err == syscall.ELOOP || err == syscall.ENOTDIR {
+			return -1, fmt.Errorf("%s is not a directory", name)
+		}
+		return -1, fmt.Errorf("open %s: %w", name, err)
+	}
+	if err := sm.chownInbox(fd); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// createInboxFile writes a new file in dir, failing with EEXIST if name is
+// taken by anything, a symlink included.
+func (sm *SessionManager) createInboxFile(dir int, name string, data []byte) error {
+	fd, err := syscall.Openat(dir, name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0600)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), name)
+	_, err = f.Write(data)
+	if err == nil {
+		err = sm.chownInbox(fd)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		syscall.Unlinkat(dir, name)
+	}
+	return err
+}
+
+// chownInbox gives an open inbox file or directory to the user Claude runs
+// as.
+func (sm *SessionManager) chownInbox(fd int) error {
+	if sm.inboxOwner == nil {
+		return nil
+	}
+	return syscall.Fchown(fd, int(sm.inboxOwner.Uid), int(sm.inboxOwner.Gid))
+}
+
+// inboxFileName makes a file name sent from Telegram safe to save: no
+// directories, and never empty or hidden.
+func inboxFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.TrimLeft(name, ".")
+	if name == "" || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+// formatBytes renders a size like "12.3 KB".
+func formatBytes(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
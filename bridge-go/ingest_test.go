@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestIngesterFor(t *testing.T) {
+	loc := tgbotapi.Location{Latitude: 1, Longitude: 2}
+	cases := []struct {
+		msg  *tgbotapi.Message
+		want string
+	}{
+		{&tgbotapi.Message{Venue: &tgbotapi.Venue{Location: loc}, Location: &loc}, "venue"},
+		{&tgbotapi.Message{Animation: &tgbotapi.Animation{}, Document: &tgbotapi.Document{}}, "animation"},
+		{&tgbotapi.Message{Document: &tgbotapi.Document{}}, "document"},
+		{&tgbotapi.Message{Contact: &tgbotapi.Contact{}}, "contact"},
+		{&tgbotapi.Message{Text: "hi"}, ""},
+	}
+	for _, c := range cases {
+		got := ""
+		if ing := ingesterFor(c.msg); ing != nil {
+			got = ing.name
+		}
+		if got != c.want {
+			t.Errorf("ingesterFor(%+v) = %q, want %q", c.msg, got, c.want)
+		}
+	}
+}
+
+func TestIngest_LocationVenueContact(t *testing.T) {
+	loc := tgbotapi.Location{Latitude: 51.5007, Longitude: -0.1246, LivePeriod: 900}
+	res, _ := ingestLocation(nil, &tgbotapi.Message{Location: &loc})
+	if want := "[Location: 51.500700, -0.124600, shared live — https://www.google.com/maps?q=51.500700,-0.124600]"; res.Text != want {
+		t.Errorf("location: %q", res.Text)
+	}
+
+	res, _ = ingestVenue(nil, &tgbotapi.Message{Venue: &tgbotapi.Venue{
+		Title: "Big Ben", Address: "Westminster, London", Location: tgbotapi.Location{Latitude: 51.5007, Longitude: -0.1246},
+	}})
+	if !strings.HasPrefix(res.Text, "[Venue: Big Ben, Westminster, London, 51.500700, -0.124600 — ") {
+		t.Errorf("venue: %q", res.Text)
+	}
+
+	res, _ = ingestContact(nil, &tgbotapi.Message{Contact: &tgbotapi.Contact{
+		FirstName: "Ada", LastName: "Lovelace", PhoneNumber: "+441234", UserID: 42,
+		VCard: "BEGIN:VCARD\nEMAIL:ada@example.com\nEND:VCARD",
+	}})
+	if !strings.HasPrefix(res.Text, "[Contact: Ada Lovelace, +441234, Telegram user ID 42]\nBEGIN:VCARD") {
+		t.Errorf("contact: %q", res.Text)
+	}
+}
+
+func TestInboxFileName(t *testing.T) {
+	for in, want := range map[string]string{
+		"report.docx":      "report.docx",
+		"../../etc/passwd": "passwd",
+		`..\..\boot.ini`:   "boot.ini",
+		".bashrc":          "bashrc",
+		"..":               "file",
+		"":                 "file",
+	} {
+		if got := inboxFileName(in); got != want {
+			t.Errorf("inboxFileName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSendMessage_FakeRunner_SavesFilesToInbox(t *testing.T) {
+	sm, runner := newFakeRunnerManager(t, fakeRun{lines: []string{textLine("ok")}}, fakeRun{lines: []string{textLine("ok")}})
+	sm.config.Sessions.DefaultWorkDir = t.TempDir()
+
+	file := &Attachment{Type: "file", FileName: "notes.zip", Base64: "aGVsbG8="}
+	for i := 0; i < 2; i++ {
+		if _, err := sm.SendMessage("user1", "unpack this", []*Attachment{file}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := sm.GetSession("user1")
+	dir := filepath.Join(s.WorkDir, inboxDirName, s.ID[:8])
+	if data, err := os.ReadFile(filepath.Join(s.WorkDir, inboxDirName, ".gitignore")); err != nil || string(data) != "*\n" {
+		t.Errorf("inbox .gitignore: %q %v", data, err)
+	}
+	for i, name := range []string{"notes.zip", "notes-1.zip"} {
+		path := filepath.Join(dir, name)
+		if data, err := os.ReadFile(path); err != nil || string(data) != "hello" {
+			t.Errorf("%s: %q %v", name, data, err)
+		}
+		req := runner.requests()[i]
+		if req.Stdin != nil {
+			t.Error("a saved file must not need stream-json input")
+		}
+		if prompt := req.Args[1]; !strings.Contains(prompt, "unpack this\n\n[File notes.zip (5 bytes) is saved at "+path+"]") {
+			t.Errorf("prompt %d: %q", i, prompt)
+		}
+	}
+}
+
+func TestWriteInboxFile_RefusesSymlinks(t *testing.T) {
+	sm := newTestSessionManager()
+	sm.stateDir = t.TempDir()
+	s := sm.CreateSession("user1", "1")
+	s.WorkDir = t.TempDir()
+	target := t.TempDir()
+	file := &Attachment{Type: "file", FileName: "passwd", Base64: "aGVsbG8="}
+
+	// A link in place of the session's inbox directory
+	if err := os.Mkdir(filepath.Join(s.WorkDir, inboxDirName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(s.WorkDir, inboxDirName, s.ID[:8])); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sm.writeInboxFile(s, file); err == nil {
+		t.Error("a symlinked inbox directory should be refused")
+	}
+
+	// A link in place of the file itself
+	os.Remove(filepath.Join(s.WorkDir, inboxDirName, s.ID[:8]))
+	if err := os.Mkdir(filepath.Join(s.WorkDir, inboxDirName, s.ID[:8]), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(target, "passwd"), filepath.Join(s.WorkDir, inboxDirName, s.ID[:8], "passwd")); err != nil {
+		t.Fatal(err)
+	}
+	path, _, err := sm.writeInboxFile(s, file)
+	if err != nil || filepath.Base(path) != "passwd-1" {
+		t.Errorf("a symlinked name should be skipped: %q %v", path, err)
+	}
+
+	if entries, _ := os.ReadDir(target); len(entries) != 0 {
+		t.Errorf("nothing may be written through a link: %v", entries)
+	}
+}
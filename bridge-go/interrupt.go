@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
+)
+
+// maxInterruptedTail caps how much of an interrupted reply is quoted back to
+// Claude with the message that interrupted it.
+const maxInterruptedTail = 1500
+
+// Interrupt stops the run in the user's active session so msg goes next,
+// ahead of anything already queued. It reports false if the active session
+// isn't running anything, in which case the caller should send msg as usual.
+func (sm *SessionManager) Interrupt(userID string, msg pendingMessage) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	s := sm.activeSession(userID)
+	if s == nil || s.Status != "busy" {
+		return false
+	}
+	return sm.interruptLocked(s, msg) == nil
+}
+
+// InterruptQueued promotes a queued message to interrupt the run it is
+// waiting behind.
+func (sm *SessionManager) InterruptQueued(userID, sessionID, msgID string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	s, ok := sm.sessions[sessionID]
+	if !ok || s.UserID != userID {
+		return fmt.Errorf("that session has ended")
+	}
+	if _, running := sm.procs[s.ID]; !running {
+		return fmt.Errorf("already sent")
+	}
+	msg, ok := s.removePending(msgID)
+	if !ok {
+		return fmt.Errorf("already sent")
+	}
+	return sm.interruptLocked(s, msg)
+}
+
+// interruptLocked cancels s's run and records msg to follow it. msg waits
+// at the front of the queue until the run has stopped, so it is persisted
+// like any queued message; after a restart it is sent as one. A second
+// interruption before the run has stopped just queues at the front.
+// Caller must hold sm.mu.
+func (sm *SessionManager) interruptLocked(s *Session, msg pendingMessage) error {
+	cancel, running := sm.procs[s.ID]
+	if !running {
+		return fmt.Errorf("nothing is running")
+	}
+	if msg.ID == "" {
+		msg.ID = uuid.New().String()[:8]
+	}
+	s.pushFront([]pendingMessage{msg})
+	if s.interruptionID != "" {
+		return nil
+	}
+	s.interruptionID = msg.ID
+	s.cancelled = true
+	cancel()
+	log.Printf("[PAI Bridge] User %s interrupted the run in session %s", s.UserID, s.ID[:8])
+	return nil
+}
+
+// pushFront puts messages at the front of the queue.
+func (s *Session) pushFront(msgs []pendingMessage) {
+	if len(msgs) == 0 {
+		return
+	}
+	s.pendingMu.Lock()
+	s.pending = append(append([]pendingMessage(nil), msgs...), s.pending...)
+	s.persistQueueLocked()
+	s.pendingMu.Unlock()
+}
+
+// removePending takes one queued message out of the queue by ID.
+func (s *Session) removePending(id string) (pendingMessage, bool) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	for i, m := range s.pending {
+		if m.ID == id {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			s.persistQueueLocked()
+			return m, true
+		}
+	}
+	return pendingMessage{}, false
+}
+
+// interruptPrompt tells Claude its last turn was cut short, quoting the end
+// of what it had written so it can pick up from there, followed by the
+// message that interrupted it.
+func interruptPrompt(partial, text string) string {
+	var sb strings.Builder
+	sb.WriteString("[I interrupted your previous response before it finished.")
+	if p := strings.TrimSpace(partial); p != "" {
+		if r := []rune(p); len(r) > maxInterruptedTail {
+			p = "…" + string(r[len(r)-maxInterruptedTail:])
+		}
+		sb.WriteString(" What you had written so far:]\n")
+		sb.WriteString(p)
+		sb.WriteString("\n[End of interrupted response.")
+	}
+	sb.WriteString(" My new message:]\n\n")
+	sb.WriteString(text)
+	return sb.String()
+}
+
+// handleInterruptCallback resolves "intr:<session id>:<message id>" from a
+// queued acknowledgement.
+func (b *Bot) handleInterruptCallback(cq *tgbotapi.CallbackQuery, userID, arg string) {
+	sessionID, msgID, _ := strings.Cut(arg, ":")
+	ack := "⚡ Interrupting the current task…"
+	if err := b.sessions.InterruptQueued(userID, sessionID, msgID); err != nil {
+		ack = fmt.Sprintf("Can't interrupt: %v.", err)
+	}
+	b.answerCallback(cq.ID, ack)
+	if cq.Message != nil {
+		b.api.Request(tgbotapi.NewEditMessageText(cq.Message.Chat.ID, cq.Message.MessageID, ack))
+	}
+}
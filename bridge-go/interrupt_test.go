@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInterrupt_PreemptsRunAndKeepsQueue(t *testing.T) {
+	sm, runner := newFakeRunnerManager(t, fakeRun{lines: []string{systemLine("claude-1"), textLine("Step one done, starting step two")}, hold: make(chan struct{})})
+
+	done := startHeldRun(t, sm, "long task")
+	if r, err := sm.SendMessage("user1", "later", nil, nil); err != nil || r.Queued != 1 || r.QueuedID == "" {
+		t.Fatalf("queue: %+v %v", r, err)
+	}
+	if !sm.Interrupt("user1", pendingMessage{Text: "stop, use Go instead"}) {
+		t.Fatal("interrupt of a running task should succeed")
+	}
+	// Until the run has stopped, the interruption is kept on disk with the
+	// queue, ahead of what was already queued
+	if onDisk := readQueueFile(sm.queueDir(sm.GetSession("user1").ID), "pending.json"); len(onDisk) != 2 || onDisk[0].Text != "stop, use Go instead" {
+		t.Errorf("persisted queue: %+v", onDisk)
+	}
+
+	var out runOutcome
+	select {
+	case out = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not stop after interrupt")
+	}
+	if out.err != nil {
+		t.Fatalf("an interrupted run is not an error: %v", out.err)
+	}
+	fu := out.result.FollowUp
+	if !out.result.Interrupted || fu == nil || fu.Count != 1 {
+		t.Fatalf("result: %+v", out.result)
+	}
+	for _, want := range []string{"interrupted your previous response", "starting step two", "stop, use Go instead"} {
+		if !strings.Contains(fu.Text, want) {
+			t.Errorf("follow-up %q missing %q", fu.Text, want)
+		}
+	}
+	if strings.Contains(fu.Text, "later") {
+		t.Error("queued messages should wait behind the interruption")
+	}
+	s := sm.GetSession("user1")
+	if s.pendingCount() != 1 || s.Status != "active" {
+		t.Errorf("queue should be kept: %+v", s)
+	}
+	// A crash before the bot sends the interruption on keeps it, and the
+	// queue behind it
+	crashed := reloadSessionManager(sm).GetSession("user1")
+	if crashed.interrupted == nil || crashed.interrupted.Text != "stop, use Go instead" || len(crashed.pending) != 1 || crashed.pending[0].Text != "later" {
+		t.Errorf("after a crash: interrupted %+v, pending %+v", crashed.interrupted, crashed.pending)
+	}
+	if len(runner.requests()) != 1 {
+		t.Error("the interruption must not start a run of its own")
+	}
+}
+
+func TestInterrupt_Idle(t *testing.T) {
+	sm, _ := newFakeRunnerManager(t, fakeRun{lines: []string{textLine("ok")}})
+	if sm.Interrupt("user1", pendingMessage{Text: "hi"}) {
+		t.Error("no session: nothing to interrupt")
+	}
+	if _, err := sm.SendMessage("user1", "hi", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if sm.Interrupt("user1", pendingMessage{Text: "again"}) {
+		t.Error("idle session: nothing to interrupt")
+	}
+}
+
+func TestInterruptQueued(t *testing.T) {
+	sm, _ := newFakeRunnerManager(t, fakeRun{lines: []string{systemLine("claude-1")}, hold: make(chan struct{})})
+
+	done := startHeldRun(t, sm, "long task")
+	first, _ := sm.SendMessage("user1", "first", nil, nil)
+	second, _ := sm.SendMessage("user1", "second", nil, nil)
+
+	if err := sm.InterruptQueued("user2", second.SessionID, second.QueuedID); err == nil {
+		t.Error("another user must not interrupt this run")
+	}
+	if err := sm.InterruptQueued("user1", second.SessionID, "nope"); err == nil {
+		t.Error("unknown message ID should fail")
+	}
+	if err := sm.InterruptQueued("user1", second.SessionID, second.QueuedID); err != nil {
+		t.Fatal(err)
+	}
+
+	out := <-done
+	if out.err != nil || out.result.FollowUp == nil || !strings.HasSuffix(out.result.FollowUp.Text, "second") {
+		t.Fatalf("result: %+v %v", out.result, out.err)
+	}
+	s := sm.GetSession("user1")
+	msgs := s.takePending()
+	if len(msgs) != 1 || msgs[0].ID != first.QueuedID {
+		t.Errorf("the other queued message should stay queued: %+v", msgs)
+	}
+	if err := sm.InterruptQueued("user1", second.SessionID, first.QueuedID); err == nil {
+		t.Error("nothing is running any more")
+	}
+}
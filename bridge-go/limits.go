@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Per-run resource limits for Claude subprocesses. rlimits are always
+// available and are applied to the claude process right after it starts, so
+// everything it spawns inherits them. Memory and process-count limits for the
+// whole tree need a cgroup v2 child per run, which only works when the
+// bridge's own cgroup is writable (Delegate=yes without
+// ProtectControlGroups=true); otherwise runs fall back to rlimits alone.
+
+// limitError reports a run stopped by one of its resource limits, so the bot
+// can tell the user what happened instead of showing a generic failure.
+type limitError struct {
+	Limit  string // "memory", "process", "CPU time", "output", "time"
+	Detail string // the configured value, e.g. "2048 MB"
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("hit the %s limit (%s)", e.Limit, e.Detail)
+}
+
+// rlimitNproc is RLIMIT_NPROC, which package syscall does not export.
+const rlimitNproc = 6
+
+type rlimitSetting struct {
+	resource int
+	value    uint64 // soft limit
+	hard     uint64 // 0 = same as value
+}
+
+// cpuHardMargin is how far the RLIMIT_CPU hard limit sits above the soft one,
+// so the process gets SIGXCPU (reportable as a CPU breach) before SIGKILL.
+const cpuHardMargin = 5
+
+// rlimits lists the rlimits to apply to a run. RLIMIT_NPROC counts every
+// process of the real uid, so it is only safe when Claude runs as its own
+// user rather than the bridge's.
+func (l LimitsConfig) rlimits(ownUser bool) []rlimitSetting {
+	var out []rlimitSetting
+	if l.AddressSpaceMB > 0 {
+		out = append(out, rlimitSetting{resource: syscall.RLIMIT_AS, value: uint64(l.AddressSpaceMB) << 20})
+	}
+	if l.CPUSeconds > 0 {
+		out = append(out, rlimitSetting{resource: syscall.RLIMIT_CPU, value: uint64(l.CPUSeconds), hard: uint64(l.CPUSeconds) + cpuHardMargin})
+	}
+	if l.OpenFiles > 0 {
+		out = append(out, rlimitSetting{resource: syscall.RLIMIT_NOFILE, value: uint64(l.OpenFiles)})
+	}
+	if l.Processes > 0 && ownUser {
+		out = append(out, rlimitSetting{resource: rlimitNproc, value: uint64(l.Processes)})
+	}
+	return out
+}
+
+// applyRlimits sets limits on a running process with prlimit(2). The hard
+// limit is set too so Claude can't raise the soft one again.
+func applyRlimits(pid int, limits []rlimitSetting) error {
+	var errs []error
+	for _, l := range limits {
+		lim := syscall.Rlimit{Cur: l.value, Max: l.hard}
+		if lim.Max == 0 {
+			lim.Max = l.value
+		}
+		_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(l.resource),
+			uintptr(unsafe.Pointer(&lim)), 0, 0, 0)
+		if errno != 0 {
+			errs = append(errs, fmt.Errorf("rlimit %d: %w", l.resource, errno))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// cappedReader passes through at most limit bytes, then reports EOF and
+// records whether the underlying reader had more to give.
+type cappedReader struct {
+	r        io.Reader
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.read >= c.limit {
+		var probe [1]byte
+		if n, _ := c.r.Read(probe[:]); n > 0 {
+			c.exceeded = true
+		}
+		return 0, io.EOF
+	}
+	if remaining := c.limit - c.read; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+// runBreach decides whether a finished run was stopped by one of its limits
+// rather than failing on its own. A run that succeeded despite hitting
+// pids.max (failed forks) is not a breach.
+func runBreach(l LimitsConfig, outputExceeded bool, cg *runCgroup, exitErr error) *limitError {
+	if outputExceeded {
+		return &limitError{"output", fmt.Sprintf("%d MB", l.OutputMB)}
+	}
+	if exitErr == nil {
+		return nil
+	}
+	if cg != nil {
+		switch cg.breach() {
+		case "memory":
+			return &limitError{"memory", fmt.Sprintf("%d MB", l.MemoryMB)}
+		case "process":
+			return &limitError{"process", fmt.Sprintf("%d processes", l.Processes)}
+		}
+	}
+	var ee *exec.ExitError
+	if errors.As(exitErr, &ee) {
+		if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() && ws.Signal() == syscall.SIGXCPU {
+			return &limitError{"CPU time", fmt.Sprintf("%d seconds", l.CPUSeconds)}
+		}
+	}
+	return nil
+}
+
+// --- cgroup v2 ---
+
+const cgroupMount = "/sys/fs/cgroup"
+
+// cgroup2Magic is CGROUP2_SUPER_MAGIC, the statfs type of a cgroup v2 mount.
+const cgroup2Magic = 0x63677270
+
+// runCgroups creates a cgroup v2 child per Claude run under the bridge's own
+// cgroup.
+type runCgroups struct {
+	base string // the bridge's cgroup directory; runs are created inside it
+}
+
+// parseCgroupV2Path extracts the unified-hierarchy path from the contents of
+// /proc/self/cgroup ("0::/system.slice/pai-bridge.service").
+func parseCgroupV2Path(procCgroup string) (string, bool) {
+	for _, line := range strings.Split(procCgroup, "\n") {
+		if rest, ok := strings.CutPrefix(line, "0::"); ok && rest != "" {
+			return rest, true
+		}
+	}
+	return "", false
+}
+
+// setupRunCgroups prepares the bridge's cgroup for per-run children. cgroup
+// v2 forbids processes in a cgroup that delegates controllers to children,
+// so the bridge first moves itself into a "bridge" leaf. Finally it starts
+// /bin/true in a probe cgroup to check the kernel can spawn straight into
+// one (clone3 with CLONE_INTO_CGROUP).
+func setupRunCgroups() (*runCgroups, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, err
+	}
+	rel, ok := parseCgroupV2Path(string(data))
+	var fs syscall.Statfs_t
+	if !ok || syscall.Statfs(cgroupMount, &fs) != nil || fs.Type != cgroup2Magic {
+		return nil, fmt.Errorf("cgroup v2 is not mounted at %s", cgroupMount)
+	}
+	base := filepath.Join(cgroupMount, rel)
+	if filepath.Base(base) == "bridge" {
+		base = filepath.Dir(base) // restarted inside our own leaf
+	}
+
+	controllers, err := os.ReadFile(filepath.Join(base, "cgroup.controllers"))
+	if err != nil {
+		return nil, err
+	}
+	for _, want := range []string{"memory", "pids"} {
+		if !strings.Contains(" "+strings.TrimSpace(string(controllers))+" ", " "+want+" ") {
+			return nil, fmt.Errorf("controller %q is not delegated to %s", want, base)
+		}
+	}
+
+	leaf := filepath.Join(base, "bridge")
+	if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		return nil, fmt.Errorf("move bridge into %s: %w", leaf, err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "cgroup.subtree_control"), []byte("+memory +pids"), 0); err != nil {
+		return nil, fmt.Errorf("enable controllers: %w", err)
+	}
+
+	// Runs left over from a bridge that crashed mid-run
+	if stale, err := filepath.Glob(filepath.Join(base, "run-*")); err == nil {
+		for _, dir := range stale {
+			(&runCgroup{dir: dir}).remove()
+		}
+	}
+
+	rc := &runCgroups{base: base}
+	probe, err := rc.create("probe", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer probe.remove()
+	cmd := exec.Command("/bin/true")
+	probe.attach(cmd)
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("cannot start processes in a cgroup: %w", err)
+	}
+	return rc, nil
+}
+
+// runCgroup is one run's cgroup.
+type runCgroup struct {
+	dir string
+	fd  *os.File
+}
+
+// create makes a child cgroup with the given limits (0 = unlimited).
+func (rc *runCgroups) create(name string, memoryMB, pids int) (*runCgroup, error) {
+	dir := filepath.Join(rc.base, "run-"+name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create cgroup: %w", err)
+	}
+	cg := &runCgroup{dir: dir}
+	if memoryMB > 0 {
+		if err := cg.write("memory.max", strconv.Itoa(memoryMB<<20)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+		cg.write("memory.swap.max", "0") // absent without swap accounting
+	}
+	if pids > 0 {
+		if err := cg.write("pids.max", strconv.Itoa(pids)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+	fd, err := os.Open(dir)
+	if err != nil {
+		cg.remove()
+		return nil, err
+	}
+	cg.fd = fd
+	return cg, nil
+}
+
+func (cg *runCgroup) write(file, value string) error {
+	if err := os.WriteFile(filepath.Join(cg.dir, file), []byte(value), 0); err != nil {
+		return fmt.Errorf("set %s: %w", file, err)
+	}
+	return nil
+}
+
+// attach makes cmd start inside the cgroup.
+func (cg *runCgroup) attach(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cg.fd.Fd())
+}
+
+// breach reports which cgroup limit the run ran into, if any: "memory" when
+// the OOM killer fired inside it, "process" when a fork hit pids.max.
+func (cg *runCgroup) breach() string {
+	if readCgroupEvent(filepath.Join(cg.dir, "memory.events"), "oom_kill") > 0 {
+		return "memory"
+	}
+	if readCgroupEvent(filepath.Join(cg.dir, "pids.events"), "max") > 0 {
+		return "process"
+	}
+	return ""
+}
+
+// readCgroupEvent returns a counter from a flat-keyed cgroup events file.
+func readCgroupEvent(path, key string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if k, v, ok := strings.Cut(scanner.Text(), " "); ok && k == key {
+			n, _ := strconv.Atoi(v)
+			return n
+		}
+	}
+	return 0
+}
+
+// remove kills anything left in the cgroup and deletes it. rmdir fails while
+// killed processes are still exiting, so it retries briefly.
+func (cg *runCgroup) remove() {
+	if cg.fd != nil {
+		cg.fd.Close()
+	}
+	cg.write("cgroup.kill", "1")
+	for i := 0; i < 20; i++ {
+		if err := os.Remove(cg.dir); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
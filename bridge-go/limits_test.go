@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseCgroupV2Path(t *testing.T) {
+	got, ok := parseCgroupV2Path("0::/system.slice/pai-bridge.service\n")
+	if !ok || got != "/system.slice/pai-bridge.service" {
+		t.Errorf("unified: got %q %v", got, ok)
+	}
+	// Hybrid hierarchy: only the 0:: line counts
+	got, ok = parseCgroupV2Path("4:memory:/foo\n0::/system.slice/x.service\n")
+	if !ok || got != "/system.slice/x.service" {
+		t.Errorf("hybrid: got %q %v", got, ok)
+	}
+	if _, ok := parseCgroupV2Path("4:memory:/foo\n"); ok {
+		t.Error("v1-only should not parse")
+	}
+}
+
+func TestRunCgroupBreach(t *testing.T) {
+	dir := t.TempDir()
+	cg := &runCgroup{dir: dir}
+	if got := cg.breach(); got != "" {
+		t.Errorf("no events files: got %q", got)
+	}
+
+	os.WriteFile(filepath.Join(dir, "pids.events"), []byte("max 3\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "memory.events"), []byte("low 0\nhigh 0\nmax 12\noom 1\noom_kill 0\n"), 0644)
+	if got := cg.breach(); got != "process" {
+		t.Errorf("pids.max hit: got %q", got)
+	}
+	os.WriteFile(filepath.Join(dir, "memory.events"), []byte("max 12\noom 1\noom_kill 2\n"), 0644)
+	if got := cg.breach(); got != "memory" {
+		t.Errorf("OOM kill should win: got %q", got)
+	}
+}
+
+func TestLimitsRlimits(t *testing.T) {
+	l := LimitsConfig{AddressSpaceMB: 8192, OpenFiles: 1024, Processes: 256}
+	if got := len(l.rlimits(false)); got != 2 {
+		t.Errorf("without a dedicated user RLIMIT_NPROC must be skipped, got %d limits", got)
+	}
+	limits := l.rlimits(true)
+	if len(limits) != 3 || limits[0].value != 8192<<20 {
+		t.Errorf("got %+v", limits)
+	}
+	if got := (LimitsConfig{}).rlimits(true); len(got) != 0 {
+		t.Errorf("zero config should set nothing, got %+v", got)
+	}
+}
+
+func TestApplyRlimits(t *testing.T) {
+	cmd := exec.Command("sleep", "5")
+	if err := cmd.Start(); err != nil {
+		t.Skip("sleep not available")
+	}
+	defer cmd.Process.Kill()
+
+	if err := applyRlimits(cmd.Process.Pid, []rlimitSetting{{resource: syscall.RLIMIT_NOFILE, value: 123}}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(cmd.Process.Pid) + "/limits")
+	if err != nil {
+		t.Skip("needs /proc")
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "Max open files") {
+			if f := strings.Fields(line); f[3] != "123" || f[4] != "123" {
+				t.Errorf("limit not applied: %q", line)
+			}
+			return
+		}
+	}
+	t.Error("no open files line in /proc/pid/limits")
+}
+
+func TestCappedReader(t *testing.T) {
+	c := &cappedReader{r: strings.NewReader("0123456789"), limit: 4}
+	data, _ := io.ReadAll(c)
+	if string(data) != "0123" || !c.exceeded {
+		t.Errorf("got %q exceeded=%v", data, c.exceeded)
+	}
+
+	// Output that ends exactly at the cap is not a breach
+	c = &cappedReader{r: strings.NewReader("0123"), limit: 4}
+	io.ReadAll(c)
+	if c.exceeded {
+		t.Error("exact-size output should not count as exceeded")
+	}
+}
+
+func TestSendMessage_OutputLimit(t *testing.T) {
+	fakeClaude(t, `echo '{"type":"system","session_id":"claude-out"}'
+exec yes '{"type":"assistant","message":{"content":[{"type":"text","text":"spam"}]}}'
+`)
+	sm := newTestSessionManager()
+	sm.stateDir = t.TempDir()
+	sm.config.Sessions.Limits.OutputMB = 1
+
+	_, err := sm.SendMessage("user1", "flood", nil, nil)
+	var le *limitError
+	if !errors.As(err, &le) || le.Limit != "output" {
+		t.Fatalf("expected an output limit error, got %v", err)
+	}
+	if s := sm.GetSession("user1"); s == nil || s.Status != "active" || s.ClaudeSessionID != "claude-out" {
+		t.Errorf("session should survive a breach: %+v", s)
+	}
+}
+
+func TestSendMessage_CPULimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("burns a second of CPU")
+	}
+	// The pause gives prlimit time to land before the loop starts
+	fakeClaude(t, `sleep 0.2
+while :; do :; done
+`)
+	sm := newTestSessionManager()
+	sm.stateDir = t.TempDir()
+	sm.config.Sessions.Limits.CPUSeconds = 1
+
+	_, err := sm.SendMessage("user1", "spin", nil, nil)
+	var le *limitError
+	if !errors.As(err, &le) || le.Limit != "CPU time" {
+		t.Fatalf("expected a CPU limit error, got %v", err)
+	}
+}
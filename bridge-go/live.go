@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// telegramAPI is the subset of *tgbotapi.BotAPI used by messages that are
+// edited in place. It exists so live updates can be tested without Telegram.
+type telegramAPI interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error)
+}
+
+const (
+	// liveEditInterval is the minimum gap between edits of a live message.
+	// Telegram starts returning 429s at roughly one edit per second per chat.
+	liveEditInterval = 1500 * time.Millisecond
+
+	// liveMessageLimit keeps streamed pages under Telegram's 4096-char cap,
+	// matching the chunk size used for normal replies.
+	liveMessageLimit = 4000
+
+	livePlaceholder = "💭 Thinking…"
+)
+
+// liveReply streams Claude's response into Telegram by posting a placeholder
+// message and editing it as text arrives. When a page fills up it rolls over
+// to a new message. Edits are throttled to liveEditInterval and back off when
+// Telegram reports flood control.
+//
+// mu only guards what Append shares with the edit loop. The page state below
+// it belongs to whichever of Start, the edit loop, and Finish or Abort is
+// running (they never overlap), so no lock is held while talking to
+// Telegram and Append never waits on a request or a flood-control backoff.
+type liveReply struct {
+	api      telegramAPI
+	chatID   int64
+	interval time.Duration
+	limit    int
+
+	mu      sync.Mutex
+	text    string // full text received so far
+	dirty   bool
+	started bool
+	stopped bool
+
+	msgIDs     []int     // Telegram message IDs holding the text, in order
+	shown      []string  // text currently displayed in each message
+	retryAfter time.Time // flood control: no edits before this time
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+func newLiveReply(api telegramAPI, chatID int64) *liveReply {
+	return &liveReply{
+		api:      api,
+		chatID:   chatID,
+		interval: liveEditInterval,
+		limit:    liveMessageLimit,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+// Start posts the placeholder message and begins the edit loop.
+func (lr *liveReply) Start() {
+	if msg, err := lr.api.Send(tgbotapi.NewMessage(lr.chatID, livePlaceholder)); err != nil {
+		log.Printf("[PAI Bridge] Live reply placeholder failed: %v", err)
+	} else {
+		lr.msgIDs = append(lr.msgIDs, msg.MessageID)
+		lr.shown = append(lr.shown, livePlaceholder)
+	}
+
+	lr.mu.Lock()
+	lr.started = true
+	lr.mu.Unlock()
+
+	go lr.loop()
+}
+
+// Append adds a chunk of response text. It never blocks on Telegram; the
+// edit loop picks up the change on its next tick.
+func (lr *liveReply) Append(chunk string) {
+	if chunk == "" {
+		return
+	}
+	lr.mu.Lock()
+	lr.text += chunk
+	lr.dirty = true
+	lr.mu.Unlock()
+}
+
+func (lr *liveReply) loop() {
+	defer close(lr.doneCh)
+	ticker := time.NewTicker(lr.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lr.stopCh:
+			return
+		case <-ticker.C:
+			lr.flush()
+		}
+	}
+}
+
+// flush pushes any new text to Telegram, editing existing pages and sending
+// new ones when the text outgrows the last page. It works from a snapshot of
+// the text; anything appended meanwhile goes out on a later flush.
+func (lr *liveReply) flush() {
+	if time.Now().Before(lr.retryAfter) {
+		return
+	}
+	lr.mu.Lock()
+	text, dirty := lr.text, lr.dirty
+	lr.dirty = false
+	lr.mu.Unlock()
+	if !dirty {
+		return
+	}
+
+	for i, page := range chunkForTelegram(text, lr.limit) {
+		if strings.TrimSpace(page) == "" {
+			continue
+		}
+		if i < len(lr.msgIDs) {
+			if lr.shown[i] == page {
+				continue
+			}
+			if err := lr.request(tgbotapi.NewEditMessageText(lr.chatID, lr.msgIDs[i], page)); err != nil {
+				lr.markDirty()
+				return
+			}
+			lr.shown[i] = page
+			continue
+		}
+		msg, err := lr.api.Send(tgbotapi.NewMessage(lr.chatID, page))
+		if err != nil {
+			lr.noteError(err)
+			lr.markDirty()
+			return
+		}
+		lr.msgIDs = append(lr.msgIDs, msg.MessageID)
+		lr.shown = append(lr.shown, page)
+	}
+}
+
+// markDirty leaves the text to be pushed again on the next flush.
+func (lr *liveReply) markDirty() {
+	lr.mu.Lock()
+	lr.dirty = true
+	lr.mu.Unlock()
+}
+
+// request performs an edit, treating "message is not modified" as success.
+func (lr *liveReply) request(c tgbotapi.Chattable) error {
+	_, err := lr.api.Request(c)
+	if err == nil || strings.Contains(err.Error(), "message is not modified") {
+		return nil
+	}
+	lr.noteError(err)
+	return err
+}
+
+// noteError records flood-control backoff from a Telegram error.
+func (lr *liveReply) noteError(err error) {
+	var tgErr *tgbotapi.Error
+	if errors.As(err, &tgErr) && tgErr.RetryAfter > 0 {
+		lr.retryAfter = time.Now().Add(time.Duration(tgErr.RetryAfter) * time.Second)
+		log.Printf("[PAI Bridge] Live reply rate limited, backing off %ds", tgErr.RetryAfter)
+		return
+	}
+	log.Printf("[PAI Bridge] Live reply update failed: %v", err)
+}
+
+// stop halts the edit loop. Safe to call more than once.
+func (lr *liveReply) stop() {
+	lr.mu.Lock()
+	if lr.stopped {
+		lr.mu.Unlock()
+		return
+	}
+	lr.stopped = true
+	started := lr.started
+	lr.mu.Unlock()
+	if !started {
+		return
+	}
+	close(lr.stopCh)
+	<-lr.doneCh
+}
+
+// Finish stops streaming and replaces the live pages with the final,
+// formatted HTML chunks. Surplus pages are deleted and missing ones are sent
+// as new messages.
+func (lr *liveReply) Finish(chunks []string) {
+	lr.stop()
+
+	if wait := time.Until(lr.retryAfter); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	for i, chunk := range chunks {
+		if i < len(lr.msgIDs) {
+			edit := tgbotapi.NewEditMessageText(lr.chatID, lr.msgIDs[i], chunk)
+			edit.ParseMode = tgbotapi.ModeHTML
+			if _, err := lr.api.Request(edit); err != nil && !strings.Contains(err.Error(), "message is not modified") {
+				log.Printf("[PAI Bridge] HTML edit failed, falling back: %v", err)
+				edit.ParseMode = ""
+				lr.api.Request(edit)
+			}
+			continue
+		}
+		msg := tgbotapi.NewMessage(lr.chatID, chunk)
+		msg.ParseMode = tgbotapi.ModeHTML
+		if _, err := lr.api.Send(msg); err != nil {
+			log.Printf("[PAI Bridge] HTML parse failed, falling back: %v", err)
+			msg.ParseMode = ""
+			lr.api.Send(msg)
+		}
+	}
+
+	for i := len(chunks); i < len(lr.msgIDs); i++ {
+		lr.api.Request(tgbotapi.NewDeleteMessage(lr.chatID, lr.msgIDs[i]))
+	}
+}
+
+// Abort stops streaming after a failed run. Pages that already show partial
+// output are left in place; a placeholder that never received text is removed.
+func (lr *liveReply) Abort() {
+	lr.stop()
+
+	for i, id := range lr.msgIDs {
+		if lr.shown[i] == livePlaceholder {
+			lr.api.Request(tgbotapi.NewDeleteMessage(lr.chatID, id))
+		}
+	}
+}
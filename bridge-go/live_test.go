@@ -0,0 +1,252 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// fakeTelegram records calls made through telegramAPI and hands out
+// sequential message IDs.
+type fakeTelegram struct {
+	mu      sync.Mutex
+	nextID  int
+	sent    []tgbotapi.MessageConfig
+	edits   []tgbotapi.EditMessageTextConfig
+	deletes []tgbotapi.DeleteMessageConfig
+	other   []tgbotapi.Chattable
+	editErr error // returned from the next edit, then cleared
+
+	stalled chan struct{} // if set, edits signal here and wait for release
+	release chan struct{}
+}
+
+func (f *fakeTelegram) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if m, ok := c.(tgbotapi.MessageConfig); ok {
+		f.nextID++
+		f.sent = append(f.sent, m)
+		return tgbotapi.Message{MessageID: f.nextID}, nil
+	}
+	f.other = append(f.other, c)
+	return tgbotapi.Message{}, nil
+}
+
+func (f *fakeTelegram) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	if _, ok := c.(tgbotapi.EditMessageTextConfig); ok && f.stalled != nil {
+		f.stalled <- struct{}{}
+		<-f.release
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch v := c.(type) {
+	case tgbotapi.EditMessageTextConfig:
+		if err := f.editErr; err != nil {
+			f.editErr = nil
+			return nil, err
+		}
+		f.edits = append(f.edits, v)
+	case tgbotapi.DeleteMessageConfig:
+		f.deletes = append(f.deletes, v)
+	default:
+		f.other = append(f.other, c)
+	}
+	return &tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func TestLiveReply_PlaceholderAndEdit(t *testing.T) {
+	api := &fakeTelegram{}
+	lr := newLiveReply(api, 42)
+	lr.interval = time.Hour // drive flushes manually
+	lr.Start()
+
+	if len(api.sent) != 1 || api.sent[0].Text != livePlaceholder {
+		t.Fatalf("expected placeholder message, got %+v", api.sent)
+	}
+
+	lr.Append("Hello ")
+	lr.Append("world")
+	lr.flush()
+
+	if len(api.edits) != 1 {
+		t.Fatalf("expected 1 edit, got %d", len(api.edits))
+	}
+	if api.edits[0].Text != "Hello world" || api.edits[0].MessageID != 1 {
+		t.Errorf("unexpected edit: %+v", api.edits[0])
+	}
+
+	// No new text → no edit
+	lr.flush()
+	if len(api.edits) != 1 {
+		t.Errorf("flush without new text should not edit, got %d edits", len(api.edits))
+	}
+	lr.stop()
+}
+
+func TestLiveReply_RollsOverWhenFull(t *testing.T) {
+	api := &fakeTelegram{}
+	lr := newLiveReply(api, 42)
+	lr.interval = time.Hour
+	lr.limit = 20
+	lr.Start()
+
+	lr.Append("first paragraph\n\nsecond paragraph that spills")
+	lr.flush()
+
+	if len(api.sent) < 2 {
+		t.Fatalf("expected rollover to a second message, sent=%d", len(api.sent))
+	}
+	if api.edits[0].Text != "first paragraph" {
+		t.Errorf("first page: got %q", api.edits[0].Text)
+	}
+	if !strings.HasPrefix(api.sent[1].Text, "second") {
+		t.Errorf("second page: got %q", api.sent[1].Text)
+	}
+	lr.stop()
+}
+
+func TestLiveReply_FinishReplacesAndTrims(t *testing.T) {
+	api := &fakeTelegram{}
+	lr := newLiveReply(api, 42)
+	lr.interval = time.Hour
+	lr.limit = 10
+	lr.Start()
+	lr.Append("aaaaaaaaaa bbbbbbbbbb cccccccccc")
+	lr.flush()
+	pages := len(lr.msgIDs)
+	if pages < 3 {
+		t.Fatalf("expected at least 3 live pages, got %d", pages)
+	}
+
+	api.edits = nil
+	lr.Finish([]string{"<b>final</b>"})
+
+	if len(api.edits) != 1 || api.edits[0].ParseMode != tgbotapi.ModeHTML {
+		t.Fatalf("expected 1 HTML edit, got %+v", api.edits)
+	}
+	if len(api.deletes) != pages-1 {
+		t.Errorf("expected %d surplus pages deleted, got %d", pages-1, len(api.deletes))
+	}
+}
+
+func TestLiveReply_FinishSendsExtraChunks(t *testing.T) {
+	api := &fakeTelegram{}
+	lr := newLiveReply(api, 42)
+	lr.interval = time.Hour
+	lr.Start()
+
+	lr.Finish([]string{"one", "two", "three"})
+
+	if len(api.edits) != 1 {
+		t.Errorf("placeholder should be edited once, got %d", len(api.edits))
+	}
+	// placeholder + two new chunks
+	if len(api.sent) != 3 {
+		t.Errorf("expected 3 sends, got %d", len(api.sent))
+	}
+}
+
+func TestLiveReply_AbortRemovesUnusedPlaceholder(t *testing.T) {
+	api := &fakeTelegram{}
+	lr := newLiveReply(api, 42)
+	lr.interval = time.Hour
+	lr.Start()
+	lr.Abort()
+
+	if len(api.deletes) != 1 {
+		t.Errorf("placeholder should be deleted, got %d deletes", len(api.deletes))
+	}
+}
+
+func TestLiveReply_AbortKeepsPartialOutput(t *testing.T) {
+	api := &fakeTelegram{}
+	lr := newLiveReply(api, 42)
+	lr.interval = time.Hour
+	lr.Start()
+	lr.Append("partial")
+	lr.flush()
+	lr.Abort()
+
+	if len(api.deletes) != 0 {
+		t.Errorf("partial output should be kept, got %d deletes", len(api.deletes))
+	}
+}
+
+func TestLiveReply_FloodControlBackoff(t *testing.T) {
+	api := &fakeTelegram{}
+	lr := newLiveReply(api, 42)
+	lr.interval = time.Hour
+	lr.Start()
+
+	api.editErr = &tgbotapi.Error{Code: 429, Message: "Too Many Requests", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 30}}
+	lr.Append("text")
+	lr.flush()
+
+	if lr.retryAfter.Before(time.Now().Add(20 * time.Second)) {
+		t.Errorf("retryAfter not set from 429: %v", lr.retryAfter)
+	}
+	if !lr.dirty {
+		t.Error("failed edit should leave text dirty for retry")
+	}
+
+	// Still inside the backoff window: nothing is attempted
+	lr.flush()
+	if len(api.edits) != 0 {
+		t.Errorf("should not edit during backoff, got %d", len(api.edits))
+	}
+	lr.stop()
+}
+
+func TestLiveReply_AppendDoesNotWaitForTelegram(t *testing.T) {
+	api := &fakeTelegram{stalled: make(chan struct{}), release: make(chan struct{})}
+	lr := newLiveReply(api, 42)
+	lr.interval = time.Hour
+	lr.Start()
+
+	lr.Append("first")
+	flushed := make(chan struct{})
+	go func() {
+		lr.flush()
+		close(flushed)
+	}()
+	<-api.stalled
+
+	appended := make(chan struct{})
+	go func() {
+		lr.Append(" second")
+		close(appended)
+	}()
+	select {
+	case <-appended:
+	case <-time.After(time.Second):
+		t.Fatal("Append blocked behind an edit in flight")
+	}
+
+	close(api.release)
+	<-flushed
+	api.stalled = nil
+	lr.flush()
+	if last := api.edits[len(api.edits)-1]; last.Text != "first second" {
+		t.Errorf("text appended during an edit should go out next: %q", last.Text)
+	}
+	lr.stop()
+}
+
+func TestLiveReply_StopWithoutStart(t *testing.T) {
+	api := &fakeTelegram{}
+	lr := newLiveReply(api, 42)
+	done := make(chan struct{})
+	go func() {
+		lr.Abort()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Abort blocked on a reply that never started")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -8,12 +9,25 @@ import (
 	"os"
 	"os/signal"
 	"os/user"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "hash-passphrase":
+			os.Exit(runHashPassphrase())
+		case "mcp-relay":
+			os.Exit(runMCPRelay(os.Args[2:]))
+		}
+	}
+
 	cfg, err := LoadConfig()
 	if err != nil {
 		log.Fatalf("[PAI Bridge] Failed to load config: %v", err)
@@ -43,15 +57,65 @@ func main() {
 	memory := NewMemoryManager(cfg)
 	log.Printf("[PAI Bridge] Memory logging enabled=%v, path=%s", cfg.Memory.Enabled, cfg.Memory.BasePath)
 
+	// Claude runner
+	runner := newExecRunner(claudeCredential)
+	if cfg.Sessions.Limits.Cgroup {
+		if cg, err := setupRunCgroups(); err != nil {
+			log.Printf("[PAI Bridge] WARNING: per-run cgroups unavailable, applying rlimits only: %v", err)
+			if l := cfg.Sessions.Limits; l.MemoryMB > 0 && l.AddressSpaceMB == 0 {
+				log.Printf("[PAI Bridge] WARNING: sessions.limits.memory_mb=%d cannot be enforced and address_space_mb is 0, so Claude runs have NO memory limit. Run the bridge with Delegate=yes and without ProtectControlGroups, or set address_space_mb.", l.MemoryMB)
+			}
+		} else {
+			runner.cgroups = cg
+			log.Printf("[PAI Bridge] Claude runs get their own cgroup under %s", cg.base)
+		}
+	}
+
 	// Session manager
-	sessions := NewSessionManager(cfg, memory, claudeCredential)
+	sessions := NewSessionManager(cfg, memory, runner)
+	sessions.usage = NewUsageLedger(filepath.Join(cfg.Memory.BasePath, "usage"))
+	sessions.inboxOwner = claudeCredential
+
+	// Embedded MCP server for tools Claude calls back into the bridge
+	mcp := NewMCPServer(cfg, claudeCredential)
+	if mcp.Enabled() {
+		if err := mcp.Listen(); err != nil {
+			log.Printf("[PAI Bridge] WARNING: MCP server unavailable, falling back to text directives and no permission prompts: %v", err)
+		} else {
+			sessions.tools = mcp
+		}
+	}
 
 	// Telegram bot
-	elevenLabsKey := os.Getenv("ELEVENLABS_API_KEY")
-	bot, err := NewBot(cfg, sessions, elevenLabsKey)
+	var synth SpeechSynthesizer
+	if cfg.Voice.Enabled {
+		synth, err = newSpeechSynthesizer(cfg.Voice, ttsKeys{
+			ElevenLabs: os.Getenv("ELEVENLABS_API_KEY"),
+			OpenAI:     os.Getenv("OPENAI_API_KEY"),
+		})
+		if err != nil {
+			log.Fatalf("[PAI Bridge] Invalid voice config: %v", err)
+		}
+		if synth == nil {
+			log.Printf("[PAI Bridge] Voice enabled in config but ELEVENLABS_API_KEY not set — voice disabled")
+		} else {
+			log.Printf("[PAI Bridge] Voice enabled (provider=%s)", cfg.Voice.Provider)
+		}
+	}
+	bot, err := NewBot(cfg, sessions, synth)
 	if err != nil {
 		log.Fatalf("[PAI Bridge] Failed to create bot: %v", err)
 	}
+	mcp.actions = bot
+
+	if cfg.STT.Enabled {
+		transcriber, err := newTranscriber(cfg.STT, os.Getenv("STT_API_KEY"))
+		if err != nil {
+			log.Fatalf("[PAI Bridge] Invalid stt config: %v", err)
+		}
+		bot.transcriber = transcriber
+		log.Printf("[PAI Bridge] Voice transcription enabled (provider=%s)", cfg.STT.Provider)
+	}
 
 	// Health check server
 	mux := http.NewServeMux()
@@ -80,13 +144,16 @@ func main() {
 		}
 	}()
 
-	// Stale session cleanup + rate limiter pruning
+	// Stale session cleanup, rate limiter and queued-edit pruning, and
+	// deferred prompt replays
 	go func() {
 		ticker := time.NewTicker(60 * time.Second)
 		defer ticker.Stop()
 		for range ticker.C {
 			sessions.CleanStale()
 			bot.cleanRateMap()
+			bot.cleanQueuedRefs()
+			bot.replayDeferred()
 		}
 	}()
 
@@ -98,6 +165,7 @@ func main() {
 		<-sigCh
 		log.Println("[PAI Bridge] Shutting down...")
 		bot.Stop()
+		mcp.Close()
 		sessions.FlushAll()
 		os.Exit(0)
 	}()
@@ -106,3 +174,26 @@ func main() {
 	log.Println("[PAI Bridge] Starting bot with long-polling...")
 	bot.Start()
 }
+
+// runHashPassphrase reads a passphrase from stdin and prints the bcrypt hash
+// to paste into settings.json as telegramBridge.security.passphrase_hash.
+func runHashPassphrase() int {
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintf(os.Stderr, "read passphrase: %v\n", err)
+		return 1
+	}
+	passphrase := strings.TrimRight(line, "\r\n")
+	if passphrase == "" {
+		fmt.Fprintln(os.Stderr, "passphrase must not be empty")
+		return 1
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(passphrase), 12)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "hash passphrase: %v\n", err)
+		return 1
+	}
+	fmt.Println(string(hash))
+	return 0
+}
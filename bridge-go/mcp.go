@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// The bridge exposes tools to Claude over MCP. Claude launches the bridge
+// binary itself as a stdio server ("pai-bridge mcp-relay"); the relay only
+// copies bytes between its stdio and a unix socket served by the running
+// bridge, so the MCP protocol and all tool logic live in this process, where
+// Telegram and session state are available. Each Claude run gets a random
+// token that binds its relay connection to one user, chat and session.
+
+const (
+	mcpServerName        = "pai_bridge"
+	mcpProtocolVersion   = "2025-06-18"
+	mcpTokenEnv          = "PAI_BRIDGE_MCP_TOKEN"
+	permissionPromptTool = "permission_prompt"
+	maxMCPLineBytes      = 4 * 1024 * 1024
+)
+
+// mcpRun is the binding for one Claude subprocess.
+type mcpRun struct {
+	token     string
+	userID    string
+	chatID    int64
+	sessionID string
+	ctx       context.Context // cancelled when the run ends
+	cancel    context.CancelFunc
+}
+
+type approvalDecision int
+
+const (
+	approvalDeny approvalDecision = iota
+	approvalAllowOnce
+	approvalAllowAlways
+)
+
+// bridgeActions is implemented by the bot: things MCP tools can do in the
+// user's chat.
+type bridgeActions interface {
+	// RequestApproval asks the user to approve a tool call and blocks until
+	// they answer, the timeout passes, or ctx is cancelled (both deny).
+	RequestApproval(ctx context.Context, run *mcpRun, toolName string, input map[string]interface{}) approvalDecision
+
+	// SendFile delivers a file that already passed isSafeSendPath, as a photo
+	// or a document.
+	SendFile(run *mcpRun, path, caption string, photo bool) error
+	SendText(run *mcpRun, text string) error
+	SendVoice(run *mcpRun, text string) error
+
+	// AskUser posts a question and blocks until the user answers by button
+	// or message, the timeout passes, or ctx is cancelled.
+	AskUser(ctx context.Context, run *mcpRun, question string, options []string) (string, error)
+}
+
+// mcpTool is a tool offered to Claude. Handle returns the text result, or an
+// error that is reported to Claude as a failed tool call.
+type mcpTool struct {
+	Name        string
+	Description string
+	InputSchema map[string]interface{}
+	Handle      func(run *mcpRun, args json.RawMessage) (string, error)
+}
+
+type MCPServer struct {
+	socketPath        string
+	cred              *syscall.Credential // socket owner, so the unprivileged Claude user can connect
+	permissionPrompts bool
+	chatTools         bool
+	actions           bridgeActions
+
+	mu          sync.Mutex
+	runs        map[string]*mcpRun
+	alwaysAllow map[string]map[string]bool // sessionID -> tool name -> allowed
+	tools       []mcpTool
+	listener    net.Listener
+}
+
+func NewMCPServer(cfg *Config, cred *syscall.Credential) *MCPServer {
+	s := &MCPServer{
+		socketPath:        cfg.Server.MCPSocket,
+		cred:              cred,
+		permissionPrompts: cfg.Security.PermissionPrompts,
+		chatTools:         cfg.Server.MCPTools,
+		runs:              make(map[string]*mcpRun),
+		alwaysAllow:       make(map[string]map[string]bool),
+	}
+	if s.permissionPrompts {
+		s.tools = append(s.tools, s.permissionTool())
+	}
+	if s.chatTools {
+		s.tools = append(s.tools, s.chatToolDefs()...)
+	}
+	return s
+}
+
+// Enabled reports whether any tools are offered, i.e. whether the socket
+// needs to be served at all.
+func (s *MCPServer) Enabled() bool {
+	return s.permissionPrompts || s.chatTools
+}
+
+// ChatTools implements runTools.
+func (s *MCPServer) ChatTools() bool {
+	return s.chatTools
+}
+
+func (s *MCPServer) permissionTool() mcpTool {
+	return mcpTool{
+		Name:        permissionPromptTool,
+		Description: "Ask the Telegram user to approve a tool call.",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"tool_name":   map[string]interface{}{"type": "string"},
+				"input":       map[string]interface{}{"type": "object"},
+				"tool_use_id": map[string]interface{}{"type": "string"},
+			},
+			"required": []string{"tool_name", "input"},
+		},
+		Handle: s.handlePermissionPrompt,
+	}
+}
+
+// Listen starts serving relay connections on the unix socket.
+func (s *MCPServer) Listen() error {
+	if err := os.MkdirAll(filepath.Dir(s.socketPath), 0755); err != nil {
+		return fmt.Errorf("create socket dir: %w", err)
+	}
+	os.Remove(s.socketPath) // stale socket from a previous run
+
+	ln, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", s.socketPath, err)
+	}
+	if s.cred != nil {
+		if err := os.Chown(s.socketPath, int(s.cred.Uid), int(s.cred.Gid)); err != nil {
+			ln.Close()
+			return fmt.Errorf("chown socket: %w", err)
+		}
+	}
+	if err := os.Chmod(s.socketPath, 0600); err != nil {
+		ln.Close()
+		return fmt.Errorf("chmod socket: %w", err)
+	}
+
+	s.mu.Lock()
+	s.listener = ln
+	s.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !strings.Contains(err.Error(), "use of closed network connection") {
+					log.Printf("[PAI MCP] Accept error: %v", err)
+				}
+				return
+			}
+			go s.handleConn(conn)
+		}
+	}()
+	log.Printf("[PAI MCP] Listening on %s", s.socketPath)
+	return nil
+}
+
+func (s *MCPServer) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		s.listener.Close()
+		os.Remove(s.socketPath)
+	}
+}
+
+// ForgetSession drops the "always allow" grants made in a session.
+func (s *MCPServer) ForgetSession(sessionID string) {
+	s.mu.Lock()
+	delete(s.alwaysAllow, sessionID)
+	s.mu.Unlock()
+}
+
+// Register binds a new Claude run to a user and chat. It returns the extra
+// claude CLI arguments that attach the bridge's MCP server, and a release
+// function to call when the run ends.
+func (s *MCPServer) Register(userID, chatID, sessionID string) ([]string, func()) {
+	if !s.Enabled() {
+		return nil, func() {}
+	}
+
+	var chat int64
+	fmt.Sscanf(chatID, "%d", &chat)
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &mcpRun{
+		token:     hex.EncodeToString(buf),
+		userID:    userID,
+		chatID:    chat,
+		sessionID: sessionID,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	s.mu.Lock()
+	s.runs[run.token] = run
+	s.mu.Unlock()
+
+	release := func() {
+		cancel()
+		s.mu.Lock()
+		delete(s.runs, run.token)
+		s.mu.Unlock()
+	}
+
+	args := []string{"--mcp-config", s.mcpConfig(run.token)}
+	if s.chatTools {
+		// The chat tools enforce their own policy, so they never need approval.
+		var names []string
+		for _, t := range s.tools {
+			if t.Name != permissionPromptTool {
+				names = append(names, "mcp__"+mcpServerName+"__"+t.Name)
+			}
+		}
+		args = append(args, "--allowedTools", strings.Join(names, ","))
+	}
+	if s.permissionPrompts {
+		args = append(args, "--permission-prompt-tool", "mcp__"+mcpServerName+"__"+permissionPromptTool)
+	}
+	return args, release
+}
+
+// mcpConfig returns the --mcp-config JSON that makes Claude launch the relay.
+func (s *MCPServer) mcpConfig(token string) string {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = "pai-bridge"
+	}
+	cfg := map[string]interface{}{
+		"mcpServers": map[string]interface{}{
+			mcpServerName: map[string]interface{}{
+				"type":    "stdio",
+				"command": exe,
+				"args":    []string{"mcp-relay", "--socket", s.socketPath},
+				"env":     map[string]string{mcpTokenEnv: token},
+			},
+		},
+	}
+	data, _ := json.Marshal(cfg)
+	return string(data)
+}
+
+// handleConn authenticates a relay connection by its token line and then
+// serves MCP over it.
+func (s *MCPServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	token := strings.TrimSpace(line)
+
+	s.mu.Lock()
+	run, ok := s.runs[token]
+	s.mu.Unlock()
+	if !ok {
+		log.Printf("[PAI MCP] Rejected relay connection with unknown token")
+		return
+	}
+
+	// Close the connection when the run ends so a blocked read returns.
+	go func() {
+		<-run.ctx.Done()
+		conn.Close()
+	}()
+
+	s.serve(run, reader, conn)
+}
+
+type jsonrpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+}
+
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// serve runs the MCP JSON-RPC loop: newline-delimited messages in, responses
+// out. Tool calls run concurrently since approvals can block for minutes.
+func (s *MCPServer) serve(run *mcpRun, r io.Reader, w io.Writer) {
+	var writeMu sync.Mutex
+	reply := func(msg jsonrpcMessage) {
+		msg.JSONRPC = "2.0"
+		data, err := json.Marshal(msg)
+		if err != nil {
+			log.Printf("[PAI MCP] Failed to marshal response: %v", err)
+			return
+		}
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		w.Write(append(data, '\n'))
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxMCPLineBytes)
+	for scanner.Scan() {
+		var req jsonrpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			reply(jsonrpcMessage{Error: &jsonrpcError{Code: -32700, Message: "parse error"}})
+			continue
+		}
+		if len(req.ID) == 0 {
+			continue // notification (e.g. notifications/initialized)
+		}
+
+		switch req.Method {
+		case "initialize":
+			var params struct {
+				ProtocolVersion string `json:"protocolVersion"`
+			}
+			json.Unmarshal(req.Params, &params)
+			version := params.ProtocolVersion
+			if version == "" {
+				version = mcpProtocolVersion
+			}
+			reply(jsonrpcMessage{ID: req.ID, Result: map[string]interface{}{
+				"protocolVersion": version,
+				"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+				"serverInfo":      map[string]interface{}{"name": "pai-bridge", "version": "1"},
+			}})
+
+		case "ping":
+			reply(jsonrpcMessage{ID: req.ID, Result: map[string]interface{}{}})
+
+		case "tools/list":
+			var tools []map[string]interface{}
+			for _, t := range s.tools {
+				tools = append(tools, map[string]interface{}{
+					"name":        t.Name,
+					"description": t.Description,
+					"inputSchema": t.InputSchema,
+				})
+			}
+			reply(jsonrpcMessage{ID: req.ID, Result: map[string]interface{}{"tools": tools}})
+
+		case "tools/call":
+			wg.Add(1)
+			go func(req jsonrpcMessage) {
+				defer wg.Done()
+				reply(jsonrpcMessage{ID: req.ID, Result: s.callTool(run, req.Params)})
+			}(req)
+
+		default:
+			reply(jsonrpcMessage{ID: req.ID, Error: &jsonrpcError{Code: -32601, Message: "method not found: " + req.Method}})
+		}
+	}
+}
+
+func (s *MCPServer) callTool(run *mcpRun, params json.RawMessage) map[string]interface{} {
+	var call struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal(params, &call); err != nil {
+		return mcpToolResult(fmt.Sprintf("invalid params: %v", err), true)
+	}
+
+	for _, t := range s.tools {
+		if t.Name == call.Name {
+			text, err := t.Handle(run, call.Arguments)
+			if err != nil {
+				return mcpToolResult(err.Error(), true)
+			}
+			return mcpToolResult(text, false)
+		}
+	}
+	return mcpToolResult("unknown tool: "+call.Name, true)
+}
+
+func mcpToolResult(text string, isError bool) map[string]interface{} {
+	return map[string]interface{}{
+		"content": []map[string]interface{}{{"type": "text", "text": text}},
+		"isError": isError,
+	}
+}
+
+// handlePermissionPrompt implements Claude's --permission-prompt-tool
+// contract: the result is JSON with behavior "allow" (plus the possibly
+// updated input) or "deny" (plus a message).
+func (s *MCPServer) handlePermissionPrompt(run *mcpRun, args json.RawMessage) (string, error) {
+	var req struct {
+		ToolName string                 `json:"tool_name"`
+		Input    map[string]interface{} `json:"input"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+
+	s.mu.Lock()
+	always := s.alwaysAllow[run.sessionID][req.ToolName]
+	s.mu.Unlock()
+
+	decision := approvalAllowOnce
+	if !always {
+		if s.actions == nil {
+			decision = approvalDeny
+		} else {
+			decision = s.actions.RequestApproval(run.ctx, run, req.ToolName, req.Input)
+		}
+	}
+
+	if decision == approvalAllowAlways {
+		s.mu.Lock()
+		if s.alwaysAllow[run.sessionID] == nil {
+			s.alwaysAllow[run.sessionID] = make(map[string]bool)
+		}
+		s.alwaysAllow[run.sessionID][req.ToolName] = true
+		s.mu.Unlock()
+	}
+
+	var resp map[string]interface{}
+	if decision == approvalDeny {
+		log.Printf("[PAI MCP] Denied %s for user %s", req.ToolName, run.userID)
+		resp = map[string]interface{}{"behavior": "deny", "message": "The user denied this tool call from Telegram."}
+	} else {
+		input := req.Input
+		if input == nil {
+			input = map[string]interface{}{}
+		}
+		resp = map[string]interface{}{"behavior": "allow", "updatedInput": input}
+	}
+	data, _ := json.Marshal(resp)
+	return string(data), nil
+}
+
+// runMCPRelay is the "pai-bridge mcp-relay" entry point that Claude launches
+// as a stdio MCP server. It connects to the bridge's socket, authenticates
+// with the run token, and copies bytes in both directions until either side
+// closes.
+func runMCPRelay(args []string) int {
+	socket := ""
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--socket" && i+1 < len(args) {
+			socket = args[i+1]
+			i++
+		}
+	}
+	token := os.Getenv(mcpTokenEnv)
+	if socket == "" || token == "" {
+		fmt.Fprintln(os.Stderr, "usage: pai-bridge mcp-relay --socket PATH (with "+mcpTokenEnv+" set)")
+		return 2
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mcp-relay: connect %s: %v\n", socket, err)
+		return 1
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, token+"\n"); err != nil {
+		fmt.Fprintf(os.Stderr, "mcp-relay: handshake: %v\n", err)
+		return 1
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(conn, os.Stdin)
+		if uc, ok := conn.(*net.UnixConn); ok {
+			uc.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(os.Stdout, conn)
+		done <- struct{}{}
+	}()
+	<-done
+	return 0
+}
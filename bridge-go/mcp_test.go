@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeActions records what the MCP tools asked the bot to do. Approvals get
+// a fixed decision and questions a fixed answer.
+type fakeActions struct {
+	mu       sync.Mutex
+	decision approvalDecision
+	asked    []string
+	files    []string
+	texts    []string
+	voiceErr error
+	answer   string
+}
+
+func (f *fakeActions) RequestApproval(ctx context.Context, run *mcpRun, toolName string, input map[string]interface{}) approvalDecision {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.asked = append(f.asked, toolName)
+	return f.decision
+}
+
+func (f *fakeActions) SendFile(run *mcpRun, path, caption string, photo bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files = append(f.files, path)
+	return nil
+}
+
+func (f *fakeActions) SendText(run *mcpRun, text string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.texts = append(f.texts, text)
+	return nil
+}
+
+func (f *fakeActions) SendVoice(run *mcpRun, text string) error {
+	return f.voiceErr
+}
+
+func (f *fakeActions) AskUser(ctx context.Context, run *mcpRun, question string, options []string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.asked = append(f.asked, question)
+	return f.answer, nil
+}
+
+func newTestMCPServer(t *testing.T, actions bridgeActions) *MCPServer {
+	t.Helper()
+	cfg := &Config{
+		Server:   ServerConfig{MCPSocket: filepath.Join(t.TempDir(), "mcp.sock"), MCPTools: true},
+		Security: SecurityConfig{PermissionPrompts: true},
+	}
+	s := NewMCPServer(cfg, nil)
+	s.actions = actions
+	return s
+}
+
+// mcpClient drives serve() over in-memory pipes.
+type mcpClient struct {
+	t   *testing.T
+	w   io.WriteCloser
+	r   *bufio.Scanner
+	id  int
+	out chan map[string]interface{}
+}
+
+func startMCPClient(t *testing.T, s *MCPServer, run *mcpRun) *mcpClient {
+	t.Helper()
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	go func() {
+		s.serve(run, inR, outW)
+		outW.Close()
+	}()
+	c := &mcpClient{t: t, w: inW, r: bufio.NewScanner(outR), out: make(chan map[string]interface{}, 16)}
+	go func() {
+		for c.r.Scan() {
+			var m map[string]interface{}
+			json.Unmarshal(c.r.Bytes(), &m)
+			c.out <- m
+		}
+		close(c.out)
+	}()
+	t.Cleanup(func() { inW.Close() })
+	return c
+}
+
+func (c *mcpClient) call(method string, params interface{}) map[string]interface{} {
+	c.t.Helper()
+	c.id++
+	msg := map[string]interface{}{"jsonrpc": "2.0", "id": c.id, "method": method}
+	if params != nil {
+		msg["params"] = params
+	}
+	data, _ := json.Marshal(msg)
+	c.w.Write(append(data, '\n'))
+	select {
+	case resp := <-c.out:
+		return resp
+	case <-time.After(2 * time.Second):
+		c.t.Fatalf("no response to %s", method)
+		return nil
+	}
+}
+
+func (c *mcpClient) notify(method string) {
+	data, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "method": method})
+	c.w.Write(append(data, '\n'))
+}
+
+// toolText extracts the text content of a tools/call response.
+func toolText(t *testing.T, resp map[string]interface{}) (string, bool) {
+	t.Helper()
+	result, ok := resp["result"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("no result in %v", resp)
+	}
+	content := result["content"].([]interface{})
+	text := content[0].(map[string]interface{})["text"].(string)
+	isErr, _ := result["isError"].(bool)
+	return text, isErr
+}
+
+func testRun() *mcpRun {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &mcpRun{token: "tok", userID: "user1", chatID: 1, sessionID: "sess1", ctx: ctx, cancel: cancel}
+}
+
+func TestMCPServe_InitializeAndList(t *testing.T) {
+	s := newTestMCPServer(t, &fakeActions{})
+	c := startMCPClient(t, s, testRun())
+
+	resp := c.call("initialize", map[string]interface{}{"protocolVersion": "2024-11-05"})
+	result := resp["result"].(map[string]interface{})
+	if result["protocolVersion"] != "2024-11-05" {
+		t.Errorf("should echo client protocol version, got %v", result["protocolVersion"])
+	}
+	if _, ok := result["capabilities"].(map[string]interface{})["tools"]; !ok {
+		t.Error("should advertise tools capability")
+	}
+
+	// Notifications get no response; the next response must be for tools/list
+	c.notify("notifications/initialized")
+
+	resp = c.call("tools/list", nil)
+	tools := resp["result"].(map[string]interface{})["tools"].([]interface{})
+	found := false
+	for _, tool := range tools {
+		if tool.(map[string]interface{})["name"] == permissionPromptTool {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("tools/list missing %s: %v", permissionPromptTool, tools)
+	}
+
+	resp = c.call("bogus/method", nil)
+	if resp["error"] == nil {
+		t.Error("unknown method should return an error")
+	}
+}
+
+func TestMCPServe_PermissionPrompt(t *testing.T) {
+	tests := []struct {
+		name     string
+		decision approvalDecision
+		behavior string
+	}{
+		{"allow once", approvalAllowOnce, "allow"},
+		{"deny", approvalDeny, "deny"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actions := &fakeActions{decision: tt.decision}
+			s := newTestMCPServer(t, actions)
+			c := startMCPClient(t, s, testRun())
+
+			resp := c.call("tools/call", map[string]interface{}{
+				"name": permissionPromptTool,
+				"arguments": map[string]interface{}{
+					"tool_name": "Bash",
+					"input":     map[string]interface{}{"command": "rm -rf build"},
+				},
+			})
+			text, isErr := toolText(t, resp)
+			if isErr {
+				t.Fatalf("unexpected tool error: %s", text)
+			}
+			var out map[string]interface{}
+			if err := json.Unmarshal([]byte(text), &out); err != nil {
+				t.Fatalf("result should be JSON: %q", text)
+			}
+			if out["behavior"] != tt.behavior {
+				t.Errorf("behavior: got %v, want %s", out["behavior"], tt.behavior)
+			}
+			if tt.behavior == "allow" {
+				input := out["updatedInput"].(map[string]interface{})
+				if input["command"] != "rm -rf build" {
+					t.Errorf("updatedInput should echo the input: %v", input)
+				}
+			}
+		})
+	}
+}
+
+func TestMCPServe_AlwaysAllowSkipsPrompt(t *testing.T) {
+	actions := &fakeActions{decision: approvalAllowAlways}
+	s := newTestMCPServer(t, actions)
+	c := startMCPClient(t, s, testRun())
+
+	args := map[string]interface{}{
+		"name":      permissionPromptTool,
+		"arguments": map[string]interface{}{"tool_name": "Write", "input": map[string]interface{}{"file_path": "/tmp/x"}},
+	}
+	c.call("tools/call", args)
+	c.call("tools/call", args)
+
+	if len(actions.asked) != 1 {
+		t.Errorf("second call should be auto-allowed, asked %d times", len(actions.asked))
+	}
+
+	// A different session still asks
+	run2 := testRun()
+	run2.sessionID = "sess2"
+	c2 := startMCPClient(t, s, run2)
+	c2.call("tools/call", args)
+	if len(actions.asked) != 2 {
+		t.Errorf("always-allow must be scoped to the session, asked %d times", len(actions.asked))
+	}
+}
+
+// grantTest is a session with an MCP server whose user has chosen to always
+// allow Write.
+type grantTest struct {
+	server  *MCPServer
+	sm      *SessionManager
+	session *Session
+	actions *fakeActions
+	call    func()
+}
+
+func newGrantTest(t *testing.T) *grantTest {
+	t.Helper()
+	actions := &fakeActions{decision: approvalAllowAlways}
+	s := newTestMCPServer(t, actions)
+	sm := newTestSessionManager()
+	sm.stateDir = t.TempDir()
+	sm.tools = s
+	sess := sm.CreateSession("user1", "1")
+	run := testRun()
+	run.sessionID = sess.ID
+	c := startMCPClient(t, s, run)
+	args := map[string]interface{}{
+		"name":      permissionPromptTool,
+		"arguments": map[string]interface{}{"tool_name": "Write", "input": map[string]interface{}{"file_path": "/tmp/x"}},
+	}
+	g := &grantTest{server: s, sm: sm, session: sess, actions: actions, call: func() { c.call("tools/call", args) }}
+	g.call()
+	return g
+}
+
+// asksAgain reports whether the next Write prompts the user again.
+func (g *grantTest) asksAgain() bool {
+	before := len(g.actions.asked)
+	g.call()
+	return len(g.actions.asked) > before
+}
+
+func TestMCPServe_ForgetSession(t *testing.T) {
+	g := newGrantTest(t)
+	if g.asksAgain() {
+		t.Fatal("the grant should hold")
+	}
+	g.server.ForgetSession(g.session.ID)
+	if !g.asksAgain() {
+		t.Error("a forgotten session should ask again")
+	}
+}
+
+func TestKillSession_ForgetsGrants(t *testing.T) {
+	g := newGrantTest(t)
+	g.sm.KillSession("user1", "")
+	g.server.mu.Lock()
+	n := len(g.server.alwaysAllow)
+	g.server.mu.Unlock()
+	if n != 0 {
+		t.Errorf("grants should end with the session: %d left", n)
+	}
+}
+
+func TestChangeDir_ForgetsGrants(t *testing.T) {
+	g := newGrantTest(t)
+	if _, changed, err := g.sm.ChangeDir("user1", t.TempDir()); err != nil || !changed {
+		t.Fatalf("cd: %v", err)
+	}
+	if !g.asksAgain() {
+		t.Error("a new work dir starts a new conversation and should ask again")
+	}
+}
+
+func TestCancelRun_ForgetsGrants(t *testing.T) {
+	g := newGrantTest(t)
+	g.sm.procs[g.session.ID] = func() {}
+	if _, err := g.sm.CancelRun("user1", g.session.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if !g.asksAgain() {
+		t.Error("/cancel should end the grants")
+	}
+}
+
+func TestMCPServe_UnknownTool(t *testing.T) {
+	s := newTestMCPServer(t, &fakeActions{})
+	c := startMCPClient(t, s, testRun())
+	resp := c.call("tools/call", map[string]interface{}{"name": "nope", "arguments": map[string]interface{}{}})
+	if _, isErr := toolText(t, resp); !isErr {
+		t.Error("unknown tool should be reported as a tool error")
+	}
+}
+
+// argValue returns the value following flag in a claude argument list.
+func argValue(args []string, flag string) string {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == flag {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+func TestMCPRegister_Args(t *testing.T) {
+	s := newTestMCPServer(t, &fakeActions{})
+	args, release := s.Register("user1", "12345", "sess1")
+	defer release()
+
+	if got := argValue(args, "--permission-prompt-tool"); got != "mcp__pai_bridge__permission_prompt" {
+		t.Errorf("permission tool name: %q", got)
+	}
+	allowed := argValue(args, "--allowedTools")
+	for _, name := range []string{"send_file", "send_photo", "send_voice", "send_message", "ask_user"} {
+		if !strings.Contains(allowed, "mcp__pai_bridge__"+name) {
+			t.Errorf("--allowedTools missing %s: %q", name, allowed)
+		}
+	}
+	if strings.Contains(allowed, permissionPromptTool) {
+		t.Errorf("permission prompt tool must not be pre-allowed: %q", allowed)
+	}
+
+	var cfg struct {
+		MCPServers map[string]struct {
+			Command string            `json:"command"`
+			Args    []string          `json:"args"`
+			Env     map[string]string `json:"env"`
+		} `json:"mcpServers"`
+	}
+	if err := json.Unmarshal([]byte(argValue(args, "--mcp-config")), &cfg); err != nil {
+		t.Fatalf("mcp config not JSON: %v", err)
+	}
+	srv := cfg.MCPServers[mcpServerName]
+	if len(srv.Args) == 0 || srv.Args[0] != "mcp-relay" {
+		t.Errorf("relay args: %v", srv.Args)
+	}
+	token := srv.Env[mcpTokenEnv]
+	s.mu.Lock()
+	run := s.runs[token]
+	s.mu.Unlock()
+	if run == nil || run.chatID != 12345 || run.userID != "user1" {
+		t.Errorf("run not registered for token: %+v", run)
+	}
+
+	release()
+	s.mu.Lock()
+	_, still := s.runs[token]
+	s.mu.Unlock()
+	if still {
+		t.Error("release should unregister the run")
+	}
+	if run.ctx.Err() == nil {
+		t.Error("release should cancel the run context")
+	}
+}
+
+func TestMCPRegister_ChatToolsOnly(t *testing.T) {
+	s := NewMCPServer(&Config{Server: ServerConfig{MCPTools: true}}, nil)
+	args, release := s.Register("user1", "1", "sess1")
+	defer release()
+	if argValue(args, "--mcp-config") == "" {
+		t.Error("chat tools need the MCP server attached")
+	}
+	if argValue(args, "--permission-prompt-tool") != "" {
+		t.Error("permission prompt tool should only be set when permission_prompts is on")
+	}
+	for _, tool := range s.tools {
+		if tool.Name == permissionPromptTool {
+			t.Error("permission_prompt should not be offered when permission_prompts is off")
+		}
+	}
+}
+
+func TestMCPRegister_DisabledReturnsNoArgs(t *testing.T) {
+	s := NewMCPServer(&Config{}, nil)
+	args, release := s.Register("user1", "1", "sess1")
+	release()
+	if len(args) != 0 {
+		t.Errorf("expected no args when no MCP tools are enabled, got %v", args)
+	}
+}
+
+func TestMCPSocket_TokenAuth(t *testing.T) {
+	actions := &fakeActions{decision: approvalAllowOnce}
+	s := newTestMCPServer(t, actions)
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	args, release := s.Register("user1", "1", "sess1")
+	defer release()
+	var cfg map[string]map[string]map[string]interface{}
+	json.Unmarshal([]byte(argValue(args, "--mcp-config")), &cfg)
+	token := cfg["mcpServers"][mcpServerName]["env"].(map[string]interface{})[mcpTokenEnv].(string)
+
+	// Valid token: MCP works over the socket
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(token + "\n"))
+	conn.Write([]byte(`{"jsonrpc":"2.0","id":1,"method":"ping"}` + "\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.Contains(line, `"id":1`) {
+		t.Fatalf("ping over socket: %q %v", line, err)
+	}
+
+	// Unknown token: connection is closed without a response
+	bad, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	bad.Write([]byte("not-a-token\n"))
+	bad.Write([]byte(`{"jsonrpc":"2.0","id":1,"method":"ping"}` + "\n"))
+	bad.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := bufio.NewReader(bad).ReadString('\n'); err == nil {
+		t.Error("unknown token should not be served")
+	}
+}
+
+func TestApprovalDetail(t *testing.T) {
+	if got := approvalDetail("Bash", map[string]interface{}{"command": "make deploy"}); got != "make deploy" {
+		t.Errorf("Bash: got %q", got)
+	}
+	if got := approvalDetail("Write", map[string]interface{}{"file_path": "/etc/hosts"}); got != "/etc/hosts" {
+		t.Errorf("Write: got %q", got)
+	}
+	if got := approvalDetail("mcp__x__y", map[string]interface{}{"a": 1}); !strings.Contains(got, `"a": 1`) {
+		t.Errorf("fallback should render input JSON: %q", got)
+	}
+}
+
+func callChatTool(t *testing.T, c *mcpClient, name string, args map[string]interface{}) (string, bool) {
+	t.Helper()
+	return toolText(t, c.call("tools/call", map[string]interface{}{"name": name, "arguments": args}))
+}
+
+func TestMCPChatTools_SendFilePolicy(t *testing.T) {
+	actions := &fakeActions{}
+	s := newTestMCPServer(t, actions)
+	c := startMCPClient(t, s, testRun())
+
+	dir, err := os.MkdirTemp("/tmp", "pai-mcp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	report := filepath.Join(dir, "report.txt")
+	os.WriteFile(report, []byte("hi"), 0644)
+	secret := filepath.Join(dir, "api.key")
+	os.WriteFile(secret, []byte("hi"), 0644)
+
+	if text, isErr := callChatTool(t, c, "send_file", map[string]interface{}{"path": report}); isErr {
+		t.Errorf("allowed file should send: %s", text)
+	}
+
+	blocked := []struct {
+		name string
+		tool string
+		path string
+	}{
+		{"relative path", "send_file", "report.txt"},
+		{"missing file", "send_file", filepath.Join(dir, "nope.txt")},
+		{"directory", "send_file", dir},
+		{"denied pattern", "send_file", secret},
+		{"outside allowlist", "send_file", "/etc/hostname"},
+		{"photo of non-image", "send_photo", report},
+	}
+	for _, tt := range blocked {
+		if text, isErr := callChatTool(t, c, tt.tool, map[string]interface{}{"path": tt.path}); !isErr {
+			t.Errorf("%s: should be refused, got %q", tt.name, text)
+		}
+	}
+
+	if len(actions.files) != 1 || actions.files[0] != report {
+		t.Errorf("only the allowed file should reach the bot, got %v", actions.files)
+	}
+}
+
+func TestMCPChatTools_MessageVoiceAsk(t *testing.T) {
+	actions := &fakeActions{answer: "Ship it", voiceErr: errors.New("voice notes are not enabled on this bridge")}
+	s := newTestMCPServer(t, actions)
+	c := startMCPClient(t, s, testRun())
+
+	if _, isErr := callChatTool(t, c, "send_message", map[string]interface{}{"text": "Halfway there"}); isErr {
+		t.Error("send_message should succeed")
+	}
+	if len(actions.texts) != 1 || actions.texts[0] != "Halfway there" {
+		t.Errorf("texts: %v", actions.texts)
+	}
+
+	if _, isErr := callChatTool(t, c, "send_message", map[string]interface{}{"text": "  "}); !isErr {
+		t.Error("empty send_message should be refused")
+	}
+
+	if text, isErr := callChatTool(t, c, "send_voice", map[string]interface{}{"text": "Hello"}); !isErr || !strings.Contains(text, "not enabled") {
+		t.Errorf("voice error should be reported to Claude, got %q", text)
+	}
+
+	text, isErr := callChatTool(t, c, "ask_user", map[string]interface{}{
+		"question": "Deploy now?",
+		"options":  []string{"Ship it", "Wait"},
+	})
+	if isErr || text != "Ship it" {
+		t.Errorf("ask_user should return the answer, got %q (error=%v)", text, isErr)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Chat tools replace the SEND:/VOICE: text directives: Claude calls them
+// like any other tool, and they act on the chat bound to the run. Path
+// policy is enforced here, before anything reaches the bot.
+
+func stringProp(desc string) map[string]interface{} {
+	return map[string]interface{}{"type": "string", "description": desc}
+}
+
+func objectSchema(props map[string]interface{}, required ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+		"required":   required,
+	}
+}
+
+func (s *MCPServer) chatToolDefs() []mcpTool {
+	fileProps := map[string]interface{}{
+		"path":    stringProp("Absolute path of the file to send."),
+		"caption": stringProp("Optional caption shown under the file."),
+	}
+	return []mcpTool{
+		{
+			Name: "send_file",
+			Description: "Send a file to the user's Telegram chat as a document. Use only when the user wants to " +
+				"receive the file, not when reading it yourself.",
+			InputSchema: objectSchema(fileProps, "path"),
+			Handle:      s.handleSendFile(false),
+		},
+		{
+			Name:        "send_photo",
+			Description: "Send an image (png, jpg, gif, webp) to the user's Telegram chat as a photo.",
+			InputSchema: objectSchema(fileProps, "path"),
+			Handle:      s.handleSendFile(true),
+		},
+		{
+			Name:        "send_voice",
+			Description: "Speak a short text (1-3 sentences) to the user as a Telegram voice note.",
+			InputSchema: objectSchema(map[string]interface{}{
+				"text": stringProp("Text to speak."),
+			}, "text"),
+			Handle: s.handleSendVoice,
+		},
+		{
+			Name: "send_message",
+			Description: "Send an interim message to the user right away, e.g. a status update during a long task. " +
+				"Your final reply is delivered automatically; don't repeat it here.",
+			InputSchema: objectSchema(map[string]interface{}{
+				"text": stringProp("Message text (Markdown)."),
+			}, "text"),
+			Handle: s.handleSendMessage,
+		},
+		{
+			Name: "ask_user",
+			Description: "Ask the user a question and wait for the answer. Optional short options are shown " +
+				"as buttons; the user can always reply in free text instead.",
+			InputSchema: objectSchema(map[string]interface{}{
+				"question": stringProp("The question to ask."),
+				"options": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "string"},
+					"description": "Optional answer choices.",
+				},
+			}, "question"),
+			Handle: s.handleAskUser,
+		},
+	}
+}
+
+// checkSendPath applies the same policy as SEND: directives: an existing
+// regular file, given as an absolute path, that passes isSafeSendPath.
+func checkSendPath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("path must be absolute: %q", path)
+	}
+	path = filepath.Clean(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("file not found: %s", path)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s is a directory", path)
+	}
+	if !isSafeSendPath(path) {
+		log.Printf("[PAI MCP] send blocked (path not in allowlist): %s", path)
+		return "", fmt.Errorf("sending %s is not allowed: files must be under %s and must not look like secrets",
+			path, strings.Join(sendAllowedPrefixes, ", "))
+	}
+	return path, nil
+}
+
+func (s *MCPServer) handleSendFile(photo bool) func(run *mcpRun, args json.RawMessage) (string, error) {
+	return func(run *mcpRun, args json.RawMessage) (string, error) {
+		var req struct {
+			Path    string `json:"path"`
+			Caption string `json:"caption"`
+		}
+		if err := json.Unmarshal(args, &req); err != nil {
+			return "", fmt.Errorf("invalid arguments: %w", err)
+		}
+		path, err := checkSendPath(req.Path)
+		if err != nil {
+			return "", err
+		}
+		if photo && !imageExtRe.MatchString(path) {
+			return "", fmt.Errorf("%s is not an image; use send_file instead", filepath.Base(path))
+		}
+		if s.actions == nil {
+			return "", fmt.Errorf("bridge is not ready")
+		}
+		if err := s.actions.SendFile(run, path, req.Caption, photo); err != nil {
+			return "", err
+		}
+		return "Sent " + filepath.Base(path) + " to the user.", nil
+	}
+}
+
+func (s *MCPServer) handleSendVoice(run *mcpRun, args json.RawMessage) (string, error) {
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil || strings.TrimSpace(req.Text) == "" {
+		return "", fmt.Errorf("text is required")
+	}
+	if s.actions == nil {
+		return "", fmt.Errorf("bridge is not ready")
+	}
+	if err := s.actions.SendVoice(run, req.Text); err != nil {
+		return "", err
+	}
+	return "Voice note sent.", nil
+}
+
+func (s *MCPServer) handleSendMessage(run *mcpRun, args json.RawMessage) (string, error) {
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil || strings.TrimSpace(req.Text) == "" {
+		return "", fmt.Errorf("text is required")
+	}
+	if s.actions == nil {
+		return "", fmt.Errorf("bridge is not ready")
+	}
+	if err := s.actions.SendText(run, req.Text); err != nil {
+		return "", err
+	}
+	return "Message sent.", nil
+}
+
+func (s *MCPServer) handleAskUser(run *mcpRun, args json.RawMessage) (string, error) {
+	var req struct {
+		Question string   `json:"question"`
+		Options  []string `json:"options"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil || strings.TrimSpace(req.Question) == "" {
+		return "", fmt.Errorf("question is required")
+	}
+	if s.actions == nil {
+		return "", fmt.Errorf("bridge is not ready")
+	}
+	answer, err := s.actions.AskUser(run.ctx, run, req.Question, req.Options)
+	if err != nil {
+		return "", err
+	}
+	return answer, nil
+}
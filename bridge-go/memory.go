@@ -146,24 +146,18 @@ func (mm *MemoryManager) FlushSession(userID, sessionID, model string) {
 	// Build the summarization prompt
 	prompt := flushPrompt + conversationLog
 
-	// Resolve claude binary
-	claudePath := os.Getenv("CLAUDE_PATH")
-	if claudePath == "" {
-		home, _ := os.UserHomeDir()
-		claudePath = filepath.Join(home, ".local/bin/claude")
-	}
-	if resolved, err := filepath.EvalSymlinks(claudePath); err == nil {
-		claudePath = resolved
-	}
-
 	// Spawn Claude with a 2-minute timeout for summarization
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, claudePath, "-p", prompt, "--model", model, "--output-format", "text")
+	cmd := exec.CommandContext(ctx, claudeBinary(), "-p", prompt, "--model", model, "--output-format", "text")
 	cmd.Env = os.Environ()
+	runInProcessGroup(cmd, defaultKillGrace)
 
 	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		reapProcessGroup(cmd)
+	}
 	summary := strings.TrimSpace(string(output))
 
 	if err != nil || summary == "" {
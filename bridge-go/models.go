@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// modelOption is one entry of the /model allowlist.
+type modelOption struct {
+	Alias string
+	ID    string
+}
+
+// modelOptions lists the models /model may switch to, sorted by alias. The
+// default model is always allowed, even if the admin left it out.
+func modelOptions(cfg SessionConfig) []modelOption {
+	var opts []modelOption
+	hasDefault := false
+	for alias, id := range cfg.Models {
+		opts = append(opts, modelOption{Alias: alias, ID: id})
+		if id == cfg.DefaultModel {
+			hasDefault = true
+		}
+	}
+	sort.Slice(opts, func(i, j int) bool { return opts[i].Alias < opts[j].Alias })
+	if !hasDefault && cfg.DefaultModel != "" {
+		opts = append(opts, modelOption{Alias: "default", ID: cfg.DefaultModel})
+	}
+	return opts
+}
+
+// resolveModel maps an alias (case-insensitive) or a full model ID to an
+// allowed model ID. Anything not on the allowlist is rejected.
+func resolveModel(cfg SessionConfig, input string) (string, bool) {
+	input = strings.TrimSpace(input)
+	for _, opt := range modelOptions(cfg) {
+		if strings.EqualFold(opt.Alias, input) || opt.ID == input {
+			return opt.ID, true
+		}
+	}
+	return "", false
+}
+
+// modelLabel renders a model ID with its alias, e.g. "sonnet (claude-sonnet-4-5-20250929)".
+func modelLabel(cfg SessionConfig, id string) string {
+	for _, opt := range modelOptions(cfg) {
+		if opt.ID == id {
+			return opt.Alias + " (" + id + ")"
+		}
+	}
+	return id
+}
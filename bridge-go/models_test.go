@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func testModelConfig() SessionConfig {
+	return SessionConfig{
+		DefaultModel: "claude-sonnet-4-5",
+		Models: map[string]string{
+			"opus":   "claude-opus-4-1",
+			"sonnet": "claude-sonnet-4-5",
+			"haiku":  "claude-haiku-4-5",
+		},
+	}
+}
+
+func TestModelOptions(t *testing.T) {
+	opts := modelOptions(testModelConfig())
+	if len(opts) != 3 || opts[0].Alias != "haiku" || opts[1].Alias != "opus" || opts[2].Alias != "sonnet" {
+		t.Errorf("options should be sorted by alias: %v", opts)
+	}
+
+	cfg := testModelConfig()
+	cfg.DefaultModel = "claude-custom"
+	opts = modelOptions(cfg)
+	if last := opts[len(opts)-1]; last.Alias != "default" || last.ID != "claude-custom" {
+		t.Errorf("default model should always be offered, got %v", opts)
+	}
+}
+
+func TestResolveModel(t *testing.T) {
+	cfg := testModelConfig()
+	tests := []struct {
+		input string
+		want  string
+		ok    bool
+	}{
+		{"opus", "claude-opus-4-1", true},
+		{"Haiku", "claude-haiku-4-5", true},
+		{"claude-sonnet-4-5", "claude-sonnet-4-5", true},
+		{" sonnet ", "claude-sonnet-4-5", true},
+		{"claude-opus-3", "", false},
+		{"gpt-4", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := resolveModel(cfg, tt.input)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("resolveModel(%q) = %q, %v; want %q, %v", tt.input, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestModelLabel(t *testing.T) {
+	cfg := testModelConfig()
+	if got := modelLabel(cfg, "claude-opus-4-1"); got != "opus (claude-opus-4-1)" {
+		t.Errorf("got %q", got)
+	}
+	if got := modelLabel(cfg, "claude-unknown"); got != "claude-unknown" {
+		t.Errorf("unknown model should render as its ID, got %q", got)
+	}
+}
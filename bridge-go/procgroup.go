@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// defaultKillGrace is how long a cancelled Claude process group gets between
+// SIGTERM and SIGKILL.
+const defaultKillGrace = 5 * time.Second
+
+// runInProcessGroup starts cmd (built with exec.CommandContext) in its own
+// process group and replaces the context's default kill of the direct PID:
+// when the context is done the whole group gets SIGTERM, then SIGKILL once
+// grace has passed. Without this, shells, test runs and dev servers Claude
+// started through Bash outlive the run as orphans.
+func runInProcessGroup(cmd *exec.Cmd, grace time.Duration) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		err := syscall.Kill(-pgid, syscall.SIGTERM)
+		time.AfterFunc(grace, func() { syscall.Kill(-pgid, syscall.SIGKILL) })
+		return err
+	}
+	// Backstop for Wait if something holds the output pipes open past the
+	// group SIGKILL (a child that moved to its own session, say).
+	cmd.WaitDelay = grace + 5*time.Second
+}
+
+// reapProcessGroup SIGKILLs whatever is left of a cancelled run's process
+// group once the leader has exited. Calling it for a group that is already
+// gone is harmless.
+func reapProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// processGone reports whether pid has exited. Zombies count as gone: in a
+// container without an init that reaps, killed orphans linger as zombies.
+func processGone(pid int) bool {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return true
+	}
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestCancelRun_KillsProcessTree(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("needs /proc")
+	}
+	pidFile := filepath.Join(t.TempDir(), "pids")
+	t.Setenv("FAKE_CLAUDE_PIDS", pidFile)
+
+	// One child ignores SIGTERM and must be SIGKILLed after the grace period;
+	// the other is an ordinary background job.
+	fakeClaude(t, `sh -c 'trap "" TERM; while :; do sleep 1; done' &
+echo $! >> "$FAKE_CLAUDE_PIDS"
+sleep 300 &
+echo $! >> "$FAKE_CLAUDE_PIDS"
+echo '{"type":"system","session_id":"claude-tree"}'
+echo '{"type":"assistant","message":{"content":[{"type":"text","text":"spawned"}]}}'
+wait
+`)
+	sm := newTestSessionManager()
+	sm.stateDir = t.TempDir()
+	sm.runner = &execRunner{killGrace: 300 * time.Millisecond}
+
+	started := make(chan struct{})
+	stream := &StreamCallbacks{OnText: func(string) { close(started) }}
+	done := make(chan error, 1)
+	go func() {
+		_, err := sm.SendMessage("user1", "spawn things", nil, stream)
+		done <- err
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fake claude produced no output")
+	}
+	data, _ := os.ReadFile(pidFile)
+	var pids []int
+	for _, f := range strings.Fields(string(data)) {
+		pid, _ := strconv.Atoi(f)
+		pids = append(pids, pid)
+	}
+	if len(pids) != 2 {
+		t.Fatalf("expected 2 child pids, got %q", data)
+	}
+
+	if _, err := sm.CancelRun("user1", sm.BusySession("user1").ID, false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("cancelled run returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return; children kept stdout open")
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for _, pid := range pids {
+		for !processGone(pid) {
+			if time.Now().After(deadline) {
+				t.Fatalf("child %d survived the cancelled run", pid)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
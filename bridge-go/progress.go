@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// progressRefresh is how often the elapsed time is re-rendered when no new
+// steps have arrived, so a quiet-but-working run still visibly ticks.
+const progressRefresh = 10 * time.Second
+
+type stepStatus int
+
+const (
+	stepRunning stepStatus = iota
+	stepOK
+	stepFailed
+)
+
+type progressStep struct {
+	id     string
+	desc   string
+	status stepStatus
+}
+
+// progressTracker maintains a single editable Telegram message per run that
+// lists the last few tool steps Claude took plus elapsed time.
+//
+// Like liveReply, mu guards only what the stream callbacks share with the
+// refresh loop; the message state below it belongs to Start, the loop and
+// finish in turn, so ToolUse and ToolResult never wait on Telegram.
+type progressTracker struct {
+	api      telegramAPI
+	chatID   int64
+	maxSteps int
+	interval time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	stopData string // callback data for the Stop button; "" = no button
+	started  time.Time
+	steps    []progressStep
+	total    int
+	dirty    bool
+	running  bool
+	stopped  bool
+
+	msgID      int
+	shown      string
+	renderedAt time.Time
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+func newProgressTracker(api telegramAPI, chatID int64, maxSteps int) *progressTracker {
+	return &progressTracker{
+		api:      api,
+		chatID:   chatID,
+		maxSteps: maxSteps,
+		interval: liveEditInterval,
+		now:      time.Now,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+// SetStopButton attaches a Stop button with the given callback data to the
+// progress message while the run is working. Call it before Start.
+func (pt *progressTracker) SetStopButton(data string) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.stopData = data
+}
+
+// keyboard returns the Stop button markup, or nil once the run has finished.
+// Caller must hold pt.mu.
+func (pt *progressTracker) keyboard() *tgbotapi.InlineKeyboardMarkup {
+	if pt.stopData == "" || pt.stopped {
+		return nil
+	}
+	kb := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("⏹ Stop", pt.stopData),
+	))
+	return &kb
+}
+
+// Start posts the progress message and begins the refresh loop.
+func (pt *progressTracker) Start() {
+	pt.mu.Lock()
+	pt.started = pt.now()
+	text := pt.render("⚙️ Working")
+	msg := tgbotapi.NewMessage(pt.chatID, text)
+	if kb := pt.keyboard(); kb != nil {
+		msg.ReplyMarkup = *kb
+	}
+	pt.mu.Unlock()
+
+	if msg, err := pt.api.Send(msg); err != nil {
+		log.Printf("[PAI Bridge] Progress message failed: %v", err)
+	} else {
+		pt.msgID = msg.MessageID
+		pt.shown = text
+		pt.renderedAt = pt.now()
+	}
+
+	pt.mu.Lock()
+	pt.running = true
+	pt.mu.Unlock()
+
+	go pt.loop()
+}
+
+// ToolUse records a new step. Steps are keyed by tool_use ID so the matching
+// tool_result can mark them done.
+func (pt *progressTracker) ToolUse(id, name string, input map[string]interface{}) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.steps = append(pt.steps, progressStep{id: id, desc: describeToolUse(name, input)})
+	if len(pt.steps) > pt.maxSteps {
+		pt.steps = pt.steps[len(pt.steps)-pt.maxSteps:]
+	}
+	pt.total++
+	pt.dirty = true
+}
+
+// ToolResult marks the step with the given tool_use ID as finished.
+func (pt *progressTracker) ToolResult(id string, isError bool) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	for i := range pt.steps {
+		if pt.steps[i].id == id {
+			pt.steps[i].status = stepOK
+			if isError {
+				pt.steps[i].status = stepFailed
+			}
+			pt.dirty = true
+			return
+		}
+	}
+}
+
+func (pt *progressTracker) loop() {
+	defer close(pt.doneCh)
+	ticker := time.NewTicker(pt.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pt.stopCh:
+			return
+		case <-ticker.C:
+			pt.flush()
+		}
+	}
+}
+
+func (pt *progressTracker) flush() {
+	if pt.msgID == 0 {
+		return
+	}
+	pt.mu.Lock()
+	if !pt.dirty && pt.now().Sub(pt.renderedAt) < progressRefresh {
+		pt.mu.Unlock()
+		return
+	}
+	pt.dirty = false
+	text, kb := pt.render("⚙️ Working"), pt.keyboard()
+	pt.mu.Unlock()
+	pt.edit(text, kb)
+}
+
+// edit replaces the progress message text and its markup. It must not be
+// called with pt.mu held.
+func (pt *progressTracker) edit(text string, kb *tgbotapi.InlineKeyboardMarkup) {
+	pt.renderedAt = pt.now()
+	if text == pt.shown {
+		return
+	}
+	// An edit without markup removes the Stop button, which is what the
+	// final edit wants.
+	edit := tgbotapi.NewEditMessageText(pt.chatID, pt.msgID, text)
+	edit.ReplyMarkup = kb
+	if _, err := pt.api.Request(edit); err != nil &&
+		!strings.Contains(err.Error(), "message is not modified") {
+		log.Printf("[PAI Bridge] Progress update failed: %v", err)
+		return
+	}
+	pt.shown = text
+}
+
+// Finish stops the refresh loop and leaves a final summary in place.
+func (pt *progressTracker) Finish(ok bool) {
+	header := "✅ Done"
+	if !ok {
+		header = "❌ Stopped"
+	}
+	pt.finish(header)
+}
+
+// FinishCancelled is Finish for a run the user stopped with /cancel.
+func (pt *progressTracker) FinishCancelled() {
+	pt.finish("⏹ Cancelled")
+}
+
+func (pt *progressTracker) finish(header string) {
+	pt.mu.Lock()
+	if pt.stopped {
+		pt.mu.Unlock()
+		return
+	}
+	pt.stopped = true
+	running := pt.running
+	pt.mu.Unlock()
+
+	if running {
+		close(pt.stopCh)
+		<-pt.doneCh
+	}
+
+	if pt.msgID == 0 {
+		return
+	}
+	pt.mu.Lock()
+	text := pt.render(header)
+	pt.mu.Unlock()
+	pt.edit(text, nil)
+}
+
+// render builds the progress text. Caller must hold pt.mu.
+func (pt *progressTracker) render(header string) string {
+	elapsed := pt.now().Sub(pt.started).Truncate(time.Second)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s · %s", header, formatElapsed(elapsed))
+	if pt.total > 0 {
+		fmt.Fprintf(&sb, " · %d step", pt.total)
+		if pt.total != 1 {
+			sb.WriteString("s")
+		}
+	}
+	for _, s := range pt.steps {
+		mark := "⏳"
+		switch s.status {
+		case stepOK:
+			mark = "✓"
+		case stepFailed:
+			mark = "✗"
+		}
+		fmt.Fprintf(&sb, "\n%s %s", mark, s.desc)
+	}
+	return sb.String()
+}
+
+func formatElapsed(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	}
+	if d < time.Hour {
+		return fmt.Sprintf("%dm%02ds", int(d.Minutes()), int(d.Seconds())%60)
+	}
+	return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// describeToolUse turns a tool_use block into a short human-readable step,
+// e.g. "Reading foo.go" or "Running go test ./...".
+func describeToolUse(name string, input map[string]interface{}) string {
+	str := func(key string) string {
+		v, _ := input[key].(string)
+		return v
+	}
+	base := func(key string) string {
+		if p := str(key); p != "" {
+			return filepath.Base(p)
+		}
+		return "file"
+	}
+
+	switch name {
+	case "Read":
+		return "Reading " + base("file_path")
+	case "Write":
+		return "Writing " + base("file_path")
+	case "Edit", "MultiEdit":
+		return "Editing " + base("file_path")
+	case "NotebookEdit":
+		return "Editing " + base("notebook_path")
+	case "Bash":
+		cmd := strings.Join(strings.Fields(str("command")), " ")
+		if cmd == "" {
+			return "Running a command"
+		}
+		return "Running " + truncate(cmd, 60)
+	case "Grep":
+		return fmt.Sprintf("Searching for %q", truncate(str("pattern"), 40))
+	case "Glob":
+		return "Finding " + truncate(str("pattern"), 40)
+	case "WebFetch":
+		if u, err := url.Parse(str("url")); err == nil && u.Host != "" {
+			return "Fetching " + u.Host
+		}
+		return "Fetching a web page"
+	case "WebSearch":
+		return fmt.Sprintf("Searching the web for %q", truncate(str("query"), 40))
+	case "Task", "Agent":
+		if d := str("description"); d != "" {
+			return "Delegating: " + truncate(d, 50)
+		}
+		return "Delegating to a subagent"
+	case "TodoWrite":
+		return "Updating task list"
+	}
+
+	// MCP tools are named mcp__<server>__<tool>
+	if strings.HasPrefix(name, "mcp__") {
+		parts := strings.SplitN(strings.TrimPrefix(name, "mcp__"), "__", 2)
+		if len(parts) == 2 {
+			return fmt.Sprintf("Using %s (%s)", parts[1], parts[0])
+		}
+	}
+	return "Using " + name
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestDescribeToolUse(t *testing.T) {
+	tests := []struct {
+		name  string
+		tool  string
+		input map[string]interface{}
+		want  string
+	}{
+		{"read", "Read", map[string]interface{}{"file_path": "/home/pai/projects/app/foo.go"}, "Reading foo.go"},
+		{"write", "Write", map[string]interface{}{"file_path": "/tmp/out.txt"}, "Writing out.txt"},
+		{"edit", "Edit", map[string]interface{}{"file_path": "/src/main.go"}, "Editing main.go"},
+		{"bash", "Bash", map[string]interface{}{"command": "go test ./..."}, "Running go test ./..."},
+		{"bash whitespace collapsed", "Bash", map[string]interface{}{"command": "cd /x &&\n  make"}, "Running cd /x && make"},
+		{"bash truncated", "Bash", map[string]interface{}{"command": strings.Repeat("a", 80)}, "Running " + strings.Repeat("a", 60) + "..."},
+		{"bash empty", "Bash", nil, "Running a command"},
+		{"grep", "Grep", map[string]interface{}{"pattern": "TODO"}, `Searching for "TODO"`},
+		{"webfetch", "WebFetch", map[string]interface{}{"url": "https://example.com/a/b"}, "Fetching example.com"},
+		{"task", "Task", map[string]interface{}{"description": "Review the diff"}, "Delegating: Review the diff"},
+		{"mcp tool", "mcp__github__create_issue", nil, "Using create_issue (github)"},
+		{"unknown", "Frobnicate", nil, "Using Frobnicate"},
+		{"missing path", "Read", map[string]interface{}{}, "Reading file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describeToolUse(tt.tool, tt.input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatElapsed(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{5 * time.Second, "5s"},
+		{3*time.Minute + 7*time.Second, "3m07s"},
+		{2*time.Hour + 5*time.Minute, "2h05m"},
+	}
+	for _, tt := range tests {
+		if got := formatElapsed(tt.d); got != tt.want {
+			t.Errorf("formatElapsed(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+// newTestProgressTracker returns a tracker with a controllable clock whose
+// refresh loop never ticks on its own.
+func newTestProgressTracker(api *fakeTelegram, maxSteps int) (*progressTracker, *time.Time) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	pt := newProgressTracker(api, 42, maxSteps)
+	pt.interval = time.Hour
+	pt.now = func() time.Time { return now }
+	return pt, &now
+}
+
+func TestProgressTracker_StepsAndResults(t *testing.T) {
+	api := &fakeTelegram{}
+	pt, now := newTestProgressTracker(api, 5)
+	pt.Start()
+
+	pt.ToolUse("t1", "Read", map[string]interface{}{"file_path": "/a/foo.go"})
+	pt.ToolUse("t2", "Bash", map[string]interface{}{"command": "go test"})
+	pt.ToolResult("t1", false)
+	pt.ToolResult("t2", true)
+	*now = now.Add(90 * time.Second)
+	pt.flush()
+
+	if len(api.edits) != 1 {
+		t.Fatalf("expected 1 edit, got %d", len(api.edits))
+	}
+	got := api.edits[0].Text
+	for _, want := range []string{"1m30s", "2 steps", "✓ Reading foo.go", "✗ Running go test"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("progress text missing %q:\n%s", want, got)
+		}
+	}
+	pt.Finish(true)
+}
+
+func TestProgressTracker_ToolUseDoesNotWaitForTelegram(t *testing.T) {
+	api := &fakeTelegram{stalled: make(chan struct{}), release: make(chan struct{})}
+	pt, _ := newTestProgressTracker(api, 5)
+	pt.Start()
+
+	pt.ToolUse("t1", "Read", map[string]interface{}{"file_path": "/a/foo.go"})
+	flushed := make(chan struct{})
+	go func() {
+		pt.flush()
+		close(flushed)
+	}()
+	<-api.stalled
+
+	recorded := make(chan struct{})
+	go func() {
+		pt.ToolResult("t1", false)
+		pt.ToolUse("t2", "Bash", map[string]interface{}{"command": "go test"})
+		close(recorded)
+	}()
+	select {
+	case <-recorded:
+	case <-time.After(time.Second):
+		t.Fatal("ToolUse blocked behind an edit in flight")
+	}
+
+	close(api.release)
+	<-flushed
+	api.stalled = nil
+	pt.Finish(true)
+	if got := api.edits[len(api.edits)-1].Text; !strings.Contains(got, "2 steps") {
+		t.Errorf("steps recorded during an edit should be shown:\n%s", got)
+	}
+}
+
+func TestProgressTracker_KeepsLastNSteps(t *testing.T) {
+	api := &fakeTelegram{}
+	pt, _ := newTestProgressTracker(api, 2)
+	pt.Start()
+
+	pt.ToolUse("t1", "Read", map[string]interface{}{"file_path": "/one.go"})
+	pt.ToolUse("t2", "Read", map[string]interface{}{"file_path": "/two.go"})
+	pt.ToolUse("t3", "Read", map[string]interface{}{"file_path": "/three.go"})
+	pt.Finish(true)
+
+	got := api.edits[len(api.edits)-1].Text
+	if strings.Contains(got, "one.go") {
+		t.Errorf("oldest step should be dropped:\n%s", got)
+	}
+	if !strings.Contains(got, "three.go") || !strings.Contains(got, "3 steps") {
+		t.Errorf("unexpected final text:\n%s", got)
+	}
+	if !strings.HasPrefix(got, "✅ Done") {
+		t.Errorf("final text should start with done header:\n%s", got)
+	}
+}
+
+func TestProgressTracker_RefreshesElapsedWhenIdle(t *testing.T) {
+	api := &fakeTelegram{}
+	pt, now := newTestProgressTracker(api, 5)
+	pt.Start()
+
+	*now = now.Add(2 * time.Second)
+	pt.flush()
+	if len(api.edits) != 0 {
+		t.Errorf("should not refresh before progressRefresh, got %d edits", len(api.edits))
+	}
+
+	*now = now.Add(progressRefresh)
+	pt.flush()
+	if len(api.edits) != 1 {
+		t.Errorf("should refresh elapsed time after progressRefresh, got %d edits", len(api.edits))
+	}
+	pt.Finish(false)
+	if !strings.HasPrefix(api.edits[len(api.edits)-1].Text, "❌ Stopped") {
+		t.Errorf("failed run should show stopped header: %q", api.edits[len(api.edits)-1].Text)
+	}
+}
+
+func TestProgressTracker_FinishWithoutStart(t *testing.T) {
+	api := &fakeTelegram{}
+	pt, _ := newTestProgressTracker(api, 5)
+	pt.Finish(true)
+	if len(api.sent)+len(api.edits) != 0 {
+		t.Error("unstarted tracker should not touch Telegram")
+	}
+}
+
+func TestProgressTracker_StopButton(t *testing.T) {
+	api := &fakeTelegram{}
+	pt, now := newTestProgressTracker(api, 5)
+	pt.SetStopButton("stop:abc")
+	pt.Start()
+
+	kb, ok := api.sent[0].ReplyMarkup.(tgbotapi.InlineKeyboardMarkup)
+	if !ok || *kb.InlineKeyboard[0][0].CallbackData != "stop:abc" {
+		t.Fatalf("progress message should carry a Stop button: %#v", api.sent[0].ReplyMarkup)
+	}
+
+	*now = now.Add(progressRefresh)
+	pt.flush()
+	if api.edits[0].ReplyMarkup == nil {
+		t.Error("working updates should keep the Stop button")
+	}
+
+	pt.FinishCancelled()
+	last := api.edits[len(api.edits)-1]
+	if last.ReplyMarkup != nil {
+		t.Error("final edit should remove the Stop button")
+	}
+	if !strings.HasPrefix(last.Text, "⏹ Cancelled") {
+		t.Errorf("cancelled run header: %q", last.Text)
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// A session's message queue is mirrored to stateDir/queue/<session ID>/ so a
+// restart, deploy or crash doesn't lose it:
+//
+//	pending.json   messages waiting behind the current run
+//	inflight.json  the prompt of the run in progress, or of the follow-up
+//	               the bot is about to start
+//	*.b64          attachment payloads, spilled out of the JSON
+//
+// The directory is removed once the session is idle with nothing queued. An
+// inflight.json found at startup means the bridge died mid-run.
+
+// queueFile is the on-disk shape of pending.json and inflight.json.
+type queueFile struct {
+	Messages []pendingMessage `json:"messages"`
+}
+
+// persistQueueLocked writes the session's queue and in-flight prompt to its
+// queue dir. Caller must hold s.pendingMu.
+func (s *Session) persistQueueLocked() {
+	if s.queueDir == "" {
+		return
+	}
+	if len(s.pending) == 0 && s.inflight == nil {
+		os.RemoveAll(s.queueDir)
+		return
+	}
+	if err := os.MkdirAll(s.queueDir, 0700); err != nil {
+		log.Printf("[PAI Bridge] Failed to create queue dir: %v", err)
+		return
+	}
+
+	keep := make(map[string]bool)
+	writeQueueFile(filepath.Join(s.queueDir, "pending.json"), spillMessages(s.queueDir, s.pending, keep))
+	var inflight []pendingMessage
+	if s.inflight != nil {
+		inflight = []pendingMessage{*s.inflight}
+	}
+	writeQueueFile(filepath.Join(s.queueDir, "inflight.json"), spillMessages(s.queueDir, inflight, keep))
+	removeUnusedSpills(s.queueDir, keep)
+}
+
+// setInflight records the prompt of the run starting in the session, or nil
+// once it has finished.
+func (s *Session) setInflight(msg *pendingMessage) {
+	s.pendingMu.Lock()
+	s.inflight = msg
+	s.persistQueueLocked()
+	s.pendingMu.Unlock()
+}
+
+// handOff takes the messages queued behind a run that has ended and, in the
+// same write, records the follow-up built from them as in flight in place of
+// the run's prompt, so the queue files never go without them. An
+// interrupting message still queued (its ID is interruptionID) goes next on
+// its own and the rest stay queued behind it; otherwise the whole queue goes
+// as one batch. next is nil if there is nothing to follow up with. The
+// follow-up's own run replaces the record; dropInflight clears it if the
+// follow-up is dropped instead.
+func (s *Session) handOff(interruptionID string) (queued []pendingMessage, next *pendingMessage, interrupted bool) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	for i, m := range s.pending {
+		if interruptionID != "" && m.ID == interruptionID {
+			s.pending = append(s.pending[:i:i], s.pending[i+1:]...)
+			s.inflight = &m
+			s.persistQueueLocked()
+			return []pendingMessage{m}, &m, true
+		}
+	}
+	queued = s.pending
+	s.pending = nil
+	s.inflight = nil
+	if text, attachments := s.buildBatch(queued); text != "" || len(attachments) > 0 {
+		next = &pendingMessage{Text: text, Attachments: attachments}
+		s.inflight = next
+	}
+	s.persistQueueLocked()
+	return queued, next, false
+}
+
+// dropInflight clears msg from the in-flight record unless a later run has
+// already replaced it.
+func (s *Session) dropInflight(msg *pendingMessage) {
+	if msg == nil {
+		return
+	}
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if s.inflight == msg {
+		s.inflight = nil
+		s.persistQueueLocked()
+	}
+}
+
+// loadQueue restores a session's queue and in-flight prompt from its queue
+// dir.
+func (s *Session) loadQueue() {
+	if s.queueDir == "" {
+		return
+	}
+	s.pending = readQueueFile(s.queueDir, "pending.json")
+	if inflight := readQueueFile(s.queueDir, "inflight.json"); len(inflight) > 0 {
+		s.inflight = &inflight[0]
+		s.interrupted = &inflight[0]
+	}
+}
+
+func writeQueueFile(path string, msgs []pendingMessage) {
+	if len(msgs) == 0 {
+		os.Remove(path)
+		return
+	}
+	data, err := json.MarshalIndent(queueFile{Messages: msgs}, "", "  ")
+	if err != nil {
+		log.Printf("[PAI Bridge] Failed to marshal queue: %v", err)
+		return
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("[PAI Bridge] Failed to save queue: %v", err)
+		return
+	}
+	os.Rename(tmp, path)
+}
+
+func readQueueFile(dir, name string) []pendingMessage {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[PAI Bridge] Failed to read %s: %v", name, err)
+		}
+		return nil
+	}
+	var file queueFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		log.Printf("[PAI Bridge] Failed to parse %s: %v", name, err)
+		return nil
+	}
+	return unspillMessages(dir, file.Messages)
+}
+
+// spillMessages returns copies of msgs whose attachment payloads have been
+// written to files in dir, adding the file names to keep.
+func spillMessages(dir string, msgs []pendingMessage, keep map[string]bool) []pendingMessage {
+	out := make([]pendingMessage, len(msgs))
+	for i, m := range msgs {
+		out[i] = pendingMessage{ID: m.ID, Text: m.Text, Attachments: spillAttachments(dir, m.Attachments, keep)}
+	}
+	return out
+}
+
+// spillAttachments returns copies of attachments with their payloads spilled
+// to files in dir.
+func spillAttachments(dir string, attachments []*Attachment, keep map[string]bool) []*Attachment {
+	if len(attachments) == 0 {
+		return nil
+	}
+	out := make([]*Attachment, len(attachments))
+	for i, a := range attachments {
+		out[i] = spillAttachment(dir, a, keep)
+	}
+	return out
+}
+
+// spillAttachment writes a's base64 payload to a file in dir named by its
+// hash and returns a copy that refers to the file instead.
+func spillAttachment(dir string, a *Attachment, keep map[string]bool) *Attachment {
+	if a == nil || a.Base64 == "" {
+		return a
+	}
+	sum := sha256.Sum256([]byte(a.Base64))
+	name := hex.EncodeToString(sum[:8]) + ".b64"
+	keep[name] = true
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.WriteFile(path, []byte(a.Base64), 0600); err != nil {
+			log.Printf("[PAI Bridge] Failed to spill attachment: %v", err)
+			return a
+		}
+	}
+	spilled := *a
+	spilled.Base64 = ""
+	spilled.Spill = name
+	return &spilled
+}
+
+func unspillMessages(dir string, msgs []pendingMessage) []pendingMessage {
+	for i := range msgs {
+		msgs[i].Attachments = unspillAttachments(dir, msgs[i].Attachments)
+	}
+	return msgs
+}
+
+// unspillAttachments reads spilled payloads back from dir, dropping any
+// attachment whose file is gone.
+func unspillAttachments(dir string, attachments []*Attachment) []*Attachment {
+	var out []*Attachment
+	for _, a := range attachments {
+		if a.Spill != "" {
+			data, err := os.ReadFile(filepath.Join(dir, filepath.Base(a.Spill)))
+			if err != nil {
+				log.Printf("[PAI Bridge] Lost queued attachment %s: %v", a.Spill, err)
+				continue
+			}
+			a.Base64 = string(data)
+			a.Spill = ""
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+// removeUnusedSpills deletes attachment files in dir that aren't in keep.
+func removeUnusedSpills(dir string, keep map[string]bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".b64") && !keep[e.Name()] {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+}
+
+// queuedSession is a session restored with work left over from before a
+// restart.
+type queuedSession struct {
+	Session     *Session
+	Pending     []pendingMessage
+	Interrupted *pendingMessage // prompt of the run the restart cut short
+}
+
+// RestoredQueues hands over the work sessions were restored with: queued
+// messages and any run that was cut short. Sessions with an interrupted run
+// keep their queue until the user decides whether to retry it, so Pending
+// is only set for the others.
+func (sm *SessionManager) RestoredQueues() []queuedSession {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	var out []queuedSession
+	for _, s := range sm.sessions {
+		s.pendingMu.Lock()
+		q := queuedSession{Session: s, Interrupted: s.interrupted}
+		if s.interrupted == nil && len(s.pending) > 0 {
+			q.Pending = s.pending
+			s.pending = nil
+			s.persistQueueLocked()
+		}
+		s.pendingMu.Unlock()
+		if q.Interrupted != nil || len(q.Pending) > 0 {
+			out = append(out, q)
+		}
+	}
+	return out
+}
+
+// ResolveInterrupted clears a session's interrupted run and returns its
+// prompt, or nil if there is none (already resolved, or the session ended).
+func (sm *SessionManager) ResolveInterrupted(userID, sessionID string) (*Session, *pendingMessage) {
+	sm.mu.RLock()
+	s, ok := sm.sessions[sessionID]
+	sm.mu.RUnlock()
+	if !ok || s.UserID != userID {
+		return nil, nil
+	}
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	msg := s.interrupted
+	s.interrupted = nil
+	if msg != nil && s.inflight == msg {
+		s.inflight = nil
+		s.persistQueueLocked()
+	}
+	return s, msg
+}
+
+// DropFollowUp clears the in-flight record of a follow-up the bot won't run.
+func (sm *SessionManager) DropFollowUp(sessionID string, f *FollowUp) {
+	if f == nil {
+		return
+	}
+	sm.mu.RLock()
+	s, ok := sm.sessions[sessionID]
+	sm.mu.RUnlock()
+	if ok {
+		s.dropInflight(f.held)
+	}
+}
+
+// recoverQueues picks up work restored from before a restart. Queued
+// messages go on to Claude as a follow-up batch; a run the restart cut short
+// is offered for a retry.
+func (b *Bot) recoverQueues() {
+	for _, q := range b.sessions.RestoredQueues() {
+		s := q.Session
+		chatID, err := strconv.ParseInt(s.ChatID, 10, 64)
+		if err != nil {
+			log.Printf("[PAI Bridge] Can't recover queue for session %s: invalid chat ID %q", s.ID[:8], s.ChatID)
+			continue
+		}
+
+		if q.Interrupted != nil {
+			log.Printf("[PAI Bridge] Session %s was interrupted by a restart", s.ID[:8])
+			text := fmt.Sprintf("⚠️ The bridge restarted while Claude was working on %s in session %s. Anything it finished before then is kept in the session.",
+				messagePreview(q.Interrupted.Text, q.Interrupted.Attachments), s.Name)
+			if n := s.pendingCount(); n > 0 {
+				text += fmt.Sprintf(" %d queued message(s) are waiting behind it.", n)
+			}
+			msg := tgbotapi.NewMessage(chatID, text)
+			msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔁 Retry", "resume:"+s.ID+":retry"),
+				tgbotapi.NewInlineKeyboardButtonData("Dismiss", "resume:"+s.ID+":dismiss"),
+			))
+			b.api.Send(msg)
+			continue
+		}
+
+		text, attachments := s.buildBatch(q.Pending)
+		if text == "" && len(attachments) == 0 {
+			continue
+		}
+		log.Printf("[PAI Bridge] Resuming %d queued message(s) for session %s", len(q.Pending), s.ID[:8])
+		b.send(chatID, fmt.Sprintf("♻️ The bridge restarted. Sending your %d queued message(s) to session %s.", len(q.Pending), s.Name))
+		go b.runMessages(chatID, 0, s.UserID, s.ID, text, attachments, len(q.Pending), nil)
+	}
+}
+
+// handleResumeCallback resolves "resume:<session id>:retry|dismiss" from the
+// interrupted-run notice. Either way, the messages that were held behind the
+// interrupted run are sent on afterwards.
+func (b *Bot) handleResumeCallback(cq *tgbotapi.CallbackQuery, userID, arg string) {
+	sessionID, action, _ := strings.Cut(arg, ":")
+	s, interrupted := b.sessions.ResolveInterrupted(userID, sessionID)
+	if interrupted == nil {
+		b.answerCallback(cq.ID, "Already handled.")
+		return
+	}
+	chatID, _ := strconv.ParseInt(s.ChatID, 10, 64)
+	if cq.Message != nil {
+		chatID = cq.Message.Chat.ID
+	}
+
+	if action == "retry" {
+		b.answerCallback(cq.ID, "Retrying…")
+		if cq.Message != nil {
+			b.api.Request(tgbotapi.NewEditMessageText(chatID, cq.Message.MessageID, "🔁 Retrying the interrupted task."))
+		}
+		text := interrupted.Text
+		if s.ClaudeSessionID != "" {
+			text = "[The bridge restarted before you finished this request, so it is sent again. Check what was already done before redoing it.]\n\n" + text
+		}
+		b.runMessages(chatID, 0, userID, s.ID, text, interrupted.Attachments, 0, nil)
+		return
+	}
+
+	b.answerCallback(cq.ID, "Dismissed.")
+	if cq.Message != nil {
+		b.api.Request(tgbotapi.NewEditMessageText(chatID, cq.Message.MessageID, "Dismissed the interrupted task."))
+	}
+	if msgs := s.takePending(); len(msgs) > 0 {
+		if text, attachments := s.buildBatch(msgs); text != "" || len(attachments) > 0 {
+			b.runMessages(chatID, 0, userID, s.ID, text, attachments, len(msgs), nil)
+		}
+	}
+}
+
+// Queue returns a copy of each of the user's sessions' queued messages, for
+// sessions that have any, oldest session first.
+func (sm *SessionManager) Queue(userID string) []queuedSession {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	var out []queuedSession
+	for _, s := range sm.userSessions(userID) {
+		s.pendingMu.Lock()
+		pending := append([]pendingMessage(nil), s.pending...)
+		s.pendingMu.Unlock()
+		if len(pending) > 0 {
+			out = append(out, queuedSession{Session: s, Pending: pending})
+		}
+	}
+	return out
+}
+
+// RemoveQueued drops one queued message. It reports false if the message is
+// no longer queued.
+func (sm *SessionManager) RemoveQueued(userID, sessionID, msgID string) bool {
+	s := sm.userSession(userID, sessionID)
+	if s == nil {
+		return false
+	}
+	_, ok := s.removePending(msgID)
+	return ok
+}
+
+// ClearQueue drops every message queued in the user's sessions and returns
+// how many there were.
+func (sm *SessionManager) ClearQueue(userID string) int {
+	sm.mu.RLock()
+	sessions := sm.userSessions(userID)
+	sm.mu.RUnlock()
+	n := 0
+	for _, s := range sessions {
+		n += len(s.takePending())
+	}
+	return n
+}
+
+// EditQueued replaces the text of a queued message, keeping its attachments
+// and place in the queue. It reports false if the message is no longer
+// queued.
+func (sm *SessionManager) EditQueued(userID, sessionID, msgID, text string) bool {
+	s := sm.userSession(userID, sessionID)
+	if s == nil {
+		return false
+	}
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	for i := range s.pending {
+		if s.pending[i].ID == msgID {
+			s.pending[i].Text = text
+			s.persistQueueLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// IsQueued reports whether a message is still waiting in a session's queue.
+func (sm *SessionManager) IsQueued(sessionID, msgID string) bool {
+	sm.mu.RLock()
+	s, ok := sm.sessions[sessionID]
+	sm.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	for _, m := range s.pending {
+		if m.ID == msgID {
+			return true
+		}
+	}
+	return false
+}
+
+// userSession returns the session with the given ID if it belongs to the
+// user, or nil.
+func (sm *SessionManager) userSession(userID, sessionID string) *Session {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	if s, ok := sm.sessions[sessionID]; ok && s.UserID == userID {
+		return s
+	}
+	return nil
+}
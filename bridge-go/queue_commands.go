@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// queuedRefKey identifies a Telegram message by chat and message ID.
+type queuedRefKey struct {
+	chatID    int64
+	messageID int
+}
+
+// queuedRef is the queue entry a Telegram message became.
+type queuedRef struct {
+	SessionID string
+	MsgID     string
+}
+
+// sendQueuedAck tells the user their message is waiting behind the current
+// task, with buttons to interrupt the task with it or take it out of the
+// queue. replyTo is the user's Telegram message, or 0 if there isn't one;
+// editing that message later updates the queued copy.
+func (b *Bot) sendQueuedAck(chatID int64, replyTo int, result *MessageResult) {
+	text := fmt.Sprintf("⏳ Queued behind the current task (%d waiting).", result.Queued)
+	if replyTo != 0 {
+		b.queuedMu.Lock()
+		b.queuedRefs[queuedRefKey{chatID, replyTo}] = queuedRef{SessionID: result.SessionID, MsgID: result.QueuedID}
+		b.queuedMu.Unlock()
+		text += " Edit your message to change it before it's sent."
+	}
+	reply := tgbotapi.NewMessage(chatID, text)
+	reply.ReplyToMessageID = replyTo
+	ref := result.SessionID + ":" + result.QueuedID
+	reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("⚡ Interrupt", "intr:"+ref),
+		tgbotapi.NewInlineKeyboardButtonData("🗑 Remove", "queue:"+ref+":ack"),
+	))
+	b.api.Send(reply)
+}
+
+// handleEdited applies an edit of a queued message to the queued copy.
+// Edits of messages that weren't queued are ignored as before; edits that
+// arrive after the message was sent get a note that they came too late.
+func (b *Bot) handleEdited(msg *tgbotapi.Message) {
+	if msg.From == nil || !b.isAllowedUser(fmt.Sprintf("%d", msg.From.ID)) {
+		return
+	}
+	userID := fmt.Sprintf("%d", msg.From.ID)
+	if b.passphrase != nil && !b.passphrase.IsUnlocked(userID) {
+		return
+	}
+	if b.totp != nil && b.totp.Required(totpActionMessage) && !b.totp.Elevated(userID) {
+		return
+	}
+
+	key := queuedRefKey{msg.Chat.ID, msg.MessageID}
+	b.queuedMu.Lock()
+	ref, ok := b.queuedRefs[key]
+	b.queuedMu.Unlock()
+	if !ok {
+		return
+	}
+
+	text := msg.Text
+	if text == "" {
+		text = msg.Caption
+	}
+	reply := tgbotapi.NewMessage(msg.Chat.ID, "✏️ Updated the queued message.")
+	if !b.sessions.EditQueued(userID, ref.SessionID, ref.MsgID, text) {
+		b.queuedMu.Lock()
+		delete(b.queuedRefs, key)
+		b.queuedMu.Unlock()
+		reply.Text = "✏️ Too late to edit: that message was already sent to Claude."
+	} else {
+		log.Printf("[PAI Bridge] User %s edited queued message %s", userID, ref.MsgID)
+	}
+	reply.ReplyToMessageID = msg.MessageID
+	b.api.Send(reply)
+}
+
+// cleanQueuedRefs forgets Telegram messages that are no longer queued.
+func (b *Bot) cleanQueuedRefs() {
+	b.queuedMu.Lock()
+	defer b.queuedMu.Unlock()
+	for key, ref := range b.queuedRefs {
+		if !b.sessions.IsQueued(ref.SessionID, ref.MsgID) {
+			delete(b.queuedRefs, key)
+		}
+	}
+}
+
+// handleQueue implements /queue: the messages waiting behind running tasks,
+// with a button to remove each. "/queue clear" removes them all.
+func (b *Bot) handleQueue(msg *tgbotapi.Message, userID string) {
+	chatID := msg.Chat.ID
+	switch strings.ToLower(strings.TrimSpace(msg.CommandArguments())) {
+	case "":
+	case "clear":
+		b.send(chatID, fmt.Sprintf("Removed %d queued message(s).", b.sessions.ClearQueue(userID)))
+		return
+	default:
+		b.send(chatID, "Usage: /queue, or /queue clear to remove every queued message")
+		return
+	}
+	text, keyboard := b.renderQueue(userID)
+	reply := tgbotapi.NewMessage(chatID, text)
+	if keyboard != nil {
+		reply.ReplyMarkup = keyboard
+	}
+	b.api.Send(reply)
+}
+
+func (b *Bot) renderQueue(userID string) (string, *tgbotapi.InlineKeyboardMarkup) {
+	queues := b.sessions.Queue(userID)
+	if len(queues) == 0 {
+		return "Nothing is queued.", nil
+	}
+	var sb strings.Builder
+	sb.WriteString("📥 Queued messages:")
+	var rows [][]tgbotapi.InlineKeyboardButton
+	n := 0
+	for _, q := range queues {
+		if len(queues) > 1 {
+			fmt.Fprintf(&sb, "\n\nSession %s:", q.Session.Name)
+		}
+		for _, m := range q.Pending {
+			n++
+			fmt.Fprintf(&sb, "\n%d. %s", n, messagePreview(m.Text, m.Attachments))
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("Remove %d", n), "queue:"+q.Session.ID+":"+m.ID),
+			))
+		}
+	}
+	if n > 1 {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Remove all", "queue:all"),
+		))
+	}
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return sb.String(), &keyboard
+}
+
+// handleQueueCallback resolves "queue:<session id>:<message id>" and
+// "queue:all" from the /queue list, redrawing it in place, and
+// "queue:<session id>:<message id>:ack" from a queued acknowledgement.
+func (b *Bot) handleQueueCallback(cq *tgbotapi.CallbackQuery, userID, arg string) {
+	if arg == "all" {
+		b.answerCallback(cq.ID, fmt.Sprintf("Removed %d.", b.sessions.ClearQueue(userID)))
+	} else {
+		parts := strings.Split(arg, ":")
+		if len(parts) < 2 {
+			b.answerCallback(cq.ID, "")
+			return
+		}
+		ack := "Already sent or removed."
+		if b.sessions.RemoveQueued(userID, parts[0], parts[1]) {
+			ack = "Removed."
+		}
+		b.answerCallback(cq.ID, ack)
+		if len(parts) == 3 && parts[2] == "ack" {
+			if cq.Message != nil && ack == "Removed." {
+				b.api.Request(tgbotapi.NewEditMessageText(cq.Message.Chat.ID, cq.Message.MessageID, "🗑 Removed from the queue."))
+			}
+			return
+		}
+	}
+	if cq.Message == nil {
+		return
+	}
+	text, keyboard := b.renderQueue(userID)
+	edit := tgbotapi.NewEditMessageText(cq.Message.Chat.ID, cq.Message.MessageID, text)
+	edit.ReplyMarkup = keyboard
+	b.api.Request(edit)
+}
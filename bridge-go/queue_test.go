@@ -0,0 +1,222 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// reloadSessionManager starts a fresh manager on sm's state dir, as after a
+// restart.
+func reloadSessionManager(sm *SessionManager) *SessionManager {
+	restarted := newTestSessionManager()
+	restarted.stateDir = sm.stateDir
+	restarted.loadFromDisk()
+	return restarted
+}
+
+func TestQueue_SurvivesRestartMidRun(t *testing.T) {
+	hold := make(chan struct{})
+	sm, _ := newFakeRunnerManager(t, fakeRun{lines: []string{systemLine("claude-1")}, hold: hold})
+	done := startHeldRun(t, sm, "long task")
+
+	image := &Attachment{Type: "image", MimeType: "image/png", Base64: "aW1hZ2UgYnl0ZXM="}
+	sm.SendMessage("user1", "also this", nil, nil)
+	sm.SendMessage("user1", "", []*Attachment{image}, nil)
+
+	s := sm.GetSession("user1")
+	dir := sm.queueDir(s.ID)
+	for _, name := range []string{"pending.json", "inflight.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("%s not written: %v", name, err)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "pending.json")); strings.Contains(string(data), image.Base64) {
+		t.Error("attachment payload should be spilled out of pending.json")
+	}
+
+	// The bridge dies here; a new one loads the same state
+	restarted := reloadSessionManager(sm)
+	rs := restarted.GetSession("user1")
+	if rs == nil || rs.Status != "active" || rs.interrupted == nil || rs.interrupted.Text != "long task" {
+		t.Fatalf("interrupted run not restored: %+v", rs)
+	}
+	if len(rs.pending) != 2 || rs.pending[0].Text != "also this" || len(rs.pending[1].Attachments) != 1 || rs.pending[1].Attachments[0].Base64 != image.Base64 {
+		t.Fatalf("queue not restored: %+v", rs.pending)
+	}
+
+	queues := restarted.RestoredQueues()
+	if len(queues) != 1 || queues[0].Interrupted == nil || queues[0].Pending != nil {
+		t.Fatalf("an interrupted session should hold its queue: %+v", queues)
+	}
+	if _, msg := restarted.ResolveInterrupted("user2", rs.ID); msg != nil {
+		t.Error("other users must not resolve the run")
+	}
+	if _, msg := restarted.ResolveInterrupted("user1", rs.ID); msg == nil || msg.Text != "long task" {
+		t.Errorf("resolve: %+v", msg)
+	}
+	if _, msg := restarted.ResolveInterrupted("user1", rs.ID); msg != nil {
+		t.Error("an interrupted run resolves once")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "inflight.json")); !os.IsNotExist(err) {
+		t.Errorf("inflight.json should be gone once resolved: %v", err)
+	}
+
+	// The original run finishing hands the queue on as its follow-up, which
+	// stays in flight on disk until the bot runs or drops it
+	close(hold)
+	out := <-done
+	fu := out.result.FollowUp
+	if fu == nil || fu.Count != 2 {
+		t.Fatalf("follow-up: %+v", fu)
+	}
+	if crashed := reloadSessionManager(sm).GetSession("user1"); crashed.interrupted == nil || crashed.interrupted.Text != fu.Text || len(crashed.interrupted.Attachments) != 1 {
+		t.Errorf("a crash before the follow-up starts should keep it: %+v", crashed.interrupted)
+	}
+	sm.DropFollowUp(out.result.SessionID, fu)
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("queue dir should be removed when idle: %v", err)
+	}
+}
+
+func TestQueue_FollowUpReplacesInflightWhenItStarts(t *testing.T) {
+	hold := make(chan struct{})
+	sm, _ := newFakeRunnerManager(t,
+		fakeRun{lines: []string{systemLine("claude-1"), textLine("done")}, hold: hold},
+		fakeRun{lines: []string{textLine("next")}},
+	)
+	done := startHeldRun(t, sm, "long task")
+	sm.SendMessage("user1", "also this", nil, nil)
+	close(hold)
+	out := <-done
+
+	fu := out.result.FollowUp
+	if _, err := sm.SendToSession(out.result.SessionID, fu.Text, fu.Attachments, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The follow-up's own run has ended, so dropping it late is a no-op
+	sm.DropFollowUp(out.result.SessionID, fu)
+	if _, err := os.Stat(sm.queueDir(out.result.SessionID)); !os.IsNotExist(err) {
+		t.Errorf("queue dir should be removed once the follow-up has run: %v", err)
+	}
+}
+
+func TestQueue_RestoredPendingIsHandedOver(t *testing.T) {
+	sm, _ := newFakeRunnerManager(t)
+	s := sm.CreateSession("user1", "user1")
+	sm.Requeue("user1", s.ID, []pendingMessage{{Text: "one"}, {Text: "two"}})
+	os.MkdirAll(filepath.Join(sm.stateDir, "queue", "ended-session"), 0700)
+
+	restarted := reloadSessionManager(sm)
+	if _, err := os.Stat(filepath.Join(sm.stateDir, "queue", "ended-session")); !os.IsNotExist(err) {
+		t.Error("queues of unknown sessions should be removed on load")
+	}
+	queues := restarted.RestoredQueues()
+	if len(queues) != 1 || queues[0].Interrupted != nil || len(queues[0].Pending) != 2 || queues[0].Pending[1].Text != "two" {
+		t.Fatalf("restored queues: %+v", queues)
+	}
+	if restarted.GetSession("user1").pendingCount() != 0 {
+		t.Error("handed-over messages should leave the queue")
+	}
+	if len(reloadSessionManager(sm).RestoredQueues()) != 0 {
+		t.Error("handed-over messages should not be restored twice")
+	}
+}
+
+func TestDeferredStore_SpillsAttachments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deferred.json")
+	st := newDeferredStore(path)
+	p := &deferredPrompt{UserID: "u1", Text: "look", Attachments: []*Attachment{{Type: "image", Base64: "cGl4ZWxz"}},
+		Queued: []pendingMessage{{Text: "and this", Attachments: []*Attachment{{Type: "document", Base64: "cGRm"}}}}}
+	st.Add(p)
+
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), "cGl4ZWxz") {
+		t.Error("payload should be spilled out of deferred.json")
+	}
+	if p.Attachments[0].Base64 == "" {
+		t.Error("spilling must not touch the prompt in memory")
+	}
+	list := newDeferredStore(path).List("u1")
+	if len(list) != 1 || list[0].Attachments[0].Base64 != "cGl4ZWxz" || list[0].Queued[0].Attachments[0].Base64 != "cGRm" {
+		t.Fatalf("reloaded: %+v", list)
+	}
+
+	st.Remove("u1", p.ID)
+	if files, _ := filepath.Glob(filepath.Join(st.spillDir, "*.b64")); len(files) != 0 {
+		t.Errorf("spilled files should go with their prompt: %v", files)
+	}
+}
+
+func TestQueue_EditRemoveClear(t *testing.T) {
+	hold := make(chan struct{})
+	sm, _ := newFakeRunnerManager(t, fakeRun{lines: []string{systemLine("claude-1")}, hold: hold})
+	done := startHeldRun(t, sm, "long task")
+
+	image := &Attachment{Type: "image", MimeType: "image/png", Base64: "aW1hZ2UgYnl0ZXM="}
+	first, _ := sm.SendMessage("user1", "frist", []*Attachment{image}, nil)
+	second, _ := sm.SendMessage("user1", "second", nil, nil)
+	third, _ := sm.SendMessage("user1", "third", nil, nil)
+
+	if sm.EditQueued("user2", first.SessionID, first.QueuedID, "mine") {
+		t.Error("another user must not edit this queue")
+	}
+	if !sm.EditQueued("user1", first.SessionID, first.QueuedID, "first") {
+		t.Fatal("edit of a queued message should succeed")
+	}
+	if sm.RemoveQueued("user2", second.SessionID, second.QueuedID) {
+		t.Error("another user must not remove from this queue")
+	}
+	if !sm.RemoveQueued("user1", second.SessionID, second.QueuedID) || sm.IsQueued(second.SessionID, second.QueuedID) {
+		t.Fatal("remove of a queued message should succeed")
+	}
+	if sm.RemoveQueued("user1", second.SessionID, second.QueuedID) {
+		t.Error("removing twice should report false")
+	}
+
+	queues := sm.Queue("user1")
+	if len(queues) != 1 || len(queues[0].Pending) != 2 {
+		t.Fatalf("queue: %+v", queues)
+	}
+	if m := queues[0].Pending[0]; m.Text != "first" || len(m.Attachments) != 1 || m.ID != first.QueuedID {
+		t.Errorf("edit should keep the attachment and place in the queue: %+v", m)
+	}
+	if len(sm.Queue("user2")) != 0 {
+		t.Error("other users see nothing queued")
+	}
+
+	// The edit reaches Claude, and the queue on disk, as edited
+	if restored := reloadSessionManager(sm).Queue("user1"); len(restored) != 1 || restored[0].Pending[0].Text != "first" {
+		t.Errorf("edit not persisted: %+v", restored)
+	}
+	close(hold)
+	out := <-done
+	if fu := out.result.FollowUp; fu == nil || !strings.Contains(fu.Text, "first") || strings.Contains(fu.Text, "frist") || strings.Contains(fu.Text, "second") {
+		t.Fatalf("follow-up: %+v", fu)
+	}
+	if sm.EditQueued("user1", third.SessionID, third.QueuedID, "too late") {
+		t.Error("a message that was sent can't be edited")
+	}
+}
+
+func TestQueue_Clear(t *testing.T) {
+	hold := make(chan struct{})
+	sm, _ := newFakeRunnerManager(t, fakeRun{lines: []string{systemLine("claude-1")}, hold: hold})
+	done := startHeldRun(t, sm, "long task")
+	sm.SendMessage("user1", "one", nil, nil)
+	sm.SendMessage("user1", "two", nil, nil)
+
+	if n := sm.ClearQueue("user1"); n != 2 {
+		t.Errorf("cleared %d, want 2", n)
+	}
+	if len(sm.Queue("user1")) != 0 {
+		t.Error("queue should be empty")
+	}
+	if _, err := os.Stat(filepath.Join(sm.queueDir(sm.GetSession("user1").ID), "pending.json")); !os.IsNotExist(err) {
+		t.Errorf("pending.json should be gone: %v", err)
+	}
+	close(hold)
+	if out := <-done; out.result.FollowUp != nil {
+		t.Errorf("nothing should follow the run: %+v", out.result.FollowUp)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxQuotaGrant caps how long a /quota grant override lasts.
+const maxQuotaGrant = 7 * 24 * time.Hour
+
+// enabled reports whether any quota limit is set.
+func (c QuotaConfig) enabled() bool {
+	return c.Daily != (QuotaLimits{}) || c.Monthly != (QuotaLimits{})
+}
+
+// quotaGate checks a user's recorded usage against QuotaConfig before a
+// message starts a Claude run. Admin overrides live in memory only, so a
+// restart ends them.
+type quotaGate struct {
+	daily       QuotaLimits
+	monthly     QuotaLimits
+	warnPercent int
+	admins      map[string]bool
+	ledger      *UsageLedger
+	loc         *time.Location
+	now         func() time.Time
+
+	mu        sync.Mutex
+	overrides map[string]time.Time // userID -> when an admin's override ends
+	warned    map[string]bool      // "user|period|start|metric" already warned about
+}
+
+func newQuotaGate(cfg QuotaConfig, ledger *UsageLedger, loc *time.Location) *quotaGate {
+	g := &quotaGate{
+		daily:       cfg.Daily,
+		monthly:     cfg.Monthly,
+		warnPercent: cfg.WarnPercent,
+		admins:      make(map[string]bool),
+		ledger:      ledger,
+		loc:         loc,
+		now:         time.Now,
+		overrides:   make(map[string]time.Time),
+		warned:      make(map[string]bool),
+	}
+	for _, id := range cfg.Admins {
+		g.admins[id] = true
+	}
+	return g
+}
+
+// quotaPeriod is a window one set of limits applies to.
+type quotaPeriod struct {
+	name   string // "daily" or "monthly"
+	limits QuotaLimits
+	start  time.Time
+	reset  time.Time
+}
+
+func (g *quotaGate) periods(now time.Time) []quotaPeriod {
+	day := startOfDay(now, g.loc)
+	month := startOfMonth(now, g.loc)
+	return []quotaPeriod{
+		{name: "daily", limits: g.daily, start: day, reset: day.AddDate(0, 0, 1)},
+		{name: "monthly", limits: g.monthly, start: month, reset: month.AddDate(0, 1, 0)},
+	}
+}
+
+// quotaMeter is one limited metric's use within a period.
+type quotaMeter struct {
+	metric string // "runs", "tokens" or "minutes"
+	used   int64
+	limit  int64
+}
+
+func (m quotaMeter) String() string {
+	if m.metric == "tokens" {
+		return fmt.Sprintf("%s/%s tokens", formatTokens(m.used), formatTokens(m.limit))
+	}
+	return fmt.Sprintf("%d/%d %s", m.used, m.limit, m.metric)
+}
+
+// quotaMeters pairs each limit that is set with what has been used.
+func quotaMeters(l QuotaLimits, t UsageTotals) []quotaMeter {
+	var out []quotaMeter
+	if l.Runs > 0 {
+		out = append(out, quotaMeter{"runs", int64(t.Runs), int64(l.Runs)})
+	}
+	if l.Tokens > 0 {
+		out = append(out, quotaMeter{"tokens", t.InputTokens + t.CacheCreationTokens + t.OutputTokens, int64(l.Tokens)})
+	}
+	if l.Minutes > 0 {
+		out = append(out, quotaMeter{"minutes", t.DurationMS / 60000, int64(l.Minutes)})
+	}
+	return out
+}
+
+// Check decides whether userID may start a Claude run now. block is the
+// refusal to send instead; warnings are one-time notices for limits past
+// the warning threshold, to send before the run.
+func (g *quotaGate) Check(userID string) (block string, warnings []string) {
+	now := g.now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if until, ok := g.overrides[userID]; ok {
+		if now.Before(until) {
+			return "", nil
+		}
+		delete(g.overrides, userID)
+	}
+
+	// When several limits are hit, the one that resets last is the one
+	// that matters.
+	var blockReset time.Time
+	for _, p := range g.periods(now) {
+		for _, m := range quotaMeters(p.limits, g.ledger.Totals(userID, p.start)) {
+			switch {
+			case m.used >= m.limit:
+				if p.reset.After(blockReset) {
+					blockReset = p.reset
+					block = fmt.Sprintf("⛔ %s quota reached: %s. It resets %s.",
+						capitalize(p.name), m, describeReset(p.reset, now))
+				}
+			case m.used*100 >= m.limit*int64(g.warnPercent):
+				key := strings.Join([]string{userID, p.name, p.start.Format("2006-01-02"), m.metric}, "|")
+				if !g.warned[key] {
+					g.warned[key] = true
+					warnings = append(warnings, fmt.Sprintf("⚠️ %d%% of your %s %s quota is used (%s). It resets %s.",
+						m.used*100/m.limit, p.name, strings.TrimSuffix(m.metric, "s"), m, describeReset(p.reset, now)))
+				}
+			}
+		}
+	}
+	if block != "" {
+		log.Printf("[PAI Bridge] Quota reached for user %s", userID)
+		if len(g.admins) > 0 {
+			block += fmt.Sprintf(" An admin can lift it with /quota grant %s.", userID)
+		}
+		return block, nil
+	}
+	return "", warnings
+}
+
+// IsAdmin reports whether userID may grant overrides.
+func (g *quotaGate) IsAdmin(userID string) bool {
+	return g.admins[userID]
+}
+
+// Grant lifts userID's quotas for d, returning when the override ends.
+func (g *quotaGate) Grant(userID string, d time.Duration) time.Time {
+	if d > maxQuotaGrant {
+		d = maxQuotaGrant
+	}
+	until := g.now().Add(d)
+	g.mu.Lock()
+	g.overrides[userID] = until
+	g.mu.Unlock()
+	return until
+}
+
+// Revoke ends an override early. It reports whether one was active.
+func (g *quotaGate) Revoke(userID string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	until, ok := g.overrides[userID]
+	delete(g.overrides, userID)
+	return ok && g.now().Before(until)
+}
+
+// Status renders /quota: each limit's use and when its period resets.
+func (g *quotaGate) Status(userID string) string {
+	now := g.now()
+	var sb strings.Builder
+	sb.WriteString("📏 Quotas\n")
+	for _, p := range g.periods(now) {
+		meters := quotaMeters(p.limits, g.ledger.Totals(userID, p.start))
+		if len(meters) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "\n%s (resets %s):\n", capitalize(p.name), describeReset(p.reset, now))
+		for _, m := range meters {
+			fmt.Fprintf(&sb, "• %s\n", m)
+		}
+	}
+	g.mu.Lock()
+	until, ok := g.overrides[userID]
+	g.mu.Unlock()
+	if ok && now.Before(until) {
+		fmt.Fprintf(&sb, "\nOverride active until %s.\n", until.In(g.loc).Format("Mon Jan 2 15:04 MST"))
+	}
+	return sb.String()
+}
+
+// describeReset says when a period ends: "at 00:00 EDT (in 3h12m)" within a
+// day, "on Sun Nov 1 at 00:00 EST (in 15 days)" further out.
+func describeReset(reset, now time.Time) string {
+	d := reset.Sub(now)
+	if d <= 24*time.Hour {
+		return fmt.Sprintf("at %s (in %s)", reset.Format("15:04 MST"), formatElapsed(d))
+	}
+	return fmt.Sprintf("on %s (in %d days)", reset.Format("Mon Jan 2 at 15:04 MST"), int(d.Hours()/24))
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
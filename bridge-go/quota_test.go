@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestQuotaGate(t *testing.T, cfg QuotaConfig, now time.Time) *quotaGate {
+	t.Helper()
+	if cfg.WarnPercent == 0 {
+		cfg.WarnPercent = 80
+	}
+	g := newQuotaGate(cfg, NewUsageLedger(t.TempDir()), time.UTC)
+	g.now = func() time.Time { return now }
+	return g
+}
+
+func recordRun(g *quotaGate, userID string, at time.Time, tokens int64, d time.Duration) {
+	g.ledger.Record(UsageRecord{Timestamp: at.UnixMilli(), UserID: userID, InputTokens: tokens, DurationMS: d.Milliseconds()})
+}
+
+func TestQuotaGate_WarnsThenBlocks(t *testing.T) {
+	now := time.Date(2026, 10, 16, 15, 0, 0, 0, time.UTC)
+	g := newTestQuotaGate(t, QuotaConfig{Daily: QuotaLimits{Runs: 5}}, now)
+
+	// Yesterday's runs don't count toward today
+	for i := 0; i < 5; i++ {
+		recordRun(g, "u1", now.Add(-24*time.Hour), 0, 0)
+	}
+	if block, warnings := g.Check("u1"); block != "" || len(warnings) != 0 {
+		t.Fatalf("fresh day: block=%q warnings=%v", block, warnings)
+	}
+
+	for i := 0; i < 4; i++ {
+		recordRun(g, "u1", now, 0, 0)
+	}
+	block, warnings := g.Check("u1")
+	if block != "" || len(warnings) != 1 || !strings.Contains(warnings[0], "80% of your daily run quota") {
+		t.Fatalf("at 80%%: block=%q warnings=%v", block, warnings)
+	}
+	if _, warnings := g.Check("u1"); len(warnings) != 0 {
+		t.Errorf("warning should be sent once, got %v", warnings)
+	}
+
+	recordRun(g, "u1", now, 0, 0)
+	block, _ = g.Check("u1")
+	for _, want := range []string{"Daily quota reached: 5/5 runs", "resets at 00:00 UTC (in 9h00m)"} {
+		if !strings.Contains(block, want) {
+			t.Errorf("block %q missing %q", block, want)
+		}
+	}
+	if block, _ := g.Check("u2"); block != "" {
+		t.Errorf("other users are unaffected: %q", block)
+	}
+}
+
+func TestQuotaGate_TokensAndMinutes(t *testing.T) {
+	now := time.Date(2026, 10, 16, 15, 0, 0, 0, time.UTC)
+	g := newTestQuotaGate(t, QuotaConfig{Daily: QuotaLimits{Tokens: 1000, Minutes: 30}}, now)
+
+	recordRun(g, "u1", now, 500, 10*time.Minute)
+	if block, warnings := g.Check("u1"); block != "" || len(warnings) != 0 {
+		t.Fatalf("under both: block=%q warnings=%v", block, warnings)
+	}
+	recordRun(g, "u1", now, 100, 20*time.Minute)
+	if block, _ := g.Check("u1"); !strings.Contains(block, "30/30 minutes") {
+		t.Errorf("minutes should block: %q", block)
+	}
+
+	// Cache reads don't count toward the token quota
+	g.ledger.Record(UsageRecord{Timestamp: now.UnixMilli(), UserID: "u2", CacheReadTokens: 1_000_000, OutputTokens: 999})
+	if block, warnings := g.Check("u2"); block != "" || len(warnings) != 1 {
+		t.Errorf("cache reads counted: block=%q warnings=%v", block, warnings)
+	}
+}
+
+func TestQuotaGate_LatestResetWins(t *testing.T) {
+	now := time.Date(2026, 10, 16, 15, 0, 0, 0, time.UTC)
+	g := newTestQuotaGate(t, QuotaConfig{
+		Daily:   QuotaLimits{Runs: 1},
+		Monthly: QuotaLimits{Runs: 3},
+		Admins:  []string{"admin"},
+	}, now)
+	for i := 0; i < 3; i++ {
+		recordRun(g, "u1", now.AddDate(0, 0, -i), 0, 0)
+	}
+
+	block, _ := g.Check("u1")
+	for _, want := range []string{"Monthly quota reached: 3/3 runs", "on Sun Nov 1 at 00:00 UTC (in 15 days)", "/quota grant u1"} {
+		if !strings.Contains(block, want) {
+			t.Errorf("block %q missing %q", block, want)
+		}
+	}
+}
+
+func TestQuotaGate_Override(t *testing.T) {
+	now := time.Date(2026, 10, 16, 15, 0, 0, 0, time.UTC)
+	g := newTestQuotaGate(t, QuotaConfig{Daily: QuotaLimits{Runs: 1}, Admins: []string{"admin"}}, now)
+	recordRun(g, "u1", now, 0, 0)
+
+	if !g.IsAdmin("admin") || g.IsAdmin("u1") {
+		t.Error("admin list not applied")
+	}
+	if g.Revoke("u1") {
+		t.Error("revoke without an override should report false")
+	}
+	if until := g.Grant("u1", 30*24*time.Hour); !until.Equal(now.Add(maxQuotaGrant)) {
+		t.Errorf("grant should be capped at a week, got %v", until)
+	}
+	if block, _ := g.Check("u1"); block != "" {
+		t.Errorf("override should lift the quota: %q", block)
+	}
+	if status := g.Status("u1"); !strings.Contains(status, "1/1 runs") || !strings.Contains(status, "Override active until") {
+		t.Errorf("status: %q", status)
+	}
+	if !g.Revoke("u1") {
+		t.Error("revoke should end the active override")
+	}
+	if block, _ := g.Check("u1"); block == "" {
+		t.Error("quota should apply again after revoke")
+	}
+
+	g.Grant("u1", time.Hour)
+	g.now = func() time.Time { return now.Add(2 * time.Hour) }
+	if block, _ := g.Check("u1"); block == "" {
+		t.Error("expired override should not lift the quota")
+	}
+}
+
+func TestDescribeReset(t *testing.T) {
+	now := time.Date(2026, 10, 16, 22, 30, 0, 0, time.UTC)
+	if got, want := describeReset(time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC), now), "at 00:00 UTC (in 1h30m)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := describeReset(time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), now), "on Sun Nov 1 at 00:00 UTC (in 15 days)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// capacityError reports a run Claude refused for lack of capacity: the
+// subscription's usage limit, an API rate limit, or overload. Unlike other
+// failures these pass with time, so the bot defers the prompt and replays it.
+type capacityError struct {
+	Kind      string           // "usage limit", "rate limit" or "overloaded"
+	Detail    string           // what Claude said
+	ResetAt   time.Time        // when the limit lifts, if Claude said; zero otherwise
+	SessionID string           // session the run belonged to
+	Queued    []pendingMessage // messages that were waiting behind the failed run
+}
+
+func (e *capacityError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason(), e.Detail)
+}
+
+// Reason says what is wrong in a sentence fragment for the user.
+func (e *capacityError) Reason() string {
+	switch e.Kind {
+	case "usage limit":
+		return "Claude's usage limit is reached"
+	case "overloaded":
+		return "Claude is overloaded"
+	}
+	return "Claude is rate limited"
+}
+
+var (
+	// Older CLIs: "Claude AI usage limit reached|1760547600"
+	usageLimitEpochRe = regexp.MustCompile(`(?i)usage limit reached\|(\d{9,})`)
+	// Newer CLIs: "5-hour limit reached ∙ resets 3pm", "You've hit your limit
+	// · resets Oct 20, 2:30am (Europe/Berlin)"
+	usageLimitRe = regexp.MustCompile(`(?i)usage limit|limit reached|hit your limit|out of (?:extra )?usage`)
+	resetsAtRe   = regexp.MustCompile(`(?i)resets?\s+(?:at\s+)?(?:([a-z]{3})\s+(\d{1,2}),?\s+(?:at\s+)?)?(\d{1,2})(?::(\d{2}))?\s*([ap]m)?(?:\s*\(([^)]+)\))?`)
+	rateLimitRe  = regexp.MustCompile(`(?i)rate[_ ]limit|API Error: 429|too many requests`)
+	overloadRe   = regexp.MustCompile(`(?i)overloaded|API Error: 529`)
+)
+
+// detectCapacityError decides whether a failed run's output says Claude is out
+// of capacity. apiErrorType is the type of the last API error event, text is
+// stderr and the run's error messages. Times without a zone are read in loc.
+func detectCapacityError(apiErrorType, text string, now time.Time, loc *time.Location) *capacityError {
+	detail := strings.TrimSpace(text)
+	if i := strings.IndexByte(detail, '\n'); i >= 0 {
+		detail = detail[:i]
+	}
+	if m := usageLimitEpochRe.FindStringSubmatch(text); m != nil {
+		sec, _ := strconv.ParseInt(m[1], 10, 64)
+		return &capacityError{Kind: "usage limit", Detail: "usage limit reached", ResetAt: time.Unix(sec, 0)}
+	}
+	if usageLimitRe.MatchString(text) {
+		return &capacityError{Kind: "usage limit", Detail: detail, ResetAt: parseResetTime(text, now, loc)}
+	}
+	switch {
+	case apiErrorType == "overloaded_error" || overloadRe.MatchString(text):
+		return &capacityError{Kind: "overloaded", Detail: detail}
+	case apiErrorType == "rate_limit" || apiErrorType == "rate_limit_error" || rateLimitRe.MatchString(text):
+		return &capacityError{Kind: "rate limit", Detail: detail, ResetAt: parseResetTime(text, now, loc)}
+	}
+	return nil
+}
+
+// parseResetTime finds "resets 3pm", "resets 14:30" or "resets Oct 20, 3pm
+// (Europe/Berlin)" in text and returns the next such time after now, or the
+// zero time if there is none.
+func parseResetTime(text string, now time.Time, loc *time.Location) time.Time {
+	m := resetsAtRe.FindStringSubmatch(text)
+	if m == nil || (m[4] == "" && m[5] == "") {
+		return time.Time{}
+	}
+	if m[6] != "" {
+		if l, err := time.LoadLocation(m[6]); err == nil {
+			loc = l
+		}
+	}
+	hour, _ := strconv.Atoi(m[3])
+	minute, _ := strconv.Atoi(m[4])
+	if m[5] != "" {
+		if hour < 1 || hour > 12 {
+			return time.Time{}
+		}
+		hour %= 12
+		if strings.EqualFold(m[5], "pm") {
+			hour += 12
+		}
+	}
+	if hour > 23 || minute > 59 {
+		return time.Time{}
+	}
+
+	local := now.In(loc)
+	if m[1] != "" {
+		month, err := time.Parse("Jan", strings.ToUpper(m[1][:1])+strings.ToLower(m[1][1:]))
+		if err != nil {
+			return time.Time{}
+		}
+		day, _ := strconv.Atoi(m[2])
+		t := time.Date(local.Year(), month.Month(), day, hour, minute, 0, 0, loc)
+		if t.Before(now) {
+			t = t.AddDate(1, 0, 0)
+		}
+		return t
+	}
+	t := time.Date(local.Year(), local.Month(), local.Day(), hour, minute, 0, 0, loc)
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
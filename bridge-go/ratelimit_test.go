@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDetectCapacityError(t *testing.T) {
+	ny, _ := time.LoadLocation("America/New_York")
+	now := time.Date(2026, 10, 16, 13, 0, 0, 0, ny)
+	tests := []struct {
+		name    string
+		errType string
+		text    string
+		kind    string
+		resetAt time.Time
+	}{
+		{"epoch suffix", "", "Claude AI usage limit reached|1760640000", "usage limit", time.Unix(1760640000, 0)},
+		{"resets today", "rate_limit", "5-hour limit reached ∙ resets 3pm", "usage limit", time.Date(2026, 10, 16, 15, 0, 0, 0, ny)},
+		{"resets tomorrow", "", "You've hit your limit · resets 9:30am", "usage limit", time.Date(2026, 10, 17, 9, 30, 0, 0, ny)},
+		{"dated with zone", "", "Weekly limit reached ∙ resets Oct 20, 2am (Europe/Berlin)", "usage limit", time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)},
+		{"no reset time", "", "Claude usage limit reached.", "usage limit", time.Time{}},
+		{"API 429", "", `API Error: 429 {"type":"error","error":{"type":"rate_limit_error"}}`, "rate limit", time.Time{}},
+		{"rate limit type", "rate_limit_error", "Number of requests has exceeded your rate limit", "rate limit", time.Time{}},
+		{"overloaded type", "overloaded_error", "Overloaded", "overloaded", time.Time{}},
+		{"API 529", "", "API Error: 529", "overloaded", time.Time{}},
+		{"other failure", "", "Error: ENOENT: no such file", "", time.Time{}},
+		{"auth failure", "authentication_failed", "Invalid API key", "", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := detectCapacityError(tt.errType, tt.text, now, ny)
+			if tt.kind == "" {
+				if got != nil {
+					t.Fatalf("expected no capacity error, got %+v", got)
+				}
+				return
+			}
+			if got == nil || got.Kind != tt.kind {
+				t.Fatalf("got %+v, want kind %q", got, tt.kind)
+			}
+			if !got.ResetAt.Equal(tt.resetAt) {
+				t.Errorf("reset at %v, want %v", got.ResetAt, tt.resetAt)
+			}
+		})
+	}
+}
+
+func TestParseResetTime(t *testing.T) {
+	now := time.Date(2026, 12, 30, 22, 0, 0, 0, time.UTC)
+	tests := []struct {
+		text string
+		want time.Time
+	}{
+		{"resets 14:30", time.Date(2026, 12, 31, 14, 30, 0, 0, time.UTC)},
+		{"resets at 11pm", time.Date(2026, 12, 30, 23, 0, 0, 0, time.UTC)},
+		{"resets 12am", time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)},
+		{"resets Jan 2, 5am", time.Date(2027, 1, 2, 5, 0, 0, 0, time.UTC)},
+		{"resets 3", time.Time{}},
+		{"resets 13pm", time.Time{}},
+		{"no time here", time.Time{}},
+	}
+	for _, tt := range tests {
+		if got := parseResetTime(tt.text, now, time.UTC); !got.Equal(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSendMessage_FakeRunner_CapacityError(t *testing.T) {
+	hold := make(chan struct{})
+	sm, _ := newFakeRunnerManager(t,
+		fakeRun{
+			lines: []string{
+				systemLine("claude-1"),
+				`{"type":"assistant","error":"rate_limit","message":{"content":[{"type":"text","text":"Claude AI usage limit reached|1760640000"}]}}`,
+				`{"type":"result","subtype":"success","is_error":true,"result":"Claude AI usage limit reached|1760640000"}`,
+			},
+			hold: hold,
+		},
+		fakeRun{lines: []string{`{"type":"result","subtype":"success","is_error":true,"result":"API Error: 529 Overloaded"}`}},
+	)
+
+	done := startHeldRun(t, sm, "long task")
+	sm.SendMessage("user1", "also this", nil, nil)
+	close(hold)
+
+	out := <-done
+	var capErr *capacityError
+	if !errors.As(out.err, &capErr) || capErr.Kind != "usage limit" || !capErr.ResetAt.Equal(time.Unix(1760640000, 0)) {
+		t.Fatalf("expected a usage limit error, got %v", out.err)
+	}
+	if capErr.SessionID != sm.GetSession("user1").ID || len(capErr.Queued) != 1 || capErr.Queued[0].Text != "also this" {
+		t.Errorf("queued messages should come back with the error: %+v", capErr)
+	}
+	if s := sm.GetSession("user1"); s.Status != "active" || s.ClaudeSessionID != "claude-1" {
+		t.Errorf("session should stay resumable: %+v", s)
+	}
+
+	// A clean exit with a failed result still counts
+	_, err := sm.SendMessage("user1", "again", nil, nil)
+	if !errors.As(err, &capErr) || capErr.Kind != "overloaded" {
+		t.Errorf("expected overloaded, got %v", err)
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	sm, _ := newFakeRunnerManager(t)
+	s := sm.CreateSession("user1", "user1")
+	s.pending = []pendingMessage{{Text: "newer"}}
+
+	id, err := sm.Requeue("user1", s.ID, []pendingMessage{{Text: "older"}})
+	if err != nil || id != s.ID {
+		t.Fatalf("requeue: %q %v", id, err)
+	}
+	if len(s.pending) != 2 || s.pending[0].Text != "older" {
+		t.Errorf("requeued messages should go first: %+v", s.pending)
+	}
+
+	// An ended session falls back to the active one
+	if id, _ := sm.Requeue("user1", "gone", nil); id != s.ID {
+		t.Errorf("fallback session = %q", id)
+	}
+	if id, err := sm.Requeue("user2", "gone", nil); err != nil || id == "" || sm.GetSession("user2") == nil {
+		t.Errorf("a user without sessions should get a new one: %q %v", id, err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ClaudeRunner starts Claude for one message. The exec implementation runs
+// the claude CLI; tests substitute a fake that replays scripted stream-json.
+type ClaudeRunner interface {
+	// Run returns once Claude has started. The run stops when ctx is done.
+	Run(ctx context.Context, req RunRequest) (*ClaudeRun, error)
+}
+
+// RunRequest describes one Claude invocation.
+type RunRequest struct {
+	Args    []string // CLI arguments after the binary
+	Stdin   []byte   // stream-json input; nil when the prompt is in Args
+	WorkDir string
+	Name    string // short label for logs and the run's cgroup
+	Limits  LimitsConfig
+}
+
+// ClaudeRun is a started Claude invocation. Events delivers each stream-json
+// event from stdout and is closed when the output ends; Wait then returns how
+// the run finished.
+type ClaudeRun struct {
+	Events <-chan *StreamEvent
+	wait   func() *RunResult
+}
+
+// Wait blocks until the run has exited. Drain Events first.
+func (r *ClaudeRun) Wait() *RunResult {
+	return r.wait()
+}
+
+// RunResult is how a run ended.
+type RunResult struct {
+	ExitErr error       // non-nil if Claude failed or was killed
+	Stderr  string      // Claude's stderr, for error messages
+	Breach  *limitError // set when a resource limit stopped the run
+}
+
+// claudeBinary resolves the claude CLI: CLAUDE_PATH, or ~/.local/bin/claude.
+func claudeBinary() string {
+	claudePath := os.Getenv("CLAUDE_PATH")
+	if claudePath == "" {
+		home, _ := os.UserHomeDir()
+		claudePath = filepath.Join(home, ".local/bin/claude")
+	}
+	if resolved, err := filepath.EvalSymlinks(claudePath); err == nil {
+		claudePath = resolved
+	}
+	return claudePath
+}
+
+// execRunner runs the claude CLI as a subprocess: optionally as an
+// unprivileged user, in its own process group, under the request's limits.
+type execRunner struct {
+	credential *syscall.Credential // nil = run as current user
+	killGrace  time.Duration       // SIGTERM -> SIGKILL delay for a cancelled run's process group
+	cgroups    *runCgroups         // nil = rlimits only
+}
+
+func newExecRunner(cred *syscall.Credential) *execRunner {
+	return &execRunner{credential: cred, killGrace: defaultKillGrace}
+}
+
+// env inherits the bridge's environment, overriding HOME when Claude runs as
+// the unprivileged user so it finds its config under that user's home.
+func (r *execRunner) env() []string {
+	env := os.Environ()
+	if r.credential == nil {
+		return env
+	}
+	claudeHome := os.Getenv("CLAUDE_USER_HOME")
+	if claudeHome == "" {
+		claudeHome = "/home/pai"
+	}
+	filtered := make([]string, 0, len(env))
+	for _, e := range env {
+		if !strings.HasPrefix(e, "HOME=") {
+			filtered = append(filtered, e)
+		}
+	}
+	return append(filtered, "HOME="+claudeHome)
+}
+
+func (r *execRunner) Run(ctx context.Context, req RunRequest) (*ClaudeRun, error) {
+	// The output cap stops the run through its own cancel
+	ctx, cancel := context.WithCancel(ctx)
+
+	cmd := exec.CommandContext(ctx, claudeBinary(), req.Args...)
+	cmd.Dir = req.WorkDir
+	cmd.Env = r.env()
+	if r.credential != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: r.credential,
+		}
+	}
+	runInProcessGroup(cmd, r.killGrace)
+	if req.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(req.Stdin)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	var cg *runCgroup
+	if r.cgroups != nil {
+		name := req.Name + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+		if cg, err = r.cgroups.create(name, req.Limits.MemoryMB, req.Limits.Processes); err != nil {
+			log.Printf("[PAI Bridge] Running without a cgroup: %v", err)
+			cg = nil
+		} else {
+			cg.attach(cmd)
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		if cg != nil {
+			cg.remove()
+		}
+		return nil, err
+	}
+	if err := applyRlimits(cmd.Process.Pid, req.Limits.rlimits(r.credential != nil)); err != nil {
+		log.Printf("[PAI Bridge] Failed to apply rlimits: %v", err)
+	}
+
+	events := make(chan *StreamEvent, 16)
+	done := make(chan *RunResult, 1)
+	go func() {
+		defer cancel()
+
+		output := &cappedReader{r: stdout, limit: math.MaxInt64}
+		if req.Limits.OutputMB > 0 {
+			output.limit = int64(req.Limits.OutputMB) << 20
+		}
+		if err := decodeStream(output, events); err != nil {
+			log.Printf("[PAI Bridge] Reading Claude output for run %s: %v", req.Name, err)
+		}
+		close(events)
+
+		if output.exceeded {
+			log.Printf("[PAI Bridge] Output limit reached for run %s, stopping it", req.Name)
+			cancel()
+		}
+
+		stderrScanner := bufio.NewScanner(stderr)
+		var stderrBuf strings.Builder
+		for stderrScanner.Scan() {
+			stderrBuf.WriteString(stderrScanner.Text())
+			stderrBuf.WriteString("\n")
+		}
+
+		exitErr := cmd.Wait()
+		if ctx.Err() != nil {
+			// Cancelled, timed out or over a limit: make sure nothing from
+			// the run survives
+			reapProcessGroup(cmd)
+		}
+		result := &RunResult{
+			ExitErr: exitErr,
+			Stderr:  stderrBuf.String(),
+			Breach:  runBreach(req.Limits, output.exceeded, cg, exitErr),
+		}
+		if cg != nil {
+			// Also stops anything the run left behind in its cgroup
+			cg.remove()
+		}
+		done <- result
+	}()
+
+	return &ClaudeRun{
+		Events: events,
+		wait:   func() *RunResult { return <-done },
+	}, nil
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRunner replays scripted stream-json instead of running claude. Each
+// Run consumes the next script and records its request.
+type fakeRunner struct {
+	mu      sync.Mutex
+	scripts []fakeRun
+	reqs    []RunRequest
+}
+
+type fakeRun struct {
+	lines   []string // stream-json written to stdout
+	stderr  string
+	exitErr error
+	breach  *limitError
+	hold    chan struct{} // if set, the run stays open after its lines until closed or ctx ends
+}
+
+func (f *fakeRunner) Run(ctx context.Context, req RunRequest) (*ClaudeRun, error) {
+	f.mu.Lock()
+	f.reqs = append(f.reqs, req)
+	if len(f.scripts) == 0 {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("no scripted run left")
+	}
+	script := f.scripts[0]
+	f.scripts = f.scripts[1:]
+	f.mu.Unlock()
+
+	events := make(chan *StreamEvent)
+	done := make(chan *RunResult, 1)
+	go func() {
+		for _, line := range script.lines {
+			events <- parseStreamLine(line)
+		}
+		close(events)
+		res := &RunResult{ExitErr: script.exitErr, Stderr: script.stderr, Breach: script.breach}
+		if script.hold != nil {
+			select {
+			case <-script.hold:
+			case <-ctx.Done():
+				res.ExitErr = errors.New("signal: terminated")
+			}
+		}
+		done <- res
+	}()
+	return &ClaudeRun{Events: events, wait: func() *RunResult { return <-done }}, nil
+}
+
+func (f *fakeRunner) requests() []RunRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]RunRequest(nil), f.reqs...)
+}
+
+func parseStreamLine(line string) *StreamEvent {
+	event, err := decodeStreamEvent([]byte(line))
+	if err != nil {
+		panic(err)
+	}
+	return event
+}
+
+func systemLine(sessionID string) string {
+	return fmt.Sprintf(`{"type":"system","subtype":"init","session_id":%q}`, sessionID)
+}
+
+func textLine(text string) string {
+	return fmt.Sprintf(`{"type":"assistant","message":{"content":[{"type":"text","text":%q}]}}`, text)
+}
+
+func newFakeRunnerManager(t *testing.T, scripts ...fakeRun) (*SessionManager, *fakeRunner) {
+	t.Helper()
+	runner := &fakeRunner{scripts: scripts}
+	sm := newTestSessionManager()
+	sm.stateDir = t.TempDir()
+	sm.runner = runner
+	return sm, runner
+}
+
+func hasArgs(args []string, want ...string) bool {
+	for i := 0; i+len(want) <= len(args); i++ {
+		match := true
+		for j, w := range want {
+			if args[i+j] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSendMessage_FakeRunner_ReplyAndCallbacks(t *testing.T) {
+	sm, runner := newFakeRunnerManager(t, fakeRun{lines: []string{
+		systemLine("claude-1"),
+		textLine("Hello "),
+		`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"tu1","name":"Write","input":{"file_path":"/tmp/out.txt"}}]}}`,
+		`{"type":"user","message":{"content":[{"type":"tool_result","tool_use_id":"tu1"}]}}`,
+		textLine("there"),
+		`{"type":"result","result":"Hello there"}`,
+	}})
+
+	var started string
+	var tools []string
+	stream := &StreamCallbacks{
+		OnStart:   func(id string) { started = id },
+		OnToolUse: func(id, name string, _ map[string]interface{}) { tools = append(tools, name) },
+	}
+	result, err := sm.SendMessage("user1", "hi", nil, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Text != "Hello there" {
+		t.Errorf("text = %q", result.Text)
+	}
+	if started != result.SessionID || len(tools) != 1 || tools[0] != "Write" {
+		t.Errorf("callbacks: started=%q tools=%v", started, tools)
+	}
+	if len(result.CreatedFiles) != 1 || result.CreatedFiles[0] != "/tmp/out.txt" {
+		t.Errorf("created files = %v", result.CreatedFiles)
+	}
+
+	req := runner.requests()[0]
+	if req.WorkDir != "/tmp" || !hasArgs(req.Args, "--model", "test-model") || hasArgs(req.Args, "--resume") {
+		t.Errorf("first run request: %+v", req)
+	}
+	if req.Stdin != nil {
+		t.Error("a text message should not use stream-json input")
+	}
+	if s := sm.GetSession("user1"); s.ClaudeSessionID != "claude-1" || s.Status != "active" {
+		t.Errorf("session after run: %+v", s)
+	}
+}
+
+func TestSendMessage_FakeRunner_Resume(t *testing.T) {
+	sm, runner := newFakeRunnerManager(t,
+		fakeRun{lines: []string{systemLine("claude-1"), textLine("one")}},
+		fakeRun{lines: []string{systemLine("claude-1"), textLine("two")}},
+	)
+	if _, err := sm.SendMessage("user1", "first", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.SendMessage("user1", "second", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := runner.requests()
+	if !strings.HasSuffix(reqs[0].Args[1], "first") || reqs[0].Args[1] == "first" {
+		t.Errorf("first message should carry the bridge preamble: %q", reqs[0].Args[1])
+	}
+	if reqs[1].Args[1] != "second" || !hasArgs(reqs[1].Args, "--resume", "claude-1") {
+		t.Errorf("second run should resume without the preamble: %v", reqs[1].Args)
+	}
+}
+
+func TestSendMessage_FakeRunner_ExpiredSession(t *testing.T) {
+	sm, runner := newFakeRunnerManager(t,
+		fakeRun{lines: []string{systemLine("claude-old")}},
+		fakeRun{stderr: "Error: Could not find session claude-old\n", exitErr: errors.New("exit status 1")},
+		fakeRun{lines: []string{systemLine("claude-new"), textLine("fresh")}},
+	)
+	if _, err := sm.SendMessage("user1", "first", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := sm.SendMessage("user1", "second", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "Session expired") {
+		t.Fatalf("expected a session-expired error, got %v", err)
+	}
+	if s := sm.GetSession("user1"); s.ClaudeSessionID != "" || s.Status != "active" {
+		t.Errorf("expired Claude session should be cleared: %+v", s)
+	}
+
+	result, err := sm.SendMessage("user1", "again", nil, nil)
+	if err != nil || result.Text != "fresh" {
+		t.Fatalf("retry: %v %+v", err, result)
+	}
+	if reqs := runner.requests(); hasArgs(reqs[2].Args, "--resume") {
+		t.Errorf("retry should start a new Claude session: %v", reqs[2].Args)
+	}
+	if s := sm.GetSession("user1"); s.ClaudeSessionID != "claude-new" {
+		t.Errorf("new Claude session not captured: %+v", s)
+	}
+}
+
+func TestSendMessage_FakeRunner_ExitError(t *testing.T) {
+	sm, _ := newFakeRunnerManager(t,
+		fakeRun{stderr: "boom\n", exitErr: errors.New("exit status 1")},
+		fakeRun{exitErr: errors.New("signal: killed")},
+		fakeRun{
+			lines: []string{
+				`{"type":"error","error":{"type":"api_error","message":"Internal server error"}}`,
+				`{"type":"result","subtype":"error_during_execution","is_error":true}`,
+			},
+			exitErr: errors.New("exit status 1"),
+		},
+	)
+	if _, err := sm.SendMessage("user1", "x", nil, nil); err == nil || err.Error() != "Claude exited: boom" {
+		t.Errorf("stderr failure: %v", err)
+	}
+	if _, err := sm.SendMessage("user1", "y", nil, nil); err == nil || err.Error() != "claude subprocess failed" {
+		t.Errorf("silent failure: %v", err)
+	}
+	if _, err := sm.SendMessage("user1", "z", nil, nil); err == nil || err.Error() != "Claude exited: Internal server error" {
+		t.Errorf("failure reported in the stream: %v", err)
+	}
+}
+
+type runOutcome struct {
+	result *MessageResult
+	err    error
+}
+
+// startHeldRun sends a message whose run stays open, and returns once the
+// run has started along with a channel for its outcome.
+func startHeldRun(t *testing.T, sm *SessionManager, text string) <-chan runOutcome {
+	t.Helper()
+	started := make(chan struct{})
+	done := make(chan runOutcome, 1)
+	go func() {
+		r, err := sm.SendMessage("user1", text, nil, &StreamCallbacks{OnStart: func(string) { close(started) }})
+		done <- runOutcome{r, err}
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not start")
+	}
+	return done
+}
+
+func TestSendMessage_FakeRunner_QueuedFollowUp(t *testing.T) {
+	hold := make(chan struct{})
+	sm, runner := newFakeRunnerManager(t, fakeRun{lines: []string{systemLine("claude-1"), textLine("done")}, hold: hold})
+
+	done := startHeldRun(t, sm, "long task")
+
+	for i, text := range []string{"also this", "and that"} {
+		r, err := sm.SendMessage("user1", text, nil, nil)
+		if err != nil || r.Queued != i+1 {
+			t.Fatalf("queue %q: %+v %v", text, r, err)
+		}
+	}
+	close(hold)
+
+	out := <-done
+	if out.err != nil {
+		t.Fatal(out.err)
+	}
+	fu := out.result.FollowUp
+	if fu == nil || fu.Count != 2 || !strings.Contains(fu.Text, "also this") || !strings.Contains(fu.Text, "and that") {
+		t.Fatalf("follow-up: %+v", fu)
+	}
+	if len(runner.requests()) != 1 {
+		t.Error("queued messages must not start runs of their own")
+	}
+	if s := sm.GetSession("user1"); s.pendingCount() != 0 || s.Status != "active" {
+		t.Errorf("queue should be handed over: %+v", s)
+	}
+}
+
+func TestSendMessage_FakeRunner_Timeout(t *testing.T) {
+	sm, _ := newFakeRunnerManager(t, fakeRun{lines: []string{systemLine("claude-1")}, hold: make(chan struct{})})
+	sm.runTimeout = 50 * time.Millisecond
+
+	done := startHeldRun(t, sm, "slow")
+	sm.SendMessage("user1", "queued", nil, nil)
+
+	var out runOutcome
+	select {
+	case out = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not time out")
+	}
+	var le *limitError
+	if !errors.As(out.err, &le) || le.Limit != "time" {
+		t.Fatalf("expected a time limit error, got %v", out.err)
+	}
+	s := sm.GetSession("user1")
+	if s.Status != "active" || s.ClaudeSessionID != "claude-1" || s.pendingCount() != 0 {
+		t.Errorf("after timeout: %+v", s)
+	}
+}
+
+func TestSendMessage_FakeRunner_BreachDropsQueue(t *testing.T) {
+	sm, _ := newFakeRunnerManager(t, fakeRun{
+		exitErr: errors.New("signal: killed"),
+		breach:  &limitError{"memory", "2048 MB"},
+	})
+	_, err := sm.SendMessage("user1", "big", nil, nil)
+	var le *limitError
+	if !errors.As(err, &le) || le.Limit != "memory" {
+		t.Fatalf("expected a memory limit error, got %v", err)
+	}
+}
+
+func TestSendMessage_FakeRunner_BinaryAttachment(t *testing.T) {
+	sm, runner := newFakeRunnerManager(t, fakeRun{lines: []string{textLine("a cat")}})
+	att := &Attachment{Type: "image", MimeType: "image/png", Base64: "aGVsbG8="}
+	if _, err := sm.SendMessage("user1", "", []*Attachment{att}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	req := runner.requests()[0]
+	if !hasArgs(req.Args, "--input-format", "stream-json") {
+		t.Errorf("args: %v", req.Args)
+	}
+	var msg struct {
+		Type    string `json:"type"`
+		Message struct {
+			Content []struct {
+				Type   string            `json:"type"`
+				Text   string            `json:"text"`
+				Source map[string]string `json:"source"`
+			} `json:"content"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(req.Stdin, &msg); err != nil {
+		t.Fatal(err)
+	}
+	content := msg.Message.Content
+	if msg.Type != "user" || len(content) != 2 || content[0].Type != "image" || content[0].Source["data"] != "aGVsbG8=" || content[1].Type != "text" {
+		t.Fatalf("stdin message: %s", req.Stdin)
+	}
+}
+
+func TestSendMessage_FakeRunner_FollowUpKeepsEveryAttachment(t *testing.T) {
+	hold := make(chan struct{})
+	sm, runner := newFakeRunnerManager(t,
+		fakeRun{lines: []string{systemLine("claude-1")}, hold: hold},
+		fakeRun{lines: []string{textLine("two screenshots")}},
+	)
+	done := startHeldRun(t, sm, "long task")
+	for _, data := range []string{"b25l", "dHdv"} {
+		sm.SendMessage("user1", "", []*Attachment{{Type: "image", MimeType: "image/png", Base64: data}}, nil)
+	}
+	close(hold)
+	fu := (<-done).result.FollowUp
+	if fu == nil || len(fu.Attachments) != 2 {
+		t.Fatalf("follow-up: %+v", fu)
+	}
+	if _, err := sm.SendToSession(sm.GetSession("user1").ID, fu.Text, fu.Attachments, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg struct {
+		Message struct {
+			Content []struct {
+				Type   string            `json:"type"`
+				Text   string            `json:"text"`
+				Source map[string]string `json:"source"`
+			} `json:"content"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(runner.requests()[1].Stdin, &msg); err != nil {
+		t.Fatal(err)
+	}
+	c := msg.Message.Content
+	if len(c) != 5 || c[0].Text != "[Attachment from follow-up message 1/2, image]" || c[1].Source["data"] != "b25l" ||
+		c[2].Text != "[Attachment from follow-up message 2/2, image]" || c[3].Source["data"] != "dHdv" || c[4].Type != "text" {
+		t.Fatalf("stdin content: %+v", c)
+	}
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -20,6 +21,7 @@ import (
 
 type Session struct {
 	ID              string `json:"id"`
+	Name            string `json:"name"`
 	UserID          string `json:"userId"`
 	ChatID          string `json:"chatId"`
 	WorkDir         string `json:"workDir"`
@@ -30,55 +32,116 @@ type Session struct {
 	Status          string `json:"status"`
 	ClaudeSessionID string `json:"claudeSessionId,omitempty"`
 
+	// cancelled is set by CancelRun so the run's exit is reported as a
+	// cancellation rather than a failure. interruptionID is the queued
+	// message that cancelled it to go next, if it was interrupted. Guarded
+	// by SessionManager.mu.
+	cancelled      bool
+	interruptionID string
+
 	// pendingMu guards the pending message queue. Messages arriving while
 	// the session is busy are appended here and drained as a single batch
 	// once the active Claude subprocess finishes.
 	pendingMu sync.Mutex
 	pending   []pendingMessage
+
+	// queueDir mirrors pending and inflight to disk (see queue.go); empty
+	// for sessions that aren't persisted. inflight is the prompt of the run
+	// in progress, and interrupted the one a restart cut short, until the
+	// user retries or dismisses it. Both are guarded by pendingMu.
+	queueDir    string
+	inflight    *pendingMessage
+	interrupted *pendingMessage
 }
 
 type pendingMessage struct {
-	Text       string
-	Attachment *Attachment
+	ID          string        `json:"id,omitempty"`
+	Text        string        `json:"text"`
+	Attachments []*Attachment `json:"attachments,omitempty"`
 }
 
 type Attachment struct {
-	Type        string // "image", "document", "text-file"
-	Base64      string
-	MimeType    string
-	FileName    string
-	TextContent string
+	Type        string `json:"type"` // "image", "document", "text-file", "file" (saved to the session inbox)
+	Base64      string `json:"base64,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
+	FileName    string `json:"fileName,omitempty"`
+	TextContent string `json:"textContent,omitempty"`
+	Label       string `json:"label,omitempty"` // which message of a batch it came with, shown to Claude
+	Spill       string `json:"spill,omitempty"` // file holding Base64 while the attachment is on disk
 }
 
+// maxBatchAttachmentBytes caps the decoded size of the binary attachments sent
+// with one run. Base64 adds a third, which keeps the request under the API's
+// 32 MB limit.
+const maxBatchAttachmentBytes = 20 << 20
+
 type MessageResult struct {
+	SessionID    string // session that handled (or queued) the message
 	Text         string
 	CreatedFiles []string
 	Queued       int       // >0 means message was queued; value = queue depth
+	QueuedID     string    // ID of the queued message
 	FollowUp     *FollowUp // non-nil when queued messages need processing after this response
+	Cancelled    bool      // the run was stopped with /cancel; Text is the partial output
+	Interrupted  bool      // the run was cancelled by a message that is now the FollowUp
 }
 
 // FollowUp carries batched queued messages back to the bot layer so it can
 // deliver the first response to Telegram before starting the next Claude run.
 type FollowUp struct {
-	Text       string
-	Attachment *Attachment
-	Count      int // number of queued messages in this batch
+	Text        string
+	Attachments []*Attachment
+	Count       int // number of queued messages in this batch
+
+	held *pendingMessage // the session's in-flight record of this batch
+}
+
+// StreamCallbacks lets the bot layer observe a Claude run while it is in
+// progress. Callbacks are invoked synchronously from the stdout reader, so
+// they must not block. Any field may be nil.
+type StreamCallbacks struct {
+	OnStart      func(sessionID string)                              // subprocess started (not called for queued messages)
+	OnText       func(chunk string)                                  // text block from an assistant event
+	OnToolUse    func(id, name string, input map[string]interface{}) // tool_use block from an assistant event
+	OnToolResult func(id string, isError bool)                       // tool_result block from a user event
+}
+
+// runTools attaches bridge-provided tools (the embedded MCP server) to a
+// Claude run. Register returns extra CLI args and a release func for when the
+// run ends. ChatTools reports whether send_file and friends are offered, which
+// decides how the bridge context teaches Claude to deliver files.
+type runTools interface {
+	Register(userID, chatID, sessionID string) ([]string, func())
+	ChatTools() bool
+	ForgetSession(sessionID string) // drops "always allow" grants
 }
 
 const maxPendingMessages = 20
 
+// defaultSessionName is used for the session created implicitly by a user's
+// first message.
+const defaultSessionName = "main"
+
+var sessionNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
 type SessionManager struct {
-	mu              sync.RWMutex
-	sessions        map[string]*Session
-	procs           map[string]context.CancelFunc
-	config          *Config
-	stateDir        string
-	memory          *MemoryManager
-	resetLocation   *time.Location
-	claudeCredential *syscall.Credential // nil = run as current user
+	mu            sync.RWMutex
+	sessions      map[string]*Session // keyed by session ID
+	active        map[string]string   // userID -> ID of the session new messages go to
+	recentDirs    map[string][]string // userID -> directories from /cd, most recent first
+	procs         map[string]context.CancelFunc
+	config        *Config
+	stateDir      string
+	memory        *MemoryManager
+	resetLocation *time.Location
+	runner        ClaudeRunner
+	runTimeout    time.Duration       // per-message limit on a Claude run
+	tools         runTools            // nil = no bridge MCP tools
+	usage         *UsageLedger        // nil = usage not recorded
+	inboxOwner    *syscall.Credential // owner of files saved to session inboxes; nil = the bridge's own user
 }
 
-func NewSessionManager(cfg *Config, memory *MemoryManager, cred *syscall.Credential) *SessionManager {
+func NewSessionManager(cfg *Config, memory *MemoryManager, runner ClaudeRunner) *SessionManager {
 	home, _ := os.UserHomeDir()
 	paiDir := os.Getenv("PAI_DIR")
 	if paiDir == "" {
@@ -93,18 +156,30 @@ func NewSessionManager(cfg *Config, memory *MemoryManager, cred *syscall.Credent
 	}
 
 	sm := &SessionManager{
-		sessions:         make(map[string]*Session),
-		procs:            make(map[string]context.CancelFunc),
-		config:           cfg,
-		stateDir:         stateDir,
-		memory:           memory,
-		resetLocation:    loc,
-		claudeCredential: cred,
+		sessions:      make(map[string]*Session),
+		active:        make(map[string]string),
+		recentDirs:    make(map[string][]string),
+		procs:         make(map[string]context.CancelFunc),
+		config:        cfg,
+		stateDir:      stateDir,
+		memory:        memory,
+		resetLocation: loc,
+		runner:        runner,
+		runTimeout:    time.Duration(cfg.Sessions.SubprocessTimeoutMin) * time.Minute,
 	}
 	sm.loadFromDisk()
 	return sm
 }
 
+// sessionsFile is the on-disk shape of sessions.json. Files written before
+// named sessions existed hold a bare array with one session per user; those
+// load as each user's active "main" session.
+type sessionsFile struct {
+	Sessions   []*Session          `json:"sessions"`
+	Active     map[string]string   `json:"active"` // userID -> session ID
+	RecentDirs map[string][]string `json:"recentDirs,omitempty"`
+}
+
 func (sm *SessionManager) loadFromDisk() {
 	path := filepath.Join(sm.stateDir, "sessions.json")
 	data, err := os.ReadFile(path)
@@ -112,28 +187,71 @@ func (sm *SessionManager) loadFromDisk() {
 		return
 	}
 
-	var sessions []*Session
-	if err := json.Unmarshal(data, &sessions); err != nil {
-		return
+	var file sessionsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		var legacy []*Session
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return
+		}
+		file.Sessions = legacy
+		file.Active = make(map[string]string)
+		for _, s := range legacy {
+			file.Active[s.UserID] = s.ID
+		}
 	}
 
-	for _, s := range sessions {
+	for _, s := range file.Sessions {
 		s.Status = "active"
-		sm.sessions[s.UserID] = s
+		if s.Name == "" {
+			s.Name = defaultSessionName
+		}
+		s.queueDir = sm.queueDir(s.ID)
+		s.loadQueue()
+		sm.sessions[s.ID] = s
+	}
+	sm.removeOrphanQueues()
+	for userID, id := range file.Active {
+		if _, ok := sm.sessions[id]; ok {
+			sm.active[userID] = id
+		}
+	}
+	for userID, dirs := range file.RecentDirs {
+		sm.recentDirs[userID] = dirs
+	}
+	log.Printf("[PAI Bridge] Loaded %d session(s) from disk.", len(file.Sessions))
+}
+
+// queueDir is where a session's queue is persisted.
+func (sm *SessionManager) queueDir(sessionID string) string {
+	return filepath.Join(sm.stateDir, "queue", sessionID)
+}
+
+// removeOrphanQueues deletes queue dirs of sessions that no longer exist.
+// Caller must hold sm.mu or be loading.
+func (sm *SessionManager) removeOrphanQueues() {
+	entries, err := os.ReadDir(filepath.Join(sm.stateDir, "queue"))
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if _, ok := sm.sessions[e.Name()]; !ok {
+			os.RemoveAll(filepath.Join(sm.stateDir, "queue", e.Name()))
+		}
 	}
-	log.Printf("[PAI Bridge] Loaded %d session(s) from disk.", len(sessions))
 }
 
+// saveToDisk persists all sessions. Caller must hold sm.mu.
 func (sm *SessionManager) saveToDisk() {
 	os.MkdirAll(sm.stateDir, 0755)
 	path := filepath.Join(sm.stateDir, "sessions.json")
 
-	var sessions []*Session
+	file := sessionsFile{Active: sm.active, RecentDirs: sm.recentDirs}
 	for _, s := range sm.sessions {
-		sessions = append(sessions, s)
+		file.Sessions = append(file.Sessions, s)
 	}
+	sort.Slice(file.Sessions, func(i, j int) bool { return file.Sessions[i].CreatedAt < file.Sessions[j].CreatedAt })
 
-	data, err := json.MarshalIndent(sessions, "", "  ")
+	data, err := json.MarshalIndent(file, "", "  ")
 	if err != nil {
 		log.Printf("[PAI Bridge] Failed to marshal sessions: %v", err)
 		return
@@ -141,31 +259,75 @@ func (sm *SessionManager) saveToDisk() {
 	os.WriteFile(path, data, 0644)
 }
 
-func (sm *SessionManager) CanCreate() bool {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
+// putSession adds a session and makes it the user's active one. Caller must
+// hold sm.mu.
+func (sm *SessionManager) putSession(s *Session) {
+	sm.sessions[s.ID] = s
+	sm.active[s.UserID] = s.ID
+}
+
+// activeSession returns the session the user's messages go to, or nil.
+// Caller must hold sm.mu.
+func (sm *SessionManager) activeSession(userID string) *Session {
+	return sm.sessions[sm.active[userID]]
+}
+
+// userSessions returns the user's sessions, oldest first. Caller must hold sm.mu.
+func (sm *SessionManager) userSessions(userID string) []*Session {
+	var out []*Session
+	for _, s := range sm.sessions {
+		if s.UserID == userID {
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt < out[j].CreatedAt })
+	return out
+}
+
+// findSession returns the user's session with the given name. Caller must
+// hold sm.mu.
+func (sm *SessionManager) findSession(userID, name string) *Session {
+	for _, s := range sm.sessions {
+		if s.UserID == userID && s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
 
-	active := 0
+// runningLocked counts sessions with a Claude run in progress, across all
+// users. Caller must hold sm.mu.
+func (sm *SessionManager) runningLocked() int {
+	n := 0
 	for _, s := range sm.sessions {
-		if s.Status != "idle" {
-			active++
+		if s.Status == "busy" {
+			n++
 		}
 	}
-	return active < sm.config.Sessions.MaxConcurrent
+	return n
 }
 
+// GetSession returns the user's active session, or nil.
 func (sm *SessionManager) GetSession(userID string) *Session {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
-	return sm.sessions[userID]
+	return sm.activeSession(userID)
 }
 
-func (sm *SessionManager) CreateSession(userID, chatID string) *Session {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+// ListSessions returns the user's sessions, oldest first, and the ID of the
+// active one.
+func (sm *SessionManager) ListSessions(userID string) ([]*Session, string) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.userSessions(userID), sm.active[userID]
+}
 
+// newSessionLocked builds a session with the configured defaults and makes it
+// the user's active session. Caller must hold sm.mu.
+func (sm *SessionManager) newSessionLocked(userID, chatID, name string) *Session {
 	s := &Session{
 		ID:             uuid.New().String(),
+		Name:           name,
 		UserID:         userID,
 		ChatID:         chatID,
 		WorkDir:        sm.config.Sessions.DefaultWorkDir,
@@ -175,16 +337,193 @@ func (sm *SessionManager) CreateSession(userID, chatID string) *Session {
 		MessageCount:   0,
 		Status:         "active",
 	}
-	sm.sessions[userID] = s
+	s.queueDir = sm.queueDir(s.ID)
+	sm.putSession(s)
+	return s
+}
+
+// nextSessionName picks "main", then "chat2", "chat3", ... for sessions
+// created without a name. Caller must hold sm.mu.
+func (sm *SessionManager) nextSessionName(userID string) string {
+	name := defaultSessionName
+	for i := 2; sm.findSession(userID, name) != nil; i++ {
+		name = fmt.Sprintf("chat%d", i)
+	}
+	return name
+}
+
+func (sm *SessionManager) CreateSession(userID, chatID string) *Session {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	s := sm.newSessionLocked(userID, chatID, sm.nextSessionName(userID))
 	sm.saveToDisk()
 	return s
 }
 
-func (sm *SessionManager) KillSession(userID string) bool {
+// NewNamedSession creates a session and switches the user to it. An empty
+// name picks the next free default name. The user's other sessions keep
+// their Claude conversations.
+func (sm *SessionManager) NewNamedSession(userID, chatID, name string) (*Session, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name != "" && !sessionNameRe.MatchString(name) {
+		return nil, fmt.Errorf("session names are 1-32 characters: lowercase letters, digits, - and _")
+	}
+
 	sm.mu.Lock()
+	defer sm.mu.Unlock()
 
-	s, ok := sm.sessions[userID]
-	if !ok {
+	if name != "" && sm.findSession(userID, name) != nil {
+		return nil, fmt.Errorf("you already have a session named %q — use /switch %s", name, name)
+	}
+	if limit := sm.config.Sessions.MaxPerUser; limit > 0 && len(sm.userSessions(userID)) >= limit {
+		return nil, fmt.Errorf("you already have %d sessions — end one with /clear <name> first", limit)
+	}
+	if name == "" {
+		name = sm.nextSessionName(userID)
+	}
+
+	s := sm.newSessionLocked(userID, chatID, name)
+	sm.saveToDisk()
+	log.Printf("[PAI Bridge] User %s started session %q (%s)", userID, name, s.ID[:8])
+	return s, nil
+}
+
+// SwitchSession makes the named session the user's active one.
+func (sm *SessionManager) SwitchSession(userID, name string) (*Session, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	s := sm.findSession(userID, name)
+	if s == nil {
+		return nil, fmt.Errorf("no session named %q", name)
+	}
+	sm.active[userID] = s.ID
+	sm.saveToDisk()
+	return s, nil
+}
+
+// activeOrNewLocked returns the user's active session, starting a default
+// one if they have none so settings chosen before the first message stick.
+// Caller must hold sm.mu.
+func (sm *SessionManager) activeOrNewLocked(userID string) (*Session, error) {
+	if s := sm.activeSession(userID); s != nil {
+		return s, nil
+	}
+	return sm.newSessionLocked(userID, userID, sm.nextSessionName(userID)), nil
+}
+
+// SetModel changes the model of the user's active session, starting a
+// default session if they have none. The model must already be resolved
+// against the allowlist. It applies from the next run; --resume keeps the
+// conversation.
+func (sm *SessionManager) SetModel(userID, model string) (*Session, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	s, err := sm.activeOrNewLocked(userID)
+	if err != nil {
+		return nil, err
+	}
+	s.Model = model
+	sm.saveToDisk()
+	log.Printf("[PAI Bridge] Session %s model set to %s", s.ID[:8], model)
+	return s, nil
+}
+
+// ChangeDir points the user's active session at dir, which must already be
+// validated by resolveWorkDir. Claude's --resume is scoped to the directory,
+// so a change drops the Claude session and the next message starts fresh.
+// It reports whether the directory changed.
+func (sm *SessionManager) ChangeDir(userID, dir string) (*Session, bool, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	s, err := sm.activeOrNewLocked(userID)
+	if err != nil {
+		return nil, false, err
+	}
+	if s.Status == "busy" {
+		return nil, false, fmt.Errorf("Claude is still working in %s — wait for the reply first", s.WorkDir)
+	}
+
+	changed := s.WorkDir != dir
+	if changed {
+		s.WorkDir = dir
+		s.ClaudeSessionID = ""
+		sm.forgetGrants(s.ID)
+		log.Printf("[PAI Bridge] Session %s work dir set to %s", s.ID[:8], dir)
+	}
+	sm.recentDirs[userID] = pushRecentDir(sm.recentDirs[userID], dir)
+	sm.saveToDisk()
+	return s, changed, nil
+}
+
+// RecentDirs returns the directories the user has switched to, most recent
+// first.
+func (sm *SessionManager) RecentDirs(userID string) []string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return append([]string(nil), sm.recentDirs[userID]...)
+}
+
+// BusySession returns the user's session with a Claude run in flight,
+// preferring the active one, or nil if nothing is running.
+func (sm *SessionManager) BusySession(userID string) *Session {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	if s := sm.activeSession(userID); s != nil && s.Status == "busy" {
+		return s
+	}
+	for _, s := range sm.userSessions(userID) {
+		if s.Status == "busy" {
+			return s
+		}
+	}
+	return nil
+}
+
+// CancelRun stops the Claude run in flight for one of the user's sessions
+// without ending the session. Queued messages are either kept, to run as the
+// usual follow-up batch, or discarded; it returns how many were discarded.
+func (sm *SessionManager) CancelRun(userID, sessionID string, keepQueued bool) (int, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	s, ok := sm.sessions[sessionID]
+	if !ok || s.UserID != userID {
+		return 0, fmt.Errorf("that session has ended")
+	}
+	cancel, running := sm.procs[s.ID]
+	if !running {
+		return 0, fmt.Errorf("nothing is running")
+	}
+
+	dropped := 0
+	if !keepQueued {
+		dropped = len(s.takePending())
+	}
+	s.cancelled = true
+	cancel()
+	sm.forgetGrants(s.ID)
+	log.Printf("[PAI Bridge] User %s cancelled the run in session %s", userID, s.ID[:8])
+	return dropped, nil
+}
+
+// KillSession ends the named session, or the active one if name is empty.
+// Its conversation is summarized to memory before it is removed.
+func (sm *SessionManager) KillSession(userID, name string) bool {
+	sm.mu.Lock()
+
+	var s *Session
+	if name == "" {
+		s = sm.activeSession(userID)
+	} else {
+		s = sm.findSession(userID, strings.ToLower(strings.TrimSpace(name)))
+	}
+	if s == nil {
 		sm.mu.Unlock()
 		return false
 	}
@@ -201,7 +540,7 @@ func (sm *SessionManager) KillSession(userID string) bool {
 	model := s.Model
 	msgCount := s.MessageCount
 
-	delete(sm.sessions, userID)
+	sm.removeLocked(s)
 	sm.saveToDisk()
 	sm.mu.Unlock()
 
@@ -213,6 +552,29 @@ func (sm *SessionManager) KillSession(userID string) bool {
 	return true
 }
 
+// removeLocked deletes a session. If it was the user's active session, the
+// next message starts a new one. Caller must hold sm.mu.
+func (sm *SessionManager) removeLocked(s *Session) {
+	s.pendingMu.Lock()
+	s.inflight = nil
+	s.interrupted = nil
+	s.pendingMu.Unlock()
+	os.RemoveAll(s.queueDir)
+	sm.forgetGrants(s.ID)
+	delete(sm.sessions, s.ID)
+	if sm.active[s.UserID] == s.ID {
+		delete(sm.active, s.UserID)
+	}
+}
+
+// forgetGrants drops the tools the user chose to always allow in a session,
+// when it ends, is cancelled or starts a new Claude conversation.
+func (sm *SessionManager) forgetGrants(sessionID string) {
+	if sm.tools != nil {
+		sm.tools.ForgetSession(sessionID)
+	}
+}
+
 type staleSession struct {
 	userID    string
 	sessionID string
@@ -224,10 +586,10 @@ type staleSession struct {
 func (sm *SessionManager) FlushAll() {
 	sm.mu.RLock()
 	var toFlush []staleSession
-	for userID, s := range sm.sessions {
+	for _, s := range sm.sessions {
 		if s.MessageCount > 0 {
 			toFlush = append(toFlush, staleSession{
-				userID:    userID,
+				userID:    s.UserID,
 				sessionID: s.ID,
 				model:     s.Model,
 			})
@@ -246,6 +608,9 @@ func (sm *SessionManager) FlushAll() {
 	log.Printf("[PAI Bridge] Shutdown flush complete")
 }
 
+// CleanStale ends sessions past the idle timeout, and during the daily reset
+// hour any session idle for 5+ minutes. Each named session is judged on its
+// own activity.
 func (sm *SessionManager) CleanStale() int {
 	sm.mu.Lock()
 
@@ -263,7 +628,7 @@ func (sm *SessionManager) CleanStale() int {
 
 	var toFlush []staleSession
 
-	for userID, s := range sm.sessions {
+	for _, s := range sm.sessions {
 		if s.Status == "busy" {
 			continue
 		}
@@ -288,12 +653,12 @@ func (sm *SessionManager) CleanStale() int {
 			// Collect session info for flush before deleting
 			if s.MessageCount > 0 {
 				toFlush = append(toFlush, staleSession{
-					userID:    userID,
+					userID:    s.UserID,
 					sessionID: s.ID,
 					model:     s.Model,
 				})
 			}
-			delete(sm.sessions, userID)
+			sm.removeLocked(s)
 			cleaned++
 		}
 	}
@@ -334,34 +699,69 @@ You are responding through a Telegram chat bridge. The user is on their phone.
 
 `
 
-func (sm *SessionManager) SendMessage(userID string, text string, attachment *Attachment) (*MessageResult, error) {
+// bridgeToolsContext replaces bridgeContext when the bridge's MCP chat tools
+// are attached to the run.
+const bridgeToolsContext = `[TELEGRAM BRIDGE CONTEXT]
+You are responding through a Telegram chat bridge. The user is on their phone.
+- Keep responses concise and mobile-friendly.
+- When the user asks you to send, fetch, grab, pull, or share a FILE, call the send_file tool with its absolute path (send_photo for images). Call it once per file.
+- Use send_file only when the user wants to RECEIVE a file, not when you're just reading files for your own understanding.
+- To speak a response as a voice note, call send_voice with 1-3 concise sentences. At most one per response.
+- If you need a decision from the user mid-task, call ask_user and wait for the answer instead of guessing.
+- send_message posts an interim update during long tasks; your final reply is delivered automatically.
+- For Obsidian notes: wiki-links like [[filename]] and ![[attachment]] resolve relative to the vault root. Follow links to find referenced files.
+[END BRIDGE CONTEXT]
+
+`
+
+// SendMessage runs text through the user's active session, creating a
+// default session if they have none.
+func (sm *SessionManager) SendMessage(userID string, text string, attachments []*Attachment, stream *StreamCallbacks) (*MessageResult, error) {
+	sm.mu.Lock()
+	session := sm.activeSession(userID)
+	if session == nil {
+		session = sm.newSessionLocked(userID, userID, sm.nextSessionName(userID))
+	}
+	return sm.sendLocked(session, text, attachments, stream)
+}
+
+// SendToSession runs text through a specific session, whether or not it is
+// the active one. The bot uses it for follow-up batches so they stay with
+// the session that queued them even if the user has since switched.
+func (sm *SessionManager) SendToSession(sessionID string, text string, attachments []*Attachment, stream *StreamCallbacks) (*MessageResult, error) {
 	sm.mu.Lock()
-	session, ok := sm.sessions[userID]
+	session, ok := sm.sessions[sessionID]
 	if !ok {
-		// Enforce concurrency limit before creating a new session
-		active := 0
-		for _, s := range sm.sessions {
-			if s.Status != "idle" {
-				active++
-			}
-		}
-		if active >= sm.config.Sessions.MaxConcurrent {
-			sm.mu.Unlock()
-			return nil, fmt.Errorf("Max concurrent sessions reached. Use /clear to end your session first.")
-		}
-		session = &Session{
-			ID:             uuid.New().String(),
-			UserID:         userID,
-			ChatID:         userID,
-			WorkDir:        sm.config.Sessions.DefaultWorkDir,
-			Model:          sm.config.Sessions.DefaultModel,
-			CreatedAt:      time.Now().UnixMilli(),
-			LastActivityAt: time.Now().UnixMilli(),
-			MessageCount:   0,
-			Status:         "active",
-		}
-		sm.sessions[userID] = session
+		sm.mu.Unlock()
+		return nil, fmt.Errorf("that session has ended")
+	}
+	return sm.sendLocked(session, text, attachments, stream)
+}
+
+// Requeue resolves the session a deferred prompt replays in and puts the
+// messages that were queued behind it back at the front of its queue, so they
+// follow the prompt as a batch. The prompt's own session is used if it still
+// exists, else the user's active one, else a new one. It returns the session
+// ID.
+func (sm *SessionManager) Requeue(userID, sessionID string, msgs []pendingMessage) (string, error) {
+	sm.mu.Lock()
+	session, ok := sm.sessions[sessionID]
+	if !ok {
+		session = sm.activeSession(userID)
 	}
+	if session == nil {
+		session = sm.newSessionLocked(userID, userID, sm.nextSessionName(userID))
+	}
+	sm.mu.Unlock()
+
+	session.pushFront(msgs)
+	return session.ID, nil
+}
+
+// sendLocked queues the message if the session is busy, otherwise runs
+// Claude. It is called with sm.mu held and releases it.
+func (sm *SessionManager) sendLocked(session *Session, text string, attachments []*Attachment, stream *StreamCallbacks) (*MessageResult, error) {
+	userID := session.UserID
 
 	// If the session is already processing a message, queue this one
 	if session.Status == "busy" {
@@ -371,27 +771,27 @@ func (sm *SessionManager) SendMessage(userID string, text string, attachment *At
 			session.pendingMu.Unlock()
 			return nil, fmt.Errorf("too many queued messages (%d), wait for the current task to finish", maxPendingMessages)
 		}
-		session.pending = append(session.pending, pendingMessage{Text: text, Attachment: attachment})
+		id := uuid.New().String()[:8]
+		session.pending = append(session.pending, pendingMessage{ID: id, Text: text, Attachments: attachments})
+		session.persistQueueLocked()
 		depth := len(session.pending)
 		session.pendingMu.Unlock()
 		log.Printf("[PAI Bridge] Message queued for user %s (%d pending)", userID, depth)
-		return &MessageResult{Queued: depth}, nil
+		return &MessageResult{SessionID: session.ID, Queued: depth, QueuedID: id}, nil
+	}
+
+	// max_concurrent bounds Claude subprocesses across all sessions
+	if limit := sm.config.Sessions.MaxConcurrent; sm.runningLocked() >= limit {
+		sm.mu.Unlock()
+		return nil, fmt.Errorf("Claude is already running %d tasks (the max_concurrent limit), try again when one finishes", limit)
 	}
 
 	session.Status = "busy"
 	session.LastActivityAt = time.Now().UnixMilli()
 	session.MessageCount++
+	sm.saveToDisk() // so a session created for this message is known after a crash
 	sm.mu.Unlock()
-
-	// Resolve claude binary
-	claudePath := os.Getenv("CLAUDE_PATH")
-	if claudePath == "" {
-		home, _ := os.UserHomeDir()
-		claudePath = filepath.Join(home, ".local/bin/claude")
-	}
-	if resolved, err := filepath.EvalSymlinks(claudePath); err == nil {
-		claudePath = resolved
-	}
+	session.setInflight(&pendingMessage{Text: text, Attachments: attachments})
 
 	// Prepend bridge context + previous session summaries + daily notes on first message
 	isFirst := session.ClaudeSessionID == ""
@@ -399,20 +799,27 @@ func (sm *SessionManager) SendMessage(userID string, text string, attachment *At
 	if isFirst {
 		recentContext := sm.memory.GetRecentContext(userID, sm.config.Memory.MaxSummaries)
 		dailyNotes := sm.memory.GetDailyNotes(userID)
-		messageText = bridgeContext + recentContext + dailyNotes + text
+		preamble := bridgeContext
+		if sm.tools != nil && sm.tools.ChatTools() {
+			preamble = bridgeToolsContext
+		}
+		messageText = preamble + recentContext + dailyNotes + text
 	}
 
-	// Inline text-file attachments
-	if attachment != nil && attachment.Type == "text-file" && attachment.TextContent != "" {
-		label := attachment.FileName
-		if label == "" {
-			label = "document"
+	// Inline text-file attachments and save files to the session inbox;
+	// binary ones (images, PDFs) need stream-json input
+	var binary []*Attachment
+	for _, a := range attachments {
+		switch {
+		case isInlineBinary(a):
+			binary = append(binary, a)
+		case a.Type == "file":
+			messageText = joinNonEmpty(messageText, sm.saveToInbox(session, a))
+		case a.TextContent != "":
+			messageText = inlineTextFile(messageText, a)
 		}
-		messageText = fmt.Sprintf("%s\n\n--- %s ---\n%s\n--- end ---", messageText, label, attachment.TextContent)
 	}
-
-	// Determine if we need stream-json input (for binary attachments)
-	useStreamJSON := attachment != nil && attachment.Type != "text-file"
+	useStreamJSON := len(binary) > 0
 	hasResume := session.ClaudeSessionID != ""
 
 	args := []string{"-p"}
@@ -429,123 +836,37 @@ func (sm *SessionManager) SendMessage(userID string, text string, attachment *At
 		args = append(args, "--resume", session.ClaudeSessionID)
 	}
 
+	if sm.tools != nil {
+		toolArgs, release := sm.tools.Register(userID, session.ChatID, session.ID)
+		defer release()
+		args = append(args, toolArgs...)
+	}
+
 	// Log the user's message
 	sm.memory.LogTurn(userID, session.ID, "user", text)
 
-	subprocessTimeout := time.Duration(sm.config.Sessions.SubprocessTimeoutMin) * time.Minute
-	ctx, cancel := context.WithTimeout(context.Background(), subprocessTimeout)
-
-	cmd := exec.CommandContext(ctx, claudePath, args...)
-	cmd.Dir = session.WorkDir
-
-	// Build environment: inherit parent env, override HOME for unprivileged user
-	env := os.Environ()
-	if sm.claudeCredential != nil {
-		claudeHome := os.Getenv("CLAUDE_USER_HOME")
-		if claudeHome == "" {
-			claudeHome = "/home/pai"
-		}
-		// Override HOME so Claude finds its config under the pai user's home
-		filtered := make([]string, 0, len(env))
-		for _, e := range env {
-			if !strings.HasPrefix(e, "HOME=") {
-				filtered = append(filtered, e)
-			}
-		}
-		env = append(filtered, "HOME="+claudeHome)
-
-		cmd.SysProcAttr = &syscall.SysProcAttr{
-			Credential: sm.claudeCredential,
-		}
+	req := RunRequest{
+		Args:    args,
+		WorkDir: session.WorkDir,
+		Name:    session.ID[:8],
+		Limits:  sm.config.Sessions.Limits,
+	}
+	if useStreamJSON {
+		req.Stdin = streamJSONInput(messageText, binary)
 	}
-	cmd.Env = env
 
-	// resetBusy resets session status if subprocess setup fails, preventing
-	// the session from being stuck in "busy" state forever.
-	resetBusy := func() {
+	ctx, cancel := context.WithTimeout(context.Background(), sm.runTimeout)
+	runStarted := time.Now()
+	run, err := sm.runner.Run(ctx, req)
+	if err != nil {
+		cancel()
+		// Reset status so the session isn't stuck in "busy" forever
 		sm.mu.Lock()
 		session.Status = "active"
 		sm.saveToDisk()
 		sm.mu.Unlock()
 		session.drainPending()
-	}
-
-	if useStreamJSON {
-		stdin, err := cmd.StdinPipe()
-		if err != nil {
-			cancel()
-			resetBusy()
-			return nil, fmt.Errorf("stdin pipe: %w", err)
-		}
-
-		go func() {
-			defer stdin.Close()
-			var content []interface{}
-
-			if attachment.Type == "image" {
-				content = append(content, map[string]interface{}{
-					"type": "image",
-					"source": map[string]interface{}{
-						"type":       "base64",
-						"media_type": attachment.MimeType,
-						"data":       attachment.Base64,
-					},
-				})
-			} else if attachment.Type == "document" {
-				content = append(content, map[string]interface{}{
-					"type": "document",
-					"source": map[string]interface{}{
-						"type":       "base64",
-						"media_type": attachment.MimeType,
-						"data":       attachment.Base64,
-					},
-				})
-			}
-
-			defaultPrompt := messageText
-			if defaultPrompt == "" {
-				if attachment.Type == "image" {
-					defaultPrompt = "What is in this image?"
-				} else {
-					defaultPrompt = "Please analyze this document."
-				}
-			}
-			content = append(content, map[string]interface{}{
-				"type": "text",
-				"text": defaultPrompt,
-			})
-
-			msg := map[string]interface{}{
-				"type": "user",
-				"message": map[string]interface{}{
-					"role":    "user",
-					"content": content,
-				},
-			}
-
-			data, _ := json.Marshal(msg)
-			stdin.Write(data)
-			stdin.Write([]byte("\n"))
-		}()
-	}
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		cancel()
-		resetBusy()
-		return nil, fmt.Errorf("stdout pipe: %w", err)
-	}
-
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		cancel()
-		resetBusy()
-		return nil, fmt.Errorf("stderr pipe: %w", err)
-	}
-
-	if err := cmd.Start(); err != nil {
-		cancel()
-		resetBusy()
+		session.setInflight(nil)
 		return nil, fmt.Errorf("start claude: %w", err)
 	}
 
@@ -554,60 +875,85 @@ func (sm *SessionManager) SendMessage(userID string, text string, attachment *At
 	sm.procs[session.ID] = cancel
 	sm.mu.Unlock()
 
+	if stream != nil && stream.OnStart != nil {
+		stream.OnStart(session.ID)
+	}
+
 	var fullResponse strings.Builder
 	var createdFiles []string
+	var lastError, apiErrorType string
+	runModel := session.Model
+	var resultEvent *StreamEvent
 
-	scanner := bufio.NewScanner(stdout)
-	scanner.Buffer(make([]byte, 1024*1024), 1024*1024) // 1MB buffer
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue
+	for event := range run.Events {
+		// Capture session ID
+		if event.Type == "system" && event.SessionID != "" && session.ClaudeSessionID == "" {
+			sm.mu.Lock()
+			session.ClaudeSessionID = event.SessionID
+			sm.saveToDisk()
+			sm.mu.Unlock()
 		}
-
-		var event map[string]interface{}
-		if err := json.Unmarshal([]byte(line), &event); err != nil {
-			continue
+		if event.Type == "system" && event.Subtype == "init" && event.Model != "" {
+			runModel = event.Model
+		}
+		if event.Type == "result" {
+			resultEvent = event
 		}
 
-		// Capture session ID
-		if event["type"] == "system" {
-			if sid, ok := event["session_id"].(string); ok && sid != "" && session.ClaudeSessionID == "" {
-				sm.mu.Lock()
-				session.ClaudeSessionID = sid
-				sm.saveToDisk()
-				sm.mu.Unlock()
-			}
+		// Remember what went wrong, for when Claude exits without stderr. A
+		// failed result only says how the run ended, so it doesn't replace
+		// a more specific error seen earlier.
+		if msg := event.ErrorMessage(); msg != "" && (lastError == "" || event.Type != "result") {
+			lastError = msg
+		}
+		if event.Error != nil {
+			apiErrorType = event.Error.Type
 		}
 
 		// Extract text
-		if chunk := extractTextFromEvent(event); chunk != "" {
+		if chunk := event.Text(); chunk != "" {
 			fullResponse.WriteString(chunk)
+			if stream != nil && stream.OnText != nil {
+				stream.OnText(chunk)
+			}
+		}
+
+		// Forward tool activity for progress display
+		if stream != nil && stream.OnToolUse != nil {
+			for _, tu := range event.ToolUses() {
+				stream.OnToolUse(tu.ID, tu.Name, tu.Input)
+			}
+		}
+		if stream != nil && stream.OnToolResult != nil {
+			for _, tr := range event.ToolResults() {
+				stream.OnToolResult(tr.ToolUseID, tr.IsError)
+			}
 		}
 
 		// Extract created files
-		for _, f := range extractCreatedFilesFromEvent(event) {
+		for _, f := range event.CreatedFiles() {
 			createdFiles = appendUnique(createdFiles, f)
 		}
 	}
 
-	// Read stderr
-	stderrScanner := bufio.NewScanner(stderr)
-	var stderrBuf strings.Builder
-	for stderrScanner.Scan() {
-		stderrBuf.WriteString(stderrScanner.Text())
-		stderrBuf.WriteString("\n")
-	}
+	res := run.Wait()
+	timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
 
-	exitErr := cmd.Wait()
+	// Every run counts against quotas, including ones that failed or were
+	// cancelled before reporting their usage
+	if sm.usage != nil {
+		sm.usage.Record(newUsageRecord(session, runModel, resultEvent, time.Since(runStarted)))
+	}
 
 	// Cleanup: take pending queue BEFORE setting status to "active" to
 	// close the race window where a new message could steal the session.
-	queued := session.takePending()
-
 	sm.mu.Lock()
 	delete(sm.procs, session.ID)
+	cancelled := session.cancelled
+	interruptionID := session.interruptionID
+	session.cancelled = false
+	session.interruptionID = ""
+	queued, next, interrupted := session.handOff(interruptionID)
 	session.Status = "active"
 	sm.saveToDisk()
 	sm.mu.Unlock()
@@ -616,16 +962,34 @@ func (sm *SessionManager) SendMessage(userID string, text string, attachment *At
 
 	// On any subprocess error, drop queued messages and return the error.
 	// This is consistent across all failure modes (session expired, stderr,
-	// signal kill, OOM, context timeout, etc.).
-	if exitErr != nil {
+	// signal kill, OOM, context timeout, etc.). A cancelled run is not an
+	// error: its partial output is returned and the Claude session is kept
+	// so the next message resumes it.
+	if cancelled {
+		log.Printf("[PAI Bridge] Run cancelled for session %s (%d queued message(s) kept)", session.ID[:8], len(queued))
+	} else if breach := sm.runBreach(res, timedOut); breach != nil {
+		log.Printf("[PAI Bridge] Session %s: %v (dropped %d queued message(s))", session.ID[:8], breach, len(queued))
+		session.dropInflight(next)
+		return nil, breach
+	} else if capErr := sm.capacityError(res, resultEvent, apiErrorType, lastError); capErr != nil {
+		// Out of capacity: hand the queued messages back with the error so
+		// they can be retried along with the failed prompt
+		capErr.SessionID = session.ID
+		capErr.Queued = queued
+		session.dropInflight(next)
+		log.Printf("[PAI Bridge] Session %s: %v (%d queued message(s) returned)", session.ID[:8], capErr, len(queued))
+		return nil, capErr
+	} else if res.ExitErr != nil {
 		if len(queued) > 0 {
 			log.Printf("[PAI Bridge] Dropped %d queued message(s) for session %s due to subprocess error", len(queued), session.ID[:8])
 		}
 		queued = nil // release for GC
-		stderrText := stderrBuf.String()
+		session.dropInflight(next)
+		stderrText := res.Stderr
 		if hasResume && strings.Contains(stderrText, "Could not find session") {
 			sm.mu.Lock()
 			session.ClaudeSessionID = ""
+			sm.forgetGrants(session.ID)
 			sm.saveToDisk()
 			sm.mu.Unlock()
 			return nil, fmt.Errorf("Session expired. Send your message again to start a new conversation.")
@@ -633,6 +997,9 @@ func (sm *SessionManager) SendMessage(userID string, text string, attachment *At
 		if stderrText != "" {
 			return nil, fmt.Errorf("Claude exited: %s", strings.TrimSpace(stderrText))
 		}
+		if lastError != "" {
+			return nil, fmt.Errorf("Claude exited: %s", lastError)
+		}
 		return nil, fmt.Errorf("claude subprocess failed")
 	}
 
@@ -644,48 +1011,163 @@ func (sm *SessionManager) SendMessage(userID string, text string, attachment *At
 	// Package queued messages as a FollowUp for the bot layer to process
 	// after delivering this response.
 	result := &MessageResult{
+		SessionID:    session.ID,
 		Text:         fullResponse.String(),
 		CreatedFiles: createdFiles,
+		Cancelled:    cancelled,
 	}
 
-	if len(queued) > 0 {
-		batchText, batchAttachment := session.buildBatch(queued)
-		if batchText != "" || batchAttachment != nil {
+	// An interrupting message goes next on its own; otherwise the queue goes
+	// as one batch. Either stays in flight on disk until the bot starts it.
+	if next != nil {
+		result.FollowUp = &FollowUp{
+			Text:        next.Text,
+			Attachments: next.Attachments,
+			Count:       len(queued),
+			held:        next,
+		}
+		if interrupted {
+			result.Interrupted = true
+			result.FollowUp.Text = interruptPrompt(result.Text, next.Text)
+		} else {
 			log.Printf("[PAI Bridge] %d queued message(s) ready for follow-up (user %s)", len(queued), userID)
-			result.FollowUp = &FollowUp{
-				Text:       batchText,
-				Attachment: batchAttachment,
-				Count:      len(queued),
-			}
 		}
 	}
 
 	return result, nil
 }
 
-// buildBatch concatenates queued messages into a single prompt. If any queued
-// message has a binary attachment, only the last one is kept (text attachments
-// are inlined into the prompt text). Returns empty string if all messages were
+// runBreach reports the limit that stopped a run: a resource limit the runner
+// enforced, or the subprocess timeout.
+func (sm *SessionManager) runBreach(res *RunResult, timedOut bool) *limitError {
+	if res.Breach != nil {
+		return res.Breach
+	}
+	if timedOut && res.ExitErr != nil {
+		return &limitError{"time", formatElapsed(sm.runTimeout)}
+	}
+	return nil
+}
+
+// capacityError checks a failed run for a usage limit, rate limit or overload.
+// Claude may exit cleanly after reporting one, so a failed result counts as
+// a failure too.
+func (sm *SessionManager) capacityError(res *RunResult, result *StreamEvent, apiErrorType, lastError string) *capacityError {
+	if res.ExitErr == nil && (result == nil || !result.IsError) {
+		return nil
+	}
+	text := strings.TrimSpace(res.Stderr + "\n" + lastError)
+	return detectCapacityError(apiErrorType, text, time.Now(), sm.resetLocation)
+}
+
+// streamJSONInput builds the stream-json user message that carries binary
+// attachments, in order and each after its label if it has one, with a
+// default prompt when the message has no text.
+func streamJSONInput(messageText string, attachments []*Attachment) []byte {
+	var content []interface{}
+
+	for _, a := range attachments {
+		if a.Type != "image" && a.Type != "document" {
+			continue
+		}
+		if a.Label != "" {
+			content = append(content, map[string]interface{}{
+				"type": "text",
+				"text": "[" + a.Label + "]",
+			})
+		}
+		content = append(content, map[string]interface{}{
+			"type": a.Type,
+			"source": map[string]interface{}{
+				"type":       "base64",
+				"media_type": a.MimeType,
+				"data":       a.Base64,
+			},
+		})
+	}
+
+	defaultPrompt := messageText
+	if defaultPrompt == "" {
+		switch {
+		case len(attachments) > 1:
+			defaultPrompt = "Please look at these attachments."
+		case attachments[0].Type == "image":
+			defaultPrompt = "What is in this image?"
+		default:
+			defaultPrompt = "Please analyze this document."
+		}
+	}
+	content = append(content, map[string]interface{}{
+		"type": "text",
+		"text": defaultPrompt,
+	})
+
+	msg := map[string]interface{}{
+		"type": "user",
+		"message": map[string]interface{}{
+			"role":    "user",
+			"content": content,
+		},
+	}
+
+	data, _ := json.Marshal(msg)
+	return append(data, '\n')
+}
+
+// inlineTextFile appends a text-file attachment to the prompt.
+func inlineTextFile(text string, a *Attachment) string {
+	label := a.FileName
+	if label == "" {
+		label = "document"
+	}
+	return fmt.Sprintf("%s\n\n--- %s ---\n%s\n--- end ---", text, label, a.TextContent)
+}
+
+// buildBatch concatenates queued messages into a single prompt. Text
+// attachments are inlined into the prompt text; binary ones (images, PDFs,
+// files for the inbox) are returned in order, each labelled with the message
+// it came with. If the images and PDFs together exceed
+// maxBatchAttachmentBytes, the ones that don't fit are left out and the
+// prompt says so. Returns empty string if all messages were
 // empty (no text, no attachments).
-func (s *Session) buildBatch(msgs []pendingMessage) (string, *Attachment) {
+func (s *Session) buildBatch(msgs []pendingMessage) (string, []*Attachment) {
 	var parts []string
-	var binaryAttachment *Attachment
+	var binary []*Attachment
+	var dropped []string
+	size := 0
 
 	for i, m := range msgs {
 		text := m.Text
-
-		// Inline text-file attachments the same way SendMessage does
-		if m.Attachment != nil && m.Attachment.Type == "text-file" && m.Attachment.TextContent != "" {
-			label := m.Attachment.FileName
-			if label == "" {
-				label = "document"
+		attached := 0
+		for _, a := range m.Attachments {
+			if a.Type == "text-file" {
+				if a.TextContent != "" {
+					text = inlineTextFile(text, a)
+				}
+				continue
+			}
+			attached++
+			name := attachmentName(a)
+			if a.Label != "" {
+				name = a.Label
 			}
-			text = fmt.Sprintf("%s\n\n--- %s ---\n%s\n--- end ---", text, label, m.Attachment.TextContent)
-		} else if m.Attachment != nil && m.Attachment.Type != "text-file" {
-			// Binary attachment (image, PDF) — keep the last one
-			binaryAttachment = m.Attachment
+			label := fmt.Sprintf("follow-up message %d/%d, %s", i+1, len(msgs), name)
+			if isInlineBinary(a) {
+				n := base64.StdEncoding.DecodedLen(len(a.Base64))
+				if size+n > maxBatchAttachmentBytes {
+					dropped = append(dropped, fmt.Sprintf("%s (%.1f MB)", label, float64(n)/(1<<20)))
+					continue
+				}
+				size += n
+			}
+			labelled := *a
+			labelled.Label = "Attachment from " + label
+			binary = append(binary, &labelled)
 		}
 
+		if text == "" && attached > 0 {
+			text = fmt.Sprintf("(%d attachment(s))", attached)
+		}
 		if text != "" {
 			parts = append(parts, fmt.Sprintf("[Follow-up message %d/%d]:\n%s", i+1, len(msgs), text))
 		}
@@ -693,12 +1175,27 @@ func (s *Session) buildBatch(msgs []pendingMessage) (string, *Attachment) {
 
 	// If all messages were empty text with no binary attachment, signal
 	// the caller to skip the follow-up by returning empty string.
-	if len(parts) == 0 && binaryAttachment == nil {
+	if len(parts) == 0 && len(binary) == 0 {
 		return "", nil
 	}
 
 	header := fmt.Sprintf("[While you were working, I sent %d follow-up message(s):]\n\n", len(msgs))
-	return header + strings.Join(parts, "\n\n"), binaryAttachment
+	text := header + strings.Join(parts, "\n\n")
+	if len(dropped) > 0 {
+		log.Printf("[PAI Bridge] Left %d attachment(s) out of a follow-up batch for session %s", len(dropped), s.ID[:8])
+		text += fmt.Sprintf("\n\n[Note from the bridge: %d attachment(s) were left out because the batch exceeded the %d MB attachment limit: %s. Ask me to send them again if you need them.]",
+			len(dropped), maxBatchAttachmentBytes>>20, strings.Join(dropped, "; "))
+	}
+	return text, binary
+}
+
+// attachmentName describes an attachment by file name, or by type if it has
+// none.
+func attachmentName(a *Attachment) string {
+	if a.FileName != "" {
+		return a.FileName
+	}
+	return a.Type
 }
 
 // drainPending discards any queued messages (used on error paths where we
@@ -708,10 +1205,18 @@ func (s *Session) takePending() []pendingMessage {
 	s.pendingMu.Lock()
 	msgs := s.pending
 	s.pending = nil
+	s.persistQueueLocked()
 	s.pendingMu.Unlock()
 	return msgs
 }
 
+// pendingCount reports how many messages are queued behind the current run.
+func (s *Session) pendingCount() int {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	return len(s.pending)
+}
+
 // drainPending discards any queued messages (used on error paths where we
 // can't process them). Logs a warning if messages were dropped.
 func (s *Session) drainPending() {
@@ -720,89 +1225,6 @@ func (s *Session) drainPending() {
 	}
 }
 
-func extractTextFromEvent(event map[string]interface{}) string {
-	if event["type"] != "assistant" {
-		return ""
-	}
-
-	msg, ok := event["message"].(map[string]interface{})
-	if !ok {
-		return ""
-	}
-
-	content, ok := msg["content"].([]interface{})
-	if !ok {
-		return ""
-	}
-
-	var sb strings.Builder
-	for _, block := range content {
-		b, ok := block.(map[string]interface{})
-		if !ok {
-			continue
-		}
-		if b["type"] == "text" {
-			if text, ok := b["text"].(string); ok {
-				sb.WriteString(text)
-			}
-		}
-	}
-	return sb.String()
-}
-
-var (
-	redirectPattern   = regexp.MustCompile(`>\s*(/\S+\.\w+)`)
-	outputFlagPattern = regexp.MustCompile(`(?:-o|--output)\s+["']?(\S+\.\w+)["']?`)
-)
-
-func extractCreatedFilesFromEvent(event map[string]interface{}) []string {
-	if event["type"] != "assistant" {
-		return nil
-	}
-
-	msg, ok := event["message"].(map[string]interface{})
-	if !ok {
-		return nil
-	}
-
-	content, ok := msg["content"].([]interface{})
-	if !ok {
-		return nil
-	}
-
-	var files []string
-	for _, block := range content {
-		b, ok := block.(map[string]interface{})
-		if !ok || b["type"] != "tool_use" {
-			continue
-		}
-
-		input, ok := b["input"].(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		if b["name"] == "Write" {
-			if fp, ok := input["file_path"].(string); ok {
-				files = append(files, fp)
-			}
-		}
-
-		if b["name"] == "Bash" {
-			if cmd, ok := input["command"].(string); ok {
-				for _, m := range redirectPattern.FindAllStringSubmatch(cmd, -1) {
-					files = append(files, m[1])
-				}
-				for _, m := range outputFlagPattern.FindAllStringSubmatch(cmd, -1) {
-					files = append(files, m[1])
-				}
-			}
-		}
-	}
-
-	return files
-}
-
 func appendUnique(slice []string, item string) []string {
 	for _, s := range slice {
 		if s == item {
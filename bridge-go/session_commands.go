@@ -0,0 +1,430 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// handleNewSession implements /new [name]: start a session and switch to it.
+// The previous session keeps its conversation and can be switched back to.
+func (b *Bot) handleNewSession(msg *tgbotapi.Message, userID string) {
+	chatID := msg.Chat.ID
+	s, err := b.sessions.NewNamedSession(userID, fmt.Sprintf("%d", chatID), msg.CommandArguments())
+	if err != nil {
+		b.send(chatID, fmt.Sprintf("Can't start session: %v", err))
+		return
+	}
+	b.send(chatID, fmt.Sprintf("Started session %q. Messages now go here; /sessions lists the others.", s.Name))
+}
+
+// handleSwitchSession implements /switch <name>. Without a name it shows the
+// session list.
+func (b *Bot) handleSwitchSession(msg *tgbotapi.Message, userID string) {
+	chatID := msg.Chat.ID
+	name := strings.TrimSpace(msg.CommandArguments())
+	if name == "" {
+		b.sendSessionList(chatID, userID)
+		return
+	}
+	s, err := b.sessions.SwitchSession(userID, name)
+	if err != nil {
+		b.send(chatID, fmt.Sprintf("%v. /sessions lists your sessions.", err))
+		return
+	}
+	b.send(chatID, fmt.Sprintf("Switched to %q.", s.Name))
+}
+
+// sendSessionList posts the user's sessions with a button per session to
+// switch to it.
+func (b *Bot) sendSessionList(chatID int64, userID string) {
+	text, keyboard := b.renderSessionList(userID)
+	msg := tgbotapi.NewMessage(chatID, text)
+	if keyboard != nil {
+		msg.ReplyMarkup = *keyboard
+	}
+	b.api.Send(msg)
+}
+
+func (b *Bot) renderSessionList(userID string) (string, *tgbotapi.InlineKeyboardMarkup) {
+	sessions, activeID := b.sessions.ListSessions(userID)
+	if len(sessions) == 0 {
+		return "No sessions. Send a message to start one, or /new <name>.", nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Sessions:")
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, s := range sessions {
+		mark := "  "
+		if s.ID == activeID {
+			mark = "▶ "
+		}
+		idle := formatElapsed(time.Since(time.UnixMilli(s.LastActivityAt)).Truncate(time.Second))
+		fmt.Fprintf(&sb, "\n%s%s — %d msgs, %s, idle %s", mark, s.Name, s.MessageCount, s.Status, idle)
+
+		if s.ID != activeID {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Switch to "+s.Name, "sess:"+s.Name),
+			))
+		}
+	}
+	if len(rows) == 0 {
+		return sb.String(), nil
+	}
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return sb.String(), &keyboard
+}
+
+// handleSessionCallback resolves a "sess:<name>" button press from the
+// session list and redraws the list in place.
+func (b *Bot) handleSessionCallback(cq *tgbotapi.CallbackQuery, userID, name string) {
+	s, err := b.sessions.SwitchSession(userID, name)
+	if err != nil {
+		b.answerCallback(cq.ID, "That session has ended.")
+	} else {
+		b.answerCallback(cq.ID, "Switched to "+s.Name)
+	}
+	if cq.Message == nil {
+		return
+	}
+	text, keyboard := b.renderSessionList(userID)
+	edit := tgbotapi.NewEditMessageText(cq.Message.Chat.ID, cq.Message.MessageID, text)
+	edit.ReplyMarkup = keyboard
+	b.api.Request(edit)
+}
+
+// handleModel implements /model [alias|id]. Without an argument it shows the
+// current model and a button per allowed model.
+func (b *Bot) handleModel(msg *tgbotapi.Message, userID string) {
+	chatID := msg.Chat.ID
+	arg := strings.TrimSpace(msg.CommandArguments())
+	if arg == "" {
+		text, keyboard := b.renderModelPicker(userID)
+		reply := tgbotapi.NewMessage(chatID, text)
+		reply.ReplyMarkup = keyboard
+		b.api.Send(reply)
+		return
+	}
+
+	model, ok := resolveModel(b.config.Sessions, arg)
+	if !ok {
+		b.send(chatID, fmt.Sprintf("%q is not an allowed model. Choose one of: %s", arg, b.allowedModelAliases()))
+		return
+	}
+	s, err := b.sessions.SetModel(userID, model)
+	if err != nil {
+		b.send(chatID, fmt.Sprintf("Can't change model: %v", err))
+		return
+	}
+	b.send(chatID, fmt.Sprintf("Session %q now uses %s.", s.Name, modelLabel(b.config.Sessions, model)))
+}
+
+func (b *Bot) allowedModelAliases() string {
+	var aliases []string
+	for _, opt := range modelOptions(b.config.Sessions) {
+		aliases = append(aliases, opt.Alias)
+	}
+	return strings.Join(aliases, ", ")
+}
+
+func (b *Bot) renderModelPicker(userID string) (string, tgbotapi.InlineKeyboardMarkup) {
+	current := b.config.Sessions.DefaultModel
+	if s := b.sessions.GetSession(userID); s != nil {
+		current = s.Model
+	}
+
+	var row []tgbotapi.InlineKeyboardButton
+	for _, opt := range modelOptions(b.config.Sessions) {
+		label := opt.Alias
+		if opt.ID == current {
+			label = "✓ " + label
+		}
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(label, "model:"+opt.Alias))
+	}
+	return "Model: " + modelLabel(b.config.Sessions, current), tgbotapi.NewInlineKeyboardMarkup(row)
+}
+
+// handleModelCallback resolves a "model:<alias>" button press. The alias is
+// re-checked against the allowlist since callback data comes from the client.
+func (b *Bot) handleModelCallback(cq *tgbotapi.CallbackQuery, userID, alias string) {
+	model, ok := resolveModel(b.config.Sessions, alias)
+	if !ok {
+		b.answerCallback(cq.ID, "That model is no longer allowed.")
+		return
+	}
+	if _, err := b.sessions.SetModel(userID, model); err != nil {
+		b.answerCallback(cq.ID, err.Error())
+		return
+	}
+	b.answerCallback(cq.ID, "Model: "+alias)
+	if cq.Message == nil {
+		return
+	}
+	text, keyboard := b.renderModelPicker(userID)
+	b.api.Request(tgbotapi.NewEditMessageTextAndMarkup(cq.Message.Chat.ID, cq.Message.MessageID, text, keyboard))
+}
+
+// handleChangeDir implements /cd [path]. Without a path it shows the current
+// work dir with buttons for the default and recent directories.
+func (b *Bot) handleChangeDir(msg *tgbotapi.Message, userID string) {
+	chatID := msg.Chat.ID
+	arg := strings.TrimSpace(msg.CommandArguments())
+	if arg == "" {
+		text, keyboard := b.renderRecentDirs(userID)
+		reply := tgbotapi.NewMessage(chatID, text)
+		reply.ReplyMarkup = keyboard
+		b.api.Send(reply)
+		return
+	}
+	b.send(chatID, b.changeDir(userID, arg))
+}
+
+// currentWorkDir is the active session's work dir, or the default.
+func (b *Bot) currentWorkDir(userID string) string {
+	if s := b.sessions.GetSession(userID); s != nil {
+		return s.WorkDir
+	}
+	return b.config.Sessions.DefaultWorkDir
+}
+
+// changeDir validates input against the project roots, applies the TOTP gate
+// for directories outside the default work dir, and moves the active session
+// there. It returns the reply for the user.
+func (b *Bot) changeDir(userID, input string) string {
+	cfg := b.config.Sessions
+	dir, err := resolveWorkDir(input, b.currentWorkDir(userID), cfg.ProjectRoots)
+	if err != nil {
+		return fmt.Sprintf("Can't change directory: %v", err)
+	}
+
+	if b.totp != nil && b.totp.Required(totpActionChangeDir) && !b.totp.Elevated(userID) {
+		home := cfg.DefaultWorkDir
+		if resolved, err := filepath.EvalSymlinks(home); err == nil {
+			home = resolved
+		}
+		if dirNeedsTOTP(dir, home) {
+			log.Printf("[PAI Bridge] /cd held (TOTP unlock required): %s", dir)
+			return fmt.Sprintf("🔐 %s is outside %s — /unlock with your authenticator code first.", dir, cfg.DefaultWorkDir)
+		}
+	}
+
+	s, changed, err := b.sessions.ChangeDir(userID, dir)
+	if err != nil {
+		return fmt.Sprintf("Can't change directory: %v", err)
+	}
+	if !changed {
+		return fmt.Sprintf("Session %q is already in %s.", s.Name, dir)
+	}
+	return fmt.Sprintf("Session %q now works in %s. The next message starts a fresh Claude conversation there.", s.Name, dir)
+}
+
+func (b *Bot) renderRecentDirs(userID string) (string, tgbotapi.InlineKeyboardMarkup) {
+	rows := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("🏠 "+filepath.Base(b.config.Sessions.DefaultWorkDir), "cd:home")),
+	}
+	for i, dir := range b.sessions.RecentDirs(userID) {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(projectLabel(dir, b.config.Sessions.ProjectRoots), fmt.Sprintf("cd:r%d", i)),
+		))
+	}
+	text := "Work dir: " + b.currentWorkDir(userID) + "\n\n/cd <path> to change it, /projects to pick a repo."
+	return text, tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// handleProjects implements /projects: a button per git repo under the
+// project roots.
+func (b *Bot) handleProjects(msg *tgbotapi.Message, userID string) {
+	chatID := msg.Chat.ID
+	roots := b.config.Sessions.ProjectRoots
+	projects := listProjects(roots)
+	if len(projects) == 0 {
+		b.send(chatID, "No git repositories under "+strings.Join(roots, ", ")+".")
+		return
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i := 0; i < len(projects); i += 2 {
+		var row []tgbotapi.InlineKeyboardButton
+		for j := i; j < i+2 && j < len(projects); j++ {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData(truncate(projectLabel(projects[j], roots), 40), fmt.Sprintf("cd:p%d", j)))
+		}
+		rows = append(rows, row)
+	}
+	reply := tgbotapi.NewMessage(chatID, "Work dir: "+b.currentWorkDir(userID)+"\nPick a project:")
+	reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	b.api.Send(reply)
+}
+
+// handleChangeDirCallback resolves a "cd:<target>" button press: "home" for
+// the default work dir, "r<i>" for a recent dir, "p<i>" for a project. Paths
+// are looked up again and re-validated rather than trusted from the button.
+func (b *Bot) handleChangeDirCallback(cq *tgbotapi.CallbackQuery, userID, target string) {
+	var dir string
+	if target == "home" {
+		dir = b.config.Sessions.DefaultWorkDir
+	} else if len(target) > 1 {
+		var list []string
+		switch target[0] {
+		case 'r':
+			list = b.sessions.RecentDirs(userID)
+		case 'p':
+			list = listProjects(b.config.Sessions.ProjectRoots)
+		}
+		if i, err := strconv.Atoi(target[1:]); err == nil && i >= 0 && i < len(list) {
+			dir = list[i]
+		}
+	}
+	if dir == "" {
+		b.answerCallback(cq.ID, "That directory is no longer listed.")
+		return
+	}
+
+	b.answerCallback(cq.ID, "")
+	if cq.Message != nil {
+		b.send(cq.Message.Chat.ID, b.changeDir(userID, dir))
+	}
+}
+
+// handleCancel implements /cancel [keep|drop]: stop the running Claude task
+// but keep the session. When messages are queued behind it and the user
+// didn't say what to do with them, ask with buttons.
+func (b *Bot) handleCancel(msg *tgbotapi.Message, userID string) {
+	chatID := msg.Chat.ID
+	s := b.sessions.BusySession(userID)
+	if s == nil {
+		b.send(chatID, "Nothing is running.")
+		return
+	}
+
+	switch strings.ToLower(strings.TrimSpace(msg.CommandArguments())) {
+	case "keep":
+		b.send(chatID, b.cancelRun(userID, s.ID, true))
+	case "drop", "all":
+		b.send(chatID, b.cancelRun(userID, s.ID, false))
+	case "":
+		if s.pendingCount() > 0 {
+			b.askQueuedOnCancel(chatID, s)
+			return
+		}
+		b.send(chatID, b.cancelRun(userID, s.ID, false))
+	default:
+		b.send(chatID, "Usage: /cancel, /cancel keep (run queued messages next) or /cancel drop (discard them)")
+	}
+}
+
+// askQueuedOnCancel offers to stop the run while keeping or discarding the
+// messages queued behind it.
+func (b *Bot) askQueuedOnCancel(chatID int64, s *Session) {
+	n := s.pendingCount()
+	reply := tgbotapi.NewMessage(chatID, fmt.Sprintf("Stop %q? %d message(s) are queued behind this task.", s.Name, n))
+	reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("⏹ Stop, run queued", "stop:"+s.ID+":keep"),
+		tgbotapi.NewInlineKeyboardButtonData("⏹ Stop, discard queued", "stop:"+s.ID+":drop"),
+	))
+	b.api.Send(reply)
+}
+
+// cancelRun stops the run and returns the acknowledgement. The partial reply
+// itself is delivered by the handleMessage call that started the run.
+func (b *Bot) cancelRun(userID, sessionID string, keepQueued bool) string {
+	dropped, err := b.sessions.CancelRun(userID, sessionID, keepQueued)
+	if err != nil {
+		return fmt.Sprintf("Can't cancel: %v", err)
+	}
+	if dropped > 0 {
+		return fmt.Sprintf("Stopping… %d queued message(s) discarded.", dropped)
+	}
+	return "Stopping…"
+}
+
+// handleStopCallback resolves "stop:<session id>[:keep|:drop]" from the
+// progress message's Stop button or the /cancel prompt.
+func (b *Bot) handleStopCallback(cq *tgbotapi.CallbackQuery, userID, arg string) {
+	sessionID, mode, _ := strings.Cut(arg, ":")
+	if mode == "" {
+		if s := b.sessions.BusySession(userID); s != nil && s.ID == sessionID && s.pendingCount() > 0 && cq.Message != nil {
+			b.answerCallback(cq.ID, "")
+			b.askQueuedOnCancel(cq.Message.Chat.ID, s)
+			return
+		}
+	}
+
+	dropped, err := b.sessions.CancelRun(userID, sessionID, mode == "keep")
+	ack := "Stopping…"
+	if err != nil {
+		ack = "Already finished."
+	} else if dropped > 0 {
+		ack = fmt.Sprintf("Stopping… %d queued message(s) discarded.", dropped)
+	}
+	b.answerCallback(cq.ID, ack)
+
+	// Clear the buttons on the /cancel prompt so they can't be pressed twice
+	if mode != "" && cq.Message != nil {
+		b.api.Request(tgbotapi.NewEditMessageText(cq.Message.Chat.ID, cq.Message.MessageID, ack))
+	}
+}
+
+// handleUsage implements /usage: what Claude runs cost today and this week,
+// with the week broken down by session and model.
+func (b *Bot) handleUsage(msg *tgbotapi.Message, userID string) {
+	if b.sessions.usage == nil {
+		b.send(msg.Chat.ID, "Usage tracking is not enabled.")
+		return
+	}
+	b.send(msg.Chat.ID, renderUsage(b.sessions.usage, b.config.Sessions, userID, time.Now(), b.sessions.resetLocation))
+}
+
+// handleQuota implements /quota: the caller's quota use, and for admins
+// "grant <userID> [hours]" and "revoke <userID>" to lift a user's quotas for
+// a while.
+func (b *Bot) handleQuota(msg *tgbotapi.Message, userID string) {
+	chatID := msg.Chat.ID
+	if b.quota == nil {
+		b.send(chatID, "Quotas are not enabled.")
+		return
+	}
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) == 0 {
+		b.send(chatID, b.quota.Status(userID))
+		return
+	}
+
+	if !b.quota.IsAdmin(userID) {
+		b.send(chatID, "Only quota admins can grant or revoke overrides.")
+		return
+	}
+	if b.totp != nil && b.totp.Required(totpActionQuotaGrant) && !b.totp.Elevated(userID) {
+		b.send(chatID, "🔐 /unlock with your authenticator code first.")
+		return
+	}
+	switch {
+	case args[0] == "grant" && (len(args) == 2 || len(args) == 3):
+		hours := 24
+		if len(args) == 3 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n <= 0 {
+				b.send(chatID, "Usage: /quota grant <userID> [hours]")
+				return
+			}
+			hours = n
+		}
+		until := b.quota.Grant(args[1], time.Duration(hours)*time.Hour)
+		log.Printf("[PAI Bridge] Quota override for user %s granted by %s until %s", args[1], userID, until.Format(time.RFC3339))
+		b.send(chatID, fmt.Sprintf("Quotas lifted for %s until %s.", args[1], until.In(b.sessions.resetLocation).Format("Mon Jan 2 15:04 MST")))
+	case args[0] == "revoke" && len(args) == 2:
+		if b.quota.Revoke(args[1]) {
+			log.Printf("[PAI Bridge] Quota override for user %s revoked by %s", args[1], userID)
+			b.send(chatID, fmt.Sprintf("Override for %s ended.", args[1]))
+		} else {
+			b.send(chatID, fmt.Sprintf("%s has no active override.", args[1]))
+		}
+	default:
+		b.send(chatID, "Usage: /quota, /quota grant <userID> [hours], /quota revoke <userID>")
+	}
+}
@@ -2,187 +2,17 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"encoding/base64"
 	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
-func TestExtractTextFromEvent(t *testing.T) {
-	tests := []struct {
-		name  string
-		event map[string]interface{}
-		want  string
-	}{
-		{
-			name: "assistant text block",
-			event: map[string]interface{}{
-				"type": "assistant",
-				"message": map[string]interface{}{
-					"role": "assistant",
-					"content": []interface{}{
-						map[string]interface{}{
-							"type": "text",
-							"text": "Hello world",
-						},
-					},
-				},
-			},
-			want: "Hello world",
-		},
-		{
-			name: "multiple text blocks",
-			event: map[string]interface{}{
-				"type": "assistant",
-				"message": map[string]interface{}{
-					"content": []interface{}{
-						map[string]interface{}{"type": "text", "text": "First "},
-						map[string]interface{}{"type": "text", "text": "Second"},
-					},
-				},
-			},
-			want: "First Second",
-		},
-		{
-			name: "tool_use block ignored",
-			event: map[string]interface{}{
-				"type": "assistant",
-				"message": map[string]interface{}{
-					"content": []interface{}{
-						map[string]interface{}{"type": "tool_use", "name": "Read"},
-					},
-				},
-			},
-			want: "",
-		},
-		{
-			name:  "system event returns empty",
-			event: map[string]interface{}{"type": "system", "session_id": "abc"},
-			want:  "",
-		},
-		{
-			name:  "user event returns empty",
-			event: map[string]interface{}{"type": "user"},
-			want:  "",
-		},
-		{
-			name: "no content field",
-			event: map[string]interface{}{
-				"type":    "assistant",
-				"message": map[string]interface{}{},
-			},
-			want: "",
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := extractTextFromEvent(tt.event)
-			if got != tt.want {
-				t.Errorf("got %q, want %q", got, tt.want)
-			}
-		})
-	}
-}
-
-func TestExtractCreatedFilesFromEvent(t *testing.T) {
-	tests := []struct {
-		name  string
-		event map[string]interface{}
-		want  []string
-	}{
-		{
-			name: "Write tool creates file",
-			event: map[string]interface{}{
-				"type": "assistant",
-				"message": map[string]interface{}{
-					"content": []interface{}{
-						map[string]interface{}{
-							"type": "tool_use",
-							"name": "Write",
-							"input": map[string]interface{}{
-								"file_path": "/tmp/output.txt",
-							},
-						},
-					},
-				},
-			},
-			want: []string{"/tmp/output.txt"},
-		},
-		{
-			name: "Bash redirect",
-			event: map[string]interface{}{
-				"type": "assistant",
-				"message": map[string]interface{}{
-					"content": []interface{}{
-						map[string]interface{}{
-							"type": "tool_use",
-							"name": "Bash",
-							"input": map[string]interface{}{
-								"command": "echo hello > /tmp/out.txt",
-							},
-						},
-					},
-				},
-			},
-			want: []string{"/tmp/out.txt"},
-		},
-		{
-			name: "Bash output flag",
-			event: map[string]interface{}{
-				"type": "assistant",
-				"message": map[string]interface{}{
-					"content": []interface{}{
-						map[string]interface{}{
-							"type": "tool_use",
-							"name": "Bash",
-							"input": map[string]interface{}{
-								"command": "curl -o /tmp/download.json http://example.com",
-							},
-						},
-					},
-				},
-			},
-			want: []string{"/tmp/download.json"},
-		},
-		{
-			name: "non-assistant event",
-			event: map[string]interface{}{
-				"type": "system",
-			},
-			want: nil,
-		},
-		{
-			name: "text block - no files",
-			event: map[string]interface{}{
-				"type": "assistant",
-				"message": map[string]interface{}{
-					"content": []interface{}{
-						map[string]interface{}{"type": "text", "text": "hello"},
-					},
-				},
-			},
-			want: nil,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := extractCreatedFilesFromEvent(tt.event)
-			if len(got) != len(tt.want) {
-				t.Errorf("got %d files %v, want %d files %v", len(got), got, len(tt.want), tt.want)
-				return
-			}
-			for i, f := range got {
-				if f != tt.want[i] {
-					t.Errorf("file[%d]: got %q, want %q", i, f, tt.want[i])
-				}
-			}
-		})
-	}
-}
-
 func TestAppendUnique(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -220,44 +50,16 @@ func TestAppendUnique(t *testing.T) {
 	}
 }
 
-// TestExtractTextFromEvent_RoundTrip tests with actual JSON parsing to simulate
-// real stream-json events from Claude CLI.
-func TestExtractTextFromEvent_RoundTrip(t *testing.T) {
-	jsonEvent := `{
-		"type": "assistant",
-		"message": {
-			"role": "assistant",
-			"content": [
-				{"type": "text", "text": "Here is the answer."},
-				{"type": "tool_use", "name": "Read", "input": {"file_path": "/tmp/x"}}
-			]
-		}
-	}`
-
-	var event map[string]interface{}
-	if err := json.Unmarshal([]byte(jsonEvent), &event); err != nil {
-		t.Fatalf("unmarshal: %v", err)
-	}
-
-	got := extractTextFromEvent(event)
-	if got != "Here is the answer." {
-		t.Errorf("round-trip: got %q", got)
-	}
-
-	files := extractCreatedFilesFromEvent(event)
-	if len(files) != 0 {
-		t.Errorf("Read tool should not produce created files, got: %v", files)
-	}
-}
-
 // --- Message queue tests ---
 
 // newTestSessionManager creates a minimal SessionManager suitable for unit
 // tests that don't need disk persistence or a real MemoryManager.
 func newTestSessionManager() *SessionManager {
 	return &SessionManager{
-		sessions: make(map[string]*Session),
-		procs:    make(map[string]context.CancelFunc),
+		sessions:   make(map[string]*Session),
+		active:     make(map[string]string),
+		recentDirs: make(map[string][]string),
+		procs:      make(map[string]context.CancelFunc),
 		config: &Config{
 			Sessions: SessionConfig{
 				MaxConcurrent:  2,
@@ -265,8 +67,10 @@ func newTestSessionManager() *SessionManager {
 				DefaultModel:   "test-model",
 			},
 		},
-		stateDir: "/tmp/pai-test-state",
-		memory:   &MemoryManager{enabled: false},
+		stateDir:   "/tmp/pai-test-state",
+		memory:     &MemoryManager{enabled: false},
+		runner:     &execRunner{},
+		runTimeout: time.Minute,
 	}
 }
 
@@ -325,11 +129,11 @@ func TestBuildBatch_TextFileAttachment(t *testing.T) {
 	msgs := []pendingMessage{
 		{
 			Text: "review this",
-			Attachment: &Attachment{
+			Attachments: []*Attachment{{
 				Type:        "text-file",
 				FileName:    "config.yaml",
 				TextContent: "key: value",
-			},
+			}},
 		},
 	}
 	text, att := session.buildBatch(msgs)
@@ -349,10 +153,10 @@ func TestBuildBatch_TextFileAttachment_DefaultLabel(t *testing.T) {
 	msgs := []pendingMessage{
 		{
 			Text: "look at this",
-			Attachment: &Attachment{
+			Attachments: []*Attachment{{
 				Type:        "text-file",
 				TextContent: "some content",
-			},
+			}},
 		},
 	}
 	text, _ := session.buildBatch(msgs)
@@ -361,24 +165,53 @@ func TestBuildBatch_TextFileAttachment_DefaultLabel(t *testing.T) {
 	}
 }
 
-func TestBuildBatch_BinaryAttachment_LastOneWins(t *testing.T) {
+func TestBuildBatch_KeepsEveryBinaryAttachment(t *testing.T) {
 	session := &Session{ID: "test-session-id"}
 	img1 := &Attachment{Type: "image", Base64: "aaa", MimeType: "image/png"}
 	img2 := &Attachment{Type: "image", Base64: "bbb", MimeType: "image/jpeg"}
+	pdf := &Attachment{Type: "document", Base64: "ccc", MimeType: "application/pdf", FileName: "spec.pdf"}
 	msgs := []pendingMessage{
-		{Text: "first image", Attachment: img1},
-		{Text: "second image", Attachment: img2},
+		{Text: "first image", Attachments: []*Attachment{img1}},
+		{Text: "just text"},
+		{Attachments: []*Attachment{img2, pdf}},
 	}
 	text, att := session.buildBatch(msgs)
-	if att == nil {
-		t.Fatal("expected binary attachment")
+	if len(att) != 3 || att[0].Base64 != "aaa" || att[1].Base64 != "bbb" || att[2].Base64 != "ccc" {
+		t.Fatalf("every binary attachment should be kept in order: %+v", att)
+	}
+	for i, want := range []string{"follow-up message 1/3, image", "follow-up message 3/3, image", "follow-up message 3/3, spec.pdf"} {
+		if !strings.Contains(att[i].Label, want) {
+			t.Errorf("attachment %d label %q missing %q", i, att[i].Label, want)
+		}
 	}
-	if att.Base64 != "bbb" {
-		t.Errorf("should keep last binary attachment, got Base64=%q", att.Base64)
+	if img1.Label != "" {
+		t.Error("labels go on copies, not the queued attachments")
 	}
-	if !strings.Contains(text, "first image") || !strings.Contains(text, "second image") {
+	if !strings.Contains(text, "first image") || !strings.Contains(text, "[Follow-up message 3/3]:\n(2 attachment(s))") {
 		t.Errorf("text messages should still be included: %q", text)
 	}
+	if strings.Contains(text, "left out") {
+		t.Errorf("nothing was dropped: %q", text)
+	}
+}
+
+func TestBuildBatch_AttachmentSizeCap(t *testing.T) {
+	session := &Session{ID: "test-session-id"}
+	big := strings.Repeat("A", base64.StdEncoding.EncodedLen(12<<20))
+	msgs := []pendingMessage{
+		{Text: "one", Attachments: []*Attachment{{Type: "image", Base64: big}}},
+		{Text: "two", Attachments: []*Attachment{{Type: "image", Base64: big, FileName: "second.png"}}},
+		{Text: "three", Attachments: []*Attachment{{Type: "image", Base64: "c21hbGw="}}},
+	}
+	text, att := session.buildBatch(msgs)
+	if len(att) != 2 || att[0].Base64 != big || att[1].Base64 != "c21hbGw=" {
+		t.Fatalf("the attachment over the cap should be dropped, the rest kept: %d kept", len(att))
+	}
+	for _, want := range []string{"1 attachment(s) were left out", "20 MB", "follow-up message 2/3, second.png (12.0 MB)"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("note %q missing %q", text, want)
+		}
+	}
 }
 
 func TestBuildBatch_AllEmptyMessages(t *testing.T) {
@@ -424,7 +257,7 @@ func TestBuildBatch_EmptyTextWithBinaryAttachment(t *testing.T) {
 	session := &Session{ID: "test-session-id"}
 	img := &Attachment{Type: "image", Base64: "data", MimeType: "image/png"}
 	msgs := []pendingMessage{
-		{Text: "", Attachment: img},
+		{Text: "", Attachments: []*Attachment{img}},
 	}
 	text, att := session.buildBatch(msgs)
 	// Text is empty but there's a binary attachment — should NOT return empty
@@ -478,11 +311,11 @@ func TestQueueDepthCap(t *testing.T) {
 		UserID: "user1",
 		Status: "busy",
 	}
-	sm.sessions["user1"] = session
+	sm.putSession(session)
 
 	// Fill to capacity
 	for i := 0; i < maxPendingMessages; i++ {
-		result, err := sm.SendMessage("user1", fmt.Sprintf("msg %d", i), nil)
+		result, err := sm.SendMessage("user1", fmt.Sprintf("msg %d", i), nil, nil)
 		if err != nil {
 			t.Fatalf("message %d should queue successfully: %v", i, err)
 		}
@@ -492,7 +325,7 @@ func TestQueueDepthCap(t *testing.T) {
 	}
 
 	// The next one should be rejected
-	_, err := sm.SendMessage("user1", "one too many", nil)
+	_, err := sm.SendMessage("user1", "one too many", nil, nil)
 	if err == nil {
 		t.Fatal("expected error when queue is full")
 	}
@@ -525,7 +358,7 @@ func TestConcurrentQueueSafety(t *testing.T) {
 		UserID: "user1",
 		Status: "busy",
 	}
-	sm.sessions["user1"] = session
+	sm.putSession(session)
 
 	const goroutines = 50
 	var wg sync.WaitGroup
@@ -536,7 +369,7 @@ func TestConcurrentQueueSafety(t *testing.T) {
 	for i := 0; i < goroutines; i++ {
 		go func(n int) {
 			defer wg.Done()
-			_, err := sm.SendMessage("user1", fmt.Sprintf("concurrent msg %d", n), nil)
+			_, err := sm.SendMessage("user1", fmt.Sprintf("concurrent msg %d", n), nil, nil)
 			if err != nil {
 				errors <- err
 			}
@@ -582,7 +415,7 @@ func TestConcurrentQueueAndDrain(t *testing.T) {
 		UserID: "user1",
 		Status: "busy",
 	}
-	sm.sessions["user1"] = session
+	sm.putSession(session)
 
 	const producers = 20
 	var wg sync.WaitGroup
@@ -592,7 +425,7 @@ func TestConcurrentQueueAndDrain(t *testing.T) {
 	for i := 0; i < producers; i++ {
 		go func(n int) {
 			defer wg.Done()
-			sm.SendMessage("user1", fmt.Sprintf("msg %d", n), nil)
+			sm.SendMessage("user1", fmt.Sprintf("msg %d", n), nil, nil)
 		}(i)
 	}
 
@@ -616,7 +449,7 @@ func TestQueuedMessagePreservesAttachment(t *testing.T) {
 		UserID: "user1",
 		Status: "busy",
 	}
-	sm.sessions["user1"] = session
+	sm.putSession(session)
 
 	pdf := &Attachment{
 		Type:     "document",
@@ -625,7 +458,7 @@ func TestQueuedMessagePreservesAttachment(t *testing.T) {
 		FileName: "report.pdf",
 	}
 
-	result, err := sm.SendMessage("user1", "review this PDF", pdf)
+	result, err := sm.SendMessage("user1", "review this PDF", []*Attachment{pdf}, nil)
 	if err != nil {
 		t.Fatalf("queue failed: %v", err)
 	}
@@ -636,10 +469,11 @@ func TestQueuedMessagePreservesAttachment(t *testing.T) {
 	// Simulate drain using takePending
 	queued := session.takePending()
 
-	text, att := session.buildBatch(queued)
-	if att == nil {
+	text, atts := session.buildBatch(queued)
+	if len(atts) != 1 {
 		t.Fatal("binary attachment should be preserved through queue")
 	}
+	att := atts[0]
 	if att.Base64 != "JVBERi0xLjQ=" {
 		t.Errorf("attachment Base64 corrupted: %q", att.Base64)
 	}
@@ -650,3 +484,292 @@ func TestQueuedMessagePreservesAttachment(t *testing.T) {
 		t.Errorf("text should be in batch: %q", text)
 	}
 }
+
+// --- Named session tests ---
+
+func TestNamedSessions_CreateSwitchKill(t *testing.T) {
+	sm := newTestSessionManager()
+	sm.stateDir = t.TempDir()
+	sm.config.Sessions.MaxPerUser = 3
+
+	infra, err := sm.NewNamedSession("user1", "1", "Infra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infra.Name != "infra" {
+		t.Errorf("names should be lowercased, got %q", infra.Name)
+	}
+	blog, _ := sm.NewNamedSession("user1", "1", "blog")
+	if got := sm.GetSession("user1"); got != blog {
+		t.Errorf("newest session should be active, got %v", got.Name)
+	}
+
+	if _, err := sm.NewNamedSession("user1", "1", "blog"); err == nil {
+		t.Error("duplicate name should be rejected")
+	}
+	if _, err := sm.NewNamedSession("user1", "1", "no spaces"); err == nil {
+		t.Error("invalid name should be rejected")
+	}
+	auto, err := sm.NewNamedSession("user1", "1", "")
+	if err != nil || auto.Name != defaultSessionName {
+		t.Errorf("unnamed session should get %q, got %v (%v)", defaultSessionName, auto, err)
+	}
+	if _, err := sm.NewNamedSession("user1", "1", "taxes"); err == nil {
+		t.Error("max_per_user should be enforced")
+	}
+
+	if _, err := sm.SwitchSession("user1", "infra"); err != nil {
+		t.Fatal(err)
+	}
+	if sm.GetSession("user1") != infra {
+		t.Error("switch should change the active session")
+	}
+	if _, err := sm.SwitchSession("user1", "nope"); err == nil {
+		t.Error("switching to a missing session should fail")
+	}
+
+	// Killing a background session leaves the active one alone
+	if !sm.KillSession("user1", "blog") {
+		t.Fatal("kill by name should succeed")
+	}
+	if sm.GetSession("user1") != infra {
+		t.Error("killing another session should not change the active one")
+	}
+	// Killing the active session leaves the user without one
+	if !sm.KillSession("user1", "") {
+		t.Fatal("kill active should succeed")
+	}
+	if sm.GetSession("user1") != nil {
+		t.Error("no session should be active after killing the active one")
+	}
+	if sessions, _ := sm.ListSessions("user1"); len(sessions) != 1 || sessions[0].Name != defaultSessionName {
+		t.Errorf("remaining sessions: %v", sessions)
+	}
+}
+
+func TestMaxConcurrent_CountsRuns(t *testing.T) {
+	hold := make(chan struct{})
+	sm, _ := newFakeRunnerManager(t,
+		fakeRun{lines: []string{systemLine("claude-1"), textLine("done")}, hold: hold},
+		fakeRun{lines: []string{systemLine("claude-2"), textLine("next")}},
+	)
+	sm.config.Sessions.MaxConcurrent = 1
+
+	done := startHeldRun(t, sm, "long task")
+
+	// Sessions are bounded by max_per_user only; runs by max_concurrent
+	if _, err := sm.NewNamedSession("user1", "1", "b"); err != nil {
+		t.Fatalf("a second session should not need a run slot: %v", err)
+	}
+	if _, err := sm.SendMessage("user1", "parallel", nil, nil); err == nil {
+		t.Error("a second run by the same user should be refused at max_concurrent=1")
+	}
+	if _, err := sm.SendMessage("user2", "hello", nil, nil); err == nil {
+		t.Error("another user's run should be refused at max_concurrent=1")
+	}
+
+	close(hold)
+	if out := <-done; out.err != nil {
+		t.Fatal(out.err)
+	}
+	if r, err := sm.SendMessage("user2", "hello", nil, nil); err != nil || r.Text != "next" {
+		t.Errorf("run after the slot frees: %+v %v", r, err)
+	}
+}
+
+func TestNamedSessions_Persistence(t *testing.T) {
+	dir := t.TempDir()
+	sm := newTestSessionManager()
+	sm.stateDir = dir
+	sm.NewNamedSession("user1", "1", "infra")
+	sm.NewNamedSession("user1", "1", "blog")
+	sm.SwitchSession("user1", "infra")
+
+	loaded := newTestSessionManager()
+	loaded.stateDir = dir
+	loaded.loadFromDisk()
+	sessions, activeID := loaded.ListSessions("user1")
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(sessions))
+	}
+	if active := loaded.GetSession("user1"); active == nil || active.Name != "infra" || active.ID != activeID {
+		t.Errorf("active session not restored: %v", active)
+	}
+}
+
+func TestNamedSessions_LoadsLegacyArray(t *testing.T) {
+	dir := t.TempDir()
+	legacy := `[{"id":"abc12345-old","userId":"user1","chatId":"1","model":"m","messageCount":3,"claudeSessionId":"c1"}]`
+	os.WriteFile(filepath.Join(dir, "sessions.json"), []byte(legacy), 0644)
+
+	sm := newTestSessionManager()
+	sm.stateDir = dir
+	sm.loadFromDisk()
+
+	s := sm.GetSession("user1")
+	if s == nil {
+		t.Fatal("legacy session should load as the active session")
+	}
+	if s.Name != defaultSessionName || s.ClaudeSessionID != "c1" {
+		t.Errorf("legacy session: name=%q claude=%q", s.Name, s.ClaudeSessionID)
+	}
+}
+
+func TestCleanStale_PerSession(t *testing.T) {
+	sm := newTestSessionManager()
+	sm.stateDir = t.TempDir()
+	sm.config.Sessions.TimeoutMinutes = 60
+	sm.config.Sessions.ResetHour = -1
+
+	old, _ := sm.NewNamedSession("user1", "1", "old")
+	fresh, _ := sm.NewNamedSession("user1", "1", "fresh")
+	old.LastActivityAt = time.Now().Add(-2 * time.Hour).UnixMilli()
+
+	if n := sm.CleanStale(); n != 1 {
+		t.Errorf("expected 1 cleaned, got %d", n)
+	}
+	if sessions, _ := sm.ListSessions("user1"); len(sessions) != 1 || sessions[0] != fresh {
+		t.Errorf("only the idle session should be cleaned: %v", sessions)
+	}
+	if sm.GetSession("user1") != fresh {
+		t.Error("active session should survive")
+	}
+}
+
+func TestSetModel_PersistsOnActiveSession(t *testing.T) {
+	dir := t.TempDir()
+	sm := newTestSessionManager()
+	sm.stateDir = dir
+
+	// No session yet: one is started so the choice applies to the first message
+	s, err := sm.SetModel("user1", "claude-haiku")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != defaultSessionName || s.Model != "claude-haiku" {
+		t.Errorf("got %s/%s", s.Name, s.Model)
+	}
+
+	sm.NewNamedSession("user1", "1", "infra")
+	sm.SetModel("user1", "claude-opus")
+
+	loaded := newTestSessionManager()
+	loaded.stateDir = dir
+	loaded.loadFromDisk()
+	sessions, _ := loaded.ListSessions("user1")
+	models := map[string]string{}
+	for _, s := range sessions {
+		models[s.Name] = s.Model
+	}
+	if models[defaultSessionName] != "claude-haiku" || models["infra"] != "claude-opus" {
+		t.Errorf("models after reload: %v", models)
+	}
+}
+
+func TestChangeDir_FreshClaudeSession(t *testing.T) {
+	dir := t.TempDir()
+	sm := newTestSessionManager()
+	sm.stateDir = dir
+
+	s, changed, err := sm.ChangeDir("user1", "/tmp")
+	if err != nil || changed {
+		t.Fatalf("cd to the current dir: changed=%v err=%v", changed, err)
+	}
+	s.ClaudeSessionID = "claude-1"
+
+	if _, changed, _ := sm.ChangeDir("user1", "/srv/app"); !changed {
+		t.Error("expected a change")
+	}
+	if s.WorkDir != "/srv/app" || s.ClaudeSessionID != "" {
+		t.Errorf("after cd: workDir=%q claude=%q", s.WorkDir, s.ClaudeSessionID)
+	}
+
+	s.Status = "busy"
+	if _, _, err := sm.ChangeDir("user1", "/srv/other"); err == nil {
+		t.Error("cd while Claude is running should be refused")
+	}
+	s.Status = "active"
+
+	loaded := newTestSessionManager()
+	loaded.stateDir = dir
+	loaded.loadFromDisk()
+	if got := loaded.RecentDirs("user1"); !reflect.DeepEqual(got, []string{"/srv/app", "/tmp"}) {
+		t.Errorf("recent dirs after reload: %v", got)
+	}
+	if got := loaded.GetSession("user1"); got == nil || got.WorkDir != "/srv/app" {
+		t.Errorf("work dir not persisted: %v", got)
+	}
+}
+
+// fakeClaude installs a stand-in claude binary running script and points
+// CLAUDE_PATH at it.
+func fakeClaude(t *testing.T, script string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "claude")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CLAUDE_PATH", path)
+}
+
+func TestCancelRun_KeepsSessionAndPartialOutput(t *testing.T) {
+	fakeClaude(t, `echo '{"type":"system","session_id":"claude-abc"}'
+echo '{"type":"assistant","message":{"content":[{"type":"text","text":"Halfway there"}]}}'
+exec sleep 30
+`)
+	sm := newTestSessionManager()
+	sm.stateDir = t.TempDir()
+
+	gotText := make(chan struct{})
+	var once sync.Once
+	stream := &StreamCallbacks{OnText: func(string) { once.Do(func() { close(gotText) }) }}
+
+	type outcome struct {
+		result *MessageResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		r, err := sm.SendMessage("user1", "long task", nil, stream)
+		done <- outcome{r, err}
+	}()
+
+	select {
+	case <-gotText:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fake claude produced no text")
+	}
+	s := sm.BusySession("user1")
+	if s == nil {
+		t.Fatal("session should be busy")
+	}
+	sm.SendMessage("user1", "queued one", nil, nil)
+	sm.SendMessage("user1", "queued two", nil, nil)
+
+	dropped, err := sm.CancelRun("user1", s.ID, false)
+	if err != nil || dropped != 2 {
+		t.Fatalf("CancelRun: dropped=%d err=%v", dropped, err)
+	}
+
+	var out outcome
+	select {
+	case out = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not stop after cancel")
+	}
+	if out.err != nil {
+		t.Fatalf("a cancelled run is not an error: %v", out.err)
+	}
+	if !out.result.Cancelled || out.result.Text != "Halfway there" || out.result.FollowUp != nil {
+		t.Errorf("result: %+v", out.result)
+	}
+	if got := sm.GetSession("user1"); got == nil || got.ClaudeSessionID != "claude-abc" || got.Status != "active" {
+		t.Errorf("session should survive with its Claude session: %+v", got)
+	}
+	if _, err := sm.CancelRun("user1", s.ID, false); err == nil {
+		t.Error("cancelling an idle session should fail")
+	}
+	if _, err := sm.CancelRun("user2", s.ID, false); err == nil {
+		t.Error("another user must not cancel this run")
+	}
+}
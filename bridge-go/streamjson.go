@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Claude Code's stream-json output is one JSON object per line:
+//
+//	system    "init" carries the session ID, model and cwd
+//	assistant a model turn: text and tool_use blocks
+//	user      tool_result blocks reported back to the model
+//	result    the final event, with the reply, usage and cost
+//	error     an API error surfaced outside a result
+//
+// Fields the bridge doesn't use are ignored, and so are event and block types
+// it doesn't know, so newer CLI versions keep working.
+
+// StreamEvent is one decoded stream-json line. Which fields are set depends on
+// Type.
+type StreamEvent struct {
+	Type      string `json:"type"`
+	Subtype   string `json:"subtype,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+
+	// system/init
+	Model string `json:"model,omitempty"`
+	Cwd   string `json:"cwd,omitempty"`
+
+	// assistant, user
+	Message *StreamMessage `json:"message,omitempty"`
+
+	// result
+	Result        string       `json:"result,omitempty"`
+	IsError       bool         `json:"is_error,omitempty"`
+	DurationMS    int64        `json:"duration_ms,omitempty"`
+	DurationAPIMS int64        `json:"duration_api_ms,omitempty"`
+	NumTurns      int          `json:"num_turns,omitempty"`
+	TotalCostUSD  float64      `json:"total_cost_usd,omitempty"`
+	Usage         *StreamUsage `json:"usage,omitempty"`
+
+	// error, or an assistant turn that reports an API error
+	Error *StreamError `json:"error,omitempty"`
+}
+
+// StreamMessage is the API message inside an assistant or user event.
+type StreamMessage struct {
+	ID      string         `json:"id,omitempty"`
+	Role    string         `json:"role,omitempty"`
+	Model   string         `json:"model,omitempty"`
+	Content []ContentBlock `json:"content"`
+	Usage   *StreamUsage   `json:"usage,omitempty"`
+}
+
+// ContentBlock is one block of a message: text, tool_use or tool_result.
+type ContentBlock struct {
+	Type string `json:"type"`
+
+	// text
+	Text string `json:"text,omitempty"`
+
+	// tool_use
+	ID    string                 `json:"id,omitempty"`
+	Name  string                 `json:"name,omitempty"`
+	Input map[string]interface{} `json:"input,omitempty"`
+
+	// tool_result; Content is a string or a list of blocks
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	IsError   bool            `json:"is_error,omitempty"`
+}
+
+// StreamUsage is the token count of a turn or, on a result, of the whole run.
+type StreamUsage struct {
+	InputTokens              int64 `json:"input_tokens"`
+	OutputTokens             int64 `json:"output_tokens"`
+	CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
+}
+
+// StreamError is an API error. The CLI writes it either as an object
+// ({"type":"overloaded_error","message":"Overloaded"}) or as a bare string.
+type StreamError struct {
+	Type    string `json:"type,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func (e *StreamError) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		e.Type = s
+		return nil
+	}
+	type plain StreamError
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	// Some errors nest the API's error object one level down
+	var nested struct {
+		Error *plain `json:"error"`
+	}
+	if p.Message == "" && json.Unmarshal(data, &nested) == nil && nested.Error != nil {
+		p = *nested.Error
+	}
+	*e = StreamError(p)
+	return nil
+}
+
+// decodeStreamEvent parses one stream-json line.
+func decodeStreamEvent(line []byte) (*StreamEvent, error) {
+	var event StreamEvent
+	if err := json.Unmarshal(line, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// decodeStream sends each event read from r to events, skipping blank and
+// malformed lines, until r ends. It does not close events.
+func decodeStream(r io.Reader, events chan<- *StreamEvent) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024) // 1MB buffer
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		event, err := decodeStreamEvent(line)
+		if err != nil {
+			continue
+		}
+		events <- event
+	}
+	return scanner.Err()
+}
+
+// blocks returns the content blocks of an event of the given type.
+func (e *StreamEvent) blocks(eventType string) []ContentBlock {
+	if e.Type != eventType || e.Message == nil {
+		return nil
+	}
+	return e.Message.Content
+}
+
+// Text returns the text an assistant event adds to the reply.
+func (e *StreamEvent) Text() string {
+	var sb strings.Builder
+	for _, b := range e.blocks("assistant") {
+		if b.Type == "text" {
+			sb.WriteString(b.Text)
+		}
+	}
+	return sb.String()
+}
+
+type toolUse struct {
+	ID    string
+	Name  string
+	Input map[string]interface{}
+}
+
+type toolResult struct {
+	ToolUseID string
+	IsError   bool
+}
+
+// ToolUses returns the tool_use blocks of an assistant event.
+func (e *StreamEvent) ToolUses() []toolUse {
+	var uses []toolUse
+	for _, b := range e.blocks("assistant") {
+		if b.Type == "tool_use" {
+			uses = append(uses, toolUse{ID: b.ID, Name: b.Name, Input: b.Input})
+		}
+	}
+	return uses
+}
+
+// ToolResults returns the tool_result blocks of a user event (Claude Code
+// reports tool output back as a user turn).
+func (e *StreamEvent) ToolResults() []toolResult {
+	var results []toolResult
+	for _, b := range e.blocks("user") {
+		if b.Type == "tool_result" {
+			results = append(results, toolResult{ToolUseID: b.ToolUseID, IsError: b.IsError})
+		}
+	}
+	return results
+}
+
+var (
+	redirectPattern   = regexp.MustCompile(`>\s*(/\S+\.\w+)`)
+	outputFlagPattern = regexp.MustCompile(`(?:-o|--output)\s+["']?(\S+\.\w+)["']?`)
+)
+
+// CreatedFiles guesses which files an assistant event's tool calls write:
+// Write targets, and shell redirects or -o/--output arguments in Bash.
+func (e *StreamEvent) CreatedFiles() []string {
+	var files []string
+	for _, tu := range e.ToolUses() {
+		switch tu.Name {
+		case "Write":
+			if fp, ok := tu.Input["file_path"].(string); ok {
+				files = append(files, fp)
+			}
+		case "Bash":
+			if cmd, ok := tu.Input["command"].(string); ok {
+				for _, m := range redirectPattern.FindAllStringSubmatch(cmd, -1) {
+					files = append(files, m[1])
+				}
+				for _, m := range outputFlagPattern.FindAllStringSubmatch(cmd, -1) {
+					files = append(files, m[1])
+				}
+			}
+		}
+	}
+	return files
+}
+
+// ErrorMessage describes the failure an event reports, or "" if it reports
+// none: an error event, an assistant turn flagged with an API error, or a
+// result with is_error set.
+func (e *StreamEvent) ErrorMessage() string {
+	if e.Error != nil {
+		msg := e.Error.Message
+		if msg == "" {
+			msg = e.Text()
+		}
+		if msg == "" {
+			msg = e.Error.Type
+		}
+		return msg
+	}
+	if e.Type == "result" && e.IsError {
+		if e.Result != "" {
+			return e.Result
+		}
+		return strings.ReplaceAll(e.Subtype, "_", " ")
+	}
+	return ""
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+func mustDecode(t *testing.T, line string) *StreamEvent {
+	t.Helper()
+	event, err := decodeStreamEvent([]byte(line))
+	if err != nil {
+		t.Fatalf("decode %s: %v", line, err)
+	}
+	return event
+}
+
+func TestStreamEventText(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		want  string
+	}{
+		{"assistant text block", `{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Hello world"}]}}`, "Hello world"},
+		{"multiple text blocks", `{"type":"assistant","message":{"content":[{"type":"text","text":"First "},{"type":"text","text":"Second"}]}}`, "First Second"},
+		{"tool_use block ignored", `{"type":"assistant","message":{"content":[{"type":"tool_use","name":"Read"}]}}`, ""},
+		{"system event returns empty", `{"type":"system","session_id":"abc"}`, ""},
+		{"user event returns empty", `{"type":"user"}`, ""},
+		{"no content field", `{"type":"assistant","message":{}}`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mustDecode(t, tt.event).Text(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamEventCreatedFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		want  []string
+	}{
+		{"Write tool creates file", `{"type":"assistant","message":{"content":[{"type":"tool_use","name":"Write","input":{"file_path":"/tmp/output.txt"}}]}}`, []string{"/tmp/output.txt"}},
+		{"Bash redirect", `{"type":"assistant","message":{"content":[{"type":"tool_use","name":"Bash","input":{"command":"echo hello > /tmp/out.txt"}}]}}`, []string{"/tmp/out.txt"}},
+		{"Bash output flag", `{"type":"assistant","message":{"content":[{"type":"tool_use","name":"Bash","input":{"command":"curl -o /tmp/download.json http://example.com"}}]}}`, []string{"/tmp/download.json"}},
+		{"Read tool creates nothing", `{"type":"assistant","message":{"content":[{"type":"text","text":"Here is the answer."},{"type":"tool_use","name":"Read","input":{"file_path":"/tmp/x"}}]}}`, nil},
+		{"non-assistant event", `{"type":"system"}`, nil},
+		{"text block - no files", `{"type":"assistant","message":{"content":[{"type":"text","text":"hello"}]}}`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mustDecode(t, tt.event).CreatedFiles(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamEventToolUsesAndResults(t *testing.T) {
+	assistant := mustDecode(t, `{"type":"assistant","message":{"content":[
+		{"type":"text","text":"Let me look."},
+		{"type":"tool_use","id":"toolu_1","name":"Read","input":{"file_path":"/tmp/a.go"}},
+		{"type":"tool_use","id":"toolu_2","name":"Bash","input":{"command":"ls"}}
+	]}}`)
+	user := mustDecode(t, `{"type":"user","message":{"role":"user","content":[
+		{"type":"tool_result","tool_use_id":"toolu_1","content":"package main"},
+		{"type":"tool_result","tool_use_id":"toolu_2","content":"boom","is_error":true}
+	]}}`)
+
+	uses := assistant.ToolUses()
+	if len(uses) != 2 {
+		t.Fatalf("expected 2 tool uses, got %d", len(uses))
+	}
+	if uses[0].ID != "toolu_1" || uses[0].Name != "Read" || uses[0].Input["file_path"] != "/tmp/a.go" {
+		t.Errorf("unexpected first tool use: %+v", uses[0])
+	}
+	if len(user.ToolUses()) != 0 {
+		t.Error("user event should not yield tool uses")
+	}
+
+	results := user.ToolResults()
+	if len(results) != 2 {
+		t.Fatalf("expected 2 tool results, got %d", len(results))
+	}
+	if results[0].ToolUseID != "toolu_1" || results[0].IsError {
+		t.Errorf("unexpected first result: %+v", results[0])
+	}
+	if results[1].ToolUseID != "toolu_2" || !results[1].IsError {
+		t.Errorf("unexpected second result: %+v", results[1])
+	}
+	if len(assistant.ToolResults()) != 0 {
+		t.Error("assistant event should not yield tool results")
+	}
+}
+
+func TestStreamErrorForms(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		want  string
+	}{
+		{"object", `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, "Overloaded"},
+		{"wrapped object", `{"type":"error","error":{"type":"error","error":{"type":"api_error","message":"Internal server error"}}}`, "Internal server error"},
+		{"string on assistant turn", `{"type":"assistant","error":"rate_limit","message":{"content":[{"type":"text","text":"API Error: 429"}]}}`, "API Error: 429"},
+		{"bare string", `{"type":"error","error":"authentication_failed"}`, "authentication_failed"},
+		{"failed result", `{"type":"result","subtype":"error_max_turns","is_error":true}`, "error max turns"},
+		{"successful result", `{"type":"result","subtype":"success","result":"done"}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mustDecode(t, tt.event).ErrorMessage(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// renderStream describes decoded events one per line, followed by what the
+// bridge takes from the run as a whole.
+func renderStream(events []*StreamEvent) string {
+	var sb strings.Builder
+	var text strings.Builder
+	var files []string
+	var sessionID, lastError string
+
+	for _, e := range events {
+		kind := e.Type
+		if e.Subtype != "" {
+			kind += "/" + e.Subtype
+		}
+		switch e.Type {
+		case "system":
+			fmt.Fprintf(&sb, "%s session=%s model=%s cwd=%s\n", kind, e.SessionID, e.Model, e.Cwd)
+		case "assistant", "user":
+			for _, b := range e.Message.Content {
+				switch b.Type {
+				case "text":
+					fmt.Fprintf(&sb, "%s text %q\n", kind, b.Text)
+				case "tool_use":
+					input, _ := json.Marshal(b.Input)
+					fmt.Fprintf(&sb, "%s tool_use %s %s %s\n", kind, b.ID, b.Name, input)
+				case "tool_result":
+					fmt.Fprintf(&sb, "%s tool_result %s is_error=%v\n", kind, b.ToolUseID, b.IsError)
+				default:
+					fmt.Fprintf(&sb, "%s %s (ignored)\n", kind, b.Type)
+				}
+			}
+		case "result":
+			fmt.Fprintf(&sb, "%s is_error=%v turns=%d cost=$%.4f duration=%dms", kind, e.IsError, e.NumTurns, e.TotalCostUSD, e.DurationMS)
+			if u := e.Usage; u != nil {
+				fmt.Fprintf(&sb, " in=%d out=%d cache_write=%d cache_read=%d", u.InputTokens, u.OutputTokens, u.CacheCreationInputTokens, u.CacheReadInputTokens)
+			}
+			sb.WriteString("\n")
+		case "error":
+			fmt.Fprintf(&sb, "%s\n", kind)
+		default:
+			fmt.Fprintf(&sb, "%s (ignored)\n", kind)
+		}
+		if msg := e.ErrorMessage(); msg != "" {
+			fmt.Fprintf(&sb, "  error: %s\n", msg)
+			if lastError == "" || e.Type != "result" {
+				lastError = msg
+			}
+		}
+
+		if e.Type == "system" && e.SessionID != "" && sessionID == "" {
+			sessionID = e.SessionID
+		}
+		text.WriteString(e.Text())
+		for _, f := range e.CreatedFiles() {
+			files = appendUnique(files, f)
+		}
+	}
+
+	fmt.Fprintf(&sb, "--\nsession: %s\ntext: %q\nfiles: %v\nerror: %q\n", sessionID, text.String(), files, lastError)
+	return sb.String()
+}
+
+// TestDecodeStream_Golden decodes recorded Claude Code transcripts in
+// testdata/stream and compares them with their .golden renderings. Run with
+// -update after adding a transcript.
+func TestDecodeStream_Golden(t *testing.T) {
+	transcripts, err := filepath.Glob(filepath.Join("testdata", "stream", "*.jsonl"))
+	if err != nil || len(transcripts) == 0 {
+		t.Fatalf("no transcripts: %v", err)
+	}
+	for _, path := range transcripts {
+		name := strings.TrimSuffix(filepath.Base(path), ".jsonl")
+		t.Run(name, func(t *testing.T) {
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			ch := make(chan *StreamEvent)
+			errc := make(chan error, 1)
+			go func() {
+				errc <- decodeStream(f, ch)
+				close(ch)
+			}()
+			var events []*StreamEvent
+			for e := range ch {
+				events = append(events, e)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			got := renderStream(events)
+			goldenPath := strings.TrimSuffix(path, ".jsonl") + ".golden"
+			if *updateGolden {
+				if err := os.WriteFile(goldenPath, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("%v (run go test -run Golden -update)", err)
+			}
+			if got != string(want) {
+				t.Errorf("%s mismatch\n--- got\n%s--- want\n%s", goldenPath, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOTP (RFC 6238) second factor. Each Telegram user can enroll a secret; a
+// valid code sent with /unlock elevates the user for a limited time. Depending
+// on security.totp.mode, elevation is required for every message ("all") or
+// only for flagged actions ("sensitive").
+
+const (
+	totpPeriod = 30 // seconds per time step
+	totpDigits = 6
+	totpIssuer = "PAI"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret returns a new random 160-bit secret, base32-encoded.
+func generateTOTPSecret() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(buf), nil
+}
+
+// hotp computes an RFC 4226 code for the given counter.
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, code%mod)
+}
+
+// totpProvisioningURI builds the otpauth:// URI authenticator apps scan.
+func totpProvisioningURI(secret, account string) string {
+	label := url.PathEscape(totpIssuer + ":" + account)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprintf("%d", totpDigits))
+	q.Set("period", fmt.Sprintf("%d", totpPeriod))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// --- Encrypted secret store ---
+
+// totpStore persists per-user TOTP secrets as AES-256-GCM ciphertext. The
+// store lives on the persistent volume; the key does not.
+type totpStore struct {
+	path string
+	aead cipher.AEAD
+
+	mu      sync.Mutex
+	records map[string]totpRecord
+}
+
+type totpRecord struct {
+	Secret      string `json:"secret"`    // base64(nonce || ciphertext)
+	Confirmed   bool   `json:"confirmed"` // false until the first valid code
+	CreatedAt   int64  `json:"createdAt"`
+	LastCounter uint64 `json:"lastCounter,omitempty"` // last accepted time step, bound to Secret
+}
+
+// errTOTPReplay is returned by Accept for a time step already used.
+var errTOTPReplay = errors.New("TOTP code already used")
+
+// loadTOTPKey returns the 32-byte store key from PAI_TOTP_KEY (hex or
+// base64) or from keyFile, creating keyFile with a fresh key if missing.
+func loadTOTPKey(keyFile string) ([]byte, error) {
+	if env := strings.TrimSpace(os.Getenv("PAI_TOTP_KEY")); env != "" {
+		return decodeTOTPKey(env)
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err == nil {
+		return decodeTOTPKey(strings.TrimSpace(string(data)))
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read key file: %w", err)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return nil, fmt.Errorf("create key dir: %w", err)
+	}
+	if err := os.WriteFile(keyFile, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("write key file: %w", err)
+	}
+	log.Printf("[PAI Bridge] Generated new TOTP store key at %s", keyFile)
+	return key, nil
+}
+
+func decodeTOTPKey(s string) ([]byte, error) {
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("TOTP key must be 32 bytes, hex or base64 encoded")
+}
+
+func newTOTPStore(path string, key []byte) (*totpStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	st := &totpStore{path: path, aead: aead, records: make(map[string]totpRecord)}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read TOTP store: %w", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &st.records); err != nil {
+			return nil, fmt.Errorf("parse TOTP store: %w", err)
+		}
+	}
+	return st, nil
+}
+
+func (st *totpStore) save() error {
+	if err := os.MkdirAll(filepath.Dir(st.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(st.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
+
+// totpAdditionalData binds a ciphertext to its user, so ciphertexts can't be
+// swapped between users, and to the last accepted time step, so the counter
+// can't be rolled back to replay a code. Records that never accepted a code
+// are bound to the user alone.
+func totpAdditionalData(userID string, counter uint64) []byte {
+	if counter == 0 {
+		return []byte(userID)
+	}
+	return []byte(userID + "\x00" + strconv.FormatUint(counter, 10))
+}
+
+func (st *totpStore) seal(userID, secret string, counter uint64) (string, error) {
+	nonce := make([]byte, st.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := st.aead.Seal(nonce, nonce, []byte(secret), totpAdditionalData(userID, counter))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (st *totpStore) open(userID string, rec totpRecord) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(rec.Secret)
+	if err != nil || len(sealed) < st.aead.NonceSize() {
+		return "", errors.New("corrupt TOTP record")
+	}
+	nonce, ct := sealed[:st.aead.NonceSize()], sealed[st.aead.NonceSize():]
+	plain, err := st.aead.Open(nil, nonce, ct, totpAdditionalData(userID, rec.LastCounter))
+	if err != nil {
+		return "", fmt.Errorf("decrypt TOTP secret: %w", err)
+	}
+	return string(plain), nil
+}
+
+// Put encrypts and stores a secret for userID.
+func (st *totpStore) Put(userID, secret string, confirmed bool, now time.Time) error {
+	sealed, err := st.seal(userID, secret, 0)
+	if err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.records[userID] = totpRecord{
+		Secret:    sealed,
+		Confirmed: confirmed,
+		CreatedAt: now.UnixMilli(),
+	}
+	return st.save()
+}
+
+// Get decrypts the user's secret. ok is false if the user never enrolled.
+func (st *totpStore) Get(userID string) (secret string, confirmed, ok bool, err error) {
+	st.mu.Lock()
+	rec, found := st.records[userID]
+	st.mu.Unlock()
+	if !found {
+		return "", false, false, nil
+	}
+	secret, err = st.open(userID, rec)
+	if err != nil {
+		return "", false, false, err
+	}
+	return secret, rec.Confirmed, true, nil
+}
+
+// Accept records counter as the user's last accepted time step and confirms
+// a pending enrollment. It returns errTOTPReplay, changing nothing, unless
+// counter is later than the last one, so a code works once even across
+// restarts.
+func (st *totpStore) Accept(userID string, counter uint64) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	rec, ok := st.records[userID]
+	if !ok {
+		return errors.New("not enrolled")
+	}
+	if counter <= rec.LastCounter {
+		return errTOTPReplay
+	}
+	secret, err := st.open(userID, rec)
+	if err != nil {
+		return err
+	}
+	if rec.Secret, err = st.seal(userID, secret, counter); err != nil {
+		return err
+	}
+	rec.LastCounter = counter
+	rec.Confirmed = true
+	st.records[userID] = rec
+	return st.save()
+}
+
+// --- Gate ---
+
+// totpAction identifies something that may require a fresh TOTP unlock.
+type totpAction int
+
+const (
+	totpActionMessage    totpAction = iota // any message to Claude (mode "all" only)
+	totpActionSendFile                     // delivering a file outside the projects tree
+	totpActionChangeDir                    // /cd outside the default work dir
+	totpActionQuotaGrant                   // /quota grant and revoke
+)
+
+// totpSafeSendPrefix is the tree SEND: may deliver from without a TOTP
+// unlock in "sensitive" mode.
+const totpSafeSendPrefix = "/mnt/pai-data/projects"
+
+type totpGate struct {
+	mode        string // "all" or "sensitive"
+	window      int    // accepted time steps either side of now
+	unlockFor   time.Duration
+	maxFailures int
+	lockout     time.Duration
+	now         func() time.Time
+	store       *totpStore
+
+	mu    sync.Mutex
+	users map[string]*totpState
+}
+
+type totpState struct {
+	elevatedUntil time.Time
+	failures      int
+	lockedUntil   time.Time
+}
+
+func newTOTPGate(sec SecurityConfig, store *totpStore) *totpGate {
+	return &totpGate{
+		mode:        sec.TOTP.Mode,
+		window:      sec.TOTP.WindowSteps,
+		unlockFor:   time.Duration(sec.TOTP.UnlockMinutes) * time.Minute,
+		maxFailures: sec.MaxFailedAttempts,
+		lockout:     time.Duration(sec.LockoutMinutes) * time.Minute,
+		now:         time.Now,
+		store:       store,
+		users:       make(map[string]*totpState),
+	}
+}
+
+func (g *totpGate) state(userID string) *totpState {
+	st, ok := g.users[userID]
+	if !ok {
+		st = &totpState{}
+		g.users[userID] = st
+	}
+	return st
+}
+
+// Required reports whether the action needs a TOTP unlock under the
+// configured mode.
+func (g *totpGate) Required(action totpAction) bool {
+	switch g.mode {
+	case "all":
+		return true
+	case "sensitive":
+		return action != totpActionMessage
+	}
+	return false
+}
+
+// Enrolled reports whether the user has a confirmed TOTP secret.
+func (g *totpGate) Enrolled(userID string) bool {
+	_, confirmed, ok, err := g.store.Get(userID)
+	return err == nil && ok && confirmed
+}
+
+// Elevated reports whether the user has a current TOTP unlock.
+func (g *totpGate) Elevated(userID string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.now().Before(g.state(userID).elevatedUntil)
+}
+
+// Enroll creates a new pending secret for the user, replacing any previous
+// one. It becomes active after the first successful Verify.
+func (g *totpGate) Enroll(userID, account string) (secret, uri string, err error) {
+	secret, err = generateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	if err := g.store.Put(userID, secret, false, g.now()); err != nil {
+		return "", "", fmt.Errorf("store secret: %w", err)
+	}
+	return secret, totpProvisioningURI(secret, account), nil
+}
+
+// Verify checks a code against the user's secret, accepting codes up to
+// window steps either side of now. On success the user is elevated for
+// unlockFor and a pending enrollment is confirmed.
+func (g *totpGate) Verify(userID, code string) (unlockResult, time.Time, error) {
+	secret, _, ok, err := g.store.Get(userID)
+	if err != nil {
+		return unlockWrong, time.Time{}, err
+	}
+	if !ok {
+		return unlockWrong, time.Time{}, errors.New("not enrolled")
+	}
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return unlockWrong, time.Time{}, fmt.Errorf("decode secret: %w", err)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	st := g.state(userID)
+	now := g.now()
+	if now.Before(st.lockedUntil) {
+		return unlockLockedOut, st.lockedUntil, nil
+	}
+
+	code = strings.TrimSpace(code)
+	current := uint64(now.Unix()) / totpPeriod
+	for d := -g.window; d <= g.window; d++ {
+		counter := uint64(int64(current) + int64(d))
+		if !hmac.Equal([]byte(hotp(key, counter)), []byte(code)) {
+			continue
+		}
+		// The store keeps the last accepted step, so replays are rejected
+		// across restarts too
+		if err := g.store.Accept(userID, counter); errors.Is(err, errTOTPReplay) {
+			continue
+		} else if err != nil {
+			log.Printf("[PAI Bridge] Failed to record TOTP use for %s: %v", userID, err)
+		}
+		st.failures = 0
+		st.elevatedUntil = now.Add(g.unlockFor)
+		log.Printf("[PAI Bridge] TOTP unlock for user %s until %s", userID, st.elevatedUntil.Format(time.RFC3339))
+		return unlockOK, st.elevatedUntil, nil
+	}
+
+	st.failures++
+	log.Printf("[PAI Bridge] Failed TOTP attempt for user %s (%d/%d)", userID, st.failures, g.maxFailures)
+	if g.maxFailures > 0 && st.failures >= g.maxFailures {
+		st.failures = 0
+		st.lockedUntil = now.Add(g.lockout)
+		return unlockLockedOut, st.lockedUntil, nil
+	}
+	return unlockWrong, time.Time{}, nil
+}
+
+// Lock ends the user's TOTP elevation.
+func (g *totpGate) Lock(userID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.state(userID).elevatedUntil = time.Time{}
+}
+
+// sendNeedsTOTP reports whether delivering path is a flagged action: files
+// outside the projects tree.
+func sendNeedsTOTP(path string) bool {
+	return !(strings.HasPrefix(path, totpSafeSendPrefix+"/") || path == totpSafeSendPrefix)
+}
+
+// dirNeedsTOTP reports whether switching to dir is a flagged action:
+// directories outside the default work dir tree. Both paths must be resolved.
+func dirNeedsTOTP(dir, defaultWorkDir string) bool {
+	return !(strings.HasPrefix(dir, defaultWorkDir+"/") || dir == defaultWorkDir)
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// RFC 6238 Appendix B vectors (SHA1 key), truncated to 6 digits.
+func TestHOTP_RFC6238Vectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got := hotp(key, uint64(tt.unix)/totpPeriod); got != tt.want {
+			t.Errorf("T=%d: got %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := totpProvisioningURI("JBSWY3DPEHPK3PXP", "alice")
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" {
+		t.Errorf("unexpected scheme/host: %s", uri)
+	}
+	if u.Path != "/PAI:alice" {
+		t.Errorf("label: got %q", u.Path)
+	}
+	q := u.Query()
+	if q.Get("secret") != "JBSWY3DPEHPK3PXP" || q.Get("issuer") != "PAI" || q.Get("digits") != "6" {
+		t.Errorf("unexpected query: %v", q)
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	s, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(s)
+	if err != nil || len(key) != 20 {
+		t.Errorf("secret should be 20 bytes of base32, got %q (%v)", s, err)
+	}
+}
+
+func testTOTPKey() []byte {
+	return bytes.Repeat([]byte{0x42}, 32)
+}
+
+func TestTOTPStore_EncryptedRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "totp.json")
+	st, err := newTOTPStore(path, testTOTPKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Put("user1", "JBSWY3DPEHPK3PXP", false, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := os.ReadFile(path)
+	if strings.Contains(string(raw), "JBSWY3DPEHPK3PXP") {
+		t.Fatal("secret stored in plaintext")
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("store should be 0600, got %v", info.Mode().Perm())
+	}
+
+	// Reload from disk
+	st2, err := newTOTPStore(path, testTOTPKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, confirmed, ok, err := st2.Get("user1")
+	if err != nil || !ok || confirmed || secret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("Get: secret=%q confirmed=%v ok=%v err=%v", secret, confirmed, ok, err)
+	}
+
+	// Wrong key can't decrypt
+	st3, _ := newTOTPStore(path, bytes.Repeat([]byte{0x01}, 32))
+	if _, _, _, err := st3.Get("user1"); err == nil {
+		t.Error("wrong key should fail to decrypt")
+	}
+}
+
+func TestTOTPStore_CiphertextBoundToUser(t *testing.T) {
+	st, _ := newTOTPStore(filepath.Join(t.TempDir(), "totp.json"), testTOTPKey())
+	st.Put("user1", "SECRET", true, time.Now())
+	st.records["user2"] = st.records["user1"]
+	if _, _, _, err := st.Get("user2"); err == nil {
+		t.Error("a record copied to another user must not decrypt")
+	}
+}
+
+func TestLoadTOTPKey(t *testing.T) {
+	t.Setenv("PAI_TOTP_KEY", "")
+	keyFile := filepath.Join(t.TempDir(), "sub", "totp.key")
+
+	key, err := loadTOTPKey(keyFile)
+	if err != nil || len(key) != 32 {
+		t.Fatalf("generate key: len=%d err=%v", len(key), err)
+	}
+	again, err := loadTOTPKey(keyFile)
+	if err != nil || !bytes.Equal(key, again) {
+		t.Error("second load should return the same key from the file")
+	}
+
+	t.Setenv("PAI_TOTP_KEY", strings.Repeat("ab", 32))
+	envKey, err := loadTOTPKey(keyFile)
+	if err != nil || envKey[0] != 0xab {
+		t.Errorf("env key should take precedence: %v", err)
+	}
+
+	t.Setenv("PAI_TOTP_KEY", "too-short")
+	if _, err := loadTOTPKey(keyFile); err == nil {
+		t.Error("invalid env key should error")
+	}
+}
+
+// newTestTOTPGate returns an enrolled, confirmed user1 with a fixed clock.
+func newTestTOTPGate(t *testing.T, mode string) (*totpGate, []byte, *time.Time) {
+	t.Helper()
+	st, err := newTOTPStore(filepath.Join(t.TempDir(), "totp.json"), testTOTPKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newTOTPGate(SecurityConfig{
+		MaxFailedAttempts: 3,
+		LockoutMinutes:    10,
+		TOTP:              TOTPConfig{Mode: mode, WindowSteps: 1, UnlockMinutes: 15},
+	}, st)
+	now := time.Unix(1_800_000_000, 0)
+	g.now = func() time.Time { return now }
+
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // "12345678901234567890"
+	if err := st.Put("user1", secret, true, now); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	return g, key, &now
+}
+
+func codeAt(key []byte, ts time.Time) string {
+	return hotp(key, uint64(ts.Unix())/totpPeriod)
+}
+
+func TestTOTPGate_VerifyAndExpiry(t *testing.T) {
+	g, key, now := newTestTOTPGate(t, "sensitive")
+
+	if g.Elevated("user1") {
+		t.Fatal("should not start elevated")
+	}
+	res, until, err := g.Verify("user1", codeAt(key, *now))
+	if err != nil || res != unlockOK {
+		t.Fatalf("valid code: res=%v err=%v", res, err)
+	}
+	if !until.Equal(now.Add(15 * time.Minute)) {
+		t.Errorf("elevated until %v", until)
+	}
+	if !g.Elevated("user1") {
+		t.Error("should be elevated")
+	}
+
+	*now = now.Add(16 * time.Minute)
+	if g.Elevated("user1") {
+		t.Error("elevation should expire")
+	}
+}
+
+func TestTOTPGate_Window(t *testing.T) {
+	g, key, now := newTestTOTPGate(t, "sensitive")
+
+	// One step behind is accepted (clock skew)
+	if res, _, _ := g.Verify("user1", codeAt(key, now.Add(-30*time.Second))); res != unlockOK {
+		t.Errorf("code from previous step should be accepted, got %v", res)
+	}
+
+	// Two steps ahead is outside the window
+	*now = now.Add(5 * time.Minute)
+	if res, _, _ := g.Verify("user1", codeAt(key, now.Add(61*time.Second))); res != unlockWrong {
+		t.Errorf("code two steps ahead should be rejected, got %v", res)
+	}
+}
+
+func TestTOTPGate_RejectsReplay(t *testing.T) {
+	g, key, now := newTestTOTPGate(t, "sensitive")
+	code := codeAt(key, *now)
+	if res, _, _ := g.Verify("user1", code); res != unlockOK {
+		t.Fatal("first use should succeed")
+	}
+	if res, _, _ := g.Verify("user1", code); res != unlockWrong {
+		t.Error("replayed code should be rejected")
+	}
+}
+
+func TestTOTPGate_RejectsReplayAfterRestart(t *testing.T) {
+	g, key, now := newTestTOTPGate(t, "sensitive")
+	code := codeAt(key, *now)
+	if res, _, _ := g.Verify("user1", code); res != unlockOK {
+		t.Fatal("first use should succeed")
+	}
+
+	st, err := newTOTPStore(g.store.path, testTOTPKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := newTOTPGate(SecurityConfig{TOTP: TOTPConfig{Mode: "sensitive", WindowSteps: 1, UnlockMinutes: 15}}, st)
+	restarted.now = g.now
+	if res, _, _ := restarted.Verify("user1", code); res != unlockWrong {
+		t.Error("a code used before a restart should be rejected after it")
+	}
+	if res, _, _ := restarted.Verify("user1", codeAt(key, now.Add(30*time.Second))); res != unlockOK {
+		t.Error("the next code should still work")
+	}
+
+	// Rolling the counter back on disk breaks the record instead of
+	// reopening the window
+	rec := st.records["user1"]
+	rec.LastCounter = 0
+	st.records["user1"] = rec
+	if _, _, _, err := st.Get("user1"); err == nil {
+		t.Error("a record with its counter rolled back must not decrypt")
+	}
+}
+
+func TestTOTPGate_Lockout(t *testing.T) {
+	g, key, now := newTestTOTPGate(t, "sensitive")
+	for i := 0; i < 2; i++ {
+		if res, _, _ := g.Verify("user1", "000000"); res != unlockWrong {
+			t.Fatalf("attempt %d: got %v", i, res)
+		}
+	}
+	res, until, _ := g.Verify("user1", "000000")
+	if res != unlockLockedOut || !until.Equal(now.Add(10*time.Minute)) {
+		t.Fatalf("expected lockout until +10m, got %v %v", res, until)
+	}
+	if res, _, _ := g.Verify("user1", codeAt(key, *now)); res != unlockLockedOut {
+		t.Error("valid code during lockout should be rejected")
+	}
+	*now = now.Add(11 * time.Minute)
+	if res, _, _ := g.Verify("user1", codeAt(key, *now)); res != unlockOK {
+		t.Errorf("after lockout: got %v", res)
+	}
+}
+
+func TestTOTPGate_EnrollConfirmsOnFirstCode(t *testing.T) {
+	g, _, now := newTestTOTPGate(t, "all")
+
+	secret, uri, err := g.Enroll("user2", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(uri, secret) {
+		t.Errorf("URI should carry the secret: %s", uri)
+	}
+	if g.Enrolled("user2") {
+		t.Error("enrollment should be pending until first code")
+	}
+
+	key, _ := totpEncoding.DecodeString(secret)
+	if res, _, err := g.Verify("user2", codeAt(key, *now)); err != nil || res != unlockOK {
+		t.Fatalf("confirm: res=%v err=%v", res, err)
+	}
+	if !g.Enrolled("user2") {
+		t.Error("first valid code should confirm enrollment")
+	}
+}
+
+func TestTOTPGate_NotEnrolled(t *testing.T) {
+	g, _, _ := newTestTOTPGate(t, "sensitive")
+	if _, _, err := g.Verify("nobody", "123456"); err == nil {
+		t.Error("unenrolled user should get an error")
+	}
+}
+
+func TestTOTPGate_Required(t *testing.T) {
+	all, _, _ := newTestTOTPGate(t, "all")
+	sensitive, _, _ := newTestTOTPGate(t, "sensitive")
+
+	if !all.Required(totpActionMessage) || !all.Required(totpActionSendFile) {
+		t.Error("mode all should gate everything")
+	}
+	if sensitive.Required(totpActionMessage) {
+		t.Error("mode sensitive should not gate plain messages")
+	}
+	if !sensitive.Required(totpActionSendFile) || !sensitive.Required(totpActionChangeDir) {
+		t.Error("mode sensitive should gate flagged actions")
+	}
+}
+
+func TestSendNeedsTOTP(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/mnt/pai-data/projects/repo/out.png", false},
+		{"/mnt/pai-data/projects", false},
+		{"/mnt/pai-data/memory/notes.md", true},
+		{"/tmp/report.pdf", true},
+		{"/home/pai/doc.txt", true},
+		{"/mnt/pai-data/projects-other/x", true},
+	}
+	for _, tt := range tests {
+		if got := sendNeedsTOTP(tt.path); got != tt.want {
+			t.Errorf("sendNeedsTOTP(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestDirNeedsTOTP(t *testing.T) {
+	tests := []struct {
+		dir  string
+		want bool
+	}{
+		{"/home/pai/projects", false},
+		{"/home/pai/projects/app", false},
+		{"/home/pai/projects-old", true},
+		{"/mnt/pai-data/projects/app", true},
+	}
+	for _, tt := range tests {
+		if got := dirNeedsTOTP(tt.dir, "/home/pai/projects"); got != tt.want {
+			t.Errorf("dirNeedsTOTP(%q) = %v, want %v", tt.dir, got, tt.want)
+		}
+	}
+}
+
+// newTestBotAPI returns a Bot API client backed by a fake Telegram server, and
+// a function returning the toasts of the callbacks it has answered.
+func newTestBotAPI(t *testing.T) (*tgbotapi.BotAPI, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var answers []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		if strings.HasSuffix(r.URL.Path, "/answerCallbackQuery") {
+			answers = append(answers, r.PostForm.Get("text"))
+		}
+		mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/getMe") {
+			w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"bot","username":"bot"}}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":true}`))
+	}))
+	t.Cleanup(srv.Close)
+	api, err := tgbotapi.NewBotAPIWithClient("token", srv.URL+"/bot%s/%s", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), answers...)
+	}
+}
+
+func TestHandleCallback_RequiresTOTPElevation(t *testing.T) {
+	g, key, now := newTestTOTPGate(t, "all")
+	api, answers := newTestBotAPI(t)
+	sm, runner := newFakeRunnerManager(t)
+	b := &Bot{
+		api:       api,
+		config:    &Config{AllowedUsers: []string{"1"}},
+		sessions:  sm,
+		totp:      g,
+		approvals: make(map[string]*pendingApproval),
+	}
+	pa := &pendingApproval{userID: "1", answer: make(chan approvalDecision, 1)}
+	b.approvals["abcd"] = pa
+	press := func(data string) {
+		b.handleCallback(&tgbotapi.CallbackQuery{ID: "cq", From: &tgbotapi.User{ID: 1}, Data: data})
+	}
+
+	press("perm:abcd:always")
+	press("resume:somesession")
+	press("stop:somesession")
+	got := answers()
+	if len(got) != 3 || !strings.HasPrefix(got[0], "🔐") || !strings.HasPrefix(got[1], "🔐") {
+		t.Fatalf("answers without elevation: %q", got)
+	}
+	if strings.HasPrefix(got[2], "🔐") {
+		t.Error("stop must work without elevation")
+	}
+	if len(pa.answer) != 0 || len(runner.requests()) != 0 {
+		t.Fatal("a button pressed without elevation must have no effect")
+	}
+
+	// The same press works once the user has unlocked
+	if err := g.store.Put("1", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", true, *now); err != nil {
+		t.Fatal(err)
+	}
+	if res, _, _ := g.Verify("1", codeAt(key, *now)); res != unlockOK {
+		t.Fatalf("unlock: %v", res)
+	}
+	press("perm:abcd:always")
+	select {
+	case d := <-pa.answer:
+		if d != approvalAllowAlways {
+			t.Errorf("decision: %v", d)
+		}
+	default:
+		t.Error("an elevated press should answer the prompt")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Transcriber turns a 16 kHz mono WAV file into text.
+type Transcriber interface {
+	Transcribe(ctx context.Context, wavPath string) (string, error)
+}
+
+func newTranscriber(cfg STTConfig, apiKey string) (Transcriber, error) {
+	switch cfg.Provider {
+	case "whisper-cpp", "":
+		args := cfg.Args
+		if len(args) == 0 {
+			args = []string{"-m", cfg.Model, "-f", "{input}", "-nt", "-np"}
+			if cfg.Language != "" {
+				args = append(args, "-l", cfg.Language)
+			}
+		}
+		return &execTranscriber{command: cfg.Command, args: args}, nil
+	case "http":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("stt.url is required for the http provider")
+		}
+		return &httpTranscriber{
+			url:      cfg.URL,
+			model:    cfg.Model,
+			language: cfg.Language,
+			apiKey:   apiKey,
+			client:   ctxHTTPClient, // bounded by stt.timeout_seconds
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid stt.provider %q (want whisper-cpp or http)", cfg.Provider)
+	}
+}
+
+// execTranscriber runs a local whisper.cpp-style executable. "{input}" in the
+// arguments is replaced with the WAV path and stdout is the transcript.
+type execTranscriber struct {
+	command string
+	args    []string
+}
+
+func (t *execTranscriber) Transcribe(ctx context.Context, wavPath string) (string, error) {
+	args := make([]string, len(t.args))
+	for i, a := range t.args {
+		args[i] = strings.ReplaceAll(a, "{input}", wavPath)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %w (%s)", filepath.Base(t.command), err, truncate(strings.TrimSpace(stderr.String()), 200))
+	}
+	return strings.Join(strings.Fields(stdout.String()), " "), nil
+}
+
+// httpTranscriber posts to an OpenAI-compatible /v1/audio/transcriptions
+// endpoint (OpenAI itself, whisper.cpp's server, faster-whisper-server, ...).
+type httpTranscriber struct {
+	url      string
+	model    string
+	language string
+	apiKey   string
+	client   *http.Client
+}
+
+func (t *httpTranscriber) Transcribe(ctx context.Context, wavPath string) (string, error) {
+	f, err := os.Open(wavPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", filepath.Base(wavPath))
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(part, f); err != nil {
+		return "", fmt.Errorf("read audio: %w", err)
+	}
+	if t.model != "" {
+		mw.WriteField("model", t.model)
+	}
+	if t.language != "" {
+		mw.WriteField("language", t.language)
+	}
+	mw.WriteField("response_format", "json")
+	mw.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.url, &body)
+	if err != nil {
+		return "", fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if t.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("transcription request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("transcription returned %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var out struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("decode transcription: %w", err)
+	}
+	return strings.TrimSpace(out.Text), nil
+}
+
+// transcodeToWAV converts any audio Telegram sends (OGG/OPUS voice notes,
+// MP3/M4A audio files) to the 16 kHz mono PCM WAV whisper expects.
+func transcodeToWAV(ctx context.Context, inPath, outPath string) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", inPath, "-ar", "16000", "-ac", "1", "-c:a", "pcm_s16le", "-y", outPath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		// ffmpeg prints its banner first; the error is at the end
+		tail := strings.TrimSpace(string(output))
+		if len(tail) > 300 {
+			tail = tail[len(tail)-300:]
+		}
+		return fmt.Errorf("ffmpeg convert: %w (%s)", err, tail)
+	}
+	return nil
+}
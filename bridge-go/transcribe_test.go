@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestWAV(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audio.wav")
+	if err := os.WriteFile(path, []byte("RIFF....WAVE"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHTTPTranscriber(t *testing.T) {
+	var gotAuth, gotModel, gotLang, gotFile string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		gotModel = r.FormValue("model")
+		gotLang = r.FormValue("language")
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "no file", 400)
+			return
+		}
+		data, _ := io.ReadAll(f)
+		gotFile = string(data)
+		w.Write([]byte(`{"text": "  remind me to call mom  "}`))
+	}))
+	defer srv.Close()
+
+	tr, err := newTranscriber(STTConfig{Provider: "http", URL: srv.URL, Model: "whisper-1", Language: "en"}, "sk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := tr.Transcribe(context.Background(), writeTestWAV(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "remind me to call mom" {
+		t.Errorf("text: got %q", text)
+	}
+	if gotAuth != "Bearer sk-test" {
+		t.Errorf("auth header: got %q", gotAuth)
+	}
+	if gotModel != "whisper-1" || gotLang != "en" {
+		t.Errorf("form fields: model=%q language=%q", gotModel, gotLang)
+	}
+	if gotFile != "RIFF....WAVE" {
+		t.Errorf("uploaded file: got %q", gotFile)
+	}
+}
+
+func TestHTTPTranscriber_ErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model not loaded", 503)
+	}))
+	defer srv.Close()
+
+	tr, _ := newTranscriber(STTConfig{Provider: "http", URL: srv.URL}, "")
+	_, err := tr.Transcribe(context.Background(), writeTestWAV(t))
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("expected a 503 error, got %v", err)
+	}
+}
+
+func TestExecTranscriber(t *testing.T) {
+	// A stand-in for whisper-cli that echoes its -f argument back
+	script := filepath.Join(t.TempDir(), "fake-whisper")
+	os.WriteFile(script, []byte("#!/bin/sh\nwhile [ $# -gt 0 ]; do\n  if [ \"$1\" = -f ]; then echo \"  heard\"; echo \"$2\"; fi\n  shift\ndone\n"), 0755)
+
+	tr, err := newTranscriber(STTConfig{Provider: "whisper-cpp", Command: script, Model: "model.bin"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wav := writeTestWAV(t)
+	text, err := tr.Transcribe(context.Background(), wav)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "heard "+wav {
+		t.Errorf("output should be whitespace-normalized with {input} replaced, got %q", text)
+	}
+}
+
+func TestExecTranscriber_Failure(t *testing.T) {
+	tr, _ := newTranscriber(STTConfig{Command: "/bin/false"}, "")
+	if _, err := tr.Transcribe(context.Background(), writeTestWAV(t)); err == nil {
+		t.Error("non-zero exit should be an error")
+	}
+}
+
+func TestNewTranscriber_Invalid(t *testing.T) {
+	if _, err := newTranscriber(STTConfig{Provider: "http"}, ""); err == nil {
+		t.Error("http provider without url should be rejected")
+	}
+	if _, err := newTranscriber(STTConfig{Provider: "carrier-pigeon"}, ""); err == nil {
+		t.Error("unknown provider should be rejected")
+	}
+}
+
+func TestTranscodeToWAV(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg not installed")
+	}
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.ogg")
+	gen := exec.Command("ffmpeg", "-f", "lavfi", "-i", "sine=frequency=440:duration=1", "-c:a", "libopus", "-y", in)
+	if out, err := gen.CombinedOutput(); err != nil {
+		t.Skipf("ffmpeg cannot generate test audio: %v (%s)", err, out)
+	}
+	out := filepath.Join(dir, "out.wav")
+	if err := transcodeToWAV(context.Background(), in, out); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(out)
+	if len(data) < 44 || string(data[:4]) != "RIFF" {
+		t.Error("output should be a WAV file")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// SpeechSynthesizer turns text into audio. Format is the container/codec
+// extension of the returned audio ("mp3", "wav", ...); the bot converts it to
+// OGG/OPUS for Telegram's inline voice playback.
+type SpeechSynthesizer interface {
+	Synthesize(ctx context.Context, text string) (audio []byte, format string, err error)
+}
+
+// ttsKeys carries the API keys from the environment; each provider uses at
+// most one of them.
+type ttsKeys struct {
+	ElevenLabs string
+	OpenAI     string
+}
+
+// newSpeechSynthesizer builds the configured provider. It returns nil with no
+// error when the provider lacks its API key, so voice is skipped rather than
+// failing every reply.
+func newSpeechSynthesizer(cfg VoiceConfig, keys ttsKeys) (SpeechSynthesizer, error) {
+	switch cfg.Provider {
+	case "elevenlabs", "":
+		if keys.ElevenLabs == "" {
+			return nil, nil
+		}
+		return &elevenLabsSynthesizer{
+			baseURL: "https://api.elevenlabs.io",
+			voiceID: cfg.VoiceID,
+			model:   cfg.Model,
+			apiKey:  keys.ElevenLabs,
+			client:  ctxHTTPClient,
+		}, nil
+	case "openai":
+		if cfg.OpenAI.URL == "" {
+			return nil, fmt.Errorf("voice.openai.url is required for the openai provider")
+		}
+		return &openAISynthesizer{
+			url:    cfg.OpenAI.URL,
+			model:  cfg.OpenAI.Model,
+			voice:  cfg.OpenAI.Voice,
+			apiKey: keys.OpenAI,
+			client: ctxHTTPClient,
+		}, nil
+	case "command":
+		if cfg.Command.Command == "" {
+			return nil, fmt.Errorf("voice.command.command is required for the command provider")
+		}
+		return &commandSynthesizer{
+			command: cfg.Command.Command,
+			args:    cfg.Command.Args,
+			format:  cfg.Command.Format,
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid voice.provider %q (want elevenlabs, openai, or command)", cfg.Provider)
+	}
+}
+
+type elevenLabsSynthesizer struct {
+	baseURL string
+	voiceID string
+	model   string
+	apiKey  string
+	client  *http.Client
+}
+
+func (s *elevenLabsSynthesizer) Synthesize(ctx context.Context, text string) ([]byte, string, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"text":     text,
+		"model_id": s.model,
+	})
+	req, err := http.NewRequestWithContext(ctx, "POST", s.baseURL+"/v1/text-to-speech/"+s.voiceID, bytes.NewReader(body))
+	if err != nil {
+		return nil, "", fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("xi-api-key", s.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "audio/mpeg")
+
+	audio, err := doAudioRequest(s.client, req, "elevenlabs")
+	return audio, "mp3", err
+}
+
+// openAISynthesizer posts to an OpenAI-compatible /v1/audio/speech endpoint
+// (OpenAI itself, or a local server such as openedai-speech or kokoro).
+type openAISynthesizer struct {
+	url    string
+	model  string
+	voice  string
+	apiKey string
+	client *http.Client
+}
+
+func (s *openAISynthesizer) Synthesize(ctx context.Context, text string) ([]byte, string, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":           s.model,
+		"voice":           s.voice,
+		"input":           text,
+		"response_format": "opus",
+	})
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, "", fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	}
+
+	audio, err := doAudioRequest(s.client, req, "speech endpoint")
+	return audio, "ogg", err
+}
+
+func doAudioRequest(client *http.Client, req *http.Request, name string) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s request: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s returned %d: %s", name, resp.StatusCode, string(respBody))
+	}
+	audio, err := io.ReadAll(io.LimitReader(resp.Body, maxDownloadSize))
+	if err != nil {
+		return nil, fmt.Errorf("read audio: %w", err)
+	}
+	return audio, nil
+}
+
+// commandSynthesizer runs a local TTS program such as piper or espeak-ng.
+// The text is passed on stdin and as "{text}" in the arguments. If an
+// argument contains "{output}" it is replaced with a temp file path the
+// program writes to; otherwise the audio is read from stdout.
+type commandSynthesizer struct {
+	command string
+	args    []string
+	format  string
+}
+
+func (s *commandSynthesizer) Synthesize(ctx context.Context, text string) ([]byte, string, error) {
+	format := s.format
+	if format == "" {
+		format = "wav"
+	}
+
+	dir, err := os.MkdirTemp("", "pai-tts-*")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.RemoveAll(dir)
+	outPath := filepath.Join(dir, "speech."+format)
+
+	toFile := false
+	args := make([]string, len(s.args))
+	for i, a := range s.args {
+		if strings.Contains(a, "{output}") {
+			toFile = true
+		}
+		a = strings.ReplaceAll(a, "{output}", outPath)
+		args[i] = strings.ReplaceAll(a, "{text}", text)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.command, args...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, "", fmt.Errorf("%s: %w (%s)", filepath.Base(s.command), err, truncate(strings.TrimSpace(stderr.String()), 200))
+	}
+
+	if !toFile {
+		if stdout.Len() == 0 {
+			return nil, "", fmt.Errorf("%s produced no audio", filepath.Base(s.command))
+		}
+		return stdout.Bytes(), format, nil
+	}
+	audio, err := os.ReadFile(outPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s did not write %s: %w", filepath.Base(s.command), outPath, err)
+	}
+	return audio, format, nil
+}
+
+// encodeVoiceNote converts synthesized audio to OGG/OPUS via ffmpeg, which
+// Telegram requires for inline voice playback.
+func encodeVoiceNote(ctx context.Context, audio []byte, format string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "pai-voice-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	inPath := filepath.Join(dir, "speech."+format)
+	if err := os.WriteFile(inPath, audio, 0600); err != nil {
+		return nil, fmt.Errorf("write %s: %w", format, err)
+	}
+	oggPath := filepath.Join(dir, "voice.ogg")
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", inPath, "-c:a", "libopus", "-b:a", "64k", "-y", oggPath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("ffmpeg convert: %w (%s)", err, string(output))
+	}
+
+	oggData, err := os.ReadFile(oggPath)
+	if err != nil {
+		return nil, fmt.Errorf("read ogg: %w", err)
+	}
+	return oggData, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewSpeechSynthesizer(t *testing.T) {
+	synth, err := newSpeechSynthesizer(VoiceConfig{Provider: "elevenlabs"}, ttsKeys{})
+	if err != nil || synth != nil {
+		t.Errorf("elevenlabs without a key should be disabled, not an error: %v %v", synth, err)
+	}
+	if _, err := newSpeechSynthesizer(VoiceConfig{Provider: "openai"}, ttsKeys{}); err == nil {
+		t.Error("openai without a url should be rejected")
+	}
+	if _, err := newSpeechSynthesizer(VoiceConfig{Provider: "command"}, ttsKeys{}); err == nil {
+		t.Error("command without a command should be rejected")
+	}
+	if _, err := newSpeechSynthesizer(VoiceConfig{Provider: "telepathy"}, ttsKeys{}); err == nil {
+		t.Error("unknown provider should be rejected")
+	}
+}
+
+func TestElevenLabsSynthesizer(t *testing.T) {
+	var gotPath, gotKey string
+	var gotBody map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotKey = r.Header.Get("xi-api-key")
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		w.Write([]byte("ID3fake"))
+	}))
+	defer srv.Close()
+
+	synth, _ := newSpeechSynthesizer(VoiceConfig{Provider: "elevenlabs", VoiceID: "v1", Model: "m1"}, ttsKeys{ElevenLabs: "xi"})
+	synth.(*elevenLabsSynthesizer).baseURL = srv.URL
+
+	audio, format, err := synth.Synthesize(context.Background(), "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(audio) != "ID3fake" || format != "mp3" {
+		t.Errorf("got %q (%s)", audio, format)
+	}
+	if gotPath != "/v1/text-to-speech/v1" || gotKey != "xi" {
+		t.Errorf("request: path=%s key=%s", gotPath, gotKey)
+	}
+	if gotBody["text"] != "Hello" || gotBody["model_id"] != "m1" {
+		t.Errorf("body: %v", gotBody)
+	}
+}
+
+func TestOpenAISynthesizer(t *testing.T) {
+	var gotAuth string
+	var gotBody map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		if gotBody["input"] == "" {
+			http.Error(w, "empty input", 400)
+			return
+		}
+		w.Write([]byte("OggSfake"))
+	}))
+	defer srv.Close()
+
+	cfg := VoiceConfig{Provider: "openai", OpenAI: OpenAIVoiceConfig{URL: srv.URL, Model: "tts-1", Voice: "nova"}}
+	synth, err := newSpeechSynthesizer(cfg, ttsKeys{OpenAI: "sk-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, format, err := synth.Synthesize(context.Background(), "Hi there")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(audio) != "OggSfake" || format != "ogg" {
+		t.Errorf("got %q (%s)", audio, format)
+	}
+	if gotAuth != "Bearer sk-test" {
+		t.Errorf("auth: %q", gotAuth)
+	}
+	if gotBody["voice"] != "nova" || gotBody["model"] != "tts-1" || gotBody["input"] != "Hi there" {
+		t.Errorf("body: %v", gotBody)
+	}
+
+	// A local server without auth works too, and errors carry the status
+	synth, _ = newSpeechSynthesizer(cfg, ttsKeys{})
+	if _, _, err := synth.Synthesize(context.Background(), ""); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("expected 400 error, got %v", err)
+	}
+}
+
+func TestCommandSynthesizer(t *testing.T) {
+	dir := t.TempDir()
+
+	// Writes stdin to the {output} file, like piper --output_file
+	toFile := filepath.Join(dir, "fake-piper")
+	os.WriteFile(toFile, []byte("#!/bin/sh\ncat > \"$2\"\n"), 0755)
+	synth, err := newSpeechSynthesizer(VoiceConfig{Provider: "command", Command: CommandVoiceConfig{
+		Command: toFile, Args: []string{"--output_file", "{output}"}, Format: "wav",
+	}}, ttsKeys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, format, err := synth.Synthesize(context.Background(), "from stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(audio) != "from stdin" || format != "wav" {
+		t.Errorf("file mode: got %q (%s)", audio, format)
+	}
+
+	// Prints its {text} argument to stdout
+	toStdout := filepath.Join(dir, "fake-espeak")
+	os.WriteFile(toStdout, []byte("#!/bin/sh\nprintf '%s' \"$2\"\n"), 0755)
+	synth, _ = newSpeechSynthesizer(VoiceConfig{Provider: "command", Command: CommandVoiceConfig{
+		Command: toStdout, Args: []string{"--stdout", "{text}"},
+	}}, ttsKeys{})
+	audio, format, err = synth.Synthesize(context.Background(), "from args")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(audio) != "from args" || format != "wav" {
+		t.Errorf("stdout mode: got %q (%s)", audio, format)
+	}
+
+	// No audio is an error
+	synth, _ = newSpeechSynthesizer(VoiceConfig{Provider: "command", Command: CommandVoiceConfig{Command: "/bin/true"}}, ttsKeys{})
+	if _, _, err := synth.Synthesize(context.Background(), "x"); err == nil {
+		t.Error("empty output should be an error")
+	}
+}
+
+func TestEncodeVoiceNote(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg not installed")
+	}
+	wav := filepath.Join(t.TempDir(), "tone.wav")
+	if out, err := exec.Command("ffmpeg", "-f", "lavfi", "-i", "sine=duration=1", "-y", wav).CombinedOutput(); err != nil {
+		t.Skipf("ffmpeg cannot generate test audio: %v (%s)", err, out)
+	}
+	audio, _ := os.ReadFile(wav)
+	ogg, err := encodeVoiceNote(context.Background(), audio, "wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ogg) < 4 || string(ogg[:4]) != "OggS" {
+		t.Error("output should be an Ogg stream")
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UsageRecord is what one Claude run consumed, as reported by its result
+// event. Cost is Claude Code's API-equivalent figure, so it is notional for
+// subscription logins but still tracks how hard the rate-limit windows are
+// being used. A run that ended without a result (cancelled, killed) is
+// recorded with its wall-clock time only.
+type UsageRecord struct {
+	Timestamp           int64   `json:"ts"`
+	UserID              string  `json:"userId"`
+	SessionID           string  `json:"sessionId"`
+	SessionName         string  `json:"sessionName,omitempty"`
+	Model               string  `json:"model"`
+	InputTokens         int64   `json:"inputTokens"`
+	OutputTokens        int64   `json:"outputTokens"`
+	CacheCreationTokens int64   `json:"cacheCreationTokens"`
+	CacheReadTokens     int64   `json:"cacheReadTokens"`
+	Turns               int     `json:"turns"`
+	DurationMS          int64   `json:"durationMs"`
+	CostUSD             float64 `json:"costUsd"`
+}
+
+// newUsageRecord builds the ledger entry for a run from its result event, or
+// from elapsed alone if there was none.
+func newUsageRecord(session *Session, model string, result *StreamEvent, elapsed time.Duration) UsageRecord {
+	r := UsageRecord{
+		Timestamp:   time.Now().UnixMilli(),
+		UserID:      session.UserID,
+		SessionID:   session.ID,
+		SessionName: session.Name,
+		Model:       model,
+		DurationMS:  elapsed.Milliseconds(),
+	}
+	if result == nil {
+		return r
+	}
+	r.Turns = result.NumTurns
+	r.CostUSD = result.TotalCostUSD
+	if result.DurationMS > 0 {
+		r.DurationMS = result.DurationMS
+	}
+	if u := result.Usage; u != nil {
+		r.InputTokens = u.InputTokens
+		r.OutputTokens = u.OutputTokens
+		r.CacheCreationTokens = u.CacheCreationInputTokens
+		r.CacheReadTokens = u.CacheReadInputTokens
+	}
+	return r
+}
+
+// UsageTotals sums a set of records.
+type UsageTotals struct {
+	Runs                int
+	InputTokens         int64
+	OutputTokens        int64
+	CacheCreationTokens int64
+	CacheReadTokens     int64
+	Turns               int
+	DurationMS          int64
+	CostUSD             float64
+}
+
+func (t *UsageTotals) add(r UsageRecord) {
+	t.Runs++
+	t.InputTokens += r.InputTokens
+	t.OutputTokens += r.OutputTokens
+	t.CacheCreationTokens += r.CacheCreationTokens
+	t.CacheReadTokens += r.CacheReadTokens
+	t.Turns += r.Turns
+	t.DurationMS += r.DurationMS
+	t.CostUSD += r.CostUSD
+}
+
+// UsageLedger appends one JSON line per run to ledger.jsonl on the memory
+// volume and keeps the records in memory to answer /usage and /status.
+type UsageLedger struct {
+	mu      sync.Mutex
+	path    string
+	records []UsageRecord
+}
+
+// NewUsageLedger opens the ledger in dir, loading any earlier records.
+func NewUsageLedger(dir string) *UsageLedger {
+	l := &UsageLedger{path: filepath.Join(dir, "ledger.jsonl")}
+	f, err := os.Open(l.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[PAI Bridge] Failed to read usage ledger: %v", err)
+		}
+		return l
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err == nil {
+			l.records = append(l.records, r)
+		}
+	}
+	return l
+}
+
+// Record adds a run to the ledger.
+func (l *UsageLedger) Record(r UsageRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, r)
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		log.Printf("[PAI Bridge] Failed to create usage dir: %v", err)
+		return
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("[PAI Bridge] Failed to open usage ledger: %v", err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s\n", data)
+}
+
+// Totals sums a user's records since the given time.
+func (l *UsageLedger) Totals(userID string, since time.Time) UsageTotals {
+	var t UsageTotals
+	l.each(userID, since, func(r UsageRecord) { t.add(r) })
+	return t
+}
+
+// SessionTotals sums everything recorded for one session.
+func (l *UsageLedger) SessionTotals(sessionID string) UsageTotals {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var t UsageTotals
+	for _, r := range l.records {
+		if r.SessionID == sessionID {
+			t.add(r)
+		}
+	}
+	return t
+}
+
+// usageGroup is one row of a /usage breakdown.
+type usageGroup struct {
+	Label  string
+	Totals UsageTotals
+}
+
+// GroupBy sums a user's records since the given time by key, most expensive
+// group first.
+func (l *UsageLedger) GroupBy(userID string, since time.Time, key func(UsageRecord) string) []usageGroup {
+	index := make(map[string]int)
+	var groups []usageGroup
+	l.each(userID, since, func(r UsageRecord) {
+		k := key(r)
+		i, ok := index[k]
+		if !ok {
+			i = len(groups)
+			index[k] = i
+			groups = append(groups, usageGroup{Label: k})
+		}
+		groups[i].Totals.add(r)
+	})
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Totals.CostUSD > groups[j].Totals.CostUSD
+	})
+	return groups
+}
+
+func (l *UsageLedger) each(userID string, since time.Time, fn func(UsageRecord)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cutoff := since.UnixMilli()
+	for _, r := range l.records {
+		if r.UserID == userID && r.Timestamp >= cutoff {
+			fn(r)
+		}
+	}
+}
+
+// startOfDay, startOfWeek (Monday) and startOfMonth are the usage and quota
+// period boundaries in the bridge's timezone.
+func startOfDay(now time.Time, loc *time.Location) time.Time {
+	t := now.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+func startOfWeek(now time.Time, loc *time.Location) time.Time {
+	day := startOfDay(now, loc)
+	offset := (int(day.Weekday()) + 6) % 7 // days since Monday
+	return day.AddDate(0, 0, -offset)
+}
+
+func startOfMonth(now time.Time, loc *time.Location) time.Time {
+	t := now.In(loc)
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+}
+
+// formatTokens abbreviates a token count: 950, 12.3k, 1.4M.
+func formatTokens(n int64) string {
+	switch {
+	case n >= 1_000_000:
+		return fmt.Sprintf("%.1fM", float64(n)/1_000_000)
+	case n >= 1_000:
+		return fmt.Sprintf("%.1fk", float64(n)/1_000)
+	}
+	return fmt.Sprintf("%d", n)
+}
+
+// String renders totals on one line. "in" counts cache writes, which are
+// billed as input; cache reads are shown separately as "cached".
+func (t UsageTotals) String() string {
+	if t.Runs == 0 {
+		return "no runs"
+	}
+	runs := "runs"
+	if t.Runs == 1 {
+		runs = "run"
+	}
+	return fmt.Sprintf("%d %s · %s in · %s out · %s cached · $%.2f",
+		t.Runs, runs,
+		formatTokens(t.InputTokens+t.CacheCreationTokens), formatTokens(t.OutputTokens),
+		formatTokens(t.CacheReadTokens), t.CostUSD)
+}
+
+// renderUsage builds the /usage report: today, this week, and the week
+// broken down by session and by model.
+func renderUsage(l *UsageLedger, cfg SessionConfig, userID string, now time.Time, loc *time.Location) string {
+	today := startOfDay(now, loc)
+	week := startOfWeek(now, loc)
+
+	var sb strings.Builder
+	sb.WriteString("📊 Usage\n\n")
+	fmt.Fprintf(&sb, "Today: %s\n", l.Totals(userID, today))
+	weekTotals := l.Totals(userID, week)
+	fmt.Fprintf(&sb, "This week: %s\n", weekTotals)
+	if weekTotals.Runs == 0 {
+		return sb.String()
+	}
+
+	sb.WriteString("\nThis week by session:\n")
+	for _, g := range l.GroupBy(userID, week, func(r UsageRecord) string {
+		name := r.SessionName
+		if name == "" {
+			name = defaultSessionName
+		}
+		shortID := r.SessionID
+		if len(shortID) > 8 {
+			shortID = shortID[:8]
+		}
+		return fmt.Sprintf("%s (%s)", name, shortID)
+	}) {
+		fmt.Fprintf(&sb, "• %s — %s\n", g.Label, g.Totals)
+	}
+
+	sb.WriteString("\nThis week by model:\n")
+	for _, g := range l.GroupBy(userID, week, func(r UsageRecord) string {
+		return modelLabel(cfg, r.Model)
+	}) {
+		fmt.Fprintf(&sb, "• %s — %s\n", g.Label, g.Totals)
+	}
+	return sb.String()
+}
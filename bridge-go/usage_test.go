@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageLedger_PersistsAndTotals(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	l := NewUsageLedger(dir)
+	l.Record(UsageRecord{Timestamp: now.UnixMilli(), UserID: "u1", SessionID: "sess-aaaaaaaa", SessionName: "main", Model: "opus-id", InputTokens: 10, CacheCreationTokens: 90, OutputTokens: 50, CacheReadTokens: 1000, Turns: 2, CostUSD: 0.25})
+	l.Record(UsageRecord{Timestamp: now.UnixMilli(), UserID: "u1", SessionID: "sess-bbbbbbbb", SessionName: "infra", Model: "sonnet-id", InputTokens: 5, OutputTokens: 5, Turns: 1, CostUSD: 1.5})
+	l.Record(UsageRecord{Timestamp: now.Add(-48 * time.Hour).UnixMilli(), UserID: "u1", SessionID: "sess-aaaaaaaa", Model: "opus-id", CostUSD: 4})
+	l.Record(UsageRecord{Timestamp: now.UnixMilli(), UserID: "u2", SessionID: "sess-cccccccc", Model: "opus-id", CostUSD: 9})
+
+	reloaded := NewUsageLedger(dir)
+	if len(reloaded.records) != 4 {
+		t.Fatalf("reloaded %d records, want 4", len(reloaded.records))
+	}
+
+	got := reloaded.Totals("u1", now.Add(-time.Hour))
+	if got.Runs != 2 || got.InputTokens != 15 || got.CacheCreationTokens != 90 || got.Turns != 3 || got.CostUSD != 1.75 {
+		t.Errorf("totals: %+v", got)
+	}
+	if got := reloaded.SessionTotals("sess-aaaaaaaa"); got.Runs != 2 || got.CostUSD != 4.25 {
+		t.Errorf("session totals: %+v", got)
+	}
+
+	groups := reloaded.GroupBy("u1", now.Add(-time.Hour), func(r UsageRecord) string { return r.Model })
+	if len(groups) != 2 || groups[0].Label != "sonnet-id" || groups[1].Label != "opus-id" {
+		t.Errorf("groups should be ordered by cost: %+v", groups)
+	}
+}
+
+func TestUsagePeriods(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*3600)
+	// Sunday 2026-10-18 01:30 local is still Saturday in UTC
+	now := time.Date(2026, 10, 17, 23, 30, 0, 0, time.UTC)
+
+	if got := startOfDay(now, loc); !got.Equal(time.Date(2026, 10, 18, 0, 0, 0, 0, loc)) {
+		t.Errorf("start of day: %v", got)
+	}
+	if got := startOfWeek(now, loc); !got.Equal(time.Date(2026, 10, 12, 0, 0, 0, 0, loc)) {
+		t.Errorf("start of week should be Monday: %v", got)
+	}
+	monday := time.Date(2026, 10, 12, 9, 0, 0, 0, loc)
+	if got := startOfWeek(monday, loc); !got.Equal(time.Date(2026, 10, 12, 0, 0, 0, 0, loc)) {
+		t.Errorf("start of week on a Monday: %v", got)
+	}
+}
+
+func TestUsageTotalsString(t *testing.T) {
+	if got := (UsageTotals{}).String(); got != "no runs" {
+		t.Errorf("empty: %q", got)
+	}
+	tot := UsageTotals{Runs: 3, InputTokens: 400, CacheCreationTokens: 12000, OutputTokens: 950, CacheReadTokens: 1_450_000, CostUSD: 1.234}
+	if got, want := tot.String(), "3 runs · 12.4k in · 950 out · 1.4M cached · $1.23"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRenderUsage(t *testing.T) {
+	l := NewUsageLedger(t.TempDir())
+	now := time.Now()
+	cfg := SessionConfig{DefaultModel: "opus-id", Models: map[string]string{"opus": "opus-id"}}
+	if got := renderUsage(l, cfg, "u1", now, time.UTC); !strings.Contains(got, "This week: no runs") || strings.Contains(got, "by session") {
+		t.Errorf("empty report: %q", got)
+	}
+
+	l.Record(UsageRecord{Timestamp: now.UnixMilli(), UserID: "u1", SessionID: "0123456789", SessionName: "infra", Model: "opus-id", CostUSD: 0.5})
+	got := renderUsage(l, cfg, "u1", now, time.UTC)
+	for _, want := range []string{"Today: 1 run", "• infra (01234567) — 1 run", "• opus (opus-id) — 1 run"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("report missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestSendMessage_RecordsUsage(t *testing.T) {
+	sm, _ := newFakeRunnerManager(t, fakeRun{lines: []string{
+		`{"type":"system","subtype":"init","session_id":"claude-1","model":"claude-opus-4-1-20250805"}`,
+		textLine("done"),
+		`{"type":"result","subtype":"success","num_turns":3,"duration_ms":4200,"total_cost_usd":0.42,"usage":{"input_tokens":7,"output_tokens":120,"cache_creation_input_tokens":300,"cache_read_input_tokens":9000}}`,
+	}}, fakeRun{exitErr: errors.New("exit status 1")})
+	sm.usage = NewUsageLedger(t.TempDir())
+
+	result, err := sm.SendMessage("user1", "hi", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := sm.usage.records
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+	r := records[0]
+	if r.UserID != "user1" || r.SessionID != result.SessionID || r.SessionName != defaultSessionName || r.Model != "claude-opus-4-1-20250805" {
+		t.Errorf("record identity: %+v", r)
+	}
+	if r.Turns != 3 || r.DurationMS != 4200 || r.CostUSD != 0.42 || r.InputTokens != 7 || r.OutputTokens != 120 || r.CacheCreationTokens != 300 || r.CacheReadTokens != 9000 {
+		t.Errorf("record usage: %+v", r)
+	}
+
+	// A run that dies before its result event still counts, with no tokens
+	sm.SendMessage("user1", "again", nil, nil)
+	if len(sm.usage.records) != 2 {
+		t.Fatalf("failed run should be recorded: %+v", sm.usage.records)
+	}
+	if r := sm.usage.records[1]; r.Turns != 0 || r.CostUSD != 0 || r.InputTokens != 0 {
+		t.Errorf("failed run record: %+v", r)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxRecentDirs caps the per-user list of directories /cd offers as buttons.
+const maxRecentDirs = 6
+
+// maxProjects caps how many repositories /projects lists.
+const maxProjects = 30
+
+// resolveWorkDir turns a /cd argument into an absolute, symlink-free
+// directory under one of the project roots. Relative paths are taken from
+// base, the session's current work dir.
+func resolveWorkDir(input, base string, roots []string) (string, error) {
+	p := strings.TrimSpace(input)
+	if p == "" {
+		return "", fmt.Errorf("no directory given")
+	}
+	if p == "~" {
+		p = "~/"
+	}
+	p = resolveHome(p)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(base, p)
+	}
+
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", fmt.Errorf("%s does not exist", input)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil || !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", input)
+	}
+	if !underRoots(resolved, roots) {
+		return "", fmt.Errorf("%s is outside the project roots (%s)", resolved, strings.Join(roots, ", "))
+	}
+	return resolved, nil
+}
+
+// underRoots reports whether the resolved path is one of the roots or inside
+// one. Roots are resolved too, so a symlinked root still matches.
+func underRoots(path string, roots []string) bool {
+	for _, root := range roots {
+		if r, err := filepath.EvalSymlinks(root); err == nil {
+			root = r
+		}
+		root = filepath.Clean(root)
+		if path == root || strings.HasPrefix(path, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// listProjects finds git repositories directly under each root, or one level
+// further down for roots grouped by owner (projects/org/repo). Results are
+// resolved, deduplicated and sorted.
+func listProjects(roots []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	add := func(dir string) {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err != nil || seen[resolved] || !underRoots(resolved, roots) {
+			return
+		}
+		seen[resolved] = true
+		out = append(out, resolved)
+	}
+
+	for _, root := range roots {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			dir := filepath.Join(root, e.Name())
+			if strings.HasPrefix(e.Name(), ".") || !isDir(dir) {
+				continue
+			}
+			if isGitRepo(dir) {
+				add(dir)
+				continue
+			}
+			sub, err := os.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, se := range sub {
+				subDir := filepath.Join(dir, se.Name())
+				if !strings.HasPrefix(se.Name(), ".") && isDir(subDir) && isGitRepo(subDir) {
+					add(subDir)
+				}
+			}
+		}
+	}
+
+	sort.Strings(out)
+	if len(out) > maxProjects {
+		out = out[:maxProjects]
+	}
+	return out
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func isGitRepo(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+// projectLabel shortens a project path for a button: the path relative to
+// the root containing it, or the base name.
+func projectLabel(dir string, roots []string) string {
+	for _, root := range roots {
+		if r, err := filepath.EvalSymlinks(root); err == nil {
+			root = r
+		}
+		if rel, err := filepath.Rel(root, dir); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return filepath.Base(dir)
+}
+
+// pushRecentDir moves dir to the front of the list, capped at maxRecentDirs.
+func pushRecentDir(recent []string, dir string) []string {
+	out := []string{dir}
+	for _, d := range recent {
+		if d != dir && len(out) < maxRecentDirs {
+			out = append(out, d)
+		}
+	}
+	return out
+}
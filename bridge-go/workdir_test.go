@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// makeProjectTree builds root/{app,org/lib,notes} with app and org/lib as git
+// repos, plus a directory outside the root.
+func makeProjectTree(t *testing.T) (root, outside string) {
+	t.Helper()
+	base := t.TempDir()
+	// Resolve the temp dir itself; on some systems it sits behind a symlink
+	base, _ = filepath.EvalSymlinks(base)
+	root = filepath.Join(base, "projects")
+	outside = filepath.Join(base, "elsewhere")
+	for _, d := range []string{"app/.git", "org/lib/.git", "notes", ".hidden/.git"} {
+		os.MkdirAll(filepath.Join(root, d), 0755)
+	}
+	os.MkdirAll(outside, 0755)
+	os.WriteFile(filepath.Join(root, "README.md"), []byte("x"), 0644)
+	return root, outside
+}
+
+func TestResolveWorkDir(t *testing.T) {
+	root, outside := makeProjectTree(t)
+	roots := []string{root}
+
+	tests := []struct {
+		input, base string
+		want        string
+		wantErr     string
+	}{
+		{input: filepath.Join(root, "app"), want: filepath.Join(root, "app")},
+		{input: "lib", base: filepath.Join(root, "org"), want: filepath.Join(root, "org/lib")},
+		{input: "../app", base: filepath.Join(root, "notes"), want: filepath.Join(root, "app")},
+		{input: root, want: root},
+		{input: "..", base: root, wantErr: "outside the project roots"},
+		{input: outside, wantErr: "outside the project roots"},
+		{input: filepath.Join(root, "README.md"), wantErr: "not a directory"},
+		{input: filepath.Join(root, "missing"), wantErr: "does not exist"},
+		{input: "  ", wantErr: "no directory"},
+	}
+	for _, tt := range tests {
+		got, err := resolveWorkDir(tt.input, tt.base, roots)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("resolveWorkDir(%q, %q): want error %q, got %q, %v", tt.input, tt.base, tt.wantErr, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("resolveWorkDir(%q, %q) = %q, %v; want %q", tt.input, tt.base, got, err, tt.want)
+		}
+	}
+}
+
+func TestResolveWorkDir_Symlinks(t *testing.T) {
+	root, outside := makeProjectTree(t)
+
+	// A link inside the root that escapes it is judged by its target
+	escape := filepath.Join(root, "escape")
+	os.Symlink(outside, escape)
+	if _, err := resolveWorkDir(escape, "", []string{root}); err == nil {
+		t.Error("symlink out of the root should be rejected")
+	}
+
+	// A symlinked root still admits its contents
+	link := filepath.Join(filepath.Dir(root), "projects-link")
+	os.Symlink(root, link)
+	got, err := resolveWorkDir(filepath.Join(link, "app"), "", []string{link})
+	if err != nil || got != filepath.Join(root, "app") {
+		t.Errorf("via symlinked root: got %q, %v", got, err)
+	}
+}
+
+func TestListProjects(t *testing.T) {
+	root, outside := makeProjectTree(t)
+	os.MkdirAll(filepath.Join(outside, "stray/.git"), 0755)
+	os.Symlink(filepath.Join(outside, "stray"), filepath.Join(root, "stray"))
+
+	got := listProjects([]string{root, filepath.Join(root, "missing")})
+	want := []string{filepath.Join(root, "app"), filepath.Join(root, "org/lib")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listProjects = %v, want %v", got, want)
+	}
+	if label := projectLabel(want[1], []string{root}); label != "org/lib" {
+		t.Errorf("projectLabel = %q", label)
+	}
+}
+
+func TestPushRecentDir(t *testing.T) {
+	var recent []string
+	for _, d := range []string{"/a", "/b", "/c", "/a"} {
+		recent = pushRecentDir(recent, d)
+	}
+	if want := []string{"/a", "/c", "/b"}; !reflect.DeepEqual(recent, want) {
+		t.Errorf("got %v, want %v", recent, want)
+	}
+	for i := 0; i < maxRecentDirs+3; i++ {
+		recent = pushRecentDir(recent, string(rune('d'+i)))
+	}
+	if len(recent) != maxRecentDirs {
+		t.Errorf("list should be capped at %d, got %d", maxRecentDirs, len(recent))
+	}
+}